@@ -237,6 +237,11 @@ func (c *CFG) build() {
 func (c *CFG) filterEmpty() {
 	for i := len(c.Blocks) - 1; i >= 0; i-- {
 		blk := c.Blocks[i]
+		if i == 0 && len(blk.Next) > 0 {
+			// keep the entry block so a loop header at the start of the
+			// function does not become the entry block
+			continue
+		}
 		// there are no stmts AND one or more prev blks ===> a next blk exists
 		if len(blk.Stmts) == 0 && (len(blk.Prev) <= 0 || len(blk.Next) > 0) {
 			err := c.removeBlock(blk)
@@ -637,7 +642,7 @@ func (c *CFG) visitSelectStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Blo
 			commBlk = c.visitStmt(i, &stmt.Body.List, cond, commBlk)
 		}
 		commBlk = c.visitStmts(&comm.Body, commBlk)
-		if commBlk != nil {
+		if commBlk != nil && !commBlk.Exits() {
 			commBlk.Link(&Flow{
 				Block: exit,
 				Type:  Unconditional,
@@ -680,13 +685,19 @@ func (c *CFG) visitTypeSwitchStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry
 		c.pushSwitch(nil, exit)
 		caseBlk = c.visitStmts(&cas.Body, caseBlk)
 		c.popSwitch()
-		if caseBlk != nil {
+		if caseBlk != nil && !caseBlk.Exits() {
 			caseBlk.Link(&Flow{
 				Block: exit,
 				Type:  Unconditional,
 			})
 		}
 	}
+	if !hasDefault(stmt.Body) {
+		entry.Link(&Flow{
+			Block: exit,
+			Type:  TypeSwitch,
+		})
+	}
 	return exit
 }
 
@@ -734,16 +745,33 @@ func (c *CFG) visitSwitchStmt(idx int, body *[]ast.Stmt, s *ast.Stmt, entry *Blo
 		}
 		caseBlk = c.visitStmts(&cas.Body, caseBlk)
 		c.popSwitch()
-		if caseBlk != nil {
+		if caseBlk != nil && !caseBlk.Exits() {
 			caseBlk.Link(&Flow{
 				Block: exit,
 				Type:  Unconditional,
 			})
 		}
 	}
+	if !hasDefault(stmt.Body) {
+		entry.Link(&Flow{
+			Block: exit,
+			Type:  Switch,
+		})
+	}
 	return exit
 }
 
+// hasDefault reports whether the body of a switch has a default case.
+// Without one no case may match and the switch goes straight to its exit.
+func hasDefault(body *ast.BlockStmt) bool {
+	for _, s := range body.List {
+		if s.(*ast.CaseClause).List == nil {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *CFG) pushSwitch(next, exit *Block) {
 	c.nextCase = append(c.nextCase, next)
 	c.exits = append(c.exits, exit)
@@ -859,9 +887,12 @@ func (b *Block) Exits() bool {
 		return false
 	}
 	s := b.Stmts[len(b.Stmts)-1]
-	switch (*s).(type) {
+	switch stmt := (*s).(type) {
 	case *ast.ReturnStmt:
 		return true
+	case *ast.SelectStmt:
+		// select {} blocks forever
+		return len(stmt.Body.List) == 0
 	default:
 		return ContainsPanic(*s) || ContainsOsExit(*s)
 	}
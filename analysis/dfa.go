@@ -107,10 +107,8 @@ func FindDefinitions(cfg *CFG, info *types.Info) *Definitions {
 				case *ast.Ident:
 					if obj := info.Defs[e]; obj != nil {
 						// this is a definition
-						fmt.Fprintln(os.Stderr, "def", FmtNode(cfg.FSet, e), ":", obj.Id(), obj.Pos())
 						decl(blk.Id, sid, e, obj)
 					} else if obj := info.Uses[e]; obj != nil {
-						fmt.Fprintln(os.Stderr, "use", FmtNode(cfg.FSet, e), ":", obj.Id(), obj.Pos())
 						object := d.objs[obj.Pos()]
 						ref := &Reference{
 							Id:       int(e.Pos()),
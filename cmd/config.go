@@ -4,4 +4,10 @@ type Config struct {
 	GOROOT string
 	GOPATH string
 	DGPATH string
+	// Modules forces module mode even when it is not detected from the
+	// package being loaded.
+	Modules bool
+	// StockRuntime builds instrumented programs against an unmodified
+	// Go runtime instead of the patched one in src/runtime.
+	StockRuntime bool
 }
@@ -62,6 +62,24 @@ func InputFile(input_path string) (reader io.Reader, closeall func(), err error)
 }
 
 func InputDir(input_dir string) (reader io.Reader, closeall func(), err error) {
+	return inputDir(input_dir, nil)
+}
+
+// InputFiltered is Input which reads only the files of a directory whose
+// names keep accepts. A file named by input_path is always read.
+func InputFiltered(input_path string, keep func(name string) bool) (reader io.Reader, closeall func(), err error) {
+	stat, err := os.Stat(input_path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.IsDir() {
+		return inputDir(input_path, keep)
+	} else {
+		return InputFile(input_path)
+	}
+}
+
+func inputDir(input_dir string, keep func(name string) bool) (reader io.Reader, closeall func(), err error) {
 	var readers []io.Reader
 	var closers []func()
 	dir, err := ioutil.ReadDir(input_dir)
@@ -69,7 +87,7 @@ func InputDir(input_dir string) (reader io.Reader, closeall func(), err error) {
 		return nil, nil, err
 	}
 	for _, info := range dir {
-		if info.IsDir() {
+		if info.IsDir() || (keep != nil && !keep(info.Name())) {
 			continue
 		}
 		creader, closer, err := InputFile(filepath.Join(input_dir, info.Name()))
@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/packages"
+)
+
+// GoCmd constructs a command running the go tool of the configured
+// GOROOT (or the go on the PATH if there is no configured GOROOT) in
+// dir. An empty dir runs the command in the current directory.
+func GoCmd(c *Config, dir string, args ...string) *exec.Cmd {
+	goBin := "go"
+	if c.GOROOT != "" {
+		goBin = filepath.Join(c.GOROOT, "bin", "go")
+	}
+	x := exec.Command(goBin, args...)
+	x.Dir = dir
+	x.Env = GoEnv(c)
+	return x
+}
+
+// GoEnv is the process environment with GOROOT and GOPATH overridden
+// by the config.
+func GoEnv(c *Config) []string {
+	env := os.Environ()
+	if c.GOROOT != "" {
+		env = append(env, fmt.Sprintf("GOROOT=%v", c.GOROOT))
+	}
+	if c.GOPATH != "" {
+		env = append(env, fmt.Sprintf("GOPATH=%v", c.GOPATH))
+	}
+	return env
+}
+
+// GoMod finds the go.mod file of the module containing dir. It returns
+// the empty string if dir is not in a module (or the go tool does not
+// know about modules).
+func GoMod(c *Config, dir string) (string, error) {
+	output, err := GoCmd(c, dir, "env", "GOMOD").Output()
+	if err != nil {
+		return "", err
+	}
+	gomod := strings.TrimSpace(string(output))
+	if gomod == os.DevNull {
+		return "", nil
+	}
+	return gomod, nil
+}
+
+// PkgDir returns pkg (made absolute) if it names a directory on disk
+// and the empty string (the current directory) otherwise.
+func PkgDir(pkg string) string {
+	if stat, err := os.Stat(pkg); err == nil && stat.IsDir() {
+		if abs, err := filepath.Abs(pkg); err == nil {
+			return abs
+		}
+		return pkg
+	}
+	return ""
+}
+
+// ModuleMode reports whether packages found from dir should be loaded
+// and built as modules rather than from the GOPATH.
+func ModuleMode(c *Config, dir string) bool {
+	if c.Modules {
+		return true
+	}
+	if os.Getenv("GO111MODULE") == "off" {
+		return false
+	}
+	gomod, err := GoMod(c, dir)
+	return err == nil && gomod != ""
+}
+
+// ResolvePkg turns a package argument (which in module mode may be a
+// directory) into the import path of the package and the directory to
+// load it from (see LoadPkg). The directory is empty (the current
+// directory) unless the argument named one.
+func ResolvePkg(c *Config, pkg string) (path, dir string, err error) {
+	dir = PkgDir(pkg)
+	if !ModuleMode(c, dir) {
+		return pkg, dir, nil
+	}
+	pattern := pkg
+	if dir != "" {
+		pattern = "."
+	}
+	output, err := GoCmd(c, dir, "list", "-f", "{{.ImportPath}}", pattern).Output()
+	if err != nil {
+		return "", "", errors.Errorf("could not resolve package %v: %v", pkg, err)
+	}
+	return strings.TrimSpace(string(output)), dir, nil
+}
+
+// loadModule loads pkg (from dir) through go/packages and repackages the result
+// as a loader.Program so the rest of dynagrok does not need to know
+// where the program came from. The root packages are placed in Created
+// so Program.Package can find them by their import paths. When loading
+// with tests the package augmented with its _test.go files replaces the
+// plain package and the generated test main is dropped.
+func loadModule(c *Config, dir, pkg string, tests bool) (*loader.Program, error) {
+	conf := &packages.Config{
+		Mode: packages.NeedName | packages.NeedFiles | packages.NeedImports |
+			packages.NeedDeps | packages.NeedTypes | packages.NeedSyntax |
+			packages.NeedTypesInfo | packages.NeedModule,
+		Dir:   dir,
+		Env:   GoEnv(c),
+		Fset:  token.NewFileSet(),
+		Tests: tests,
+	}
+	loaded, err := packages.Load(conf, pkg)
+	if err != nil {
+		return nil, err
+	}
+	if packages.PrintErrors(loaded) > 0 {
+		return nil, errors.Errorf("could not load %v, it has errors", pkg)
+	}
+	roots := testRoots(loaded)
+	if len(roots) == 0 || (!tests && len(roots) != 1) {
+		return nil, errors.Errorf("expected %v to name one package got %d", pkg, len(roots))
+	}
+	program := &loader.Program{
+		Fset:        conf.Fset,
+		Imported:    make(map[string]*loader.PackageInfo),
+		AllPackages: make(map[*types.Package]*loader.PackageInfo),
+	}
+	packages.Visit(roots, nil, func(p *packages.Package) {
+		if p.Types == nil || p.TypesInfo == nil {
+			return
+		}
+		program.AllPackages[p.Types] = &loader.PackageInfo{
+			Pkg:                   p.Types,
+			Importable:            true,
+			TransitivelyErrorFree: true,
+			Files:                 p.Syntax,
+			Info:                  *p.TypesInfo,
+		}
+	})
+	for _, r := range roots {
+		root := program.AllPackages[r.Types]
+		program.Created = append(program.Created, root)
+		program.Imported[r.PkgPath] = root
+	}
+	return program, nil
+}
+
+// testRoots drops the generated test mains and the plain packages which
+// have a test variant (whose ID looks like "pkg [pkg.test]") from the
+// loaded roots.
+func testRoots(loaded []*packages.Package) []*packages.Package {
+	hasVariant := make(map[string]bool)
+	for _, p := range loaded {
+		if p.ID != p.PkgPath {
+			hasVariant[p.PkgPath] = true
+		}
+	}
+	roots := make([]*packages.Package, 0, len(loaded))
+	for _, p := range loaded {
+		if strings.HasSuffix(p.PkgPath, ".test") {
+			continue
+		}
+		if p.ID == p.PkgPath && hasVariant[p.PkgPath] {
+			continue
+		}
+		roots = append(roots, p)
+	}
+	return roots
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// module writes a module (example.com/m) with a main package in cmd/x
+// to a temp dir.
+func module(t *testing.T) string {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go tool on the PATH")
+	}
+	dir, err := ioutil.TempDir("", "dynagrok-modules-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"go.mod":        "module example.com/m\n",
+		"lib/lib.go":    "package lib\n\nfunc Answer() int { return 42 }\n",
+		"cmd/x/main.go": "package main\n\nimport \"example.com/m/lib\"\n\nfunc main() { println(lib.Answer()) }\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// The module is resolved and loaded from its directory, not from the
+// current directory (which is not in the module).
+func TestResolveAndLoadModule(t *testing.T) {
+	dir := module(t)
+	defer os.RemoveAll(dir)
+	c := &Config{}
+	pkg, pkgDir, err := ResolvePkg(c, filepath.Join(dir, "cmd", "x"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkg != "example.com/m/cmd/x" {
+		t.Errorf("expected example.com/m/cmd/x got %v", pkg)
+	}
+	if pkgDir != filepath.Join(dir, "cmd", "x") {
+		t.Errorf("expected the package dir got %v", pkgDir)
+	}
+	if !ModuleMode(c, pkgDir) {
+		t.Errorf("expected %v to be in module mode", pkgDir)
+	}
+	program, err := LoadPkg(c, pkgDir, pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.Package(pkg) == nil {
+		t.Fatalf("%v was not loaded", pkg)
+	}
+	found := false
+	for p := range program.AllPackages {
+		if p.Path() == "example.com/m/lib" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("the dependency example.com/m/lib was not loaded")
+	}
+}
+
+// A relative directory is made absolute so it still names the package
+// when the go tool runs elsewhere.
+func TestPkgDir(t *testing.T) {
+	dir := module(t)
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if got := PkgDir("cmd/x"); got != filepath.Join(dir, "cmd", "x") {
+		t.Errorf("expected %v got %v", filepath.Join(dir, "cmd", "x"), got)
+	}
+	if got := PkgDir("example.com/m/cmd/x"); got != "" {
+		t.Errorf("an import path is not a dir, got %v", got)
+	}
+}
@@ -36,10 +36,31 @@ func BuildContext(c *Config) *build.Context {
 	return b
 }
 
-func LoadPkg(c *Config, pkg string) (*loader.Program, error) {
+// LoadPkg loads pkg and all of its dependencies. The package and dir
+// are those returned by ResolvePkg: packages inside of the module
+// containing dir are loaded with go/packages (run in dir); everything
+// else is loaded from the GOPATH.
+func LoadPkg(c *Config, dir, pkg string) (*loader.Program, error) {
+	return loadPkg(c, dir, pkg, false)
+}
+
+// LoadPkgWithTests loads pkg augmented with its in-package _test.go files
+// and, if it has one, its external test package (pkg_test).
+func LoadPkgWithTests(c *Config, dir, pkg string) (*loader.Program, error) {
+	return loadPkg(c, dir, pkg, true)
+}
+
+func loadPkg(c *Config, dir, pkg string, tests bool) (*loader.Program, error) {
+	if ModuleMode(c, dir) {
+		return loadModule(c, dir, pkg, tests)
+	}
 	var conf loader.Config
 	conf.Build = BuildContext(c)
 	conf.Build.CgoEnabled = true
-	conf.Import(pkg)
+	if tests {
+		conf.ImportWithTests(pkg)
+	} else {
+		conf.Import(pkg)
+	}
 	return conf.Load()
 }
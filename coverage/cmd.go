@@ -0,0 +1,123 @@
+package coverage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/instrument"
+	"github.com/timtadh/dynagrok/profile"
+)
+
+func NewCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd(
+		"coverage",
+		`[options] <pkg> <profiles>+`,
+		`
+Report the block coverage of the profiles (flow-graph.txt files or
+directories of them) of an instrumented copy of <pkg> against its source.
+
+Each source file is written as an HTML page with the statements colored by
+the number of times their blocks were entered. Hovering over a statement
+shows the entrances of its block and how often each of the block's out
+edges was traversed. Blocks with an edge which was never traversed are
+underlined. A coverage profile for `+"`go tool cover`"+` is written too.
+
+If the program was instrumented with --only-func, --only-file or --skip-func
+pass the same filters: the functions they leave out are reported as not
+instrumented (rather than as never entered).
+
+Option Flags
+    -h,--help                         Show this message
+    -o,--output=<path>                Directory for the HTML pages
+                                      (defaults to coverage)
+    -c,--cover-profile=<path>         Path of the coverage profile
+                                      (defaults to <output>/coverage.out)
+    --only-func=<regex>               The functions were instrumented with
+                                      --only-func=<regex>
+    --only-file=<regex>               The functions were instrumented with
+                                      --only-file=<regex>
+    --skip-func=<regex>               The functions were instrumented with
+                                      --skip-func=<regex>
+`,
+		"o:c:",
+		[]string{
+			"output=",
+			"cover-profile=",
+			"only-func=",
+			"only-file=",
+			"skip-func=",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := "coverage"
+			coverProfile := ""
+			var filter *instrument.Filter
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-c", "--cover-profile":
+					coverProfile = oa.Arg()
+				case "--only-func", "--only-file", "--skip-func":
+					re, err := regexp.Compile(oa.Arg())
+					if err != nil {
+						return nil, cmd.Usage(r, 4, "Bad regex for %v: %v", oa.Opt(), err)
+					}
+					if filter == nil {
+						filter = new(instrument.Filter)
+					}
+					switch oa.Opt() {
+					case "--only-func":
+						filter.OnlyFunc = re
+					case "--only-file":
+						filter.OnlyFile = re
+					case "--skip-func":
+						filter.SkipFunc = re
+					}
+				}
+			}
+			if len(args) < 2 {
+				return nil, cmd.Usage(r, 5, "Expected a package name and one or more profiles got %v", args)
+			}
+			if coverProfile == "" {
+				coverProfile = filepath.Join(output, "coverage.out")
+			}
+			pkgName, pkgDir, err := cmd.ResolvePkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			merged, runs, err := profile.Load(args[1:])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			program, err := cmd.LoadPkg(c, pkgDir, pkgName)
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			report, err := NewReport(program, profile.Summarize(merged, runs), filter)
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			if err := report.WriteHTML(output); err != nil {
+				return nil, cmd.Errorf(1, "Could not write the HTML report to %v, error: %v", output, err)
+			}
+			fout, err := os.Create(coverProfile)
+			if err != nil {
+				return nil, cmd.Errorf(1, "Could not create output file: %v, error: %v", coverProfile, err)
+			}
+			defer fout.Close()
+			if err := report.WriteCoverProfile(fout); err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			fmt.Printf("wrote %v and %v\n", filepath.Join(output, "index.html"), coverProfile)
+			return nil, nil
+		})
+}
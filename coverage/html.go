@@ -0,0 +1,186 @@
+package coverage
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const style = `<style>
+body { background: #fff; color: #222; font-family: sans-serif; }
+pre { font-family: Menlo, monospace; font-size: 13px; line-height: 1.4; }
+.ln { color: #999; display: inline-block; width: 4em; text-align: right; padding-right: 1em; user-select: none; }
+.cov0 { background: #f7c6c6; }
+.cov1 { background: #d6f5d6; }
+.cov2 { background: #b8ecb8; }
+.cov3 { background: #94e094; }
+.cov4 { background: #6fd36f; }
+.cov5 { background: #4cc44c; }
+.partial { border-bottom: 2px dashed #d9a300; }
+.uninstrumented { color: #999; }
+table { border-collapse: collapse; }
+td { padding: 2px 1em; }
+</style>
+`
+
+// WriteHTML writes an HTML page for each file of the report to the
+// directory with the segments colored by the entrances of their blocks
+// and an index.html listing the files.
+func (r *Report) WriteHTML(dir string) error {
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+	max := 0
+	for _, f := range r.Files {
+		for _, seg := range f.Segments {
+			if seg.Block.Entrances > max {
+				max = seg.Block.Entrances
+			}
+		}
+	}
+	index, err := os.Create(filepath.Join(dir, "index.html"))
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	fmt.Fprintf(index, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>coverage</title>\n%v</head><body>\n", style)
+	fmt.Fprintf(index, "<table>\n<tr><th>file</th><th>statements</th><th>covered</th></tr>\n")
+	for _, f := range r.Files {
+		page := pageName(f)
+		covered, stmts := f.Covered()
+		percent := "not instrumented"
+		if stmts > 0 {
+			percent = fmt.Sprintf("%.1f%%", 100*float64(covered)/float64(stmts))
+		}
+		fmt.Fprintf(index, "<tr><td><a href=\"%v\">%v</a></td><td>%d</td><td>%v</td></tr>\n",
+			page, html.EscapeString(f.Path), stmts, percent)
+		if err := r.writeFile(filepath.Join(dir, page), f, max); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(index, "</table>\n</body></html>\n")
+	return nil
+}
+
+// pageName is the name of the HTML page of the file.
+func pageName(f *File) string {
+	return strings.Replace(f.Path, "/", "_", -1) + ".html"
+}
+
+func (r *Report) writeFile(name string, f *File, max int) error {
+	src, err := ioutil.ReadFile(f.Name)
+	if err != nil {
+		return err
+	}
+	fout, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer fout.Close()
+	fmt.Fprintf(fout, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><title>%v</title>\n%v</head><body>\n",
+		html.EscapeString(f.Path), style)
+	covered, stmts := f.Covered()
+	summary := "not instrumented"
+	if stmts > 0 {
+		summary = fmt.Sprintf("%d of %d statements covered", covered, stmts)
+	}
+	fmt.Fprintf(fout, "<p><a href=\"index.html\">index</a> %v: %v</p>\n<pre>",
+		html.EscapeString(f.Path), summary)
+	tf := r.FSet.File(f.Segments[0].Start)
+	w := &lineWriter{out: fout}
+	at := 0
+	for _, seg := range f.Segments {
+		start, end := tf.Offset(seg.Start), tf.Offset(seg.End)
+		if start < at || end > len(src) {
+			// overlapping segments are not colored twice
+			continue
+		}
+		w.write(src[at:start])
+		w.open = fmt.Sprintf("<span class=\"%v\" title=\"%v\">", class(seg.Block, max), html.EscapeString(title(seg.Block)))
+		w.write(src[start:end])
+		w.open = ""
+		at = end
+	}
+	w.write(src[at:])
+	fmt.Fprintf(fout, "</pre>\n</body></html>\n")
+	return nil
+}
+
+// class is the CSS class of the block by the log of its entrances.
+func class(b *Block, max int) string {
+	if b.NotInstrumented {
+		return "uninstrumented"
+	}
+	if b.Entrances == 0 {
+		return "cov0"
+	}
+	level := 1
+	if max > 1 {
+		level = 1 + int(4*math.Log(float64(b.Entrances))/math.Log(float64(max)))
+	}
+	if level > 5 {
+		level = 5
+	}
+	if b.Partial() {
+		return fmt.Sprintf("cov%d partial", level)
+	}
+	return fmt.Sprintf("cov%d", level)
+}
+
+// title describes the entrances of the block and the traversals of its
+// out edges.
+func title(b *Block) string {
+	if b.NotInstrumented {
+		return fmt.Sprintf("%v blk %d: not instrumented", b.Fn, b.Id)
+	}
+	parts := []string{fmt.Sprintf("%v blk %d: entered %d", b.Fn, b.Id, b.Entrances)}
+	for _, s := range b.Succs {
+		parts = append(parts, fmt.Sprintf("to blk %d: %d", s.Id, s.Traversed))
+	}
+	return strings.Join(parts, "\n")
+}
+
+// lineWriter writes the escaped source with line numbers. An open span
+// is closed at the end of each line and reopened on the next.
+type lineWriter struct {
+	out  io.Writer
+	line int
+	open string
+	bol  bool
+}
+
+func (w *lineWriter) write(src []byte) {
+	if w.line == 0 {
+		w.line = 1
+		w.bol = true
+	}
+	for len(src) > 0 {
+		if w.bol {
+			fmt.Fprintf(w.out, "<span class=\"ln\">%d</span>", w.line)
+			w.bol = false
+		}
+		text := src
+		nl := bytes.IndexByte(src, '\n')
+		if nl >= 0 {
+			text = src[:nl]
+		}
+		if w.open != "" {
+			fmt.Fprintf(w.out, "%v%v</span>", w.open, html.EscapeString(string(text)))
+		} else {
+			io.WriteString(w.out, html.EscapeString(string(text)))
+		}
+		if nl < 0 {
+			return
+		}
+		io.WriteString(w.out, "\n")
+		w.line++
+		w.bol = true
+		src = src[nl+1:]
+	}
+}
@@ -0,0 +1,267 @@
+package coverage
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+	"github.com/timtadh/dynagrok/instrument"
+	"github.com/timtadh/dynagrok/profile"
+)
+
+// A Report is the block coverage of the source files of a program.
+type Report struct {
+	FSet  *token.FileSet
+	Files []*File
+}
+
+// A File of the program with the segments of its blocks in order.
+type File struct {
+	Name     string // the path of the file
+	Path     string // the import path of its package joined with its base name
+	Segments []*Segment
+}
+
+// A Segment is the source of a statement of a block or, for a compound
+// statement (an if, for, switch, ...), its header. Stmts is the number
+// of statements which start in the segment.
+type Segment struct {
+	Start, End token.Pos
+	Stmts      int
+	Block      *Block
+}
+
+// A Block of the CFG of a function with the number of times it was
+// entered and the number of times each of its successors was entered
+// from it. The blocks of the functions the instrument filter left out
+// are NotInstrumented, they have no counts.
+type Block struct {
+	Fn              string
+	Id              int
+	Entrances       int
+	Succs           []Succ
+	NotInstrumented bool
+}
+
+type Succ struct {
+	Id        int
+	Traversed int
+}
+
+// Partial reports whether the block was entered but some of its
+// successors were never entered from it (eg. a branch never taken).
+func (b *Block) Partial() bool {
+	if b.Entrances == 0 {
+		return false
+	}
+	for _, s := range b.Succs {
+		if s.Traversed == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewReport builds the CFG of each function of the (not excluded)
+// packages of the program, the way instrument does, and counts the
+// entrances of their blocks in the summary of the profiles. The functions
+// the filter leaves out (as the program was instrumented with it) are
+// reported as not instrumented.
+func NewReport(program *loader.Program, s *profile.Summary, filter *instrument.Filter) (*Report, error) {
+	r := &Report{FSet: program.Fset}
+	for _, pkg := range program.AllPackages {
+		if excludes.ExcludedPkg(pkg.Pkg.Path()) {
+			continue
+		}
+		for _, fileAst := range pkg.Files {
+			name := program.Fset.File(fileAst.Pos()).Name()
+			f := &File{
+				Name: name,
+				Path: path.Join(pkg.Pkg.Path(), filepath.Base(name)),
+			}
+			err := analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
+				var body *[]ast.Stmt
+				switch x := fn.(type) {
+				case *ast.FuncDecl:
+					if x.Body == nil {
+						return nil
+					}
+					body = &x.Body.List
+				case *ast.FuncLit:
+					if x.Body == nil {
+						return nil
+					}
+					body = &x.Body.List
+				default:
+					return errors.Errorf("unexpected type %T", x)
+				}
+				cfg := analysis.BuildCFG(program.Fset, fnName, fn, body)
+				f.add(cfg, s, filter.Instrument(fnName, name))
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			if len(f.Segments) == 0 {
+				continue
+			}
+			sort.Slice(f.Segments, func(i, j int) bool {
+				return f.Segments[i].Start < f.Segments[j].Start
+			})
+			r.Files = append(r.Files, f)
+		}
+	}
+	sort.Slice(r.Files, func(i, j int) bool {
+		return r.Files[i].Path < r.Files[j].Path
+	})
+	return r, nil
+}
+
+// add adds the segments of the blocks of the function.
+func (f *File) add(cfg *analysis.CFG, s *profile.Summary, instrumented bool) {
+	for _, b := range cfg.Blocks {
+		if len(b.Stmts) == 0 {
+			continue
+		}
+		name := profile.BlockName(cfg.Name, b.Id)
+		blk := &Block{Fn: cfg.Name, Id: b.Id, NotInstrumented: !instrumented}
+		if x, has := s.Blocks[name]; has && instrumented {
+			blk.Entrances = x.Entrances
+		}
+		for _, n := range b.Next {
+			if n.Block == nil || !instrumented {
+				continue
+			}
+			e := profile.Edge{Kind: "flow", Src: name, Targ: profile.BlockName(cfg.Name, n.Block.Id)}
+			blk.Succs = append(blk.Succs, Succ{Id: n.Block.Id, Traversed: s.Edges[e]})
+		}
+		for _, stmt := range b.Stmts {
+			start, end := extent(*stmt)
+			for k, piece := range outsideFuncLits(*stmt, start, end) {
+				seg := &Segment{Start: piece[0], End: piece[1], Block: blk}
+				if k == 0 {
+					seg.Stmts = 1
+				}
+				f.Segments = append(f.Segments, seg)
+			}
+		}
+	}
+}
+
+// extent is the range of the statement's source which belongs to its
+// block. A compound statement's block only has its header. The init and
+// post statements of a compound statement are statements of their own
+// so they are left out of its header.
+func extent(stmt ast.Stmt) (start, end token.Pos) {
+	start = stmt.Pos()
+	if l, ok := stmt.(*ast.LabeledStmt); ok {
+		stmt = l.Stmt
+	}
+	switch s := stmt.(type) {
+	case *ast.IfStmt:
+		if s.Init != nil {
+			start = s.Cond.Pos()
+		}
+		return start, s.Body.Lbrace + 1
+	case *ast.SwitchStmt:
+		if s.Init != nil {
+			start = s.Init.End()
+		}
+		return start, s.Body.Lbrace + 1
+	case *ast.TypeSwitchStmt:
+		if s.Init != nil {
+			start = s.Assign.Pos()
+		}
+		return start, s.Body.Lbrace + 1
+	case *ast.ForStmt:
+		if s.Init == nil && s.Post == nil {
+			return start, s.Body.Lbrace + 1
+		} else if s.Cond != nil {
+			return s.Cond.Pos(), s.Cond.End()
+		}
+		return s.For, s.For + token.Pos(len("for"))
+	case *ast.RangeStmt:
+		return start, s.Body.Lbrace + 1
+	case *ast.SelectStmt:
+		return start, s.Body.Lbrace + 1
+	case *ast.BlockStmt:
+		return s.Lbrace, s.Lbrace + 1
+	case *ast.CaseClause:
+		return start, s.Colon + 1
+	case *ast.CommClause:
+		return start, s.Colon + 1
+	}
+	return start, stmt.End()
+}
+
+// outsideFuncLits splits the range around the bodies of the function
+// literals in it as they are functions (and blocks) of their own.
+func outsideFuncLits(stmt ast.Stmt, start, end token.Pos) [][2]token.Pos {
+	var pieces [][2]token.Pos
+	ast.Inspect(stmt, func(n ast.Node) bool {
+		lit, ok := n.(*ast.FuncLit)
+		if !ok {
+			return true
+		}
+		open, close := lit.Body.Lbrace+1, lit.Body.Rbrace
+		if open >= start && close <= end {
+			pieces = append(pieces, [2]token.Pos{start, open})
+			start = close
+		}
+		return false
+	})
+	return append(pieces, [2]token.Pos{start, end})
+}
+
+// Covered counts the (instrumented) statements of the file and those of
+// them which were entered.
+func (f *File) Covered() (covered, stmts int) {
+	for _, seg := range f.Segments {
+		if seg.Block.NotInstrumented {
+			continue
+		}
+		stmts += seg.Stmts
+		if seg.Block.Entrances > 0 {
+			covered += seg.Stmts
+		}
+	}
+	return covered, stmts
+}
+
+// WriteCoverProfile writes the report in the format of the coverage
+// profiles of `go test -coverprofile` (in count mode) for `go tool cover`.
+// The segments which were not instrumented are left out, like code `go
+// test` does not track.
+func (r *Report) WriteCoverProfile(fout io.Writer) error {
+	if _, err := fmt.Fprintln(fout, "mode: count"); err != nil {
+		return err
+	}
+	for _, f := range r.Files {
+		for _, seg := range f.Segments {
+			if seg.Block.NotInstrumented {
+				continue
+			}
+			start := r.FSet.Position(seg.Start)
+			end := r.FSet.Position(seg.End)
+			_, err := fmt.Fprintf(fout, "%v:%d.%d,%d.%d %d %d\n",
+				f.Path, start.Line, start.Column, end.Line, end.Column, seg.Stmts, seg.Block.Entrances)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package coverage
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+import (
+	"golang.org/x/tools/go/loader"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/instrument"
+	"github.com/timtadh/dynagrok/profile"
+)
+
+const src = `package x
+
+func f(xs []int) int {
+	s := 0
+	for i := 0; i < len(xs); i++ {
+		if x := xs[i]; x > 0 {
+			s += x
+		}
+	}
+	g := func() { s++ }
+	g()
+	return s
+}
+`
+
+func TestCoverProfile(t *testing.T) {
+	fset := token.NewFileSet()
+	fileAst, err := parser.ParseFile(fset, "x.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := fileAst.Decls[0].(*ast.FuncDecl)
+	cfg := analysis.BuildCFG(fset, "x.f", fn, &fn.Body.List)
+	s := &profile.Summary{Runs: 1, Blocks: make(map[string]*profile.Block), Edges: make(map[profile.Edge]int)}
+	for _, b := range cfg.Blocks {
+		name := profile.BlockName(cfg.Name, b.Id)
+		s.Blocks[name] = &profile.Block{Name: name, Entrances: 2}
+	}
+	f := &File{Name: "x.go", Path: "x/x.go"}
+	f.add(cfg, s, true)
+	sort.Slice(f.Segments, func(i, j int) bool { return f.Segments[i].Start < f.Segments[j].Start })
+	r := &Report{FSet: fset, Files: []*File{f}}
+	var buf bytes.Buffer
+	if err := r.WriteCoverProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"mode: count",
+		"x/x.go:4.2,4.8 1 2",    // s := 0
+		"x/x.go:5.6,5.12 1 2",   // i := 0
+		"x/x.go:5.14,5.25 1 2",  // i < len(xs)
+		"x/x.go:5.27,5.30 1 2",  // i++
+		"x/x.go:6.6,6.16 1 2",   // x := xs[i]
+		"x/x.go:6.18,6.25 1 2",  // x > 0 {
+		"x/x.go:7.4,7.10 1 2",   // s += x
+		"x/x.go:10.2,10.15 1 2", // g := func() {
+		"x/x.go:10.20,10.21 0 2",
+		"x/x.go:11.2,11.5 1 2",  // g()
+		"x/x.go:12.2,12.10 1 2", // return s
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%v\ngot\n%v", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+}
+
+const filteredSrc = `package x
+
+func f(x int) int {
+	if x > 0 {
+		return x
+	}
+	return -x
+}
+
+func g(x int) int {
+	return x * 2
+}
+`
+
+// The functions the instrument filter left out are not instrumented
+// rather than never entered.
+func TestFilteredReport(t *testing.T) {
+	conf := loader.Config{}
+	fileAst, err := conf.ParseFile("x.go", filteredSrc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.CreateFromFiles("x", fileAst)
+	program, err := conf.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &profile.Summary{Runs: 1, Blocks: make(map[string]*profile.Block), Edges: make(map[profile.Edge]int)}
+	for _, name := range []string{"x.f blk 0", "x.f blk 1", "x.g blk 0"} {
+		s.Blocks[name] = &profile.Block{Name: name, Entrances: 1}
+	}
+	filter := &instrument.Filter{SkipFunc: regexp.MustCompile(`\.g$`)}
+	r, err := NewReport(program, s, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Files) != 1 {
+		t.Fatalf("expected a file got %v", r.Files)
+	}
+	for _, seg := range r.Files[0].Segments {
+		if seg.Block.NotInstrumented != (seg.Block.Fn == "x.g") {
+			t.Errorf("expected only the blocks of x.g to be not instrumented got %v", seg.Block)
+		}
+	}
+	if covered, stmts := r.Files[0].Covered(); covered != 2 || stmts != 3 {
+		t.Errorf("expected 2 of the 3 instrumented statements to be covered got %d of %d", covered, stmts)
+	}
+	var buf bytes.Buffer
+	if err := r.WriteCoverProfile(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"mode: count",
+		"x/x.go:4.2,4.12 1 1", // if x > 0 {
+		"x/x.go:5.3,5.11 1 1", // return x
+		"x/x.go:7.2,7.11 1 0", // return -x
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected\n%v\ngot\n%v", strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+	}
+	g := &Block{Fn: "x.g", NotInstrumented: true}
+	if class(g, 10) != "uninstrumented" || title(g) != "x.g blk 0: not instrumented" {
+		t.Errorf("expected x.g to be shown as not instrumented got %v %q", class(g, 10), title(g))
+	}
+}
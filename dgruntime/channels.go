@@ -0,0 +1,202 @@
+// This file defines the calls `dynagrok instrument --channels` inserts
+// around channel operations.
+
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"reflect"
+	"sync"
+)
+
+// MaxPendingComms is the number of unmatched sends (and receives) kept
+// for each channel. Past it the oldest are dropped.
+const MaxPendingComms = 1024
+
+// ChanSend records that the current block sends v on ch. It is called
+// before the send happens (or at the start of the select case which
+// sent). site names the channel and its type at the send.
+func ChanSend(ch interface{}, site string, v interface{}) {
+	communicate(ch, site, v, true)
+}
+
+// ChanRecv records that the current block received v from ch. A receive
+// which found ch closed (ok is false) matches no send and drops whatever
+// is left unmatched on ch.
+func ChanRecv(ch interface{}, site string, v interface{}, ok bool) {
+	if !ok {
+		execCheck()
+		exec.chans.drained(ch)
+		return
+	}
+	communicate(ch, site, v, false)
+}
+
+// ChanClose replaces the builtin close: it closes ch and drops its
+// unmatched receives. Its unmatched sends are kept as their values may
+// still be buffered in ch, until a receive finds ch drained.
+func ChanClose(ch interface{}) {
+	execCheck()
+	reflect.ValueOf(ch).Close()
+	exec.chans.close(ch)
+}
+
+// communicate matches the send (or receive) of v with the oldest
+// unmatched receive (or send) of the same value on the channel. When
+// there is one a communicates-with edge from the sending block to the
+// receiving block is recorded on the goroutine which completed the
+// match.
+func communicate(ch interface{}, site string, v interface{}, send bool) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	g.m.Lock()
+	at := g.Stack[len(g.Stack)-1].Last
+	g.m.Unlock()
+	op := chanOp{at: at, site: site, key: chanKey(ch, v)}
+	peer, matched := exec.chans.match(ch, op, send)
+	if !matched {
+		return
+	}
+	c := dgtypes.ChanComm{Edge: dgtypes.FlowEdge{Src: peer.at, Targ: at}, Send: peer.site, Recv: site}
+	if send {
+		c = dgtypes.ChanComm{Edge: dgtypes.FlowEdge{Src: at, Targ: peer.at}, Send: site, Recv: peer.site}
+	}
+	g.m.Lock()
+	g.Comms[c.Edge]++
+	g.Channels[c]++
+	g.m.Unlock()
+	if exec.trace != nil {
+		exec.trace.Comm(g.GoID, c)
+	}
+}
+
+// chanKey is what a value sent on ch is matched by. The value is first
+// converted to the element type of ch (a send of an untyped constant
+// records its default type). Slices, maps and functions are matched by
+// their pointers and the values of the other types which are not
+// comparable only by their types.
+func chanKey(ch, v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	rv := reflect.ValueOf(v)
+	if elem := reflect.TypeOf(ch).Elem(); rv.Type() != elem && rv.Type().ConvertibleTo(elem) {
+		v = rv.Convert(elem).Interface()
+		if v == nil {
+			return nil
+		}
+		rv = reflect.ValueOf(v)
+	}
+	switch rv.Kind() {
+	case reflect.Slice:
+		return refKey{typ: rv.Type(), ptr: rv.Pointer(), len: rv.Len()}
+	case reflect.Map, reflect.Func:
+		return refKey{typ: rv.Type(), ptr: rv.Pointer()}
+	}
+	if !rv.Type().Comparable() {
+		return rv.Type()
+	}
+	return v
+}
+
+type refKey struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// sameKey compares the keys. A comparable type (eg. a struct) may hold an
+// interface with a value which is not, those keys are not the same.
+func sameKey(a, b interface{}) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
+
+// chanTable holds the unmatched sends and receives of each channel.
+type chanTable struct {
+	m       sync.Mutex
+	pending map[uintptr]*chanQueue
+}
+
+// chanQueue holds on to the channel so it (and so its address) stays
+// alive while it has unmatched operations.
+type chanQueue struct {
+	ch     interface{}
+	closed bool
+	sends  []chanOp
+	recvs  []chanOp
+}
+
+// chanOp is an unmatched send or receive.
+type chanOp struct {
+	at   dgtypes.BlkEntrance
+	site string
+	key  interface{}
+}
+
+func (t *chanTable) match(ch interface{}, op chanOp, send bool) (peer chanOp, matched bool) {
+	id := reflect.ValueOf(ch).Pointer()
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[uintptr]*chanQueue)
+	}
+	q := t.pending[id]
+	if q == nil {
+		q = &chanQueue{ch: ch}
+		t.pending[id] = q
+	}
+	mine, theirs := &q.sends, &q.recvs
+	if !send {
+		mine, theirs = theirs, mine
+	}
+	for k, p := range *theirs {
+		if sameKey(p.key, op.key) {
+			*theirs = append((*theirs)[:k], (*theirs)[k+1:]...)
+			if len(q.sends) == 0 && len(q.recvs) == 0 {
+				delete(t.pending, id)
+			}
+			return p, true
+		}
+	}
+	if q.closed {
+		// a send on a closed channel panics and a receive which matched
+		// nothing has no send left to wait for
+		return peer, false
+	}
+	if len(*mine) >= MaxPendingComms {
+		*mine = append((*mine)[:0], (*mine)[1:]...)
+	}
+	*mine = append(*mine, op)
+	return peer, false
+}
+
+func (t *chanTable) close(ch interface{}) {
+	id := reflect.ValueOf(ch).Pointer()
+	t.m.Lock()
+	defer t.m.Unlock()
+	q := t.pending[id]
+	if q == nil {
+		return
+	}
+	if len(q.sends) == 0 {
+		delete(t.pending, id)
+		return
+	}
+	q.closed = true
+	q.recvs = nil
+}
+
+// drained drops the unmatched operations of the closed channel.
+func (t *chanTable) drained(ch interface{}) {
+	id := reflect.ValueOf(ch).Pointer()
+	t.m.Lock()
+	defer t.m.Unlock()
+	if q := t.pending[id]; q != nil && q.closed {
+		delete(t.pending, id)
+	}
+}
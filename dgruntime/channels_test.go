@@ -0,0 +1,130 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"reflect"
+	"testing"
+)
+
+func blk(id int) dgtypes.BlkEntrance {
+	return dgtypes.BlkEntrance{In: 1, BasicBlockId: id}
+}
+
+// A buffered channel with two senders: each receive is matched with the
+// send of the value it received, not the oldest send.
+func TestChanMatchByValue(t *testing.T) {
+	var table chanTable
+	ch := make(chan int, 2)
+	op := func(at, v int) chanOp {
+		return chanOp{at: blk(at), site: "ch chan int", key: chanKey(ch, v)}
+	}
+	if _, matched := table.match(ch, op(1, 10), true); matched {
+		t.Fatal("a send with no receives matched")
+	}
+	if _, matched := table.match(ch, op(2, 20), true); matched {
+		t.Fatal("a send with no receives matched")
+	}
+	if peer, matched := table.match(ch, op(3, 20), false); !matched || peer.at != blk(2) {
+		t.Errorf("expected the receive of 20 to match the send in blk 2 got %v %v", peer, matched)
+	}
+	// a receive recorded before its send
+	if _, matched := table.match(ch, op(4, 30), false); matched {
+		t.Fatal("a receive of an unsent value matched")
+	}
+	if peer, matched := table.match(ch, op(5, 30), true); !matched || peer.at != blk(4) {
+		t.Errorf("expected the send of 30 to match the receive in blk 4 got %v %v", peer, matched)
+	}
+	if peer, matched := table.match(ch, op(6, 10), false); !matched || peer.at != blk(1) {
+		t.Errorf("expected the receive of 10 to match the send in blk 1 got %v %v", peer, matched)
+	}
+	if len(table.pending) != 0 {
+		t.Errorf("expected the matched channel to be dropped got %v", table.pending)
+	}
+}
+
+// Closing a channel drops its unmatched receives and a channel is told
+// apart from another (eg. one later at the same address).
+func TestChanClose(t *testing.T) {
+	var table chanTable
+	a, b := make(chan int), make(chan int)
+	table.match(a, chanOp{at: blk(1), key: chanKey(a, 0)}, false)
+	table.match(a, chanOp{at: blk(2), key: chanKey(a, 0)}, false)
+	table.close(a)
+	if len(table.pending) != 0 {
+		t.Fatalf("expected close to drop the receives got %v", table.pending)
+	}
+	if _, matched := table.match(a, chanOp{at: blk(3), key: chanKey(a, 0)}, true); matched {
+		t.Error("a send matched a receive from before the close")
+	}
+	if _, matched := table.match(b, chanOp{at: blk(4), key: chanKey(b, 0)}, false); matched {
+		t.Error("a receive matched a send on another channel")
+	}
+}
+
+// The sends buffered in a closed channel are still received. The rest
+// are dropped once a receive finds the channel drained.
+func TestChanCloseBuffered(t *testing.T) {
+	var table chanTable
+	ch := make(chan int, 3)
+	for v := 1; v <= 3; v++ {
+		table.match(ch, chanOp{at: blk(v), key: chanKey(ch, v)}, true)
+	}
+	table.close(ch)
+	if peer, matched := table.match(ch, chanOp{at: blk(4), key: chanKey(ch, 2)}, false); !matched || peer.at != blk(2) {
+		t.Errorf("expected the receive of 2 to match the send in blk 2 got %v %v", peer, matched)
+	}
+	if _, matched := table.match(ch, chanOp{at: blk(5), key: chanKey(ch, 4)}, false); matched {
+		t.Error("a receive of an unsent value matched")
+	}
+	if q := table.pending[reflect.ValueOf(ch).Pointer()]; q == nil || len(q.recvs) != 0 || len(q.sends) != 2 {
+		t.Fatalf("expected the two unreceived sends and no receives left got %v", q)
+	}
+	table.drained(ch)
+	if len(table.pending) != 0 {
+		t.Errorf("expected the drained channel to be dropped got %v", table.pending)
+	}
+}
+
+// The unmatched operations of a channel are bounded.
+func TestChanPendingBound(t *testing.T) {
+	var table chanTable
+	ch := make(chan int)
+	for k := 0; k <= MaxPendingComms; k++ {
+		table.match(ch, chanOp{at: blk(k), key: chanKey(ch, k)}, false)
+	}
+	for _, q := range table.pending {
+		if len(q.recvs) != MaxPendingComms {
+			t.Errorf("expected %d pending receives got %d", MaxPendingComms, len(q.recvs))
+		}
+		if q.recvs[0].at != blk(1) {
+			t.Errorf("expected the oldest receive to be dropped got %v", q.recvs[0])
+		}
+	}
+}
+
+func TestChanKey(t *testing.T) {
+	type pair struct {
+		x interface{}
+	}
+	xs := []int{1, 2}
+	cases := []struct {
+		ch   interface{}
+		a, b interface{}
+		same bool
+	}{
+		// an untyped constant is sent as its default type
+		{make(chan float64), 1, 1.0, true},
+		{make(<-chan interface{}), 1, 1, true},
+		{make(chan []int), xs, xs, true},
+		{make(chan []int), xs, xs[:1], false},
+		{make(chan []int), xs, []int{1, 2}, false},
+		{make(chan error), nil, nil, true},
+		{make(chan pair), pair{xs}, pair{xs}, false},
+		{make(chan pair), pair{1}, pair{1}, true},
+	}
+	for _, c := range cases {
+		if same := sameKey(chanKey(c.ch, c.a), chanKey(c.ch, c.b)); same != c.same {
+			t.Errorf("expected the keys of %#v and %#v on a %T to be the same %v got %v", c.a, c.b, c.ch, c.same, same)
+		}
+	}
+}
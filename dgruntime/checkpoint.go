@@ -0,0 +1,165 @@
+// This file defines the periodic checkpoints of the profile. When
+// DGCHECKPOINT is set to a duration (eg. 500ms) the profile is written to
+// $DGPROF that often while the program runs. A program which is killed
+// before it can shut down still leaves the last checkpoint behind.
+
+package dgruntime
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// startCheckpoints starts checkpointing the profile if DGCHECKPOINT is
+// set.
+func (e *Execution) startCheckpoints() {
+	env := os.Getenv("DGCHECKPOINT")
+	if env == "" {
+		return
+	}
+	every, err := time.ParseDuration(env)
+	if err != nil || every <= 0 {
+		fmt.Printf("dynagrok ignored DGCHECKPOINT=%v (expected a positive duration)\n", env)
+		return
+	}
+	e.stopCheckpoints = make(chan struct{})
+	e.checkpoints.Add(1)
+	go e.checkpointer(every)
+}
+
+// stopCheckpointing stops the checkpointer and waits for the checkpoint
+// it is writing (if any).
+func (e *Execution) stopCheckpointing() {
+	if e.stopCheckpoints == nil {
+		return
+	}
+	close(e.stopCheckpoints)
+	e.checkpoints.Wait()
+	e.stopCheckpoints = nil
+}
+
+func (e *Execution) checkpointer(every time.Duration) {
+	defer e.checkpoints.Done()
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.checkpoint()
+		case <-e.stopCheckpoints:
+			return
+		}
+	}
+}
+
+// checkpoint merges what the live goroutines have recorded so far into
+// the profile and writes it out. Goroutines in a segment are left alone,
+// their counts belong to the segment. The goroutines only lock their
+// state while it is cut.
+func (e *Execution) checkpoint() {
+	var cuts []*Goroutine
+	atomic.StoreInt32(&e.cutting, 1)
+	for _, g := range e.goroutines() {
+		if c := g.checkpointCut(); c != nil {
+			cuts = append(cuts, c)
+		}
+	}
+	atomic.StoreInt32(&e.cutting, 0)
+	e.merge(cuts)
+	e.m.Lock()
+	defer e.m.Unlock()
+	if err := e.writeProfile(false); err != nil {
+		fmt.Println("dynagrok could not write a checkpoint:", err)
+	}
+}
+
+// checkpointCut is cut for a checkpoint. It returns nil if the goroutine
+// has closed or is in a segment.
+func (g *Goroutine) checkpointCut() *Goroutine {
+	g.lockRunning()
+	defer g.m.Unlock()
+	if g.Closed || g.Segment != nil {
+		return nil
+	}
+	c := g.cutLocked()
+	stackFuncs(c.Funcs, g.Stack[1:])
+	return c
+}
+
+// profileFile is one of the files the profile is written to.
+type profileFile struct {
+	name  string
+	what  string
+	write func(io.Writer) error
+}
+
+// writeProfile writes the profile and the failures to the output
+// directory. e.m must be held. Each file is written to a temporary file
+// which is renamed into place so the files are never half written.
+func (e *Execution) writeProfile(verbose bool) error {
+	var files []profileFile
+	if !e.Profile.Empty() {
+		files = append(files,
+			profileFile{"functions.json", "functions", e.Profile.WriteFunctions},
+			profileFile{"flow-graph.dot", "flow-graph", func(w io.Writer) error {
+				e.Profile.WriteDotty(w)
+				return nil
+			}},
+			profileFile{"flow-graph.txt", "flow-graph", func(w io.Writer) error {
+				e.Profile.WriteSimple(w)
+				return nil
+			}},
+			profileFile{"profile.proto", "pprof profile", e.Profile.WritePprof},
+		)
+	}
+	if len(e.Profile.Inputs) > 0 {
+		files = append(files, profileFile{"object-profiles.bin", "object profiles", e.Profile.WriteObjectProfiles})
+	}
+	if len(e.fails) > 0 {
+		if verbose {
+			fmt.Printf("The program registered %v failures\n", len(e.fails))
+		}
+		files = append(files, profileFile{"failures", "failures", func(w io.Writer) error {
+			for _, f := range e.fails {
+				if verbose {
+					fmt.Printf("fail: %v\n", f)
+				}
+				if _, err := fmt.Fprintln(w, f); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+	}
+	for _, f := range files {
+		path := pjoin(e.OutputDir, f.name)
+		if verbose {
+			fmt.Printf("writing %v to: %v\n", f.what, path)
+		}
+		if err := writeFile(path, f.write); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFile writes path by way of a temporary file in the same directory.
+func writeFile(path string, write func(io.Writer) error) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
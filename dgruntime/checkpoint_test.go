@@ -0,0 +1,102 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// A checkpoint cuts the goroutines while they run. Every count is either
+// in the checkpoint or left on the goroutine, none are lost or counted
+// twice.
+func TestCheckpointCut(t *testing.T) {
+	dir, restore := testExecution(t)
+	defer restore()
+
+	const goroutines = 20
+	const calls = 50
+	const loops = 200
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := 0; c < calls; c++ {
+				looped(loops)
+			}
+		}()
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	checkpoints := 0
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			exec.checkpoint()
+			checkpoints++
+		}
+	}()
+	wg.Wait()
+	close(stop)
+	<-done
+	shutdown(exec)
+
+	p := exec.Profile
+	if checkpoints == 0 {
+		t.Fatal("no checkpoints were taken")
+	}
+	if p.CallCount != goroutines*calls {
+		t.Errorf("expected %d calls got %d", goroutines*calls, p.CallCount)
+	}
+	for fpc := range p.Funcs {
+		loop := dgtypes.BlkEntrance{In: fpc, BasicBlockId: 1}
+		if n := p.Flows[dgtypes.FlowEdge{Src: loop, Targ: loop}]; n != goroutines*calls*(loops-1) {
+			t.Errorf("expected the loop to be taken %d times got %d", goroutines*calls*(loops-1), n)
+		}
+	}
+	if _, err := os.Stat(pjoin(dir, "flow-graph.txt")); err != nil {
+		t.Error(err)
+	}
+}
+
+// looped is instrumented by hand as if it were
+//
+//	func looped(n int) {
+//		for i := 0; i < n; i++ {
+//		}
+//	}
+func looped(n int) {
+	EnterFunc("dgruntime.looped", stressPos, [][]int{{1}, {1, 2}, {}}, []int{1, 2, 2})
+	defer ExitFunc("dgruntime.looped")
+	for i := 0; i < n; i++ {
+		EnterBlk(1, stressPos)
+	}
+	EnterBlk(2, stressPos)
+}
+
+// testExecution swaps in an Execution of its own, which execCheck leaves
+// alone, writing to a temporary directory. restore puts the old one back.
+func testExecution(t *testing.T) (dir string, restore func()) {
+	dir, err := ioutil.TempDir("", "dgruntime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("DGPROF", dir)
+	old := exec
+	execOnce.Do(func() {})
+	exec = newExecution()
+	return dir, func() {
+		exec = old
+		if old == nil {
+			execOnce = sync.Once{}
+		}
+		os.RemoveAll(dir)
+	}
+}
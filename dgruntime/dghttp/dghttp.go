@@ -0,0 +1,40 @@
+/*
+dghttp segments the profile of an instrumented server by request. Each
+request handled by a wrapped handler gets its own flow graph. Requests
+which panic or respond with a 5xx status are counted as failures.
+
+	http.ListenAndServe(":8080", dghttp.Handler(mux))
+*/
+package dghttp
+
+import (
+	"dgruntime"
+	"fmt"
+	"net/http"
+)
+
+func Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dgruntime.BeginSegment(fmt.Sprintf("%v %v", r.Method, r.URL.Path))
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		ok := false
+		defer func() {
+			if !ok || rec.status >= 500 {
+				dgruntime.FailSegment()
+			}
+			dgruntime.EndSegment()
+		}()
+		h.ServeHTTP(rec, r)
+		ok = true
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
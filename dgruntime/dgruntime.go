@@ -7,7 +7,6 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
-	"runtime"
 	"syscall"
 	"time"
 	"unsafe"
@@ -25,7 +24,6 @@ func init() {
 }
 
 func Shutdown() {
-	fmt.Println(runtime.Wacky())
 	execCheck()
 	shutdown(exec)
 }
@@ -55,9 +53,8 @@ func EnterBlkFromCond(bbid int, pos string) bool {
 
 func EnterBlk(bbid int, pos string) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
-	g.m.Lock()
-	defer g.m.Unlock()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
 	fc := g.Stack[len(g.Stack)-1]
 	defer func() {
 		if e := recover(); e != nil {
@@ -76,59 +73,74 @@ func EnterBlk(bbid int, pos string) {
 	g.Flows[dgtypes.FlowEdge{Src: last, Targ: cur}]++
 	g.Positions[cur] = pos
 	g.Durations[last] += dur
-	//
-	// Masri's Algorithm for dynamic control dependence
-	//
-	// W. Masri and A. Podgurski, “Algorithms and Tool Support for Dynamic
-	// Information Flow Analysis,” Information and Software Technology. Feb.
-	// 2009. https://doi.org/10.1016/j.infsof.2008.05.008
-	if len(fc.CDStack) > 0 && bbid == fc.IPDom[fc.CDStack[len(fc.CDStack)-1]] {
-		fc.CDStack = fc.CDStack[:len(fc.CDStack)-1] // pop the CDStack
-	}
-	if len(fc.CDStack) > 0 {
-		// fmt.Printf("%v: dyn-cdp for %d is %d\n", fc.Name, bbid, fc.CDStack[len(fc.CDStack)-1])
-		fc.DynCDP[bbid][fc.CDStack[len(fc.CDStack)-1]] = true
-	} else {
-		// fmt.Printf("%v: dyn-cdp for %d is null\n", fc.Name, bbid)
-	}
-	if len(fc.CFG[bbid]) > 1 {
-		if len(fc.CDStack) > 0 && fc.IPDom[bbid] == fc.IPDom[fc.CDStack[len(fc.CDStack)-1]] {
-			fc.CDStack = fc.CDStack[:len(fc.CDStack)-1] // pop the CDStack
-		}
-		fc.CDStack = append(fc.CDStack, bbid)
+	g.enteredIn(cur)
+	g.spentIn(last, dur)
+	fc.EnterBlk(bbid)
+	if exec.trace != nil {
+		exec.trace.EnterBlk(g.GoID, bbid, pos)
 	}
 }
 
 func EnterFunc(name, pos string, cfg [][]int, ipdom []int) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
-	// g.m.Lock()
+	fpc := funcEntry(unsafe.Pointer(&name))
+	enterFunc(dgtypes.NewFuncCall(name, fpc, cfg, ipdom, time.Now()), name, pos, cfg, ipdom)
+}
+
+func enterFunc(fc *dgtypes.FuncCall, name, pos string, cfg [][]int, ipdom []int) {
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
 	if g.Closed {
-		// g.m.Unlock()
 		panic("enter func on closed Goroutine")
 	}
-	pc := runtime.GetCallerPC(unsafe.Pointer(&name))
-	f := runtime.FuncForPC(pc)
-	fpc := f.Entry()
-	cur := dgtypes.BlkEntrance{In: fpc, BasicBlockId: 0}
-	fc := &dgtypes.FuncCall{
-		Name:     name,
-		FuncPc:   fpc,
-		Last:     cur,
-		LastTime: time.Now(),
-		CFG:      cfg,
-		IPDom:    ipdom,
-		CDStack:  append(make([]int, 0, len(ipdom)), 0),
-		DynCDP:   make([]map[int]bool, len(cfg)),
-	}
+	fpc := fc.FuncPc
 	g.Stack = append(g.Stack, fc)
-	for i := range fc.DynCDP {
-		fc.DynCDP[i] = make(map[int]bool)
+	ctx := g.ctx()
+	if stacked() {
+		ctx = ctx.call(g.Stack[len(g.Stack)-2].Last)
+		g.stackCalls[stackBlk{ctx, fc.Last}]++
+	}
+	g.ctxs = append(g.ctxs, ctx)
+	g.enteredIn(fc.Last)
+	if len(g.Stack) == 2 && g.spawned {
+		// the first call of a goroutine started by a go statement
+		g.spawned = false
+		g.Spawns[dgtypes.FlowEdge{Src: g.spawnedAt, Targ: fc.Last}]++
+	} else {
+		g.Flows[dgtypes.FlowEdge{Src: g.Stack[len(g.Stack)-2].Last, Targ: fc.Last}]++
 	}
-	g.Flows[dgtypes.FlowEdge{Src: g.Stack[len(g.Stack)-2].Last, Targ: cur}]++
 	g.Calls[dgtypes.Call{Caller: g.Stack[len(g.Stack)-2].FuncPc, Callee: fpc}]++
-	g.Positions[cur] = pos
-	// g.m.Unlock()
+	g.Positions[fc.Last] = pos
+	if exec.trace != nil {
+		exec.trace.EnterFunc(g.GoID, fpc, name, pos, cfg, ipdom)
+	}
+}
+
+// Spawn is called by an instrumented go statement before it starts the
+// goroutine. It returns the block the statement is in which the new
+// goroutine passes to Spawned.
+func Spawn() dgtypes.BlkEntrance {
+	execCheck()
+	g := exec.Goroutine(goid())
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.Stack[len(g.Stack)-1].Last
+}
+
+// Spawned is the first call made by a goroutine started by an
+// instrumented go statement. The goroutine's first call is recorded as a
+// spawn edge from the block of the go statement.
+func Spawned(from dgtypes.BlkEntrance) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.spawned = true
+	g.spawnedAt = from
+	if exec.trace != nil {
+		exec.trace.Spawned(g.GoID, from)
+	}
+	g.crashes = true
 }
 
 func deriveProfile(items []interface{}) (dgtypes.ObjectProfile, []dgtypes.Type) {
@@ -142,7 +154,9 @@ func deriveProfile(items []interface{}) (dgtypes.ObjectProfile, []dgtypes.Type)
 			Val  interface{}
 		}); ok {
 			values = append(values, dgtypes.Param{Name: param.Name, Val: dgtypes.NewVal(param.Val)})
-			types = append(types, dgtypes.NewType(param.Val))
+			if typ := dgtypes.NewType(param.Val); typ != nil {
+				types = append(types, typ)
+			}
 		}
 	}
 	return values, types
@@ -150,19 +164,37 @@ func deriveProfile(items []interface{}) (dgtypes.ObjectProfile, []dgtypes.Type)
 
 func MethodInput(fnName string, pos string, inputs ...interface{}) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
+	g := exec.Goroutine(goid())
 	values, types := deriveProfile(inputs)
+	g.m.Lock()
+	defer g.m.Unlock()
 	g.Inputs[fnName] = append(g.Inputs[fnName], values)
 	for _, typ := range types {
 		g.Types[typ.Name()] = typ
 	}
 }
 
+// MethodOutput records the outputs of a call returning through the return
+// statement at pos.
 func MethodOutput(fnName string, pos string, outputs ...interface{}) {
+	methodOutput(fnName, dgtypes.Exit{Site: pos}, outputs)
+}
+
+// MethodPanicked records the outputs (the named results) of a call of the
+// function at pos which exited without reaching a return statement because
+// of a panic.
+func MethodPanicked(fnName string, pos string, outputs ...interface{}) {
+	methodOutput(fnName, dgtypes.Exit{Site: pos, Panicked: true}, outputs)
+}
+
+func methodOutput(fnName string, exit dgtypes.Exit, outputs []interface{}) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
+	g := exec.Goroutine(goid())
 	values, types := deriveProfile(outputs)
+	g.m.Lock()
+	defer g.m.Unlock()
 	g.Outputs[fnName] = append(g.Outputs[fnName], values)
+	g.Exits[fnName] = append(g.Exits[fnName], exit)
 	for _, typ := range types {
 		g.Types[typ.Name()] = typ
 	}
@@ -170,40 +202,72 @@ func MethodOutput(fnName string, pos string, outputs ...interface{}) {
 
 func ExitFunc(name string) {
 	execCheck()
-	g := exec.Goroutine(runtime.GoID())
-	// g.m.Lock()
+	exitFunc(exec.Goroutine(goid()), name, false)
+}
+
+// exitFunc pops the goroutine's current call, which is being unwound by a
+// panic or returning. It reports whether the call was the goroutine's
+// outermost. A panic which unwound the outermost call is a failure.
+func exitFunc(g *Goroutine, name string, unwinding bool) bool {
+	locked := g.lockOwn()
 	if g.Closed {
-		// g.m.Unlock()
+		g.unlockOwn(locked)
 		panic("enter func on closed Goroutine")
 	}
 	g.CallCount++
-	fc := g.Stack[len(g.Stack)-1]
-	g.Stack = g.Stack[:len(g.Stack)-1]
+	depth := len(g.Stack) - 1
+	fc := g.Stack[depth]
+	ctx := g.ctxs[depth]
+	g.Stack = g.Stack[:depth]
+	g.ctxs = g.ctxs[:depth]
+	exits, label := g.exits(fc, depth, unwinding)
+	if exec.trace != nil {
+		exec.trace.ExitFunc(g.GoID, label)
+	}
 	// Println(fmt.Sprintf("exit %v %v", fc.Name, fc.Flow))
 	if len(g.Stack) >= 1 {
 		ret := g.Stack[len(g.Stack)-1]
-		start := fc.LastTime
-		now := time.Now()
-		g.Flows[dgtypes.FlowEdge{Src: fc.Last, Targ: ret.Last}]++
-		g.Durations[fc.Last] += now.Sub(start)
-		ret.LastTime = now
+		exits[dgtypes.FlowEdge{Src: fc.Last, Targ: ret.Last}]++
+		if label == "" && len(g.Stack) > 1 {
+			// returned into ret.Last (rather than out of the goroutine)
+			g.enteredIn(ret.Last)
+		}
+		// the levels without durations never set LastTime
+		if start := fc.LastTime; !start.IsZero() {
+			now := time.Now()
+			dur := now.Sub(start)
+			g.Durations[fc.Last] += dur
+			if stacked() {
+				g.stackDurations[stackBlk{ctx, fc.Last}] += dur
+			}
+			ret.LastTime = now
+		}
 	}
 	if f, has := g.Funcs[fc.FuncPc]; has {
 		f.Update(fc)
 	} else {
 		g.Funcs[fc.FuncPc] = dgtypes.NewFunction(fc)
 	}
-	if len(g.Stack) == 1 {
-		// g.m.Unlock()
+	outermost := len(g.Stack) == 1
+	var failed *panicking
+	if outermost && unwinding {
+		failed = g.unwinding
+	}
+	g.unlockOwn(locked)
+	if failed != nil {
+		exec.Fail(failed.fnName, failed.site.Blk.BasicBlockId, failed.pos)
+	}
+	// a goroutine in a segment stays open until the segment ends, so
+	// whoever began it (eg. dghttp) can still fail it (see EndSegment)
+	if outermost && g.Segment == nil {
 		g.Exit()
-		return
 	}
-	// g.m.Unlock()
+	return outermost
 }
 
 func Println(data string) {
 	execCheck()
 	exec.m.Lock()
 	defer exec.m.Unlock()
-	fmt.Printf("goid %v:\t %v\n", runtime.GoID(), data)
+	fmt.Printf("goid %v:\t %v\n", goid(), data)
 }
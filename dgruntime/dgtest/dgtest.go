@@ -0,0 +1,29 @@
+/*
+dgtest segments the profile of an instrumented test binary by test. Each
+test which calls Segment gets its own flow graph, written to the pass or
+fail directory according to the test's result.
+
+	func TestFoo(t *testing.T) {
+		defer dgtest.Segment(t)()
+		...
+	}
+*/
+package dgtest
+
+import (
+	"dgruntime"
+	"testing"
+)
+
+// Segment begins a segment named after the test. The returned func ends
+// it and must be deferred so it runs after the test has finished (a
+// panicking test is counted as a failure, the panic is not recovered).
+func Segment(t testing.TB) (end func()) {
+	dgruntime.BeginSegment(t.Name())
+	return func() {
+		if dgruntime.Unwinding() || t.Failed() {
+			dgruntime.FailSegment()
+		}
+		dgruntime.EndSegment()
+	}
+}
@@ -29,6 +29,60 @@ type FuncCall struct {
 	LastTime time.Time
 }
 
+func NewFuncCall(name string, fpc uintptr, cfg [][]int, ipdom []int, now time.Time) *FuncCall {
+	fc := &FuncCall{
+		Name:     name,
+		FuncPc:   fpc,
+		Last:     BlkEntrance{In: fpc, BasicBlockId: 0},
+		LastTime: now,
+		CFG:      cfg,
+		IPDom:    ipdom,
+		CDStack:  append(make([]int, 0, len(ipdom)), 0),
+		DynCDP:   make([]map[int]bool, len(cfg)),
+	}
+	for i := range fc.DynCDP {
+		fc.DynCDP[i] = make(map[int]bool)
+	}
+	return fc
+}
+
+// NewFuncCallNoCD is NewFuncCall for the levels which do not track the
+// dynamic control dependence. The call's EnterBlk must not be used.
+func NewFuncCallNoCD(name string, fpc uintptr, cfg [][]int, ipdom []int, now time.Time) *FuncCall {
+	return &FuncCall{
+		Name:     name,
+		FuncPc:   fpc,
+		Last:     BlkEntrance{In: fpc, BasicBlockId: 0},
+		LastTime: now,
+		CFG:      cfg,
+		IPDom:    ipdom,
+	}
+}
+
+// EnterBlk tracks the dynamic control dependence of bbid as the call
+// enters it using Masri's Algorithm for dynamic control dependence:
+//
+// W. Masri and A. Podgurski, “Algorithms and Tool Support for Dynamic
+// Information Flow Analysis,” Information and Software Technology. Feb.
+// 2009. https://doi.org/10.1016/j.infsof.2008.05.008
+func (fc *FuncCall) EnterBlk(bbid int) {
+	if len(fc.CDStack) > 0 && bbid == fc.IPDom[fc.CDStack[len(fc.CDStack)-1]] {
+		fc.CDStack = fc.CDStack[:len(fc.CDStack)-1] // pop the CDStack
+	}
+	if len(fc.CDStack) > 0 {
+		// fmt.Printf("%v: dyn-cdp for %d is %d\n", fc.Name, bbid, fc.CDStack[len(fc.CDStack)-1])
+		fc.DynCDP[bbid][fc.CDStack[len(fc.CDStack)-1]] = true
+	} else {
+		// fmt.Printf("%v: dyn-cdp for %d is null\n", fc.Name, bbid)
+	}
+	if len(fc.CFG[bbid]) > 1 {
+		if len(fc.CDStack) > 0 && fc.IPDom[bbid] == fc.IPDom[fc.CDStack[len(fc.CDStack)-1]] {
+			fc.CDStack = fc.CDStack[:len(fc.CDStack)-1] // pop the CDStack
+		}
+		fc.CDStack = append(fc.CDStack, bbid)
+	}
+}
+
 func ExportFunctions(funcs map[uintptr]*Function) map[string]*ExportFunction {
 	export := make(map[string]*ExportFunction, len(funcs))
 	for _, fn := range funcs {
@@ -33,7 +33,7 @@ func valueFromRaw(raw *json.RawMessage) (Value, error) {
 	//fmt.Printf("RawMessage: %v\n", string(*raw))
 	// Put the raw Val into an object map
 	// and check if it has a field indicating its concrete type
-	if raw == nil {
+	if raw == nil || string(*raw) == "null" {
 		return nil, nil
 	}
 	var valMap map[string]*json.RawMessage
@@ -47,11 +47,19 @@ func valueFromRaw(raw *json.RawMessage) (Value, error) {
 
 	var err error
 	switch typeName {
-	case "IntValue":
+	case intType:
 		var i IntValue
 		err = json.Unmarshal(*raw, &i)
 		return &i, err
-	case "StructValue":
+	case floatType:
+		var f FloatValue
+		err = json.Unmarshal(*raw, &f)
+		return &f, err
+	case complexType:
+		var c ComplexValue
+		err = json.Unmarshal(*raw, &c)
+		return &c, err
+	case structType:
 		var s StructValue
 		var name string
 		json.Unmarshal(*valMap["TypName"], &name)
@@ -66,34 +74,92 @@ func valueFromRaw(raw *json.RawMessage) (Value, error) {
 		s.TypName = name
 		s.Fields = fields
 		return &s, err
-	case "StringValue":
+	case stringType:
 		var s StringValue
 		err = json.Unmarshal(*raw, &s)
 		return &s, err
-	case "BoolValue":
+	case boolType:
 		var s BoolValue
 		err = json.Unmarshal(*raw, &s)
 		return &s, err
-	case "ReferenceValue":
+	case referenceType:
 		var r ReferenceValue
 		json.Unmarshal(*valMap["Typename"], &r.Typename)
 		json.Unmarshal(*valMap["JSONType"], &r.JSONType)
+		unmarshalField(valMap, "ValKind", &r.ValKind)
+		unmarshalField(valMap, "Nil", &r.Nil)
+		unmarshalField(valMap, "Cycle", &r.Cycle)
 		r.Elem, err = valueFromRaw(valMap["Elem"])
 		return &r, err
-	case "ArrayValue":
+	case arrayType:
 		var a ArrayValue
 		json.Unmarshal(*valMap["ElemType"], &a.ElemType)
 		json.Unmarshal(*valMap["JSONType"], &a.JSONType)
-		var rawVals []*json.RawMessage
-		json.Unmarshal(*valMap["Val"], &rawVals)
-		a.Val = make([]Value, len(rawVals))
-		for i := range rawVals {
-			a.Val[i], err = valueFromRaw(rawVals[i])
-		}
+		unmarshalField(valMap, "Len", &a.Len)
+		unmarshalField(valMap, "Slice", &a.Slice)
+		unmarshalField(valMap, "Nil", &a.Nil)
+		a.Val, err = valuesFromRaw(valMap["Val"])
 		return &a, err
+	case mapType:
+		var m MapValue
+		json.Unmarshal(*valMap["TypName"], &m.TypName)
+		json.Unmarshal(*valMap["JSONType"], &m.JSONType)
+		unmarshalField(valMap, "Len", &m.Len)
+		unmarshalField(valMap, "Nil", &m.Nil)
+		m.Keys, err = valuesFromRaw(valMap["Keys"])
+		if err != nil {
+			return &m, err
+		}
+		m.Vals, err = valuesFromRaw(valMap["Vals"])
+		return &m, err
+	case chanType:
+		var c ChanValue
+		err = json.Unmarshal(*raw, &c)
+		return &c, err
+	case funcType:
+		var f FuncValue
+		err = json.Unmarshal(*raw, &f)
+		return &f, err
+	case nilType:
+		var n NilValue
+		err = json.Unmarshal(*raw, &n)
+		return &n, err
+	case elidedType:
+		var e ElidedValue
+		err = json.Unmarshal(*raw, &e)
+		return &e, err
 
 	default:
 		fmt.Printf("Unrecognized JSON type %s", typeName)
 		return nil, error(fmt.Errorf("Unrecognized JSON type %s", typeName))
 	}
 }
+
+// valuesFromRaw unmarshals a list of values (the elements of an array or
+// the keys or values of a map).
+func valuesFromRaw(raw *json.RawMessage) ([]Value, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	var rawVals []*json.RawMessage
+	if err := json.Unmarshal(*raw, &rawVals); err != nil {
+		return nil, err
+	}
+	vals := make([]Value, len(rawVals))
+	for i := range rawVals {
+		var err error
+		vals[i], err = valueFromRaw(rawVals[i])
+		if err != nil {
+			return vals, err
+		}
+	}
+	return vals, nil
+}
+
+// unmarshalField unmarshals the field of valMap into v if the field is
+// there. Profiles written before a field was added lack it.
+func unmarshalField(valMap map[string]*json.RawMessage, name string, v interface{}) {
+	if raw := valMap[name]; raw != nil {
+		json.Unmarshal(*raw, v)
+	}
+}
@@ -0,0 +1,102 @@
+package dgtypes
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Level is how much the instrumentation records when a basic block is
+// entered. Each level has its own dgruntime.EnterBlk* function.
+type Level int
+
+const (
+	// FullLevel records flow counts, durations and dynamic control
+	// dependence (dgruntime.EnterBlk).
+	FullLevel Level = iota
+	// NoCDLevel skips the dynamic control dependence
+	// (dgruntime.EnterBlkNoCD).
+	NoCDLevel
+	// NoDurationsLevel skips the block durations
+	// (dgruntime.EnterBlkNoDurations).
+	NoDurationsLevel
+	// CountsLevel only records flow counts (dgruntime.EnterBlkFast).
+	CountsLevel
+	// SampledLevel records flow counts for a sample of the block
+	// entrances (dgruntime.EnterBlkSampled).
+	SampledLevel
+)
+
+var levelNames = []string{"full", "no-cd", "no-durations", "counts", "sampled"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel is the inverse of Level.String.
+func ParseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q (expected one of %v)", name, strings.Join(levelNames, ", "))
+}
+
+// Durations reports whether the level records block durations.
+func (l Level) Durations() bool {
+	return l == FullLevel || l == NoCDLevel
+}
+
+// ControlDependence reports whether the level records dynamic control
+// dependence.
+func (l Level) ControlDependence() bool {
+	return l == FullLevel || l == NoDurationsLevel
+}
+
+// Instrumentation records the level a profile was collected at. When
+// the level is SampledLevel one in SampleEvery block entrances is
+// counted or, if SampleRate is set, each entrance is counted with
+// probability SampleRate.
+type Instrumentation struct {
+	Level       Level
+	SampleEvery int
+	SampleRate  float64
+}
+
+func (i Instrumentation) String() string {
+	if i.Level != SampledLevel {
+		return i.Level.String()
+	}
+	if i.SampleRate > 0 {
+		return fmt.Sprintf("%v rate %v", i.Level, i.SampleRate)
+	}
+	return fmt.Sprintf("%v every %d", i.Level, i.SampleEvery)
+}
+
+// ParseInstrumentation is the inverse of Instrumentation.String.
+func ParseInstrumentation(s string) (Instrumentation, error) {
+	var i Instrumentation
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return i, fmt.Errorf("empty instrumentation level")
+	}
+	level, err := ParseLevel(fields[0])
+	if err != nil {
+		return i, err
+	}
+	i.Level = level
+	switch {
+	case len(fields) == 1 && level != SampledLevel:
+		return i, nil
+	case len(fields) == 3 && level == SampledLevel && fields[1] == "every":
+		_, err = fmt.Sscan(fields[2], &i.SampleEvery)
+	case len(fields) == 3 && level == SampledLevel && fields[1] == "rate":
+		_, err = fmt.Sscan(fields[2], &i.SampleRate)
+	default:
+		err = fmt.Errorf("bad instrumentation level %q", s)
+	}
+	return i, err
+}
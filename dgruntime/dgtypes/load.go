@@ -0,0 +1,526 @@
+package dgtypes
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadSimple reads a profile written by WriteSimple. The input must hold
+// exactly one graph (see LoadSimpleAll).
+//
+// The functions of the loaded profile are identified by made up program
+// counters. Their CFGs and the object profiles are not part of the
+// format.
+func LoadSimple(input io.Reader) (*Profile, error) {
+	profiles, err := LoadSimpleAll(input)
+	if err != nil {
+		return nil, err
+	}
+	if len(profiles) != 1 {
+		return nil, fmt.Errorf("expected one graph got %d", len(profiles))
+	}
+	return profiles[0], nil
+}
+
+// LoadSimpleAll reads each of the profiles in the input (eg. the
+// flow-graph.txt files of several runs concatenated).
+func LoadSimpleAll(input io.Reader) ([]*Profile, error) {
+	var profiles []*Profile
+	var l *profileLoader
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		split := strings.SplitN(line, "\t", 2)
+		kind := split[0]
+		if kind == "start-graph" {
+			l = newProfileLoader()
+			continue
+		} else if l == nil {
+			return nil, fmt.Errorf("line %d: `%v` is outside of a graph", lineno, line)
+		} else if kind == "end-graph" {
+			profiles = append(profiles, l.done())
+			l = nil
+			continue
+		}
+		var tokens []string
+		if len(split) == 2 {
+			var err error
+			tokens, err = splitTokens(split[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+		}
+		if err := l.simpleLine(kind, tokens); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineno, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if l != nil {
+		return nil, fmt.Errorf("the last graph has no end-graph")
+	}
+	return profiles, nil
+}
+
+// LoadDot reads a profile written by WriteDotty. See LoadSimple for what
+// is not loaded. The DOT format does not have the call graph (the Calls),
+// the channels or the predicates either.
+func LoadDot(input io.Reader) (*Profile, error) {
+	l := newProfileLoader()
+	scanner := bufio.NewScanner(input)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	lineno := 0
+	started, ended := false, false
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case line == "digraph {":
+			if started {
+				return nil, fmt.Errorf("line %d: expected one graph", lineno)
+			}
+			started = true
+		case line == "}":
+			ended = true
+		case !started || ended:
+			return nil, fmt.Errorf("line %d: `%v` is outside of the graph", lineno, line)
+		default:
+			if err := l.dotLine(line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", lineno, err)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if !ended {
+		return nil, fmt.Errorf("the graph is not closed")
+	}
+	return l.done(), nil
+}
+
+type profileLoader struct {
+	p    *Profile
+	blks map[int]BlkEntrance
+	fns  map[string]uintptr
+}
+
+func newProfileLoader() *profileLoader {
+	return &profileLoader{
+		p:    NewProfile(),
+		blks: map[int]BlkEntrance{0: {}},
+		fns:  make(map[string]uintptr),
+	}
+}
+
+func (l *profileLoader) version(v int) error {
+	if v > ProfileVersion {
+		return fmt.Errorf("the profile is version %d, this dynagrok reads up to version %d", v, ProfileVersion)
+	}
+	return nil
+}
+
+func (l *profileLoader) simpleLine(kind string, tokens []string) error {
+	switch kind {
+	case "version":
+		if len(tokens) != 1 {
+			return fmt.Errorf("expected a version got %v", tokens)
+		}
+		v, err := strconv.Atoi(tokens[0])
+		if err != nil {
+			return err
+		}
+		return l.version(v)
+	case "level":
+		if len(tokens) != 3 {
+			return fmt.Errorf("expected a level, sample every and sample rate got %v", tokens)
+		}
+		name, err := strconv.Unquote(tokens[0])
+		if err != nil {
+			return err
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		every, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return err
+		}
+		rate, err := strconv.ParseFloat(tokens[2], 64)
+		if err != nil {
+			return err
+		}
+		l.p.Instrumentation = Instrumentation{Level: level, SampleEvery: every, SampleRate: rate}
+		return nil
+	case "function":
+		if len(tokens) != 2 {
+			return fmt.Errorf("expected a function name and calls got %v", tokens)
+		}
+		name, err := strconv.Unquote(tokens[0])
+		if err != nil {
+			return err
+		}
+		calls, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return err
+		}
+		l.function(name).Calls = calls
+		l.p.CallCount += calls
+		return nil
+	case "call":
+		if len(tokens) != 3 {
+			return fmt.Errorf("expected a caller, callee and count got %v", tokens)
+		}
+		names, err := unquoteAll(tokens[0], tokens[1])
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(tokens[2])
+		if err != nil {
+			return err
+		}
+		call := Call{Caller: l.function(names[0]).FuncPc, Callee: l.function(names[1]).FuncPc}
+		l.p.Calls[call] += count
+		return nil
+	case "vertex":
+		if len(tokens) != 6 {
+			return fmt.Errorf("expected 6 tokens got %v", tokens)
+		}
+		strs, err := unquoteAll(tokens[1], tokens[3], tokens[4], tokens[5])
+		if err != nil {
+			return err
+		}
+		id, err := strconv.Atoi(tokens[0])
+		if err != nil {
+			return err
+		}
+		bbid, err := strconv.Atoi(tokens[2])
+		if err != nil {
+			return err
+		}
+		return l.vertex(id, strs[0], bbid, strs[1], strs[2], strs[3])
+	case "panicked":
+		if len(tokens) != 3 {
+			return fmt.Errorf("expected 3 tokens got %v", tokens)
+		}
+		id, err := strconv.Atoi(tokens[0])
+		if err != nil {
+			return err
+		}
+		typ, err := strconv.Unquote(tokens[1])
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(tokens[2])
+		if err != nil {
+			return err
+		}
+		return l.panicked(id, typ, count)
+	case "channel":
+		if len(tokens) != 5 {
+			return fmt.Errorf("expected a src, targ, send, recv and count got %v", tokens)
+		}
+		var ints [3]int
+		for k, tok := range []string{tokens[0], tokens[1], tokens[4]} {
+			var err error
+			if ints[k], err = strconv.Atoi(tok); err != nil {
+				return err
+			}
+		}
+		strs, err := unquoteAll(tokens[2], tokens[3])
+		if err != nil {
+			return err
+		}
+		return l.channel(ints[0], ints[1], strs[0], strs[1], ints[2])
+	case "predicate":
+		if len(tokens) != 5 {
+			return fmt.Errorf("expected a kind, site, expr, value and count got %v", tokens)
+		}
+		strs, err := unquoteAll(tokens[:4]...)
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(tokens[4])
+		if err != nil {
+			return err
+		}
+		l.p.Predicates[Predicate{Kind: strs[0], Site: strs[1], Expr: strs[2], Value: strs[3]}] += count
+		return nil
+	}
+	if kind != "edge" && l.labeled(kind) == nil {
+		return fmt.Errorf("unexpected kind `%v`", kind)
+	}
+	if len(tokens) != 3 {
+		return fmt.Errorf("expected 3 tokens got %v", tokens)
+	}
+	var ints [3]int
+	for k := range ints {
+		var err error
+		ints[k], err = strconv.Atoi(tokens[k])
+		if err != nil {
+			return err
+		}
+	}
+	label := kind
+	if kind == "edge" {
+		label = ""
+	}
+	return l.edge(ints[0], ints[1], label, ints[2])
+}
+
+func (l *profileLoader) dotLine(line string) error {
+	line = strings.TrimSuffix(line, ";")
+	if strings.HasPrefix(line, "level=") || strings.HasPrefix(line, "version=") {
+		kv := strings.SplitN(line, "=", 2)
+		if kv[0] == "version" {
+			v, err := strconv.Atoi(kv[1])
+			if err != nil {
+				return err
+			}
+			return l.version(v)
+		}
+		s, err := strconv.Unquote(kv[1])
+		if err != nil {
+			return err
+		}
+		l.p.Instrumentation, err = ParseInstrumentation(s)
+		return err
+	}
+	open := strings.Index(line, "[")
+	if open < 0 || !strings.HasSuffix(line, "]") {
+		return fmt.Errorf("expected a vertex or an edge got `%v`", line)
+	}
+	attrs, err := dotAttrs(line[open+1 : len(line)-1])
+	if err != nil {
+		return err
+	}
+	ids := strings.Split(line[:open], "->")
+	if len(ids) == 2 {
+		src, err := strconv.Atoi(strings.TrimSpace(ids[0]))
+		if err != nil {
+			return err
+		}
+		targ, err := strconv.Atoi(strings.TrimSpace(ids[1]))
+		if err != nil {
+			return err
+		}
+		count, err := strconv.Atoi(attrs["traversed"])
+		if err != nil {
+			return err
+		}
+		return l.edge(src, targ, attrs["label"], count)
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(ids[0]))
+	if err != nil {
+		return err
+	}
+	if id == 0 {
+		return nil
+	}
+	bbid, err := strconv.Atoi(attrs["bbid"])
+	if err != nil {
+		return err
+	}
+	err = l.vertex(id, attrs["label"], bbid, attrs["fn_name"], attrs["position"], attrs["duration"])
+	if err != nil {
+		return err
+	}
+	if calls, has := attrs["calls"]; has {
+		n, err := strconv.Atoi(calls)
+		if err != nil {
+			return err
+		}
+		l.p.Funcs[l.blks[id].In].Calls = n
+		l.p.CallCount += n
+	}
+	if attrs["panicked"] == "" {
+		return nil
+	}
+	types := strings.Split(attrs["panicked"], ",")
+	counts := strings.Split(attrs["panic_counts"], ",")
+	for k, typ := range types {
+		count := 1
+		if k < len(counts) {
+			count, err = strconv.Atoi(counts[k])
+			if err != nil {
+				return err
+			}
+		}
+		if err := l.panicked(id, typ, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vertex adds the block. The function is named by fnName unless it was
+// not known to the dgruntime, then the name in the label is used.
+func (l *profileLoader) vertex(id int, label string, bbid int, fnName, pos, duration string) error {
+	if id == 0 {
+		return nil
+	}
+	if _, has := l.blks[id]; has {
+		return fmt.Errorf("duplicate vertex %d", id)
+	}
+	name := fnName
+	if name == "unknown" || name == "" {
+		name = strings.TrimSuffix(label, fmt.Sprintf(" blk %d", bbid))
+	}
+	blk := BlkEntrance{In: l.function(name).FuncPc, BasicBlockId: bbid}
+	l.blks[id] = blk
+	if pos != "" {
+		l.p.Positions[blk] = pos
+	}
+	if duration != "" {
+		d, err := time.ParseDuration(duration)
+		if err != nil {
+			return err
+		}
+		if d != 0 {
+			l.p.Durations[blk] = d
+		}
+	}
+	return nil
+}
+
+func (l *profileLoader) edge(src, targ int, label string, count int) error {
+	s, has := l.blks[src]
+	if !has {
+		return fmt.Errorf("unknown src vertex %d", src)
+	}
+	t, has := l.blks[targ]
+	if !has {
+		return fmt.Errorf("unknown targ vertex %d", targ)
+	}
+	e := FlowEdge{Src: s, Targ: t}
+	if label == "" {
+		l.p.Flows[e] += count
+	} else if edges := l.labeled(label); edges != nil {
+		edges[e] += count
+	} else {
+		return fmt.Errorf("unexpected edge label `%v`", label)
+	}
+	return nil
+}
+
+// function returns the function with the name, adding it if it is new.
+func (l *profileLoader) function(name string) *Function {
+	if pc, has := l.fns[name]; has {
+		return l.p.Funcs[pc]
+	}
+	pc := uintptr(len(l.fns) + 1)
+	l.fns[name] = pc
+	f := &Function{Name: name, FuncPc: pc}
+	l.p.Funcs[pc] = f
+	return f
+}
+
+func (l *profileLoader) labeled(label string) map[FlowEdge]int {
+	for _, labeled := range l.p.labeledEdges() {
+		if labeled.label == label {
+			return labeled.edges
+		}
+	}
+	return nil
+}
+
+func (l *profileLoader) panicked(id int, typ string, count int) error {
+	blk, has := l.blks[id]
+	if !has {
+		return fmt.Errorf("unknown vertex %d", id)
+	}
+	l.p.Panicked[PanicSite{Blk: blk, Type: typ}] += count
+	return nil
+}
+
+func (l *profileLoader) channel(src, targ int, send, recv string, count int) error {
+	s, has := l.blks[src]
+	if !has {
+		return fmt.Errorf("unknown src vertex %d", src)
+	}
+	t, has := l.blks[targ]
+	if !has {
+		return fmt.Errorf("unknown targ vertex %d", targ)
+	}
+	l.p.Channels[ChanComm{Edge: FlowEdge{Src: s, Targ: t}, Send: send, Recv: recv}] += count
+	return nil
+}
+
+func (l *profileLoader) done() *Profile {
+	return l.p
+}
+
+// splitTokens splits the comma separated tokens of a line. Commas in
+// quoted strings do not split.
+func splitTokens(s string) ([]string, error) {
+	var tokens []string
+	quotes := false
+	backslash := false
+	start := 0
+	for k, c := range s {
+		switch {
+		case backslash:
+			backslash = false
+		case c == '\\' && quotes:
+			backslash = true
+		case c == '"':
+			quotes = !quotes
+		case c == ',' && !quotes:
+			tokens = append(tokens, strings.TrimSpace(s[start:k]))
+			start = k + 1
+		}
+	}
+	if quotes {
+		return nil, fmt.Errorf("unclosed quote: `%v`", s)
+	}
+	return append(tokens, strings.TrimSpace(s[start:])), nil
+}
+
+// dotAttrs parses the attributes of a DOT vertex or edge.
+func dotAttrs(s string) (map[string]string, error) {
+	tokens, err := splitTokens(s)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string, len(tokens))
+	for _, token := range tokens {
+		kv := strings.SplitN(token, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("expected an attribute got `%v`", token)
+		}
+		value := kv[1]
+		if strings.HasPrefix(value, `"`) {
+			value, err = strconv.Unquote(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		attrs[kv[0]] = value
+	}
+	return attrs, nil
+}
+
+func unquoteAll(quoted ...string) ([]string, error) {
+	strs := make([]string, 0, len(quoted))
+	for _, q := range quoted {
+		s, err := strconv.Unquote(q)
+		if err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
@@ -0,0 +1,206 @@
+package dgtypes
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testProfile is a profile of main calling work twice where work loops,
+// panics once and spawns a goroutine running main.func1.
+func testProfile() *Profile {
+	p := NewProfile()
+	p.Instrumentation = Instrumentation{Level: SampledLevel, SampleEvery: 10}
+	main := BlkEntrance{In: 100, BasicBlockId: 0}
+	work := BlkEntrance{In: 200, BasicBlockId: 0}
+	loop := BlkEntrance{In: 200, BasicBlockId: 1}
+	lit := BlkEntrance{In: 300, BasicBlockId: 0}
+	p.Funcs[100] = &Function{Name: "main.main", FuncPc: 100, Calls: 1}
+	p.Funcs[200] = &Function{Name: "main.work", FuncPc: 200, Calls: 2}
+	p.Funcs[300] = &Function{Name: "main.main.func1", FuncPc: 300, Calls: 1}
+	p.CallCount = 4
+	p.Calls[Call{Caller: 100, Callee: 200}] = 2
+	p.Flows[FlowEdge{Src: BlkEntrance{}, Targ: main}] = 1
+	p.Flows[FlowEdge{Src: main, Targ: work}] = 2
+	p.Flows[FlowEdge{Src: work, Targ: loop}] = 2
+	p.Flows[FlowEdge{Src: loop, Targ: loop}] = 8
+	p.Flows[FlowEdge{Src: loop, Targ: main}] = 1
+	p.Panics[FlowEdge{Src: loop, Targ: main}] = 1
+	p.Spawns[FlowEdge{Src: main, Targ: lit}] = 1
+	p.Comms[FlowEdge{Src: lit, Targ: main}] = 3
+	p.Channels[ChanComm{Edge: FlowEdge{Src: lit, Targ: main}, Send: "out chan<- int", Recv: `x.results["a, b"] <-chan int`}] = 3
+	p.Panicked[PanicSite{Blk: loop, Type: "runtime.Error"}] = 1
+	p.Panicked[PanicSite{Blk: loop, Type: "string"}] = 2
+	p.Predicates[Predicate{Kind: BranchPredicate, Site: "/src/main.go:13:6", Expr: "i < n", Value: "true"}] = 8
+	p.Predicates[Predicate{Kind: BranchPredicate, Site: "/src/main.go:13:6", Expr: "i < n", Value: "false"}] = 2
+	p.Predicates[Predicate{Kind: OperandsPredicate, Site: "/src/main.go:13:6", Expr: "i < n", Value: `3, "a, b"`}] = 1
+	p.Positions[main] = "/src/main.go:5:2"
+	p.Positions[work] = "/src/main.go:12:2"
+	p.Positions[loop] = "/src/main.go:13:3"
+	p.Positions[lit] = `/src/a "quoted", path.go:20:3`
+	p.Durations[main] = 3 * time.Millisecond
+	p.Durations[loop] = 1500 * time.Microsecond
+	return p
+}
+
+// byName restates the profile with the blocks named instead of keyed by
+// program counter so profiles loaded from disk can be compared.
+func byName(p *Profile) map[string]interface{} {
+	name := func(b BlkEntrance) string {
+		if b.In == 0 {
+			return "entry"
+		}
+		return fmt.Sprintf("%v %d", p.Funcs[b.In].Name, b.BasicBlockId)
+	}
+	edges := func(es map[FlowEdge]int) map[string]int {
+		m := make(map[string]int)
+		for e, count := range es {
+			m[name(e.Src)+" -> "+name(e.Targ)] = count
+		}
+		return m
+	}
+	funcs := make(map[string]int)
+	for _, f := range p.Funcs {
+		funcs[f.Name] = f.Calls
+	}
+	calls := make(map[string]int)
+	for c, count := range p.Calls {
+		calls[p.Funcs[c.Caller].Name+" -> "+p.Funcs[c.Callee].Name] = count
+	}
+	positions := make(map[string]string)
+	for b, pos := range p.Positions {
+		positions[name(b)] = pos
+	}
+	durations := make(map[string]time.Duration)
+	for b, d := range p.Durations {
+		durations[name(b)] = d
+	}
+	panicked := make(map[string]int)
+	for site, count := range p.Panicked {
+		panicked[name(site.Blk)+" "+site.Type] = count
+	}
+	channels := make(map[string]int)
+	for c, count := range p.Channels {
+		channels[name(c.Edge.Src)+" -> "+name(c.Edge.Targ)+" "+c.Send+" -> "+c.Recv] = count
+	}
+	predicates := make(map[Predicate]int)
+	for pred, count := range p.Predicates {
+		predicates[pred] = count
+	}
+	return map[string]interface{}{
+		"predicates":      predicates,
+		"channels":        channels,
+		"instrumentation": p.Instrumentation,
+		"funcs":           funcs,
+		"call count":      p.CallCount,
+		"calls":           calls,
+		"flows":           edges(p.Flows),
+		"spawns":          edges(p.Spawns),
+		"comms":           edges(p.Comms),
+		"panics":          edges(p.Panics),
+		"recovers":        edges(p.Recovers),
+		"panicked":        panicked,
+		"positions":       positions,
+		"durations":       durations,
+	}
+}
+
+// checkRoundTrip compares the profiles except for the skipped parts.
+func checkRoundTrip(t *testing.T, expected, loaded *Profile, skip ...string) {
+	e, l := byName(expected), byName(loaded)
+	for _, k := range skip {
+		delete(e, k)
+	}
+	for k := range e {
+		if !reflect.DeepEqual(e[k], l[k]) {
+			t.Errorf("%v: expected %v got %v", k, e[k], l[k])
+		}
+	}
+}
+
+func TestSimpleRoundTrip(t *testing.T) {
+	p := testProfile()
+	var buf bytes.Buffer
+	p.WriteSimple(&buf)
+	loaded, err := LoadSimple(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, p, loaded)
+}
+
+func TestDotRoundTrip(t *testing.T) {
+	p := testProfile()
+	var buf bytes.Buffer
+	p.WriteDotty(&buf)
+	loaded, err := LoadDot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the dot format does not have the call graph, the channels or the
+	// predicates
+	checkRoundTrip(t, p, loaded, "calls", "channels", "predicates")
+}
+
+func TestSimpleLoadAll(t *testing.T) {
+	var buf bytes.Buffer
+	testProfile().WriteSimple(&buf)
+	NewProfile().WriteSimple(&buf)
+	profiles, err := LoadSimpleAll(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles got %d", len(profiles))
+	}
+	if !profiles[1].Empty() {
+		t.Errorf("expected the second profile to be empty got %v", profiles[1].Flows)
+	}
+}
+
+func TestLoadNewerVersion(t *testing.T) {
+	var buf bytes.Buffer
+	testProfile().WriteSimple(&buf)
+	newer := strings.Replace(buf.String(),
+		fmt.Sprintf("version\t%d", ProfileVersion), fmt.Sprintf("version\t%d", ProfileVersion+1), 1)
+	if _, err := LoadSimple(strings.NewReader(newer)); err == nil {
+		t.Error("expected an error loading a newer simple profile")
+	}
+	buf.Reset()
+	testProfile().WriteDotty(&buf)
+	newer = strings.Replace(buf.String(),
+		fmt.Sprintf("version=%d;", ProfileVersion), fmt.Sprintf("version=%d;", ProfileVersion+1), 1)
+	if _, err := LoadDot(strings.NewReader(newer)); err == nil {
+		t.Error("expected an error loading a newer dot profile")
+	}
+}
+
+func TestLoadUnversioned(t *testing.T) {
+	var buf bytes.Buffer
+	testProfile().WriteSimple(&buf)
+	old := strings.Replace(buf.String(), fmt.Sprintf("version\t%d\n", ProfileVersion), "", 1)
+	loaded, err := LoadSimple(strings.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, testProfile(), loaded)
+}
+
+func TestParseInstrumentation(t *testing.T) {
+	for _, i := range []Instrumentation{
+		{Level: FullLevel},
+		{Level: CountsLevel},
+		{Level: SampledLevel, SampleEvery: 100},
+		{Level: SampledLevel, SampleRate: 0.25},
+	} {
+		parsed, err := ParseInstrumentation(i.String())
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+		} else if parsed != i {
+			t.Errorf("expected %v got %v", i, parsed)
+		}
+	}
+}
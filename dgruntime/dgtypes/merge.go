@@ -0,0 +1,148 @@
+package dgtypes
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Merge adds the counts, timings, calls, channels, predicates and stacks
+// of b into p. The functions are matched by name rather than by program
+// counter as the program counters of loaded profiles (see LoadSimple) are
+// made up separately for each profile. The object profiles of b are
+// appended to those of p. An empty p takes the instrumentation of b,
+// otherwise the profiles must have been collected at the same level (and
+// sample rate) as their counts do not add up.
+func (p *Profile) Merge(b *Profile) error {
+	if p.Empty() && len(p.Funcs) == 0 {
+		p.Instrumentation = b.Instrumentation
+	} else if !b.Empty() || len(b.Funcs) > 0 {
+		if p.Instrumentation.String() != b.Instrumentation.String() {
+			return fmt.Errorf("can't merge a profile collected at the %v level with one collected at the %v level", b.Instrumentation, p.Instrumentation)
+		}
+	}
+	pcs := p.mergeFuncs(b)
+	blk := func(e BlkEntrance) BlkEntrance {
+		if pc, has := pcs[e.In]; has {
+			e.In = pc
+		}
+		return e
+	}
+	edge := func(e FlowEdge) FlowEdge {
+		return FlowEdge{Src: blk(e.Src), Targ: blk(e.Targ)}
+	}
+	p.CallCount += b.CallCount
+	for c, count := range b.Calls {
+		p.Calls[Call{Caller: blk(BlkEntrance{In: c.Caller}).In, Callee: blk(BlkEntrance{In: c.Callee}).In}] += count
+	}
+	for e, count := range b.Flows {
+		p.Flows[edge(e)] += count
+	}
+	labeled := p.labeledEdges()
+	for i, l := range b.labeledEdges() {
+		for e, count := range l.edges {
+			labeled[i].edges[edge(e)] += count
+		}
+	}
+	for site, count := range b.Panicked {
+		p.Panicked[PanicSite{Blk: blk(site.Blk), Type: site.Type}] += count
+	}
+	for c, count := range b.Channels {
+		p.Channels[ChanComm{Edge: edge(c.Edge), Send: c.Send, Recv: c.Recv}] += count
+	}
+	p.MergePredicates(b.Predicates)
+	for be, pos := range b.Positions {
+		p.Positions[blk(be)] = pos
+	}
+	for be, dur := range b.Durations {
+		p.Durations[blk(be)] += dur
+	}
+	stack := func(sb StackBlk) StackBlk {
+		sites := sb.Sites()
+		for i := range sites {
+			sites[i] = blk(sites[i])
+		}
+		return StackBlk{Stack: StackKey(sites), Blk: blk(sb.Blk)}
+	}
+	for sb, count := range b.Stacks {
+		p.Stacks[stack(sb)] += count
+	}
+	for sb, count := range b.StackCalls {
+		p.StackCalls[stack(sb)] += count
+	}
+	for sb, dur := range b.StackDurations {
+		p.StackDurations[stack(sb)] += dur
+	}
+	for funcName, instances := range b.Inputs {
+		p.Inputs[funcName] = append(p.Inputs[funcName], instances...)
+	}
+	for funcName, instances := range b.Outputs {
+		p.Outputs[funcName] = append(p.Outputs[funcName], instances...)
+	}
+	for funcName, exits := range b.Exits {
+		p.Exits[funcName] = append(p.Exits[funcName], exits...)
+	}
+	for typeName, typ := range b.Types {
+		p.Types[typeName] = typ
+	}
+	return nil
+}
+
+// mergeFuncs adds the functions of b to p and maps the program counters
+// of b to those of p.
+func (p *Profile) mergeFuncs(b *Profile) map[uintptr]uintptr {
+	names := make(map[string]uintptr, len(p.Funcs))
+	var next uintptr = 1
+	for pc, f := range p.Funcs {
+		names[f.Name] = pc
+		if pc >= next {
+			next = pc + 1
+		}
+	}
+	bpcs := make([]uintptr, 0, len(b.Funcs))
+	for pc := range b.Funcs {
+		bpcs = append(bpcs, pc)
+	}
+	sort.Slice(bpcs, func(i, j int) bool { return bpcs[i] < bpcs[j] })
+	pcs := make(map[uintptr]uintptr, len(b.Funcs))
+	for _, bpc := range bpcs {
+		f := b.Funcs[bpc]
+		if pc, has := names[f.Name]; has {
+			pcs[bpc] = pc
+			x := p.Funcs[pc]
+			x.Calls += f.Calls
+			if len(x.DynCDP) == len(f.DynCDP) {
+				for i, preds := range f.DynCDP {
+					for pred := range preds {
+						x.DynCDP[i][pred] = true
+					}
+				}
+			}
+			continue
+		}
+		pc := bpc
+		if _, has := p.Funcs[pc]; has {
+			pc = next
+			next++
+		} else if pc >= next {
+			next = pc + 1
+		}
+		pcs[bpc] = pc
+		names[f.Name] = pc
+		dcdp := make([]map[int]bool, len(f.DynCDP))
+		for i, preds := range f.DynCDP {
+			dcdp[i] = make(map[int]bool, len(preds))
+			for pred := range preds {
+				dcdp[i][pred] = true
+			}
+		}
+		p.Funcs[pc] = &Function{
+			Name:   f.Name,
+			FuncPc: pc,
+			CFG:    f.CFG,
+			IPDom:  f.IPDom,
+			Calls:  f.Calls,
+			DynCDP: dcdp,
+		}
+	}
+	return pcs
+}
@@ -0,0 +1,83 @@
+package dgtypes
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMergeLoaded(t *testing.T) {
+	var buf bytes.Buffer
+	testProfile().WriteSimple(&buf)
+	loaded, err := LoadSimple(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the loaded profile has other program counters for the functions
+	merged := testProfile()
+	if err := merged.Merge(loaded); err != nil {
+		t.Fatal(err)
+	}
+	if len(merged.Funcs) != 3 {
+		t.Fatalf("expected 3 functions got %v", merged.Funcs)
+	}
+	doubled := testProfile()
+	doubled.CallCount *= 2
+	for _, f := range doubled.Funcs {
+		f.Calls *= 2
+	}
+	for _, m := range []map[FlowEdge]int{doubled.Flows, doubled.Spawns, doubled.Comms, doubled.Panics} {
+		for e := range m {
+			m[e] *= 2
+		}
+	}
+	for c := range doubled.Calls {
+		doubled.Calls[c] *= 2
+	}
+	for c := range doubled.Channels {
+		doubled.Channels[c] *= 2
+	}
+	for pred := range doubled.Predicates {
+		doubled.Predicates[pred] *= 2
+	}
+	for s := range doubled.Panicked {
+		doubled.Panicked[s] *= 2
+	}
+	for b := range doubled.Durations {
+		doubled.Durations[b] *= 2
+	}
+	checkRoundTrip(t, doubled, merged)
+}
+
+func TestMergeIntoEmpty(t *testing.T) {
+	p := testProfile()
+	merged := NewProfile()
+	if err := merged.Merge(p); err != nil {
+		t.Fatal(err)
+	}
+	checkRoundTrip(t, p, merged)
+}
+
+// The counts of profiles collected at different levels (or sampled at
+// different rates) do not add up.
+func TestMergeLevels(t *testing.T) {
+	merged := NewProfile()
+	if err := merged.Merge(testProfile()); err != nil {
+		t.Fatal(err)
+	}
+	if merged.Instrumentation != testProfile().Instrumentation {
+		t.Errorf("expected the empty profile to take the level %v got %v", testProfile().Instrumentation, merged.Instrumentation)
+	}
+	for _, inst := range []Instrumentation{
+		{Level: FullLevel},
+		{Level: SampledLevel, SampleEvery: 100},
+	} {
+		other := testProfile()
+		other.Instrumentation = inst
+		if err := merged.Merge(other); err == nil {
+			t.Errorf("expected an error merging a %v profile into a %v one", inst, merged.Instrumentation)
+		}
+	}
+	if err := merged.Merge(NewProfile()); err != nil {
+		t.Errorf("expected an empty profile to merge into any other got %v", err)
+	}
+}
@@ -0,0 +1,849 @@
+package dgtypes
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// The binary object profile format (object-profiles.bin) is a header
+// followed by length prefixed records:
+//
+//	header: objMagic, uvarint version
+//	record: tag byte, uvarint length, payload
+//
+// The profile of a run is a types record (its TypeProfile) followed by a
+// func record for each function. The profiles of several runs may be
+// concatenated (each starts with the header again).
+//
+// The records refer to strings by their index in the string table of the
+// run. A strings record (a uvarint count followed by the strings) adds
+// the strings new to the record after it to the table, so the names of
+// the types and fields which are repeated in every call are written once
+// per run. The types and func records only depend on the strings records
+// so a reader can skip the func records it does not want (see
+// ObjectProfileReader). A func record starts with the index of the name
+// of its function.
+const (
+	objMagic   = "\x89DGOBJ\r\n"
+	objVersion = 2
+)
+
+// record tags
+const (
+	objTypesRecord byte = 1 + iota
+	objFuncRecord
+	objStringsRecord
+)
+
+// value tags
+const (
+	objNoValue byte = iota
+	objInt
+	objFloat
+	objComplex
+	objString
+	objBool
+	objStruct
+	objReference
+	objArray
+	objMap
+	objChan
+	objFunc
+	objNil
+	objElided
+)
+
+// type tags
+const (
+	objPrimitiveType byte = 1 + iota
+	objPointerType
+	objInterfaceType
+	objCollectionType
+	objStructType
+)
+
+// flags of the values
+const (
+	objNilFlag byte = 1 << iota
+	objCycleFlag
+	objSliceFlag
+)
+
+// WriteObjectProfiles writes the types and the inputs and outputs of the
+// functions in the binary format read by ObjectProfileReader.
+func (p *Profile) WriteObjectProfiles(fout io.Writer) error {
+	w := bufio.NewWriter(fout)
+	header := make([]byte, 0, len(objMagic)+binary.MaxVarintLen64)
+	header = append(header, objMagic...)
+	header = appendUvarint(header, objVersion)
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(p.Types))
+	for name := range p.Types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	types := make([]Type, 0, len(names))
+	for _, name := range names {
+		types = append(types, p.Types[name])
+	}
+	e := newObjEncoder()
+	e.typeProfile(TypeProfile{types})
+	if err := e.writeRecord(w, objTypesRecord); err != nil {
+		return err
+	}
+	fnames := make([]string, 0, len(p.Inputs))
+	for fname := range p.Inputs {
+		fnames = append(fnames, fname)
+	}
+	for fname := range p.Outputs {
+		if _, has := p.Inputs[fname]; !has {
+			fnames = append(fnames, fname)
+		}
+	}
+	sort.Strings(fnames)
+	for _, fname := range fnames {
+		e.funcProfile(FuncProfile{fname, p.Inputs[fname], p.Outputs[fname], p.Exits[fname]})
+		if err := e.writeRecord(w, objFuncRecord); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+func appendUvarint(buf []byte, x uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], x)
+	return append(buf, b[:n]...)
+}
+
+// An objEncoder encodes the records of a run.
+type objEncoder struct {
+	body  []byte         // the payload of the current record
+	strs  map[string]int // the string table of the run
+	fresh []string       // the strings new to the current record
+	types map[string]int // the index of each type written (by name)
+	ntyps int
+}
+
+func newObjEncoder() *objEncoder {
+	return &objEncoder{
+		strs:  make(map[string]int),
+		types: make(map[string]int),
+	}
+}
+
+// writeRecord writes the record of the payload encoded so far, after the
+// strings record of the strings it added to the table.
+func (e *objEncoder) writeRecord(w io.Writer, tag byte) error {
+	if len(e.fresh) > 0 {
+		table := make([]byte, 0, 16*len(e.fresh))
+		table = appendUvarint(table, uint64(len(e.fresh)))
+		for _, s := range e.fresh {
+			table = appendUvarint(table, uint64(len(s)))
+			table = append(table, s...)
+		}
+		if err := writeRecord(w, objStringsRecord, table); err != nil {
+			return err
+		}
+		e.fresh = e.fresh[:0]
+	}
+	err := writeRecord(w, tag, e.body)
+	e.body = e.body[:0]
+	return err
+}
+
+func writeRecord(w io.Writer, tag byte, payload []byte) error {
+	header := []byte{tag}
+	header = appendUvarint(header, uint64(len(payload)))
+	for _, part := range [][]byte{header, payload} {
+		if _, err := w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *objEncoder) byte(b byte) {
+	e.body = append(e.body, b)
+}
+
+func (e *objEncoder) uvarint(x uint64) {
+	e.body = appendUvarint(e.body, x)
+}
+
+func (e *objEncoder) float(f float64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+	e.body = append(e.body, b[:]...)
+}
+
+// str writes the index of the string in the string table.
+func (e *objEncoder) str(s string) {
+	i, has := e.strs[s]
+	if !has {
+		i = len(e.strs)
+		e.strs[s] = i
+		e.fresh = append(e.fresh, s)
+	}
+	e.uvarint(uint64(i))
+}
+
+func (e *objEncoder) funcProfile(f FuncProfile) {
+	e.str(f.FuncName)
+	for _, profs := range [][]ObjectProfile{f.In, f.Out} {
+		e.uvarint(uint64(len(profs)))
+		for _, prof := range profs {
+			e.objectProfile(prof)
+		}
+	}
+	e.uvarint(uint64(len(f.Exits)))
+	for _, exit := range f.Exits {
+		e.str(exit.Site)
+		if exit.Panicked {
+			e.byte(1)
+		} else {
+			e.byte(0)
+		}
+	}
+}
+
+func (e *objEncoder) objectProfile(prof ObjectProfile) {
+	e.uvarint(uint64(len(prof)))
+	for _, param := range prof {
+		e.str(param.Name)
+		e.value(param.Val)
+	}
+}
+
+func (e *objEncoder) values(vals []Value) {
+	e.uvarint(uint64(len(vals)))
+	for _, v := range vals {
+		e.value(v)
+	}
+}
+
+func (e *objEncoder) value(v Value) {
+	flags := func(bits ...bool) {
+		var f byte
+		for i, set := range bits {
+			if set {
+				f |= 1 << uint(i)
+			}
+		}
+		e.byte(f)
+	}
+	switch x := v.(type) {
+	case nil:
+		e.byte(objNoValue)
+	case *IntValue:
+		e.byte(objInt)
+		e.uvarint(uint64(x.ValKind))
+		e.uvarint(x.Val)
+	case *FloatValue:
+		e.byte(objFloat)
+		e.byte(byte(x.Bits))
+		e.float(x.float())
+	case *ComplexValue:
+		e.byte(objComplex)
+		e.byte(byte(x.Real.Bits))
+		e.float(x.Real.float())
+		e.float(x.Imag.float())
+	case *StringValue:
+		e.byte(objString)
+		e.str(x.Val)
+		e.uvarint(uint64(x.Len))
+	case *BoolValue:
+		e.byte(objBool)
+		flags(x.Val)
+	case *StructValue:
+		e.byte(objStruct)
+		e.str(x.TypName)
+		e.uvarint(uint64(len(x.Fields)))
+		for _, f := range x.Fields {
+			e.str(f.Name)
+			e.value(f.Val)
+		}
+	case *ReferenceValue:
+		e.byte(objReference)
+		e.str(x.Typename)
+		e.uvarint(uint64(x.ValKind))
+		flags(x.Nil, x.Cycle)
+		e.value(x.Elem)
+	case *ArrayValue:
+		e.byte(objArray)
+		e.str(x.ElemType)
+		e.uvarint(uint64(x.Len))
+		flags(x.Nil, false, x.Slice)
+		e.values(x.Val)
+	case *MapValue:
+		e.byte(objMap)
+		e.str(x.TypName)
+		e.uvarint(uint64(x.Len))
+		flags(x.Nil)
+		e.values(x.Keys)
+		e.values(x.Vals)
+	case *ChanValue:
+		e.byte(objChan)
+		e.str(x.TypName)
+		e.uvarint(uint64(x.Len))
+		e.uvarint(uint64(x.Cap))
+		flags(x.Nil)
+	case *FuncValue:
+		e.byte(objFunc)
+		e.str(x.TypName)
+		e.str(x.Name)
+		flags(x.Nil)
+	case *NilValue:
+		e.byte(objNil)
+	case *ElidedValue:
+		e.byte(objElided)
+		e.str(x.TypName)
+		e.uvarint(uint64(x.ValKind))
+	default:
+		panic(fmt.Errorf("cannot encode a %T", v))
+	}
+}
+
+// typeProfile writes the types (and the types in them) once each, the
+// types a type refers to first. The types are then listed by their
+// indices.
+func (e *objEncoder) typeProfile(tp TypeProfile) {
+	refs := make([]uint64, 0, len(tp.Types))
+	for _, typ := range tp.Types {
+		refs = append(refs, e.typ(typ))
+	}
+	e.byte(0)
+	e.uvarint(uint64(len(refs)))
+	for _, ref := range refs {
+		e.uvarint(ref)
+	}
+}
+
+// typ writes the type if it has not been written and returns the
+// reference to it (its index plus one, 0 is no type).
+func (e *objEncoder) typ(typ Type) uint64 {
+	if typ == nil {
+		return 0
+	}
+	if i, has := e.types[typ.Name()]; has {
+		return uint64(i) + 1
+	}
+	switch t := typ.(type) {
+	case *PrimitiveType:
+		e.byte(objPrimitiveType)
+		e.str(t.Tname)
+	case *PointerType:
+		elem := e.typ(t.Elem)
+		e.byte(objPointerType)
+		e.str(t.Tname)
+		e.uvarint(elem)
+	case *InterfaceType:
+		e.byte(objInterfaceType)
+		e.str(t.Tname)
+	case *CollectionType:
+		elem := e.typ(t.Elem)
+		e.byte(objCollectionType)
+		e.str(t.Tname)
+		e.uvarint(elem)
+		e.uvarint(uint64(t.Len))
+	case *StructType:
+		names := make([]string, 0, len(t.Fields))
+		for name := range t.Fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fields := make([]uint64, 0, len(names))
+		for _, name := range names {
+			fields = append(fields, e.typ(t.Fields[name]))
+		}
+		e.byte(objStructType)
+		e.str(t.Tname)
+		e.uvarint(uint64(len(names)))
+		for i, name := range names {
+			e.str(name)
+			e.uvarint(fields[i])
+		}
+	default:
+		panic(fmt.Errorf("cannot encode a %T", typ))
+	}
+	e.types[typ.Name()] = e.ntyps
+	e.ntyps++
+	return uint64(e.ntyps)
+}
+
+// An ObjectProfileReader reads the function profiles written by
+// WriteObjectProfiles one at a time. It also reads the JSON written by
+// SerializeProfs. Like the files written by the program, the input may be
+// the profiles of several runs concatenated, their types are listed once
+// (by name).
+//
+//	r := NewObjectProfileReader(input)
+//	for {
+//		name, err := r.Next()
+//		if err == io.EOF {
+//			break
+//		} else if err != nil {
+//			return err
+//		}
+//		if !interesting(name) {
+//			continue // the record is skipped without decoding it
+//		}
+//		f, err := r.Func()
+//		...
+//	}
+type ObjectProfileReader struct {
+	r       *bufio.Reader
+	binary  bool // a binary header has been read
+	types   []Type
+	typed   map[string]bool // the names of the types
+	name    string
+	size    int
+	pending int          // the bytes of the current record not yet read
+	table   []string     // the string table of the current run
+	json    *FuncProfile // the current profile (from JSON)
+	buf     []byte
+}
+
+func NewObjectProfileReader(r io.Reader) *ObjectProfileReader {
+	return &ObjectProfileReader{
+		r:     bufio.NewReaderSize(r, 64*1024),
+		typed: make(map[string]bool),
+	}
+}
+
+// Types lists the types of the profiles read so far.
+func (r *ObjectProfileReader) Types() []Type {
+	return r.types
+}
+
+// Size is the size of the encoded profile Next advanced to.
+func (r *ObjectProfileReader) Size() int {
+	return r.size
+}
+
+// Next advances to the next function profile and returns the name of
+// its function. It returns io.EOF after the last profile.
+func (r *ObjectProfileReader) Next() (string, error) {
+	if r.pending > 0 {
+		if _, err := r.r.Discard(r.pending); err != nil {
+			return "", r.truncated(err)
+		}
+	}
+	r.name, r.size, r.pending, r.json = "", 0, 0, nil
+	for {
+		b, err := r.r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case b == objMagic[0]:
+			if err := r.header(); err != nil {
+				return "", err
+			}
+		case b == objTypesRecord && r.binary:
+			payload, err := r.payload()
+			if err != nil {
+				return "", err
+			}
+			d := &objDecoder{buf: payload, strs: r.table}
+			types := d.typeProfile()
+			if d.err != nil {
+				return "", d.err
+			}
+			for _, typ := range types {
+				if typ != nil && !r.typed[typ.Name()] {
+					r.typed[typ.Name()] = true
+					r.types = append(r.types, typ)
+				}
+			}
+		case b == objStringsRecord && r.binary:
+			payload, err := r.payload()
+			if err != nil {
+				return "", err
+			}
+			d := &objDecoder{buf: payload, strs: r.table}
+			d.table()
+			if d.err != nil {
+				return "", d.err
+			}
+			r.table = d.strs
+		case b == objFuncRecord && r.binary:
+			return r.funcName()
+		case b == '{':
+			r.r.UnreadByte()
+			if f, err := r.jsonLine(); err != nil {
+				return "", err
+			} else if f != nil {
+				return f.FuncName, nil
+			}
+		case b == '\n' || b == '\r' || b == ' ' || b == '\t':
+		default:
+			return "", fmt.Errorf("not an object profile (unexpected byte %#x)", b)
+		}
+	}
+}
+
+func (r *ObjectProfileReader) header() error {
+	magic := make([]byte, len(objMagic)-1)
+	if _, err := io.ReadFull(r.r, magic); err != nil || string(magic) != objMagic[1:] {
+		return fmt.Errorf("not an object profile (bad header)")
+	}
+	version, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return r.truncated(err)
+	}
+	if version != objVersion {
+		return fmt.Errorf("object profile version %d is not supported (expected %d)", version, objVersion)
+	}
+	r.binary = true
+	r.table = nil
+	return nil
+}
+
+func (r *ObjectProfileReader) length() (int, error) {
+	n, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return 0, r.truncated(err)
+	}
+	if n > math.MaxInt32 {
+		return 0, fmt.Errorf("object profile record of %d bytes is too large", n)
+	}
+	return int(n), nil
+}
+
+func (r *ObjectProfileReader) payload() ([]byte, error) {
+	n, err := r.length()
+	if err != nil {
+		return nil, err
+	}
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	r.buf = r.buf[:n]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return nil, r.truncated(err)
+	}
+	return r.buf, nil
+}
+
+// funcName reads the name of the function of a func record and leaves the
+// rest of the record for Func.
+func (r *ObjectProfileReader) funcName() (string, error) {
+	n, err := r.length()
+	if err != nil {
+		return "", err
+	}
+	r.size, r.pending = n, n
+	i, err := r.recordUvarint()
+	if err != nil {
+		return "", err
+	}
+	if i >= uint64(len(r.table)) {
+		return "", fmt.Errorf("object profile is malformed: string %d is not in the table", i)
+	}
+	r.name = r.table[i]
+	return r.name, nil
+}
+
+// recordUvarint reads a uvarint of the current record.
+func (r *ObjectProfileReader) recordUvarint() (uint64, error) {
+	x, err := binary.ReadUvarint(recordReader{r})
+	if err != nil {
+		return 0, r.truncated(err)
+	}
+	return x, nil
+}
+
+// A recordReader reads the bytes of the current record.
+type recordReader struct {
+	r *ObjectProfileReader
+}
+
+func (rr recordReader) ReadByte() (byte, error) {
+	if rr.r.pending <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	rr.r.pending--
+	return rr.r.r.ReadByte()
+}
+
+func (r *ObjectProfileReader) jsonLine() (*FuncProfile, error) {
+	line, err := r.r.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	line = bytes.TrimSpace(line)
+	if bytes.HasPrefix(line, []byte(`{"Types"`)) {
+		// JSON cannot unmarshal the types (Type is an interface)
+		return nil, nil
+	}
+	f := UnserializeFunc(string(line))
+	r.json, r.name, r.size = &f, f.FuncName, len(line)
+	return &f, nil
+}
+
+func (r *ObjectProfileReader) truncated(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("object profile is truncated: %v", err)
+}
+
+// Func decodes the profile Next advanced to.
+func (r *ObjectProfileReader) Func() (FuncProfile, error) {
+	if r.json != nil {
+		return *r.json, nil
+	}
+	if r.name == "" {
+		return FuncProfile{}, fmt.Errorf("Func called before Next")
+	}
+	if cap(r.buf) < r.pending {
+		r.buf = make([]byte, r.pending)
+	}
+	r.buf = r.buf[:r.pending]
+	if _, err := io.ReadFull(r.r, r.buf); err != nil {
+		return FuncProfile{}, r.truncated(err)
+	}
+	r.pending = 0
+	d := &objDecoder{buf: r.buf, strs: r.table}
+	f := d.funcProfile(r.name)
+	r.name = ""
+	return f, d.err
+}
+
+// An objDecoder decodes the payload of a record. The first error stops
+// it (and is kept in err).
+type objDecoder struct {
+	buf  []byte
+	strs []string
+	err  error
+}
+
+func (d *objDecoder) fail(format string, args ...interface{}) {
+	if d.err == nil {
+		d.err = fmt.Errorf("object profile is malformed: "+format, args...)
+	}
+	d.buf = nil
+}
+
+func (d *objDecoder) byte() byte {
+	if len(d.buf) == 0 {
+		d.fail("unexpected end of record")
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *objDecoder) uvarint() uint64 {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail("bad uvarint")
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+// count reads the number of things in a list which are at least min
+// bytes each.
+func (d *objDecoder) count(min int) int {
+	n := d.uvarint()
+	if n > uint64(len(d.buf)/min) {
+		d.fail("list of %d is longer than the record", n)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *objDecoder) float() float64 {
+	if len(d.buf) < 8 {
+		d.fail("unexpected end of record")
+		return 0
+	}
+	f := math.Float64frombits(binary.LittleEndian.Uint64(d.buf))
+	d.buf = d.buf[8:]
+	return f
+}
+
+func (d *objDecoder) str() string {
+	i := d.uvarint()
+	if i >= uint64(len(d.strs)) {
+		d.fail("string %d is not in the table", i)
+		return ""
+	}
+	return d.strs[i]
+}
+
+// table adds the strings of a strings record to the table.
+func (d *objDecoder) table() {
+	n := d.count(1)
+	for i := 0; i < n; i++ {
+		length := d.uvarint()
+		if length > uint64(len(d.buf)) {
+			d.fail("unexpected end of record")
+			return
+		}
+		d.strs = append(d.strs, string(d.buf[:length]))
+		d.buf = d.buf[length:]
+	}
+}
+
+func (d *objDecoder) flags() (isNil, cycle, slice bool) {
+	f := d.byte()
+	return f&objNilFlag != 0, f&objCycleFlag != 0, f&objSliceFlag != 0
+}
+
+// funcProfile reads a func record after the name of its function.
+func (d *objDecoder) funcProfile(name string) FuncProfile {
+	f := FuncProfile{FuncName: name}
+	for _, profs := range []*[]ObjectProfile{&f.In, &f.Out} {
+		*profs = make([]ObjectProfile, d.count(1))
+		for i := range *profs {
+			(*profs)[i] = d.objectProfile()
+		}
+	}
+	if n := d.count(2); n > 0 {
+		f.Exits = make([]Exit, n)
+		for i := range f.Exits {
+			f.Exits[i] = Exit{Site: d.str(), Panicked: d.byte() != 0}
+		}
+	}
+	if d.err == nil && len(d.buf) != 0 {
+		d.fail("%d bytes after the profile of %v", len(d.buf), f.FuncName)
+	}
+	return f
+}
+
+func (d *objDecoder) objectProfile() ObjectProfile {
+	prof := make(ObjectProfile, d.count(2))
+	for i := range prof {
+		prof[i] = Param{Name: d.str(), Val: d.value()}
+	}
+	return prof
+}
+
+func (d *objDecoder) values() []Value {
+	vals := make([]Value, d.count(1))
+	for i := range vals {
+		vals[i] = d.value()
+	}
+	return vals
+}
+
+func (d *objDecoder) value() Value {
+	if d.err != nil {
+		return nil
+	}
+	switch tag := d.byte(); tag {
+	case objNoValue:
+		return nil
+	case objInt:
+		return &IntValue{ValKind: Kind(d.uvarint()), Val: d.uvarint(), JSONType: intType}
+	case objFloat:
+		bits := int(d.byte())
+		return floatVal(d.float(), bits)
+	case objComplex:
+		bits := int(d.byte())
+		re := d.float()
+		return complexVal(complex(re, d.float()), 2*bits)
+	case objString:
+		return &StringValue{Val: d.str(), Len: int(d.uvarint()), JSONType: stringType}
+	case objBool:
+		return &BoolValue{Val: d.byte() != 0, JSONType: boolType}
+	case objStruct:
+		s := &StructValue{TypName: d.str(), JSONType: structType}
+		s.Fields = make([]Field, d.count(2))
+		for i := range s.Fields {
+			s.Fields[i] = Field{Name: d.str(), Val: d.value()}
+		}
+		return s
+	case objReference:
+		r := &ReferenceValue{Typename: d.str(), ValKind: Kind(d.uvarint()), JSONType: referenceType}
+		r.Nil, r.Cycle, _ = d.flags()
+		r.Elem = d.value()
+		return r
+	case objArray:
+		a := &ArrayValue{ElemType: d.str(), Len: int(d.uvarint()), JSONType: arrayType}
+		a.Nil, _, a.Slice = d.flags()
+		a.Val = d.values()
+		return a
+	case objMap:
+		m := &MapValue{TypName: d.str(), Len: int(d.uvarint()), JSONType: mapType}
+		m.Nil, _, _ = d.flags()
+		m.Keys = d.values()
+		m.Vals = d.values()
+		if len(m.Keys) != len(m.Vals) {
+			d.fail("map of %d keys has %d values", len(m.Keys), len(m.Vals))
+		}
+		return m
+	case objChan:
+		c := &ChanValue{TypName: d.str(), Len: int(d.uvarint()), Cap: int(d.uvarint()), JSONType: chanType}
+		c.Nil, _, _ = d.flags()
+		return c
+	case objFunc:
+		f := &FuncValue{TypName: d.str(), Name: d.str(), JSONType: funcType}
+		f.Nil, _, _ = d.flags()
+		return f
+	case objNil:
+		return &NilValue{JSONType: nilType}
+	case objElided:
+		return &ElidedValue{TypName: d.str(), ValKind: Kind(d.uvarint()), JSONType: elidedType}
+	default:
+		d.fail("unknown value tag %d", tag)
+		return nil
+	}
+}
+
+// typeProfile reads the types of a types record (see
+// objEncoder.typeProfile).
+func (d *objDecoder) typeProfile() []Type {
+	var all []Type
+	ref := func() Type {
+		i := d.uvarint()
+		if i == 0 {
+			return nil
+		} else if i > uint64(len(all)) {
+			d.fail("type %d is not defined", i)
+			return nil
+		}
+		return all[i-1]
+	}
+	for d.err == nil {
+		var typ Type
+		switch tag := d.byte(); tag {
+		case 0:
+			types := make([]Type, d.count(1))
+			for i := range types {
+				types[i] = ref()
+			}
+			return types
+		case objPrimitiveType:
+			typ = &PrimitiveType{Tname: d.str()}
+		case objPointerType:
+			typ = &PointerType{Tname: d.str(), Elem: ref()}
+		case objInterfaceType:
+			typ = &InterfaceType{Tname: d.str()}
+		case objCollectionType:
+			typ = &CollectionType{Tname: d.str(), Elem: ref(), Len: int(d.uvarint())}
+		case objStructType:
+			s := &StructType{Tname: d.str(), Fields: make(map[string]Type)}
+			for i, n := 0, d.count(2); i < n; i++ {
+				s.Fields[d.str()] = ref()
+			}
+			typ = s
+		default:
+			d.fail("unknown type tag %d", tag)
+		}
+		all = append(all, typ)
+	}
+	return nil
+}
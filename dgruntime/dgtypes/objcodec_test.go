@@ -0,0 +1,115 @@
+package dgtypes
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+func objectProfiles() *Profile {
+	p := NewProfile()
+	list := &node{Name: "a", tags: map[string]float64{"nan": math.NaN()}}
+	list.Next = &node{Name: "b", Next: list}
+	for i := 0; i < 3; i++ {
+		in := ObjectProfile{{Name: "l", Val: NewVal(list)}, {Name: "i", Val: NewVal(i)}}
+		p.Inputs["main.insert"] = append(p.Inputs["main.insert"], in)
+		out := ObjectProfile{{Name: "err", Val: NewVal(error(nil))}, {Name: "c", Val: NewVal(complex64(1 + 2i))}}
+		p.Outputs["main.insert"] = append(p.Outputs["main.insert"], out)
+		p.Exits["main.insert"] = append(p.Exits["main.insert"], Exit{Site: "list.go:10:2", Panicked: i == 2})
+	}
+	p.Outputs["main.pop"] = []ObjectProfile{{{Name: "xs", Val: NewVal([]string{"x", "x"})}}}
+	for _, v := range []interface{}{list, 1, []string{}} {
+		typ := NewType(v)
+		p.Types[typ.Name()] = typ
+	}
+	return p
+}
+
+func readAll(t *testing.T, input io.Reader) (map[string][]FuncProfile, []Type) {
+	funcs := make(map[string][]FuncProfile)
+	r := NewObjectProfileReader(input)
+	for {
+		name, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		f, err := r.Func()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.FuncName != name {
+			t.Errorf("Next returned %v for the profile of %v", name, f.FuncName)
+		}
+		funcs[name] = append(funcs[name], f)
+	}
+	return funcs, r.Types()
+}
+
+func TestObjectProfilesRoundTrip(t *testing.T) {
+	p := objectProfiles()
+	var buf bytes.Buffer
+	if err := p.WriteObjectProfiles(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// the strings are written once for the run
+	run := buf.Bytes()
+	if n := bytes.Count(run, []byte("list.go:10:2")); n != 1 {
+		t.Errorf("expected the exit site once got %d", n)
+	}
+	if n := bytes.Count(run, []byte("tags")); n != 1 {
+		t.Errorf("expected the field name once got %d", n)
+	}
+	// the runs of a test driver are concatenated (and may be JSON)
+	buf.Write(run)
+	p.SerializeProfs(&buf)
+	funcs, types := readAll(t, &buf)
+	if len(types) != 3 {
+		t.Errorf("expected the 3 types of both binary runs once got %v", types)
+	}
+	for name, outs := range p.Outputs {
+		if len(funcs[name]) != 3 {
+			t.Fatalf("expected 3 profiles of %v got %d", name, len(funcs[name]))
+		}
+		for _, f := range funcs[name] {
+			expected := fmt.Sprint(p.Inputs[name], outs, p.Exits[name])
+			if got := fmt.Sprint(f.In, f.Out, f.Exits); got != expected {
+				t.Errorf("expected %v got %v", expected, got)
+			}
+		}
+	}
+}
+
+func TestObjectProfilesSkip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := objectProfiles().WriteObjectProfiles(&buf); err != nil {
+		t.Fatal(err)
+	}
+	r := NewObjectProfileReader(bytes.NewReader(buf.Bytes()))
+	var names []string
+	for {
+		name, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if fmt.Sprint(names) != "[main.insert main.pop]" {
+		t.Errorf("unexpected functions %v", names)
+	}
+	truncated := NewObjectProfileReader(bytes.NewReader(buf.Bytes()[:buf.Len()-3]))
+	var err error
+	for err == nil {
+		if _, err = truncated.Next(); err == nil {
+			_, err = truncated.Func()
+		}
+	}
+	if err == io.EOF {
+		t.Errorf("expected a truncated profile to be an error")
+	}
+}
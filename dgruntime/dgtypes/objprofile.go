@@ -14,16 +14,32 @@ type ObjectProfile []Param
 
 func (op ObjectProfile) Dissimilar(other Clusterable) float64 {
 	if o, ok := other.(ObjectProfile); ok {
-		distance := 0.0
-		for param := range op {
-			distance += op[param].Dissimilar(&o[param]) / float64(len(op))
-		}
-		return distance
+		return op.DissimilarFunc(o, Dissimilar)
 	} else {
 		panic("expected type ObjectProfile")
 	}
 }
 
+// DissimilarFunc is the mean dissimilarity of the params of the profiles
+// as measured by f.
+func (op ObjectProfile) DissimilarFunc(o ObjectProfile, f func(a, b Value) float64) float64 {
+	// a param only one of them has (eg. the outputs of a call unwound by a
+	// panic have none) is as dissimilar as it gets
+	n := len(op)
+	if len(o) > n {
+		n = len(o)
+	}
+	distance := 0.0
+	for param := 0; param < n; param++ {
+		if param >= len(op) || param >= len(o) {
+			distance += 1 / float64(n)
+			continue
+		}
+		distance += f(op[param].Val, o[param].Val) / float64(n)
+	}
+	return distance
+}
+
 type Param struct {
 	Name string
 	Val  Value
@@ -36,7 +52,7 @@ func (p Param) String() string {
 func (p *Param) Dissimilar(other Clusterable) float64 {
 	if o, ok := other.(*Param); ok {
 		//		fmt.Printf("Param: %v\n dissimilar from \nParam: %v\n", *p, *o)
-		return p.Val.Dissimilar(o.Val)
+		return Dissimilar(p.Val, o.Val)
 	} else {
 		panic("expected type *Param")
 	}
@@ -46,6 +62,16 @@ type FuncProfile struct {
 	FuncName string
 	In       []ObjectProfile
 	Out      []ObjectProfile
+	Exits    []Exit `json:",omitempty"` // how the call of each Out exited
+}
+
+// An Exit is how a call whose outputs were recorded exited: through the
+// return statement at Site or, when Panicked, without reaching one (it was
+// unwound by a panic or one of its deferred calls recovered it). Site is
+// then the position of the function.
+type Exit struct {
+	Site     string
+	Panicked bool `json:",omitempty"`
 }
 
 type TypeProfile struct {
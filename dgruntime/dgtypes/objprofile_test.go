@@ -0,0 +1,22 @@
+package dgtypes
+
+import (
+	"testing"
+)
+
+func TestDissimilarMissingParams(t *testing.T) {
+	out := ObjectProfile{{Name: "x", Val: NewVal(1)}, {Name: "y", Val: NewVal(2)}}
+	panicked := ObjectProfile{}
+	if d := out.Dissimilar(out); d != 0 {
+		t.Errorf("expected a profile to be similar to itself got %v", d)
+	}
+	if d := out.Dissimilar(panicked); d != 1 {
+		t.Errorf("expected 1 got %v", d)
+	}
+	if d := panicked.Dissimilar(out); d != 1 {
+		t.Errorf("expected 1 got %v", d)
+	}
+	if d := out.Dissimilar(out[:1]); d != .5 {
+		t.Errorf("expected .5 got %v", d)
+	}
+}
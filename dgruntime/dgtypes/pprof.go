@@ -0,0 +1,296 @@
+package dgtypes
+
+import (
+	"compress/gzip"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WritePprof writes the profile in the (gzipped) protocol buffer format of
+// pprof so `go tool pprof` can read it. There is a sample for each block
+// and call stack (see Stacks) with the number of times the block was
+// entered, the time spent in it and (for the first block of a function)
+// the number of calls. The sample's locations are the block and the
+// blocks the calls on the stack were made from, the innermost first. What
+// the stacks do not account for (eg. the entrances seen before the
+// profile had stacks) is in a sample of the block alone. A block's
+// location is its function and the line of its position. Each sample is
+// labeled with the block id and the position of the block.
+func (p *Profile) WritePprof(fout io.Writer) error {
+	var b pprofBuilder
+	b.strings = map[string]int64{"": 0}
+	b.table = []string{""}
+	b.funcs = make(map[pprofFunc]uint64)
+	b.locIds = make(map[BlkEntrance]uint64)
+	for _, vt := range [][2]string{{"entrances", "count"}, {"time", "nanoseconds"}, {"calls", "count"}} {
+		b.out.message(1, func(m *protobuf) {
+			m.int64(1, b.str(vt[0]))
+			m.int64(2, b.str(vt[1]))
+		})
+	}
+	entrances := make(map[BlkEntrance]int)
+	for e, count := range p.Flows {
+		entrances[e.Targ] += count
+	}
+	for e, count := range p.Spawns {
+		entrances[e.Targ] += count
+	}
+	for blk := range p.Durations {
+		if _, has := entrances[blk]; !has {
+			entrances[blk] = 0
+		}
+	}
+	blks := make([]BlkEntrance, 0, len(entrances))
+	for blk := range entrances {
+		if blk.In == 0 && blk.BasicBlockId == 0 {
+			continue
+		}
+		blks = append(blks, blk)
+	}
+	sortBlks(blks)
+	for _, blk := range blks {
+		b.location(p, blk)
+	}
+	keys := make(map[StackBlk]bool, len(p.Stacks))
+	for sb := range p.Stacks {
+		keys[sb] = true
+	}
+	for sb := range p.StackCalls {
+		keys[sb] = true
+	}
+	for sb := range p.StackDurations {
+		keys[sb] = true
+	}
+	stacks := make([]StackBlk, 0, len(keys))
+	for sb := range keys {
+		stacks = append(stacks, sb)
+	}
+	sort.Slice(stacks, func(i, j int) bool {
+		if stacks[i].Blk != stacks[j].Blk {
+			return blkLess(stacks[i].Blk, stacks[j].Blk)
+		}
+		return stacks[i].Stack < stacks[j].Stack
+	})
+	// stacked is what the stacks account for of each block
+	stacked := make(map[BlkEntrance][3]int64)
+	for _, sb := range stacks {
+		values := [3]int64{int64(p.Stacks[sb]), int64(p.StackDurations[sb]), int64(p.StackCalls[sb])}
+		locs := []uint64{b.location(p, sb.Blk)}
+		for _, site := range sb.Sites() {
+			locs = append(locs, b.location(p, site))
+		}
+		b.sample(p, sb.Blk, locs, values)
+		s := stacked[sb.Blk]
+		for i := range s {
+			s[i] += values[i]
+		}
+		stacked[sb.Blk] = s
+	}
+	for _, blk := range blks {
+		calls := 0
+		if f, has := p.Funcs[blk.In]; has && blk.BasicBlockId == 0 {
+			calls = f.Calls
+		}
+		values := [3]int64{int64(entrances[blk]), int64(p.Durations[blk]), int64(calls)}
+		rest := false
+		for i := range values {
+			values[i] -= stacked[blk][i]
+			if values[i] < 0 {
+				values[i] = 0
+			}
+			rest = rest || values[i] > 0
+		}
+		if _, has := stacked[blk]; has && !rest {
+			continue
+		}
+		b.sample(p, blk, []uint64{b.location(p, blk)}, values)
+	}
+	for _, l := range b.locs {
+		b.out.message(4, func(m *protobuf) {
+			m.uint64(1, l.id)
+			m.message(4, func(ln *protobuf) {
+				ln.uint64(1, l.fn)
+				ln.int64(2, l.line)
+			})
+		})
+	}
+	fns := make([]pprofFunc, 0, len(b.funcs))
+	for f := range b.funcs {
+		fns = append(fns, f)
+	}
+	sort.Slice(fns, func(i, j int) bool { return b.funcs[fns[i]] < b.funcs[fns[j]] })
+	for _, f := range fns {
+		b.out.message(5, func(m *protobuf) {
+			m.uint64(1, b.funcs[f])
+			m.int64(2, b.str(f.name))
+			m.int64(3, b.str(f.name))
+			m.int64(4, b.str(f.file))
+		})
+	}
+	// the comment is added to the string table before it is written
+	comment := b.str("dynagrok " + p.Instrumentation.String())
+	for _, s := range b.table {
+		b.out.bytes(6, []byte(s))
+	}
+	b.out.int64(13, comment)
+	z := gzip.NewWriter(fout)
+	if _, err := z.Write(b.out.buf); err != nil {
+		return err
+	}
+	return z.Close()
+}
+
+func sortBlks(blks []BlkEntrance) {
+	sort.Slice(blks, func(i, j int) bool { return blkLess(blks[i], blks[j]) })
+}
+
+func blkLess(a, b BlkEntrance) bool {
+	if a.In != b.In {
+		return a.In < b.In
+	}
+	return a.BasicBlockId < b.BasicBlockId
+}
+
+// splitPosition splits a position of the form file:line:col.
+func splitPosition(pos string) (file string, line int64) {
+	parts := strings.Split(pos, ":")
+	if len(parts) < 3 {
+		return pos, 0
+	}
+	line, err := strconv.ParseInt(parts[len(parts)-2], 10, 64)
+	if err != nil {
+		return pos, 0
+	}
+	return strings.Join(parts[:len(parts)-2], ":"), line
+}
+
+type pprofFunc struct {
+	name string
+	file string
+}
+
+type pprofLoc struct {
+	id   uint64
+	fn   uint64
+	line int64
+}
+
+type pprofBuilder struct {
+	out     protobuf
+	strings map[string]int64
+	table   []string
+	funcs   map[pprofFunc]uint64
+	locs    []pprofLoc
+	locIds  map[BlkEntrance]uint64
+}
+
+// str returns the index of s in the string table.
+func (b *pprofBuilder) str(s string) int64 {
+	if i, has := b.strings[s]; has {
+		return i
+	}
+	i := int64(len(b.table))
+	b.strings[s] = i
+	b.table = append(b.table, s)
+	return i
+}
+
+// function returns the id of the function.
+func (b *pprofBuilder) function(name, file string) uint64 {
+	f := pprofFunc{name, file}
+	if id, has := b.funcs[f]; has {
+		return id
+	}
+	id := uint64(len(b.funcs) + 1)
+	b.funcs[f] = id
+	return id
+}
+
+// location returns the id of the location of the block.
+func (b *pprofBuilder) location(p *Profile, blk BlkEntrance) uint64 {
+	if id, has := b.locIds[blk]; has {
+		return id
+	}
+	file, line := splitPosition(p.Positions[blk])
+	id := uint64(len(b.locs) + 1)
+	b.locIds[blk] = id
+	b.locs = append(b.locs, pprofLoc{id: id, fn: b.function(p.fn_name(blk), file), line: line})
+	return id
+}
+
+// sample writes a sample of the block with the locations and the values
+// (entrances, time and calls).
+func (b *pprofBuilder) sample(p *Profile, blk BlkEntrance, locs []uint64, values [3]int64) {
+	pos := p.Positions[blk]
+	b.out.message(2, func(m *protobuf) {
+		m.packedUint64(1, locs...)
+		m.packedInt64(2, values[:]...)
+		m.message(3, func(l *protobuf) {
+			l.int64(1, b.str("block"))
+			l.int64(2, b.str(strconv.Itoa(blk.BasicBlockId)))
+		})
+		if pos != "" {
+			m.message(3, func(l *protobuf) {
+				l.int64(1, b.str("position"))
+				l.int64(2, b.str(pos))
+			})
+		}
+	})
+}
+
+// protobuf encodes the few protocol buffer wire types the pprof format
+// needs.
+type protobuf struct {
+	buf []byte
+}
+
+func (b *protobuf) varint(x uint64) {
+	for x >= 0x80 {
+		b.buf = append(b.buf, byte(x)|0x80)
+		x >>= 7
+	}
+	b.buf = append(b.buf, byte(x))
+}
+
+func (b *protobuf) tag(field, wire int) {
+	b.varint(uint64(field)<<3 | uint64(wire))
+}
+
+func (b *protobuf) uint64(field int, x uint64) {
+	b.tag(field, 0)
+	b.varint(x)
+}
+
+func (b *protobuf) int64(field int, x int64) {
+	b.uint64(field, uint64(x))
+}
+
+func (b *protobuf) bytes(field int, x []byte) {
+	b.tag(field, 2)
+	b.varint(uint64(len(x)))
+	b.buf = append(b.buf, x...)
+}
+
+func (b *protobuf) packedUint64(field int, xs ...uint64) {
+	var m protobuf
+	for _, x := range xs {
+		m.varint(x)
+	}
+	b.bytes(field, m.buf)
+}
+
+func (b *protobuf) packedInt64(field int, xs ...int64) {
+	var m protobuf
+	for _, x := range xs {
+		m.varint(uint64(x))
+	}
+	b.bytes(field, m.buf)
+}
+
+func (b *protobuf) message(field int, write func(*protobuf)) {
+	var m protobuf
+	write(&m)
+	b.bytes(field, m.buf)
+}
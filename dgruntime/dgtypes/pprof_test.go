@@ -0,0 +1,217 @@
+package dgtypes
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pprofSample is a decoded sample: the functions of its locations (the
+// innermost first), its block label and its values.
+type pprofSample struct {
+	funcs  string
+	block  string
+	values [3]int64
+}
+
+// decodePprof decodes the samples of a profile written by WritePprof.
+func decodePprof(t *testing.T, data []byte) []pprofSample {
+	z, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := ioutil.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type rawSample struct {
+		locs   []uint64
+		values []uint64
+		labels [][2]uint64
+	}
+	var samples []rawSample
+	var table []string
+	locFunc := make(map[uint64]uint64)
+	funcName := make(map[uint64]uint64)
+	fields(t, buf, func(field int, x uint64, msg []byte) {
+		switch field {
+		case 2:
+			var s rawSample
+			fields(t, msg, func(field int, x uint64, msg []byte) {
+				switch field {
+				case 1:
+					s.locs = varints(t, msg)
+				case 2:
+					s.values = varints(t, msg)
+				case 3:
+					var l [2]uint64
+					fields(t, msg, func(field int, x uint64, _ []byte) {
+						l[field-1] = x
+					})
+					s.labels = append(s.labels, l)
+				}
+			})
+			samples = append(samples, s)
+		case 4:
+			var id, fn uint64
+			fields(t, msg, func(field int, x uint64, msg []byte) {
+				switch field {
+				case 1:
+					id = x
+				case 4:
+					fields(t, msg, func(field int, x uint64, _ []byte) {
+						if field == 1 {
+							fn = x
+						}
+					})
+				}
+			})
+			locFunc[id] = fn
+		case 5:
+			var id, name uint64
+			fields(t, msg, func(field int, x uint64, _ []byte) {
+				switch field {
+				case 1:
+					id = x
+				case 2:
+					name = x
+				}
+			})
+			funcName[id] = name
+		case 6:
+			table = append(table, string(msg))
+		}
+	})
+	decoded := make([]pprofSample, 0, len(samples))
+	for _, s := range samples {
+		var d pprofSample
+		names := make([]string, 0, len(s.locs))
+		for _, loc := range s.locs {
+			names = append(names, table[funcName[locFunc[loc]]])
+		}
+		d.funcs = strings.Join(names, " <- ")
+		for _, l := range s.labels {
+			if table[l[0]] == "block" {
+				d.block = table[l[1]]
+			}
+		}
+		for i, v := range s.values {
+			d.values[i] = int64(v)
+		}
+		decoded = append(decoded, d)
+	}
+	return decoded
+}
+
+// fields calls f with the number and the value (a varint or the bytes of
+// a length delimited field) of each field of the message.
+func fields(t *testing.T, buf []byte, f func(field int, x uint64, msg []byte)) {
+	for len(buf) > 0 {
+		key, n := varint(t, buf)
+		buf = buf[n:]
+		switch key & 7 {
+		case 0:
+			x, n := varint(t, buf)
+			buf = buf[n:]
+			f(int(key>>3), x, nil)
+		case 2:
+			size, n := varint(t, buf)
+			buf = buf[n:]
+			f(int(key>>3), 0, buf[:size])
+			buf = buf[size:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+}
+
+func varints(t *testing.T, buf []byte) []uint64 {
+	var xs []uint64
+	for len(buf) > 0 {
+		x, n := varint(t, buf)
+		xs = append(xs, x)
+		buf = buf[n:]
+	}
+	return xs
+}
+
+func varint(t *testing.T, buf []byte) (uint64, int) {
+	var x uint64
+	for i, b := range buf {
+		x |= uint64(b&0x7f) << (7 * uint(i))
+		if b < 0x80 {
+			return x, i + 1
+		}
+	}
+	t.Fatal("truncated varint")
+	return 0, 0
+}
+
+// Each sample has the call stack it was recorded with, what the stacks do
+// not account for is in samples of the blocks alone.
+func TestWritePprof(t *testing.T) {
+	p := testProfile()
+	main := BlkEntrance{In: 100, BasicBlockId: 0}
+	work := BlkEntrance{In: 200, BasicBlockId: 0}
+	loop := BlkEntrance{In: 200, BasicBlockId: 1}
+	fromMain := StackKey([]BlkEntrance{main})
+	p.Stacks[StackBlk{Blk: main}] = 2
+	p.StackCalls[StackBlk{Blk: main}] = 1
+	p.Stacks[StackBlk{Stack: fromMain, Blk: work}] = 2
+	p.StackCalls[StackBlk{Stack: fromMain, Blk: work}] = 2
+	p.Stacks[StackBlk{Stack: fromMain, Blk: loop}] = 10
+	p.StackDurations[StackBlk{Stack: fromMain, Blk: loop}] = 1500 * time.Microsecond
+	var buf bytes.Buffer
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[pprofSample]bool{
+		{"main.main", "0", [3]int64{2, 0, 1}}:                                            true,
+		{"main.work <- main.main", "0", [3]int64{2, 0, 2}}:                               true,
+		{"main.work <- main.main", "1", [3]int64{10, int64(1500 * time.Microsecond), 0}}: true,
+		// the time in main and the spawned function have no stacks
+		{"main.main", "0", [3]int64{0, int64(3 * time.Millisecond), 0}}: true,
+		{"main.main.func1", "0", [3]int64{1, 0, 1}}:                     true,
+	}
+	samples := decodePprof(t, buf.Bytes())
+	if len(samples) != len(expected) {
+		t.Errorf("expected %d samples got %v", len(expected), samples)
+	}
+	for _, s := range samples {
+		if !expected[s] {
+			t.Errorf("unexpected sample %v", s)
+		}
+	}
+
+	// without stacks each block has a sample of its own
+	buf.Reset()
+	if err := testProfile().WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range decodePprof(t, buf.Bytes()) {
+		if strings.Contains(s.funcs, "<-") {
+			t.Errorf("unexpected stack %v", s)
+		}
+		if s.funcs == "main.work" && s.block == "1" && s.values[0] != 10 {
+			t.Errorf("expected the loop to be entered 10 times got %v", s)
+		}
+	}
+	// the calls a calling context tree had no room for have a single frame
+	p = testProfile()
+	p.Stacks[StackBlk{Stack: StackKey([]BlkEntrance{TruncatedSite}), Blk: loop}] = 10
+	buf.Reset()
+	if err := p.WritePprof(&buf); err != nil {
+		t.Fatal(err)
+	}
+	truncated := pprofSample{"main.work <- <truncated>", "1", [3]int64{10, 0, 0}}
+	found := false
+	for _, s := range decodePprof(t, buf.Bytes()) {
+		found = found || s == truncated
+	}
+	if !found {
+		t.Errorf("expected the sample %v", truncated)
+	}
+}
@@ -0,0 +1,91 @@
+package dgtypes
+
+import (
+	"sort"
+)
+
+// A Predicate is something which held at an instrumented site. The
+// profile counts the times each predicate held (see Profile.Predicates).
+type Predicate struct {
+	Kind  string // BranchPredicate, OperandsPredicate, ReturnPredicate, ...
+	Site  string // the position of the site
+	Expr  string // the source of the condition or value
+	Value string // what held
+}
+
+// BranchPredicate is the value ("true" or "false") an if or for
+// condition evaluated to.
+const BranchPredicate = "branch"
+
+// OperandsPredicate is the values of the operands of a condition which
+// is a comparison of simple operands, eg. "3, 5" for x < y.
+const OperandsPredicate = "operands"
+
+// MaxOperandValues bounds the number of distinct operand values a
+// profile keeps for each site (see MergePredicates). The values beyond it
+// are counted as OtherOperands.
+const MaxOperandValues = 16
+
+// OtherOperands is the value of the operands predicate which stands for
+// the values past MaxOperandValues.
+const OtherOperands = "other"
+
+// ReturnPredicate is the sign ("<0", "==0" or ">0") of a number returned
+// by a call or whether an error or pointer it returned is "nil" or
+// "non-nil".
+const ReturnPredicate = "return"
+
+// AssignPredicate is ReturnPredicate for a value assigned to a variable
+// other than from a call.
+const AssignPredicate = "assign"
+
+// PairPredicate is how ("<", "==" or ">") a returned or assigned number
+// compares to another local of the same type in scope at the site. Its
+// Expr names both, eg. Expr "x, n" and Value "<" for x < n.
+const PairPredicate = "pair"
+
+// MergePredicates adds the counts of the predicates to the profile. Once
+// a site has MaxOperandValues operand values the values new to the
+// profile are counted as OtherOperands, the merges bound the values for
+// the whole run rather than for each goroutine. When there is room for
+// only some of the new values the most frequent are kept.
+func (p *Profile) MergePredicates(preds map[Predicate]int) {
+	var added []Predicate
+	for pred, count := range preds {
+		if _, has := p.Predicates[pred]; has || pred.Kind != OperandsPredicate || pred.Value == OtherOperands {
+			p.Predicates[pred] += count
+		} else {
+			added = append(added, pred)
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	values := make(map[Predicate]int)
+	for pred := range p.Predicates {
+		if pred.Kind == OperandsPredicate && pred.Value != OtherOperands {
+			values[otherOperands(pred)]++
+		}
+	}
+	sort.Slice(added, func(i, j int) bool {
+		a, b := preds[added[i]], preds[added[j]]
+		if a != b {
+			return a > b
+		}
+		return added[i].Value < added[j].Value
+	})
+	for _, pred := range added {
+		other := otherOperands(pred)
+		if values[other] >= MaxOperandValues {
+			p.Predicates[other] += preds[pred]
+		} else {
+			values[other]++
+			p.Predicates[pred] += preds[pred]
+		}
+	}
+}
+
+func otherOperands(pred Predicate) Predicate {
+	pred.Value = OtherOperands
+	return pred
+}
@@ -5,35 +5,82 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// ProfileVersion is the version of the flow-graph.txt and flow-graph.dot
+// formats written by WriteSimple and WriteDotty. It is bumped whenever a
+// change to a format would confuse the older readers.
+const ProfileVersion = 3
+
 type Profile struct {
-	Inputs    map[string][]ObjectProfile
-	Outputs   map[string][]ObjectProfile
-	Types     map[string]Type
-	Funcs     map[uintptr]*Function
-	Calls     map[Call]int
-	Flows     map[FlowEdge]int
-	Positions map[BlkEntrance]string
-	Durations map[BlkEntrance]time.Duration
-	CallCount int
+	Instrumentation Instrumentation
+	Inputs          map[string][]ObjectProfile
+	Outputs         map[string][]ObjectProfile
+	Exits           map[string][]Exit // how the call of each output exited
+	Types           map[string]Type
+	Funcs           map[uintptr]*Function
+	Calls           map[Call]int
+	Flows           map[FlowEdge]int
+	Spawns          map[FlowEdge]int // go statement -> first block of the goroutine
+	Comms           map[FlowEdge]int // channel send -> matching receive
+	Channels        map[ChanComm]int // the channels of the Comms
+	Panics          map[FlowEdge]int // exits unwound by a panic
+	Recovers        map[FlowEdge]int // exits after recovering a panic
+	Panicked        map[PanicSite]int
+	Predicates      map[Predicate]int // times each predicate held
+	Positions       map[BlkEntrance]string
+	Durations       map[BlkEntrance]time.Duration
+	Stacks          map[StackBlk]int           // entrances by call stack
+	StackCalls      map[StackBlk]int           // calls (of block 0) by call stack
+	StackDurations  map[StackBlk]time.Duration // time spent by call stack
+	CallCount       int
 }
 
 func NewProfile() *Profile {
 	return &Profile{
-		Calls:     make(map[Call]int),
-		Funcs:     make(map[uintptr]*Function),
-		Flows:     make(map[FlowEdge]int),
-		Positions: make(map[BlkEntrance]string),
-		Durations: make(map[BlkEntrance]time.Duration),
-		Inputs:    make(map[string][]ObjectProfile),
-		Outputs:   make(map[string][]ObjectProfile),
-		Types:     make(map[string]Type),
+		Calls:          make(map[Call]int),
+		Funcs:          make(map[uintptr]*Function),
+		Flows:          make(map[FlowEdge]int),
+		Spawns:         make(map[FlowEdge]int),
+		Comms:          make(map[FlowEdge]int),
+		Channels:       make(map[ChanComm]int),
+		Panics:         make(map[FlowEdge]int),
+		Recovers:       make(map[FlowEdge]int),
+		Panicked:       make(map[PanicSite]int),
+		Predicates:     make(map[Predicate]int),
+		Positions:      make(map[BlkEntrance]string),
+		Durations:      make(map[BlkEntrance]time.Duration),
+		Stacks:         make(map[StackBlk]int),
+		StackCalls:     make(map[StackBlk]int),
+		StackDurations: make(map[StackBlk]time.Duration),
+		Inputs:         make(map[string][]ObjectProfile),
+		Outputs:        make(map[string][]ObjectProfile),
+		Exits:          make(map[string][]Exit),
+		Types:          make(map[string]Type),
 	}
 }
 
+// ChanComm is a communication over a channel: the comm edge from the
+// sending block to the receiving block and the channel (its expression
+// and type) as it was named by the send and by the receive.
+type ChanComm struct {
+	Edge FlowEdge
+	Send string
+	Recv string
+}
+
+// PanicSite is a block which panicked and the type of the panic value
+// (UnknownPanic if the value was never seen, eg. a runtime error which
+// was not recovered).
+type PanicSite struct {
+	Blk  BlkEntrance
+	Type string
+}
+
 type Call struct {
 	Caller uintptr
 	Callee uintptr
@@ -52,20 +99,23 @@ func (p *Profile) WriteFunctions(fout io.Writer) error {
 func (p *Profile) WriteDotty(fout io.Writer) {
 	nextid := 1
 	blks := make(map[BlkEntrance]int)
+	panicked := p.panicTypes()
 	fmt.Fprintf(fout, "digraph {\n")
+	fmt.Fprintf(fout, "level=%v;\n", strconv.Quote(p.Instrumentation.String()))
+	fmt.Fprintf(fout, "version=%d;\n", ProfileVersion)
 	entry := p.blk_name(BlkEntrance{})
 	fmt.Fprintf(fout, "%d [label=%v, shape=rect];\n",
 		0,
 		strconv.Quote(entry),
 	)
 	blks[BlkEntrance{}] = 0
-	for e, _ := range p.Flows {
+	for e := range p.edges() {
 		src := p.blk_name(e.Src)
 		targ := p.blk_name(e.Targ)
 		if _, has := blks[e.Src]; !has {
 			s := nextid
 			nextid++
-			fmt.Fprintf(fout, "%d [label=%v, shape=rect, position=%v, runtime_name=%v, fn_name=%v, bbid=%d, duration=%v];\n",
+			fmt.Fprintf(fout, "%d [label=%v, shape=rect, position=%v, runtime_name=%v, fn_name=%v, bbid=%d, duration=%v%v];\n",
 				s,
 				strconv.Quote(src),
 				strconv.Quote(p.Positions[e.Src]),
@@ -73,13 +123,14 @@ func (p *Profile) WriteDotty(fout io.Writer) {
 				strconv.Quote(p.fn_name(e.Src)),
 				e.Src.BasicBlockId,
 				strconv.Quote(p.Durations[e.Src].String()),
+				p.callsAttr(e.Src)+p.panicAttr(e.Src, panicked[e.Src]),
 			)
 			blks[e.Src] = s
 		}
 		if _, has := blks[e.Targ]; !has {
 			t := nextid
 			nextid++
-			fmt.Fprintf(fout, "%d [label=%v, shape=rect, position=%v, runtime_name=%v, fn_name=%v, bbid=%d, duration=%v];\n",
+			fmt.Fprintf(fout, "%d [label=%v, shape=rect, position=%v, runtime_name=%v, fn_name=%v, bbid=%d, duration=%v%v];\n",
 				t,
 				strconv.Quote(targ),
 				strconv.Quote(p.Positions[e.Targ]),
@@ -87,6 +138,7 @@ func (p *Profile) WriteDotty(fout io.Writer) {
 				strconv.Quote(p.fn_name(e.Targ)),
 				e.Targ.BasicBlockId,
 				strconv.Quote(p.Durations[e.Targ].String()),
+				p.callsAttr(e.Targ)+p.panicAttr(e.Targ, panicked[e.Targ]),
 			)
 			blks[e.Targ] = t
 		}
@@ -101,9 +153,106 @@ func (p *Profile) WriteDotty(fout io.Writer) {
 		fmt.Fprintf(fout, "%v -> %v [traversed=%d];\n",
 			blks[e.Src], blks[e.Targ], count)
 	}
+	for _, labeled := range p.labeledEdges() {
+		for e, count := range labeled.edges {
+			if _, has := blks[e.Src]; !has {
+				continue
+			}
+			if _, has := blks[e.Targ]; !has {
+				continue
+			}
+			fmt.Fprintf(fout, "%v -> %v [label=%v, traversed=%d];\n",
+				blks[e.Src], blks[e.Targ], strconv.Quote(labeled.label), count)
+		}
+	}
 	fmt.Fprintln(fout, "}\n\n")
 }
 
+// callsAttr is the calls attribute of the DOT vertex of the first block
+// of a function with the number of times the function was called.
+func (p *Profile) callsAttr(blk BlkEntrance) string {
+	f, has := p.Funcs[blk.In]
+	if !has || blk.BasicBlockId != 0 {
+		return ""
+	}
+	return fmt.Sprintf(", calls=%d", f.Calls)
+}
+
+// panicAttr is the panicked attribute of a DOT vertex which panicked
+// with values of the given types and the panic_counts attribute with the
+// number of times it panicked with each.
+func (p *Profile) panicAttr(blk BlkEntrance, types []string) string {
+	if len(types) == 0 {
+		return ""
+	}
+	counts := make([]string, 0, len(types))
+	for _, t := range types {
+		counts = append(counts, strconv.Itoa(p.Panicked[PanicSite{Blk: blk, Type: t}]))
+	}
+	return fmt.Sprintf(", panicked=%v, panic_counts=%v",
+		strconv.Quote(strings.Join(types, ",")), strconv.Quote(strings.Join(counts, ",")))
+}
+
+// PanicLabel labels the exit edges of the calls which were unwound by a
+// panic.
+const PanicLabel = "panic"
+
+// UnknownPanic is the type of a panic value the dgruntime did not see.
+const UnknownPanic = "unknown"
+
+// RecoverLabel labels the exit edges of the calls which returned normally
+// after one of their deferred calls recovered a panic.
+const RecoverLabel = "recover"
+
+// SpawnLabel labels the edges from the block of a go statement to the
+// first block of the goroutine it started.
+const SpawnLabel = "spawn"
+
+// CommLabel labels the communicates-with edges from the block which sent
+// a value on a channel to the block which received it.
+const CommLabel = "comm"
+
+type labeledEdges struct {
+	label string
+	edges map[FlowEdge]int
+}
+
+// labeledEdges lists the edges which are not control flow by label.
+func (p *Profile) labeledEdges() []labeledEdges {
+	return []labeledEdges{
+		{SpawnLabel, p.Spawns},
+		{CommLabel, p.Comms},
+		{PanicLabel, p.Panics},
+		{RecoverLabel, p.Recovers},
+	}
+}
+
+// edges lists the flow edges and the labeled edges.
+func (p *Profile) edges() map[FlowEdge]int {
+	edges := make(map[FlowEdge]int, len(p.Flows))
+	for e, count := range p.Flows {
+		edges[e] += count
+	}
+	for _, labeled := range p.labeledEdges() {
+		for e, count := range labeled.edges {
+			edges[e] += count
+		}
+	}
+	return edges
+}
+
+// panicTypes lists the types of the values each block panicked with.
+func (p *Profile) panicTypes() map[BlkEntrance][]string {
+	types := make(map[BlkEntrance][]string)
+	for site := range p.Panicked {
+		types[site.Blk] = append(types[site.Blk], site.Type)
+	}
+	for _, t := range types {
+		sort.Strings(t)
+	}
+	return types
+}
+
 func (p *Profile) runtime_name(pc uintptr) string {
 	return runtime.FuncForPC(pc).Name()
 }
@@ -112,6 +261,9 @@ func (p *Profile) fn_name(n BlkEntrance) string {
 	if n.In == 0 && n.BasicBlockId == 0 {
 		return "entry"
 	}
+	if n == TruncatedSite {
+		return "<truncated>"
+	}
 	if f, has := p.Funcs[n.In]; has {
 		return f.Name
 	} else {
@@ -135,6 +287,26 @@ func (p *Profile) WriteSimple(fout io.Writer) {
 	blks := make(map[BlkEntrance]int)
 	entry := p.blk_name(BlkEntrance{})
 	fmt.Fprintln(fout, "start-graph")
+	fmt.Fprintf(fout, "version\t%d\n", ProfileVersion)
+	fmt.Fprintf(fout, "level\t%v, %d, %v\n",
+		strconv.Quote(p.Instrumentation.Level.String()),
+		p.Instrumentation.SampleEvery,
+		p.Instrumentation.SampleRate,
+	)
+	for _, f := range p.Funcs {
+		fmt.Fprintf(fout, "function\t%v, %d\n", strconv.Quote(f.Name), f.Calls)
+	}
+	for c, count := range p.Calls {
+		caller, has := p.Funcs[c.Caller]
+		if !has {
+			continue
+		}
+		callee, has := p.Funcs[c.Callee]
+		if !has {
+			continue
+		}
+		fmt.Fprintf(fout, "call\t%v, %v, %d\n", strconv.Quote(caller.Name), strconv.Quote(callee.Name), count)
+	}
 	fmt.Fprintf(fout, "vertex\t%d, %v, %d, %v, %v, %v\n",
 		0,
 		strconv.Quote(entry),
@@ -144,7 +316,7 @@ func (p *Profile) WriteSimple(fout io.Writer) {
 		strconv.Quote("0s"),
 	)
 	blks[BlkEntrance{}] = 0
-	for e, _ := range p.Flows {
+	for e := range p.edges() {
 		src := p.blk_name(e.Src)
 		targ := p.blk_name(e.Targ)
 		if _, has := blks[e.Src]; !has {
@@ -184,30 +356,58 @@ func (p *Profile) WriteSimple(fout io.Writer) {
 		fmt.Fprintf(fout, "edge\t%d, %d, %d\n",
 			blks[e.Src], blks[e.Targ], count)
 	}
+	for _, labeled := range p.labeledEdges() {
+		for e, count := range labeled.edges {
+			if _, has := blks[e.Src]; !has {
+				continue
+			}
+			if _, has := blks[e.Targ]; !has {
+				continue
+			}
+			fmt.Fprintf(fout, "%v\t%d, %d, %d\n",
+				labeled.label, blks[e.Src], blks[e.Targ], count)
+		}
+	}
+	for site, count := range p.Panicked {
+		if _, has := blks[site.Blk]; !has {
+			continue
+		}
+		fmt.Fprintf(fout, "panicked\t%d, %v, %d\n",
+			blks[site.Blk], strconv.Quote(site.Type), count)
+	}
+	for c, count := range p.Channels {
+		if _, has := blks[c.Edge.Src]; !has {
+			continue
+		}
+		if _, has := blks[c.Edge.Targ]; !has {
+			continue
+		}
+		fmt.Fprintf(fout, "channel\t%d, %d, %v, %v, %d\n",
+			blks[c.Edge.Src], blks[c.Edge.Targ], strconv.Quote(c.Send), strconv.Quote(c.Recv), count)
+	}
+	for pred, count := range p.Predicates {
+		fmt.Fprintf(fout, "predicate\t%v, %v, %v, %v, %d\n",
+			strconv.Quote(pred.Kind), strconv.Quote(pred.Site), strconv.Quote(pred.Expr), strconv.Quote(pred.Value), count)
+	}
 	fmt.Fprintln(fout, "end-graph")
 }
 
-func LoadSimple(fout io.Writer) (*Profile, error) {
-	p := NewProfile()
-	return p, nil
-}
-
 func (p *Profile) SerializeProfs(fout io.Writer) {
-	types := make([]Type, len(p.Types))
+	types := make([]Type, 0, len(p.Types))
 	for _, typ := range p.Types {
 		types = append(types, typ)
 	}
 	fmt.Fprint(fout, TypeProfile{types}.Serialize())
 	for fname := range p.Inputs {
 		if _, ok := p.Outputs[fname]; ok {
-			fmt.Fprint(fout, FuncProfile{fname, p.Inputs[fname], p.Outputs[fname]}.Serialize())
+			fmt.Fprint(fout, FuncProfile{fname, p.Inputs[fname], p.Outputs[fname], p.Exits[fname]}.Serialize())
 		} else {
-			fmt.Fprint(fout, FuncProfile{fname, p.Inputs[fname], []ObjectProfile{}}.Serialize())
+			fmt.Fprint(fout, FuncProfile{fname, p.Inputs[fname], []ObjectProfile{}, nil}.Serialize())
 		}
 	}
 	for fname, profs := range p.Outputs {
 		if _, ok := p.Inputs[fname]; !ok {
-			fmt.Fprint(fout, FuncProfile{fname, []ObjectProfile{}, profs}.Serialize())
+			fmt.Fprint(fout, FuncProfile{fname, []ObjectProfile{}, profs, p.Exits[fname]}.Serialize())
 		}
 	}
 }
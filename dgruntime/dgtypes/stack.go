@@ -0,0 +1,61 @@
+package dgtypes
+
+import (
+	"strconv"
+	"strings"
+)
+
+// MaxStackDepth is the most call sites kept in the call stack of a
+// StackBlk. Deeper stacks keep their innermost call sites.
+const MaxStackDepth = 64
+
+// TruncatedSite is the call site of the calls made once a goroutine's
+// calling context tree was full (or its stack too deep). The blocks they
+// entered are counted under this single "<truncated>" frame.
+var TruncatedSite = BlkEntrance{In: ^uintptr(0)}
+
+// StackBlk is a block entered with the call stack Stack, the blocks the
+// calls on the stack were made from (see StackKey). The profile counts
+// the entrances of each block by call stack in Stacks, the calls of each
+// function in StackCalls (by its block 0) and the time spent in each
+// block in StackDurations. They are only kept in memory for the pprof
+// profile (see WritePprof).
+type StackBlk struct {
+	Stack string
+	Blk   BlkEntrance
+}
+
+// StackKey encodes the call sites of a call stack, the innermost first, as
+// the Stack of a StackBlk.
+func StackKey(sites []BlkEntrance) string {
+	parts := make([]string, 0, len(sites))
+	for _, site := range sites {
+		parts = append(parts, strconv.FormatUint(uint64(site.In), 16)+"."+strconv.Itoa(site.BasicBlockId))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Sites decodes the call sites of the stack, the innermost first.
+func (s StackBlk) Sites() []BlkEntrance {
+	if s.Stack == "" {
+		return nil
+	}
+	parts := strings.Split(s.Stack, ";")
+	sites := make([]BlkEntrance, 0, len(parts))
+	for _, part := range parts {
+		dot := strings.Index(part, ".")
+		if dot < 0 {
+			continue
+		}
+		pc, err := strconv.ParseUint(part[:dot], 16, 64)
+		if err != nil {
+			continue
+		}
+		id, err := strconv.Atoi(part[dot+1:])
+		if err != nil {
+			continue
+		}
+		sites = append(sites, BlkEntrance{In: uintptr(pc), BasicBlockId: id})
+	}
+	return sites
+}
@@ -0,0 +1,577 @@
+package dgtypes
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// A trace is a stream of events written as they happen. The stream
+// starts with traceMagic and the TraceVersion. Each event starts with
+// its kind, the id of the goroutine it happened on and the nanoseconds
+// since the trace started (all uvarints). Strings and function
+// definitions are written once, the first time they are used, and are
+// referred to by id (or pc) after that.
+//
+// Version 2 added the spawn, communication, panic and predicate events
+// and the label (see PanicLabel and RecoverLabel) of the exit edge to
+// the function exits. Checkpoints and object profiles are not traced.
+
+const traceMagic = "dgtrace"
+
+const TraceVersion = 2
+
+type EventKind uint8
+
+const (
+	StringEvent EventKind = iota + 1
+	FuncDefEvent
+	EnterBlkEvent
+	EnterFuncEvent
+	ExitFuncEvent
+	GoroutineStartEvent
+	GoroutineExitEvent
+	FailEvent
+	SpawnEvent
+	CommEvent
+	PanicEvent
+	PredicateEvent
+)
+
+// Event is a decoded trace event. Which fields are set depends on the
+// Kind. String events are consumed by the TraceReader and never returned.
+type Event struct {
+	Kind         EventKind
+	GoID         int64
+	Time         time.Duration
+	FuncPc       uintptr
+	BasicBlockId int
+	Name         string // the function, or the type of a panic value
+	Pos          string
+	CFG          [][]int
+	IPDom        []int
+	Label        string    // of the exit edge of an ExitFuncEvent
+	Edge         FlowEdge  // the Src of a spawn or panic
+	Chan         ChanComm  // of a CommEvent
+	Predicate    Predicate // of a PredicateEvent
+}
+
+// TraceWriter encodes events. It is not safe for concurrent use.
+type TraceWriter struct {
+	w     *bufio.Writer
+	start time.Time
+	strs  map[string]uint64
+	funcs map[uintptr]bool
+	buf   [binary.MaxVarintLen64]byte
+}
+
+func NewTraceWriter(w io.Writer) (*TraceWriter, error) {
+	t := &TraceWriter{
+		w:     bufio.NewWriter(w),
+		start: time.Now(),
+		strs:  make(map[string]uint64),
+		funcs: make(map[uintptr]bool),
+	}
+	if _, err := t.w.WriteString(traceMagic); err != nil {
+		return nil, err
+	}
+	if err := t.uvarint(TraceVersion); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *TraceWriter) Flush() error {
+	return t.w.Flush()
+}
+
+func (t *TraceWriter) EnterBlk(goid int64, bbid int, pos string) error {
+	p, err := t.str(pos)
+	if err != nil {
+		return err
+	}
+	return t.event(EnterBlkEvent, goid, uint64(bbid), p)
+}
+
+func (t *TraceWriter) EnterFunc(goid int64, fpc uintptr, name, pos string, cfg [][]int, ipdom []int) error {
+	if !t.funcs[fpc] {
+		if err := t.funcDef(fpc, name, cfg, ipdom); err != nil {
+			return err
+		}
+	}
+	p, err := t.str(pos)
+	if err != nil {
+		return err
+	}
+	return t.event(EnterFuncEvent, goid, uint64(fpc), p)
+}
+
+// ExitFunc records the exit of the goroutine's current call. The label is
+// that of its exit edge: "" for a return, PanicLabel or RecoverLabel.
+func (t *TraceWriter) ExitFunc(goid int64, label string) error {
+	l, err := t.str(label)
+	if err != nil {
+		return err
+	}
+	return t.event(ExitFuncEvent, goid, l)
+}
+
+// Spawned records that the goroutine was started by the go statement in
+// the block from. Its next call is the target of the spawn edge.
+func (t *TraceWriter) Spawned(goid int64, from BlkEntrance) error {
+	return t.event(SpawnEvent, goid, uint64(from.In), uint64(from.BasicBlockId))
+}
+
+// Comm records a communicates-with edge and its channel (see
+// Profile.Channels).
+func (t *TraceWriter) Comm(goid int64, c ChanComm) error {
+	send, err := t.str(c.Send)
+	if err != nil {
+		return err
+	}
+	recv, err := t.str(c.Recv)
+	if err != nil {
+		return err
+	}
+	return t.event(CommEvent, goid,
+		uint64(c.Edge.Src.In), uint64(c.Edge.Src.BasicBlockId),
+		uint64(c.Edge.Targ.In), uint64(c.Edge.Targ.BasicBlockId),
+		send, recv)
+}
+
+// Panic records that a panic started unwinding the goroutine.
+func (t *TraceWriter) Panic(goid int64, site PanicSite) error {
+	typ, err := t.str(site.Type)
+	if err != nil {
+		return err
+	}
+	return t.event(PanicEvent, goid, uint64(site.Blk.In), uint64(site.Blk.BasicBlockId), typ)
+}
+
+// Predicate records that the predicate held.
+func (t *TraceWriter) Predicate(goid int64, pred Predicate) error {
+	ids := make([]uint64, 0, 4)
+	for _, s := range []string{pred.Kind, pred.Site, pred.Expr, pred.Value} {
+		id, err := t.str(s)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	return t.event(PredicateEvent, goid, ids...)
+}
+
+func (t *TraceWriter) GoroutineStart(goid int64) error {
+	return t.event(GoroutineStartEvent, goid)
+}
+
+func (t *TraceWriter) GoroutineExit(goid int64) error {
+	return t.event(GoroutineExitEvent, goid)
+}
+
+func (t *TraceWriter) Fail(goid int64, fnName string, bbid int, pos string) error {
+	n, err := t.str(fnName)
+	if err != nil {
+		return err
+	}
+	p, err := t.str(pos)
+	if err != nil {
+		return err
+	}
+	return t.event(FailEvent, goid, n, uint64(bbid), p)
+}
+
+func (t *TraceWriter) funcDef(fpc uintptr, name string, cfg [][]int, ipdom []int) error {
+	n, err := t.str(name)
+	if err != nil {
+		return err
+	}
+	if err := t.event(FuncDefEvent, 0, uint64(fpc), n, uint64(len(cfg))); err != nil {
+		return err
+	}
+	for _, nexts := range cfg {
+		if err := t.ints(nexts); err != nil {
+			return err
+		}
+	}
+	if err := t.ints(ipdom); err != nil {
+		return err
+	}
+	t.funcs[fpc] = true
+	return nil
+}
+
+// str interns s, writing a StringEvent the first time it is seen.
+func (t *TraceWriter) str(s string) (uint64, error) {
+	if id, has := t.strs[s]; has {
+		return id, nil
+	}
+	id := uint64(len(t.strs))
+	if err := t.event(StringEvent, 0, id, uint64(len(s))); err != nil {
+		return 0, err
+	}
+	if _, err := t.w.WriteString(s); err != nil {
+		return 0, err
+	}
+	t.strs[s] = id
+	return id, nil
+}
+
+func (t *TraceWriter) event(kind EventKind, goid int64, args ...uint64) error {
+	if err := t.w.WriteByte(byte(kind)); err != nil {
+		return err
+	}
+	if err := t.uvarint(uint64(goid)); err != nil {
+		return err
+	}
+	if err := t.uvarint(uint64(time.Since(t.start))); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		if err := t.uvarint(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TraceWriter) ints(xs []int) error {
+	if err := t.uvarint(uint64(len(xs))); err != nil {
+		return err
+	}
+	for _, x := range xs {
+		n := binary.PutVarint(t.buf[:], int64(x))
+		if _, err := t.w.Write(t.buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *TraceWriter) uvarint(x uint64) error {
+	n := binary.PutUvarint(t.buf[:], x)
+	_, err := t.w.Write(t.buf[:n])
+	return err
+}
+
+// TraceReader decodes the events written by a TraceWriter.
+type TraceReader struct {
+	r    *bufio.Reader
+	strs []string
+}
+
+func NewTraceReader(r io.Reader) (*TraceReader, error) {
+	t := &TraceReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(t.r, magic); err != nil {
+		return nil, err
+	}
+	if string(magic) != traceMagic {
+		return nil, fmt.Errorf("not a dynagrok trace, it started with %q", magic)
+	}
+	version, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return nil, err
+	}
+	if version != TraceVersion {
+		return nil, fmt.Errorf("can't read trace version %d (expected %d)", version, TraceVersion)
+	}
+	return t, nil
+}
+
+// Next returns the next event in the trace. It returns io.EOF at the
+// end of a complete trace and io.ErrUnexpectedEOF if the trace was cut
+// off (for instance because the program crashed) in the middle of an
+// event.
+func (t *TraceReader) Next() (*Event, error) {
+	for {
+		kind, err := t.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		e := &Event{Kind: EventKind(kind)}
+		if err := t.header(e); err != nil {
+			return nil, unexpected(err)
+		}
+		if err := t.body(e); err != nil {
+			return nil, unexpected(err)
+		}
+		if e.Kind != StringEvent {
+			return e, nil
+		}
+	}
+}
+
+func (t *TraceReader) header(e *Event) error {
+	goid, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return err
+	}
+	ns, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return err
+	}
+	e.GoID = int64(goid)
+	e.Time = time.Duration(ns)
+	return nil
+}
+
+func (t *TraceReader) body(e *Event) (err error) {
+	switch e.Kind {
+	case StringEvent:
+		return t.readStr()
+	case FuncDefEvent:
+		var fpc uint64
+		var size int
+		if fpc, err = binary.ReadUvarint(t.r); err != nil {
+			return err
+		}
+		if e.Name, err = t.str(); err != nil {
+			return err
+		}
+		if size, err = t.int(); err != nil {
+			return err
+		}
+		e.FuncPc = uintptr(fpc)
+		e.CFG = make([][]int, size)
+		for i := range e.CFG {
+			if e.CFG[i], err = t.ints(); err != nil {
+				return err
+			}
+		}
+		e.IPDom, err = t.ints()
+		return err
+	case EnterBlkEvent:
+		if e.BasicBlockId, err = t.int(); err != nil {
+			return err
+		}
+		e.Pos, err = t.str()
+		return err
+	case EnterFuncEvent:
+		var fpc uint64
+		if fpc, err = binary.ReadUvarint(t.r); err != nil {
+			return err
+		}
+		e.FuncPc = uintptr(fpc)
+		e.Pos, err = t.str()
+		return err
+	case ExitFuncEvent:
+		e.Label, err = t.str()
+		return err
+	case GoroutineStartEvent, GoroutineExitEvent:
+		return nil
+	case SpawnEvent:
+		e.Edge.Src, err = t.blk()
+		return err
+	case CommEvent:
+		if e.Chan.Edge.Src, err = t.blk(); err != nil {
+			return err
+		}
+		if e.Chan.Edge.Targ, err = t.blk(); err != nil {
+			return err
+		}
+		if e.Chan.Send, err = t.str(); err != nil {
+			return err
+		}
+		e.Chan.Recv, err = t.str()
+		return err
+	case PanicEvent:
+		if e.Edge.Src, err = t.blk(); err != nil {
+			return err
+		}
+		e.Name, err = t.str()
+		return err
+	case PredicateEvent:
+		for _, s := range []*string{&e.Predicate.Kind, &e.Predicate.Site, &e.Predicate.Expr, &e.Predicate.Value} {
+			if *s, err = t.str(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FailEvent:
+		if e.Name, err = t.str(); err != nil {
+			return err
+		}
+		if e.BasicBlockId, err = t.int(); err != nil {
+			return err
+		}
+		e.Pos, err = t.str()
+		return err
+	default:
+		return fmt.Errorf("unknown trace event kind %d", e.Kind)
+	}
+}
+
+func (t *TraceReader) readStr() error {
+	id, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return err
+	}
+	if id != uint64(len(t.strs)) {
+		return fmt.Errorf("string %d was defined out of order (expected %d)", id, len(t.strs))
+	}
+	bytes := make([]byte, size)
+	if _, err := io.ReadFull(t.r, bytes); err != nil {
+		return err
+	}
+	t.strs = append(t.strs, string(bytes))
+	return nil
+}
+
+func (t *TraceReader) str() (string, error) {
+	id, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return "", err
+	}
+	if id >= uint64(len(t.strs)) {
+		return "", fmt.Errorf("reference to undefined string %d", id)
+	}
+	return t.strs[id], nil
+}
+
+func (t *TraceReader) blk() (BlkEntrance, error) {
+	in, err := binary.ReadUvarint(t.r)
+	if err != nil {
+		return BlkEntrance{}, err
+	}
+	bbid, err := t.int()
+	return BlkEntrance{In: uintptr(in), BasicBlockId: bbid}, err
+}
+
+func (t *TraceReader) int() (int, error) {
+	x, err := binary.ReadUvarint(t.r)
+	return int(x), err
+}
+
+func (t *TraceReader) ints() ([]int, error) {
+	size, err := t.int()
+	if err != nil {
+		return nil, err
+	}
+	xs := make([]int, size)
+	for i := range xs {
+		x, err := binary.ReadVarint(t.r)
+		if err != nil {
+			return nil, err
+		}
+		xs[i] = int(x)
+	}
+	return xs, nil
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// LoadTrace replays a trace to rebuild the aggregates (flows, calls,
+// positions, durations, functions, the labeled edges, panics and
+// predicates) dgruntime would have written at shutdown. A trace which
+// was cut off by a crash is loaded up to the last complete event.
+// Failure events are not part of a Profile and are skipped; use a
+// TraceReader to see them.
+func LoadTrace(r io.Reader) (*Profile, error) {
+	t, err := NewTraceReader(r)
+	if err != nil {
+		return nil, err
+	}
+	p := NewProfile()
+	defs := make(map[uintptr]*Event)
+	stacks := make(map[int64][]*FuncCall)
+	spawnedAt := make(map[int64]BlkEntrance)
+	preds := make(map[Predicate]int)
+	for {
+		e, err := t.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			p.MergePredicates(preds)
+			return p, nil
+		} else if err != nil {
+			return nil, err
+		}
+		now := time.Time{}.Add(e.Time)
+		switch e.Kind {
+		case FuncDefEvent:
+			defs[e.FuncPc] = e
+		case GoroutineStartEvent:
+			stacks[e.GoID] = []*FuncCall{{Name: "<entry>"}}
+		case GoroutineExitEvent:
+			delete(stacks, e.GoID)
+			delete(spawnedAt, e.GoID)
+		case SpawnEvent:
+			spawnedAt[e.GoID] = e.Edge.Src
+		case CommEvent:
+			p.Comms[e.Chan.Edge]++
+			p.Channels[e.Chan]++
+		case PanicEvent:
+			p.Panicked[PanicSite{Blk: e.Edge.Src, Type: e.Name}]++
+		case PredicateEvent:
+			preds[e.Predicate]++
+		case EnterFuncEvent:
+			def, has := defs[e.FuncPc]
+			if !has {
+				return nil, fmt.Errorf("enter of undefined function 0x%x", e.FuncPc)
+			}
+			stack := stacks[e.GoID]
+			if len(stack) == 0 {
+				stack = []*FuncCall{{Name: "<entry>"}}
+			}
+			caller := stack[len(stack)-1]
+			fc := NewFuncCall(def.Name, def.FuncPc, def.CFG, def.IPDom, now)
+			if from, has := spawnedAt[e.GoID]; has && len(stack) == 1 {
+				delete(spawnedAt, e.GoID)
+				p.Spawns[FlowEdge{Src: from, Targ: fc.Last}]++
+			} else {
+				p.Flows[FlowEdge{Src: caller.Last, Targ: fc.Last}]++
+			}
+			p.Calls[Call{Caller: caller.FuncPc, Callee: fc.FuncPc}]++
+			p.Positions[fc.Last] = e.Pos
+			stacks[e.GoID] = append(stack, fc)
+		case EnterBlkEvent:
+			stack := stacks[e.GoID]
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("goroutine %d entered blk %d outside of a function", e.GoID, e.BasicBlockId)
+			}
+			fc := stack[len(stack)-1]
+			cur := BlkEntrance{In: fc.FuncPc, BasicBlockId: e.BasicBlockId}
+			p.Flows[FlowEdge{Src: fc.Last, Targ: cur}]++
+			p.Positions[cur] = e.Pos
+			p.Durations[fc.Last] += now.Sub(fc.LastTime)
+			fc.Last = cur
+			fc.LastTime = now
+			fc.EnterBlk(e.BasicBlockId)
+		case ExitFuncEvent:
+			stack := stacks[e.GoID]
+			if len(stack) < 2 {
+				return nil, fmt.Errorf("goroutine %d exited a function it never entered", e.GoID)
+			}
+			p.CallCount++
+			fc := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			stacks[e.GoID] = stack
+			ret := stack[len(stack)-1]
+			exits := p.Flows
+			switch e.Label {
+			case PanicLabel:
+				exits = p.Panics
+			case RecoverLabel:
+				exits = p.Recovers
+			}
+			exits[FlowEdge{Src: fc.Last, Targ: ret.Last}]++
+			p.Durations[fc.Last] += now.Sub(fc.LastTime)
+			ret.LastTime = now
+			if f, has := p.Funcs[fc.FuncPc]; has {
+				f.Update(fc)
+			} else {
+				p.Funcs[fc.FuncPc] = NewFunction(fc)
+			}
+		}
+	}
+}
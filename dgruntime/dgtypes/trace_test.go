@@ -0,0 +1,147 @@
+package dgtypes
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// writeTrace writes the trace of a goroutine (1) which calls f, which
+// spawns a goroutine (2) running g, sends to it, evaluates a branch and
+// panics, unwinding f and main.
+func writeTrace(t *testing.T) []byte {
+	var buf bytes.Buffer
+	w, err := NewTraceWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := [][]int{{1}, {}}
+	ipdom := []int{1, 1}
+	f := BlkEntrance{In: 0x10, BasicBlockId: 1}
+	g := BlkEntrance{In: 0x20, BasicBlockId: 0}
+	steps := []func() error{
+		func() error { return w.GoroutineStart(1) },
+		func() error { return w.EnterFunc(1, 0x10, "main.f", "f.go:1:1", cfg, ipdom) },
+		func() error { return w.EnterBlk(1, 1, "f.go:2:2") },
+		func() error { return w.GoroutineStart(2) },
+		func() error { return w.Spawned(2, f) },
+		func() error { return w.EnterFunc(2, 0x20, "main.g", "g.go:1:1", cfg, ipdom) },
+		func() error {
+			return w.Comm(1, ChanComm{Edge: FlowEdge{Src: f, Targ: g}, Send: "ch chan int", Recv: "ch <-chan int"})
+		},
+		func() error { return w.ExitFunc(2, "") },
+		func() error { return w.GoroutineExit(2) },
+		func() error {
+			return w.Predicate(1, Predicate{Kind: BranchPredicate, Site: "f.go:3:5", Expr: "x < y", Value: "true"})
+		},
+		func() error { return w.Panic(1, PanicSite{Blk: f, Type: "string"}) },
+		func() error { return w.Fail(1, "main.f", 1, "f.go:2:2") },
+		func() error { return w.ExitFunc(1, PanicLabel) },
+		func() error { return w.GoroutineExit(1) },
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTraceRoundTrip(t *testing.T) {
+	r, err := NewTraceReader(bytes.NewReader(writeTrace(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := BlkEntrance{In: 0x10, BasicBlockId: 1}
+	g := BlkEntrance{In: 0x20, BasicBlockId: 0}
+	expected := []Event{
+		{Kind: GoroutineStartEvent, GoID: 1},
+		{Kind: FuncDefEvent, FuncPc: 0x10, Name: "main.f", CFG: [][]int{{1}, {}}, IPDom: []int{1, 1}},
+		{Kind: EnterFuncEvent, GoID: 1, FuncPc: 0x10, Pos: "f.go:1:1"},
+		{Kind: EnterBlkEvent, GoID: 1, BasicBlockId: 1, Pos: "f.go:2:2"},
+		{Kind: GoroutineStartEvent, GoID: 2},
+		{Kind: SpawnEvent, GoID: 2, Edge: FlowEdge{Src: f}},
+		{Kind: FuncDefEvent, FuncPc: 0x20, Name: "main.g", CFG: [][]int{{1}, {}}, IPDom: []int{1, 1}},
+		{Kind: EnterFuncEvent, GoID: 2, FuncPc: 0x20, Pos: "g.go:1:1"},
+		{Kind: CommEvent, GoID: 1, Chan: ChanComm{Edge: FlowEdge{Src: f, Targ: g}, Send: "ch chan int", Recv: "ch <-chan int"}},
+		{Kind: ExitFuncEvent, GoID: 2},
+		{Kind: GoroutineExitEvent, GoID: 2},
+		{Kind: PredicateEvent, GoID: 1, Predicate: Predicate{Kind: BranchPredicate, Site: "f.go:3:5", Expr: "x < y", Value: "true"}},
+		{Kind: PanicEvent, GoID: 1, Edge: FlowEdge{Src: f}, Name: "string"},
+		{Kind: FailEvent, GoID: 1, Name: "main.f", BasicBlockId: 1, Pos: "f.go:2:2"},
+		{Kind: ExitFuncEvent, GoID: 1, Label: PanicLabel},
+		{Kind: GoroutineExitEvent, GoID: 1},
+	}
+	for i, exp := range expected {
+		e, err := r.Next()
+		if err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		e.Time = 0
+		if !reflect.DeepEqual(*e, exp) {
+			t.Errorf("event %d: expected %+v got %+v", i, exp, *e)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expected the end of the trace got %v", err)
+	}
+}
+
+func TestLoadTrace(t *testing.T) {
+	p, err := LoadTrace(bytes.NewReader(writeTrace(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := BlkEntrance{}
+	f0 := BlkEntrance{In: 0x10, BasicBlockId: 0}
+	f1 := BlkEntrance{In: 0x10, BasicBlockId: 1}
+	g0 := BlkEntrance{In: 0x20, BasicBlockId: 0}
+	if exp := map[FlowEdge]int{{Src: entry, Targ: f0}: 1, {Src: f0, Targ: f1}: 1, {Src: g0, Targ: entry}: 1}; !reflect.DeepEqual(p.Flows, exp) {
+		t.Errorf("expected flows %v got %v", exp, p.Flows)
+	}
+	if exp := map[FlowEdge]int{{Src: f1, Targ: g0}: 1}; !reflect.DeepEqual(p.Spawns, exp) {
+		t.Errorf("expected spawns %v got %v", exp, p.Spawns)
+	}
+	if exp := map[FlowEdge]int{{Src: f1, Targ: g0}: 1}; !reflect.DeepEqual(p.Comms, exp) {
+		t.Errorf("expected comms %v got %v", exp, p.Comms)
+	}
+	if exp := map[ChanComm]int{{Edge: FlowEdge{Src: f1, Targ: g0}, Send: "ch chan int", Recv: "ch <-chan int"}: 1}; !reflect.DeepEqual(p.Channels, exp) {
+		t.Errorf("expected channels %v got %v", exp, p.Channels)
+	}
+	if exp := map[FlowEdge]int{{Src: f1, Targ: entry}: 1}; !reflect.DeepEqual(p.Panics, exp) {
+		t.Errorf("expected panics %v got %v", exp, p.Panics)
+	}
+	if exp := map[PanicSite]int{{Blk: f1, Type: "string"}: 1}; !reflect.DeepEqual(p.Panicked, exp) {
+		t.Errorf("expected panicked %v got %v", exp, p.Panicked)
+	}
+	pred := Predicate{Kind: BranchPredicate, Site: "f.go:3:5", Expr: "x < y", Value: "true"}
+	if p.Predicates[pred] != 1 || len(p.Predicates) != 1 {
+		t.Errorf("expected the predicate %v once got %v", pred, p.Predicates)
+	}
+	if p.CallCount != 2 {
+		t.Errorf("expected 2 calls got %d", p.CallCount)
+	}
+}
+
+// A trace cut off in the middle of an event loads up to the last
+// complete event.
+func TestLoadTruncatedTrace(t *testing.T) {
+	trace := writeTrace(t)
+	cut := false
+	for n := len(trace) - 1; n > len(trace)/2; n-- {
+		p, err := LoadTrace(bytes.NewReader(trace[:n]))
+		if err != nil {
+			t.Fatalf("cut at %d: %v", n, err)
+		}
+		if len(p.Panicked) == 1 && len(p.Panics) == 0 {
+			cut = true
+		}
+	}
+	if !cut {
+		t.Errorf("expected a cut with the panic loaded but not the panicking exit")
+	}
+}
@@ -31,8 +31,10 @@ func NewPrimitiveType(typ reflect.Type) *PrimitiveType {
 		return &PrimitiveType{Tname: "Bool"}
 	case reflect.String:
 		return &PrimitiveType{Tname: "string"}
-	case reflect.Float64:
+	case reflect.Float32, reflect.Float64:
 		return &PrimitiveType{Tname: "float"}
+	case reflect.Complex64, reflect.Complex128:
+		return &PrimitiveType{Tname: "complex"}
 	default:
 		panic("Unrecognizable type")
 	}
@@ -140,6 +142,10 @@ func newType(typ reflect.Type) Type {
 		reflect.Uint32,
 		reflect.Uint64,
 		reflect.Uintptr,
+		reflect.Float32,
+		reflect.Float64,
+		reflect.Complex64,
+		reflect.Complex128,
 		reflect.String,
 		reflect.Bool:
 		return NewPrimitiveType(typ)
@@ -152,13 +158,16 @@ func newType(typ reflect.Type) Type {
 	case reflect.Array, reflect.Slice:
 		return NewCollectionType(typ)
 	default:
-		//panic(fmt.Errorf("%v has unidentified Kind %v", i, vType.Kind()))
-		return nil
-
+		// maps, chans, funcs and unsafe pointers are only known by name
+		return &PrimitiveType{Tname: typ.String()}
 	}
 }
 
+// NewType is the type of i or nil if i is a nil interface{}.
 func NewType(i interface{}) Type {
 	typ := reflect.TypeOf(i)
+	if typ == nil {
+		return nil
+	}
 	return newType(typ)
 }
@@ -9,10 +9,33 @@ import (
 	"hash"
 	"math"
 	"reflect"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// Depth is the default number of levels (of pointers, fields, elements,
+// ...) of a value NewVal copies.
 const Depth = 7
 
+// A Budget bounds how much of a value NewVal copies. Whatever is past the
+// budget is an ElidedValue (or left out of a string).
+type Budget struct {
+	Depth  int // levels of pointers, fields, elements, ... copied
+	Elems  int // elements of an array, slice or map copied
+	String int // bytes of a string copied
+}
+
+// DefaultBudget is the budget of the values whose types are not in
+// Budgets.
+var DefaultBudget = Budget{Depth: Depth, Elems: 64, String: 256}
+
+// Budgets replaces the budget for the values of the named types (as named
+// by reflect.Type.String(), eg. "*main.Node") and everything in them. Set
+// it before the program starts recording values.
+var Budgets = map[string]Budget{}
+
 type Kind uint
 
 const (
@@ -40,8 +63,44 @@ const (
 	Struct
 	Other
 	Zero // nil value
+	Float32
+	Float64
+	Complex64
+	Complex128
+	Chan
+	UnsafePointer
 )
 
+// kinds maps the reflect kinds to ours.
+var kinds = map[reflect.Kind]Kind{
+	reflect.Bool:          Bool,
+	reflect.Int:           Int,
+	reflect.Int8:          Int8,
+	reflect.Int16:         Int16,
+	reflect.Int32:         Int32,
+	reflect.Int64:         Int64,
+	reflect.Uint:          UInt,
+	reflect.Uint8:         UInt8,
+	reflect.Uint16:        UInt16,
+	reflect.Uint32:        UInt32,
+	reflect.Uint64:        UInt64,
+	reflect.Uintptr:       UIntptr,
+	reflect.Float32:       Float32,
+	reflect.Float64:       Float64,
+	reflect.Complex64:     Complex64,
+	reflect.Complex128:    Complex128,
+	reflect.Array:         Array,
+	reflect.Chan:          Chan,
+	reflect.Func:          Func,
+	reflect.Interface:     Interface,
+	reflect.Map:           Map,
+	reflect.Ptr:           Pointer,
+	reflect.Slice:         Slice,
+	reflect.String:        String,
+	reflect.Struct:        Struct,
+	reflect.UnsafePointer: UnsafePointer,
+}
+
 type Reference interface {
 	IsNil() bool
 }
@@ -55,46 +114,104 @@ type Value interface {
 	Dissimilar(Value) float64
 }
 
+// The JSONType of each value, see valueFromRaw.
+const (
+	intType       = "IntValue"
+	floatType     = "FloatValue"
+	complexType   = "ComplexValue"
+	stringType    = "StringValue"
+	boolType      = "BoolValue"
+	structType    = "StructValue"
+	referenceType = "ReferenceValue"
+	arrayType     = "ArrayValue"
+	mapType       = "MapValue"
+	chanType      = "ChanValue"
+	funcType      = "FuncValue"
+	nilType       = "NilValue"
+	elidedType    = "ElidedValue"
+)
+
+// Dissimilar is a.Dissimilar(b) for values which may be nil or of
+// different types (which are entirely dissimilar).
+func Dissimilar(a, b Value) float64 {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil || b == nil:
+		return 1
+	case reflect.TypeOf(a) != reflect.TypeOf(b) || a.TypeName() != b.TypeName():
+		return 1
+	}
+	return a.Dissimilar(b)
+}
+
+// NumberDissimilar is the difference of a and b relative to their
+// magnitudes, between 0 and 1. NaNs are only similar to NaNs and
+// infinities to themselves.
+func NumberDissimilar(a, b float64) float64 {
+	switch {
+	case a == b || (a != a && b != b):
+		return 0
+	case a != a || b != b || math.IsInf(a, 0) || math.IsInf(b, 0):
+		return 1
+	}
+	return math.Abs(a-b) / (math.Abs(a) + math.Abs(b))
+}
+
+// iface is the value as an interface{} or nil if it was read through an
+// unexported field.
+func iface(v reflect.Value) interface{} {
+	if v.CanInterface() {
+		return v.Interface()
+	}
+	return nil
+}
+
 // {{{ IntValue
 type IntValue struct {
-	kind     Kind
+	ValKind  Kind
 	Val      uint64
 	JSONType string
 }
 
-const intType = "IntValue"
-
 func IntVal(i interface{}) *IntValue {
-	switch x := i.(type) {
-	case int8:
-		return &IntValue{kind: Int8, Val: uint64(x), JSONType: intType}
-	case uint8:
-		return &IntValue{kind: UInt8, Val: uint64(x), JSONType: intType}
-	case int16:
-		return &IntValue{kind: Int16, Val: uint64(x), JSONType: intType}
-	case uint16:
-		return &IntValue{kind: UInt16, Val: uint64(x), JSONType: intType}
-	case int32:
-		return &IntValue{kind: Int32, Val: uint64(x), JSONType: intType}
-	case uint32:
-		return &IntValue{kind: UInt32, Val: uint64(x), JSONType: intType}
-	case int64:
-		return &IntValue{kind: Int64, Val: uint64(x), JSONType: intType}
-	case uint64:
-		return &IntValue{kind: UInt64, Val: uint64(x), JSONType: intType}
-	case int:
-		return &IntValue{kind: Int, Val: uint64(x), JSONType: intType}
-	case uint:
-		return &IntValue{kind: UInt, Val: uint64(x), JSONType: intType}
-	case uintptr:
-		return &IntValue{kind: UIntptr, Val: uint64(x), JSONType: intType}
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return intVal(v)
 	default:
 		panic(fmt.Errorf("%v should have been an int got %T", i, i))
 	}
 }
 
+func intVal(v reflect.Value) *IntValue {
+	i := &IntValue{ValKind: kinds[v.Kind()], JSONType: intType}
+	if i.signed() {
+		i.Val = uint64(v.Int())
+	} else {
+		i.Val = v.Uint()
+	}
+	return i
+}
+
+func (i *IntValue) signed() bool {
+	switch i.ValKind {
+	case Int, Int8, Int16, Int32, Int64, Invalid:
+		return true
+	}
+	return false
+}
+
+func (i *IntValue) float() float64 {
+	if i.signed() {
+		return float64(int64(i.Val))
+	}
+	return float64(i.Val)
+}
+
 func (i *IntValue) Kind() Kind {
-	return i.kind
+	return i.ValKind
 }
 
 func (i *IntValue) LevelHash(h hash.Hash, n int) {
@@ -105,7 +222,7 @@ func (i *IntValue) LevelHash(h hash.Hash, n int) {
 }
 
 func (i *IntValue) Value() interface{} {
-	switch i.kind {
+	switch i.ValKind {
 	case Int8:
 		return int8(i.Val)
 	case UInt8:
@@ -129,12 +246,13 @@ func (i *IntValue) Value() interface{} {
 	case UIntptr:
 		return uintptr(i.Val)
 	default:
-		panic(fmt.Errorf("%v should have been an int got %T", i, i))
+		// loaded from a profile which did not record the kind
+		return int64(i.Val)
 	}
 }
 
 func (i *IntValue) String() string {
-	return fmt.Sprintf("%d", i.Val)
+	return fmt.Sprintf("%d", i.Value())
 }
 
 func (i *IntValue) TypeName() string {
@@ -143,10 +261,7 @@ func (i *IntValue) TypeName() string {
 
 func (i *IntValue) Dissimilar(o Value) float64 {
 	if other, ok := o.(*IntValue); ok {
-		score := math.Abs(math.Abs(float64(i.Val-other.Val)) / (math.Abs(float64(math.MaxUint64))))
-		//score := math.Abs(math.Log(math.Abs(float64(i.Val-other.Val))) - math.Log(math.Abs(float64(math.MaxUint64))))
-		//fmt.Printf("Dis(%v, %v) = %v", i, other, score)
-		return score
+		return NumberDissimilar(i.float(), other.float())
 	} else {
 		panic("Dissimilar shoud be called on type int")
 	}
@@ -154,21 +269,147 @@ func (i *IntValue) Dissimilar(o Value) float64 {
 
 // }}}
 
+// {{{ FloatValue
+type FloatValue struct {
+	Val       float64
+	NonFinite string `json:",omitempty"` // "NaN", "+Inf" or "-Inf" which JSON lacks
+	Bits      int
+	JSONType  string
+}
+
+func floatVal(f float64, bits int) *FloatValue {
+	v := &FloatValue{Bits: bits, JSONType: floatType}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		v.NonFinite = strconv.FormatFloat(f, 'g', -1, 64)
+	} else {
+		v.Val = f
+	}
+	return v
+}
+
+func (f *FloatValue) float() float64 {
+	if f.NonFinite != "" {
+		x, _ := strconv.ParseFloat(f.NonFinite, 64)
+		return x
+	}
+	return f.Val
+}
+
+func (f *FloatValue) Kind() Kind {
+	if f.Bits == 32 {
+		return Float32
+	}
+	return Float64
+}
+
+func (f *FloatValue) LevelHash(h hash.Hash, n int) {
+	if n <= 0 {
+		return
+	}
+	binary.Write(h, binary.BigEndian, math.Float64bits(f.float()))
+}
+
+func (f *FloatValue) Value() interface{} {
+	if f.Bits == 32 {
+		return float32(f.float())
+	}
+	return f.float()
+}
+
+func (f *FloatValue) String() string {
+	return strconv.FormatFloat(f.float(), 'g', -1, 64)
+}
+
+func (f *FloatValue) TypeName() string {
+	return "float"
+}
+
+func (f *FloatValue) Dissimilar(o Value) float64 {
+	if other, ok := o.(*FloatValue); ok {
+		return NumberDissimilar(f.float(), other.float())
+	}
+	panic("Should have been type float")
+}
+
+// }}}
+
+// {{{ ComplexValue
+type ComplexValue struct {
+	Real     *FloatValue
+	Imag     *FloatValue
+	JSONType string
+}
+
+func complexVal(c complex128, bits int) *ComplexValue {
+	return &ComplexValue{
+		Real:     floatVal(real(c), bits/2),
+		Imag:     floatVal(imag(c), bits/2),
+		JSONType: complexType,
+	}
+}
+
+func (c *ComplexValue) Kind() Kind {
+	if c.Real.Bits == 32 {
+		return Complex64
+	}
+	return Complex128
+}
+
+func (c *ComplexValue) LevelHash(h hash.Hash, n int) {
+	c.Real.LevelHash(h, n)
+	c.Imag.LevelHash(h, n)
+}
+
+func (c *ComplexValue) Value() interface{} {
+	x := complex(c.Real.float(), c.Imag.float())
+	if c.Real.Bits == 32 {
+		return complex64(x)
+	}
+	return x
+}
+
+func (c *ComplexValue) String() string {
+	return fmt.Sprintf("(%v%+vi)", c.Real, c.Imag.float())
+}
+
+func (c *ComplexValue) TypeName() string {
+	return "complex"
+}
+
+func (c *ComplexValue) Dissimilar(o Value) float64 {
+	if other, ok := o.(*ComplexValue); ok {
+		return (c.Real.Dissimilar(other.Real) + c.Imag.Dissimilar(other.Imag)) / 2
+	}
+	panic("Should have been type complex")
+}
+
+// }}}
+
 // {{{ StringValue
 type StringValue struct {
 	Val      string
+	Len      int `json:",omitempty"` // the length of a string cut short
 	JSONType string
 }
 
 func StringVal(i interface{}) *StringValue {
 	if x, ok := i.(string); ok {
-		var s StringValue = StringValue{Val: x, JSONType: "StringValue"}
+		var s StringValue = StringValue{Val: x, JSONType: stringType}
 		return &s
 	} else {
 		panic(fmt.Errorf("%v should have been a string got %T", i, i))
 	}
 }
 
+func stringVal(v reflect.Value, b Budget) *StringValue {
+	s := &StringValue{Val: v.String(), JSONType: stringType}
+	if len(s.Val) > b.String {
+		s.Len = len(s.Val)
+		s.Val = s.Val[:b.String]
+	}
+	return s
+}
+
 func (s *StringValue) Kind() Kind {
 	return String
 }
@@ -178,6 +419,9 @@ func (s *StringValue) Value() interface{} {
 }
 
 func (s *StringValue) String() string {
+	if s.Len > len(s.Val) {
+		return fmt.Sprintf("%s...(%d bytes)", s.Val, s.Len)
+	}
 	return s.Val
 }
 
@@ -196,12 +440,12 @@ func (s *StringValue) Dissimilar(o Value) float64 {
 		if len(other.Val) > len(s.Val) {
 			length = len(other.Val)
 		}
+		if length == 0 {
+			return 0
+		}
 		// TODO Perform Hamming distance
-		for i, l := range s.Val {
-			if i == len(other.Val) {
-				break
-			}
-			if l != []rune(other.Val)[i] {
+		for i := 0; i < len(s.Val) && i < len(other.Val); i++ {
+			if s.Val[i] != other.Val[i] {
 				score += 1 / float64(length)
 			}
 		}
@@ -222,7 +466,7 @@ type BoolValue struct {
 
 func BoolVal(i interface{}) *BoolValue {
 	if x, ok := i.(bool); ok {
-		var b BoolValue = BoolValue{Val: x, JSONType: "BoolValue"}
+		var b BoolValue = BoolValue{Val: x, JSONType: boolType}
 		return &b
 	} else {
 		panic(fmt.Errorf("%v should have been a bool got %T", i, i))
@@ -281,29 +525,17 @@ type StructValue struct {
 
 func StructVal(i interface{}) *StructValue {
 	v := reflect.ValueOf(i)
-	fields := make([]Field, 0)
-	vType := v.Type()
-
-	if vType.Kind() != reflect.Struct {
-		panic(fmt.Errorf("%v should have been Struct, was %s", i, vType.Name()))
+	if v.Kind() != reflect.Struct {
+		panic(fmt.Errorf("%v should have been Struct, was %T", i, i))
 	}
-
-	for i := 0; i < v.NumField(); i++ {
-		f := v.Field(i)
-		name := vType.Field(i).Name
-		if f.CanInterface() { // f.Interface() will fail otherwise
-			fields = append(fields, Field{Name: name, exported: true, Val: NewVal(f.Interface())})
-		} else {
-			fields = append(fields, Field{Name: name, exported: false,
-				Val: nil})
-		}
-	}
-	return &StructValue{TypName: vType.Name(), Fields: fields, val: i, JSONType: "StructValue"}
+	return newWalker().value(v, DefaultBudget).(*StructValue)
 }
 
 func (s *StructValue) LevelHash(h hash.Hash, n int) {
 	for _, f := range s.Fields {
-		f.Val.LevelHash(h, n-1)
+		if f.Val != nil {
+			f.Val.LevelHash(h, n-1)
+		}
 	}
 }
 
@@ -340,16 +572,16 @@ func (s *StructValue) Dissimilar(v Value) float64 {
 		if s.TypName != other.TypName {
 			panic("Cannot compute similarity between structs of different type")
 		}
-		for i := range s.Fields {
-			if sf, ok := s.Fields[i].Val.(Reference); ok {
-				of, _ := other.Fields[i].Val.(Reference)
-				if sf.IsNil() && !of.IsNil() ||
-					!sf.IsNil() && of.IsNil() {
-					score += 1 / float64(len(s.Fields))
-				}
-			} else {
-				score += s.Fields[i].Val.Dissimilar(other.Fields[i].Val) / float64(len(s.Fields))
+		n := len(s.Fields)
+		if len(other.Fields) > n {
+			n = len(other.Fields)
+		}
+		for i := 0; i < n; i++ {
+			if i >= len(s.Fields) || i >= len(other.Fields) {
+				score += 1 / float64(n)
+				continue
 			}
+			score += Dissimilar(s.Fields[i].Val, other.Fields[i].Val) / float64(n)
 		}
 		return score
 	}
@@ -369,38 +601,39 @@ func (f Field) String() string {
 }
 
 // {{{ ReferenceValue
+
+// A ReferenceValue is a pointer, an unsafe.Pointer or an interface (held
+// in a field, element, ...) and the value it refers to. Cycle is set
+// instead of Elem when the pointer refers back to a value which is being
+// copied.
 type ReferenceValue struct {
 	JSONType string
 	val      interface{}
 	Typename string
 	Elem     Value
-	kind     Kind
+	ValKind  Kind
+	Nil      bool
+	Cycle    bool `json:",omitempty"`
 }
 
 func ReferenceVal(i interface{}) *ReferenceValue {
 	val := reflect.ValueOf(i)
-	if val.IsNil() {
-		return &ReferenceValue{val: i, Elem: nil, kind: Pointer, Typename: "*" + val.Type().Name(), JSONType: "ReferenceValue"}
-	}
-	elem := NewVal(val.Elem().Interface())
 	switch val.Kind() {
-	case reflect.Ptr:
-		return &ReferenceValue{val: i, Elem: elem, kind: Pointer, Typename: "*" + elem.TypeName(), JSONType: "ReferenceValue"}
-	case reflect.Interface:
-		// TODO determine the typename for interfaces
-		return &ReferenceValue{val: i, Elem: elem, kind: Interface, Typename: "I*" + elem.TypeName(), JSONType: "ReferenceValue"}
+	case reflect.Ptr, reflect.Interface, reflect.UnsafePointer:
+		return newWalker().value(val, DefaultBudget).(*ReferenceValue)
 	default:
 		panic(fmt.Errorf("%v should be a reference, is %T", i, i))
 	}
-	panic("This code should be unreachable")
 }
 
 func (r *ReferenceValue) Kind() Kind {
-	return r.kind
+	return r.ValKind
 }
 
 func (r *ReferenceValue) LevelHash(h hash.Hash, i int) {
-	r.LevelHash(h, i)
+	if r.Elem != nil {
+		r.Elem.LevelHash(h, i-1)
+	}
 }
 
 func (r *ReferenceValue) Value() interface{} {
@@ -408,8 +641,13 @@ func (r *ReferenceValue) Value() interface{} {
 }
 
 func (r *ReferenceValue) String() string {
-	if r.Elem == nil {
+	switch {
+	case r.Nil:
 		return "<nil>"
+	case r.Cycle:
+		return "<cycle>"
+	case r.Elem == nil:
+		return "<...>"
 	}
 	return r.Elem.String()
 }
@@ -419,12 +657,20 @@ func (r *ReferenceValue) TypeName() string {
 }
 
 func (r *ReferenceValue) IsNil() bool {
-	return r.val == nil
+	return r.Nil
 }
 
 func (r *ReferenceValue) Dissimilar(v Value) float64 {
 	if other, ok := v.(*ReferenceValue); ok {
-		return r.Elem.Dissimilar(other.Elem)
+		switch {
+		case r.Nil && other.Nil:
+			return 0
+		case r.Nil != other.Nil || r.Cycle != other.Cycle:
+			return 1
+		case r.Cycle:
+			return 0
+		}
+		return Dissimilar(r.Elem, other.Elem)
 	}
 	panic("Should have been ReferenceValue")
 }
@@ -432,35 +678,41 @@ func (r *ReferenceValue) Dissimilar(v Value) float64 {
 // }}}
 
 // {{{ ArrayValue
+
+// An ArrayValue is an array or a slice. Only the first Budget.Elems of
+// its Len elements are copied.
 type ArrayValue struct {
 	ElemType string
 	Val      []Value
 	val      interface{}
-	size     int
+	Len      int
+	Slice    bool `json:",omitempty"`
+	Nil      bool `json:",omitempty"`
 	JSONType string
 }
 
 func ArrayVal(i interface{}) *ArrayValue {
-	x := reflect.ValueOf(i)
-	vals := make([]Value, x.Len())
-	for k := range vals {
-		vals[k] = NewVal(x.Index(k).Interface())
-	}
-	if x.Len() > 0 {
-		t := vals[0].TypeName()
-		return &ArrayValue{Val: vals, val: i, size: x.Len(), ElemType: t, JSONType: "ArrayValue"}
-	} else {
-		return &ArrayValue{Val: vals, val: i, size: x.Len(), JSONType: "ArrayValue"}
+	v := reflect.ValueOf(i)
+	switch v.Kind() {
+	case reflect.Array, reflect.Slice:
+		return newWalker().value(v, DefaultBudget).(*ArrayValue)
+	default:
+		panic(fmt.Errorf("%v should have been an array or slice got %T", i, i))
 	}
 }
 
 func (a *ArrayValue) Kind() Kind {
+	if a.Slice {
+		return Slice
+	}
 	return Array
 }
 
 func (a *ArrayValue) LevelHash(h hash.Hash, i int) {
 	for _, v := range a.Val {
-		v.LevelHash(h, i)
+		if v != nil {
+			v.LevelHash(h, i)
+		}
 	}
 }
 
@@ -471,43 +723,56 @@ func (a *ArrayValue) Value() interface{} {
 func (a *ArrayValue) String() string {
 	str := "{"
 	if len(a.Val) > 0 {
-		str = fmt.Sprintf("%v%v", str, a.Val[0].String())
+		str = fmt.Sprintf("%v%v", str, a.Val[0])
 	}
 	for i, v := range a.Val {
 		if i == 0 {
 			continue
 		}
-		str = fmt.Sprintf("%v, %v", str, v.String())
+		str = fmt.Sprintf("%v, %v", str, v)
+	}
+	if a.Len > len(a.Val) {
+		str = fmt.Sprintf("%v, ...(%d elems)", str, a.Len)
 	}
 	str = fmt.Sprintf("%v}", str)
 	return str
 }
 
 func (a *ArrayValue) IsNil() bool {
-	return a.val == nil
+	return a.Nil
 }
 
 func (a *ArrayValue) TypeName() string {
 	return fmt.Sprintf("[]%v", a.ElemType)
 }
 
+// length is Len or, for an ArrayValue loaded from a profile which did not
+// record it, the number of elements.
+func (a *ArrayValue) length() int {
+	if a.Len < len(a.Val) {
+		return len(a.Val)
+	}
+	return a.Len
+}
+
 func (a *ArrayValue) Dissimilar(v Value) float64 {
 	score := 0.0
 	if other, ok := v.(*ArrayValue); ok {
-		length := len(a.Val)
-		if len(other.Val) > len(a.Val) {
-			length = len(other.Val)
+		if a.Nil != other.Nil {
+			return 1
+		}
+		length := a.length()
+		if other.length() > length {
+			length = other.length()
+		}
+		if length == 0 {
+			return 0
 		}
 		// TODO Perform Hamming distance
-		for i, l := range a.Val {
-			if i == len(other.Val) {
-				break
-			}
-			if l != other.Val[i] {
-				score += 1 / float64(length)
-			}
+		for i := 0; i < len(a.Val) && i < len(other.Val); i++ {
+			score += Dissimilar(a.Val[i], other.Val[i]) / float64(length)
 		}
-		score += math.Abs(float64(len(a.Val)-len(other.Val))) / float64(length)
+		score += math.Abs(float64(a.length()-other.length())) / float64(length)
 		return score
 	}
 	panic("Should have been array or slice type")
@@ -515,45 +780,545 @@ func (a *ArrayValue) Dissimilar(v Value) float64 {
 
 // }}}
 
+// {{{ MapValue
+
+// A MapValue is a map. Only the Budget.Elems entries with the least keys
+// (of its Len entries) are copied, ordered by their keys.
+type MapValue struct {
+	TypName  string
+	Keys     []Value
+	Vals     []Value
+	Len      int
+	Nil      bool `json:",omitempty"`
+	JSONType string
+}
+
+func (m *MapValue) Kind() Kind {
+	return Map
+}
+
+func (m *MapValue) LevelHash(h hash.Hash, n int) {
+	for i := range m.Keys {
+		if m.Keys[i] != nil {
+			m.Keys[i].LevelHash(h, n-1)
+		}
+		if m.Vals[i] != nil {
+			m.Vals[i].LevelHash(h, n-1)
+		}
+	}
+}
+
+func (m *MapValue) Value() interface{} {
+	return nil
+}
+
+func (m *MapValue) String() string {
+	if m.Nil {
+		return "map[]<nil>"
+	}
+	str := "map["
+	for i := range m.Keys {
+		if i != 0 {
+			str += ", "
+		}
+		str = fmt.Sprintf("%v%v: %v", str, m.Keys[i], m.Vals[i])
+	}
+	if m.Len > len(m.Keys) {
+		str = fmt.Sprintf("%v, ...(%d entries)", str, m.Len)
+	}
+	return str + "]"
+}
+
+func (m *MapValue) TypeName() string {
+	return m.TypName
+}
+
+func (m *MapValue) IsNil() bool {
+	return m.Nil
+}
+
+// Dissimilar matches the entries by key. An entry only one of the maps
+// has is entirely dissimilar.
+func (m *MapValue) Dissimilar(v Value) float64 {
+	if other, ok := v.(*MapValue); ok {
+		if m.Nil != other.Nil {
+			return 1
+		}
+		entries := make(map[string]int, len(other.Keys))
+		for i, k := range other.Keys {
+			entries[fmt.Sprint(k)] = i
+		}
+		union := len(other.Keys)
+		score := 0.0
+		for i, k := range m.Keys {
+			j, has := entries[fmt.Sprint(k)]
+			if !has {
+				union++
+				score++
+				continue
+			}
+			score += Dissimilar(m.Vals[i], other.Vals[j])
+		}
+		if union == 0 {
+			return 0
+		}
+		score += float64(union - len(m.Keys))
+		return score / float64(union)
+	}
+	panic("Should have been type map")
+}
+
+// }}}
+
+// {{{ ChanValue
+type ChanValue struct {
+	TypName  string
+	Len      int
+	Cap      int
+	Nil      bool `json:",omitempty"`
+	JSONType string
+}
+
+func (c *ChanValue) Kind() Kind {
+	return Chan
+}
+
+func (c *ChanValue) LevelHash(h hash.Hash, n int) {
+	binary.Write(h, binary.BigEndian, int64(c.Len))
+}
+
+func (c *ChanValue) Value() interface{} {
+	return nil
+}
+
+func (c *ChanValue) String() string {
+	if c.Nil {
+		return fmt.Sprintf("%v(<nil>)", c.TypName)
+	}
+	return fmt.Sprintf("%v(%d/%d)", c.TypName, c.Len, c.Cap)
+}
+
+func (c *ChanValue) TypeName() string {
+	return c.TypName
+}
+
+func (c *ChanValue) IsNil() bool {
+	return c.Nil
+}
+
+func (c *ChanValue) Dissimilar(v Value) float64 {
+	if other, ok := v.(*ChanValue); ok {
+		switch {
+		case c.Nil != other.Nil:
+			return 1
+		case c.Len == other.Len:
+			return 0
+		}
+		return NumberDissimilar(float64(c.Len), float64(other.Len))
+	}
+	panic("Should have been type chan")
+}
+
+// }}}
+
 // {{{ FuncValue
 type FuncValue struct {
-	name     string
-	inTypes  []Type
-	outTypes []Type
+	TypName  string
+	Name     string // the name of the function (or closure)
+	Nil      bool   `json:",omitempty"`
+	JSONType string
+}
+
+func (f *FuncValue) Kind() Kind {
+	return Func
+}
+
+func (f *FuncValue) LevelHash(h hash.Hash, n int) {
+	h.Write([]byte(f.Name))
+}
+
+func (f *FuncValue) Value() interface{} {
+	return nil
+}
+
+func (f *FuncValue) String() string {
+	if f.Nil {
+		return "<nil>"
+	}
+	return f.Name
+}
+
+func (f *FuncValue) TypeName() string {
+	return f.TypName
+}
+
+func (f *FuncValue) IsNil() bool {
+	return f.Nil
+}
+
+func (f *FuncValue) Dissimilar(v Value) float64 {
+	if other, ok := v.(*FuncValue); ok {
+		if f.Nil == other.Nil && f.Name == other.Name {
+			return 0
+		}
+		return 1
+	}
+	panic("Should have been type func")
+}
+
+// }}}
+
+// {{{ NilValue
+
+// A NilValue is a nil interface{}, which has no type.
+type NilValue struct {
+	JSONType string
+}
+
+func (n *NilValue) Kind() Kind {
+	return Zero
+}
+
+func (n *NilValue) LevelHash(h hash.Hash, i int) {
+	h.Write([]byte("nil"))
+}
+
+func (n *NilValue) Value() interface{} {
+	return nil
+}
+
+func (n *NilValue) String() string {
+	return "<nil>"
+}
+
+func (n *NilValue) TypeName() string {
+	return "nil"
+}
+
+func (n *NilValue) IsNil() bool {
+	return true
+}
+
+func (n *NilValue) Dissimilar(v Value) float64 {
+	if _, ok := v.(*NilValue); ok {
+		return 0
+	}
+	panic("Should have been type nil")
+}
+
+// }}}
+
+// {{{ ElidedValue
+
+// An ElidedValue stands for a value past the depth of its Budget.
+type ElidedValue struct {
+	TypName  string
+	ValKind  Kind
+	JSONType string
+}
+
+func (e *ElidedValue) Kind() Kind {
+	return e.ValKind
+}
+
+func (e *ElidedValue) LevelHash(h hash.Hash, n int) {}
+
+func (e *ElidedValue) Value() interface{} {
+	return nil
+}
+
+func (e *ElidedValue) String() string {
+	return "..."
+}
+
+func (e *ElidedValue) TypeName() string {
+	return e.TypName
+}
+
+func (e *ElidedValue) Dissimilar(v Value) float64 {
+	if _, ok := v.(*ElidedValue); ok {
+		return 0
+	}
+	panic("Should have been type elided")
 }
 
 // }}}
 
+// A walker copies a value for NewVal. path holds the pointers whose
+// values are being copied so a pointer back to one of them is cut off as
+// a cycle.
+type walker struct {
+	path     map[visit]bool
+	budgeted map[reflect.Type]bool // the types whose Budgets are in effect
+}
+
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+func newWalker() *walker {
+	return &walker{path: make(map[visit]bool), budgeted: make(map[reflect.Type]bool)}
+}
+
+// NewVal copies i (within its Budget) into a Value.
 func NewVal(i interface{}) Value {
-	val := reflect.ValueOf(i)
+	return newWalker().value(reflect.ValueOf(i), DefaultBudget)
+}
 
-	vType := val.Type()
-	switch vType.Kind() {
-	case reflect.Int,
-		reflect.Int8,
-		reflect.Int16,
-		reflect.Int32,
-		reflect.Int64,
-		reflect.Uint,
-		reflect.Uint8,
-		reflect.Uint16,
-		reflect.Uint32,
-		reflect.Uint64,
-		reflect.Uintptr:
-		return IntVal(val.Interface())
+func (w *walker) value(v reflect.Value, b Budget) Value {
+	if !v.IsValid() {
+		return &NilValue{JSONType: nilType}
+	}
+	typ := v.Type()
+	// a type's budget applies when the walk enters the type, the values
+	// of the type nested in it (eg. the rest of a list) use up what is
+	// left of it
+	if tb, has := Budgets[typ.String()]; has && !w.budgeted[typ] {
+		b = tb
+		w.budgeted[typ] = true
+		defer delete(w.budgeted, typ)
+	}
+	if b.Depth <= 0 {
+		return &ElidedValue{TypName: typ.String(), ValKind: kinds[v.Kind()], JSONType: elidedType}
+	}
+	b.Depth--
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return intVal(v)
+	case reflect.Float32:
+		return floatVal(v.Float(), 32)
+	case reflect.Float64:
+		return floatVal(v.Float(), 64)
+	case reflect.Complex64:
+		return complexVal(v.Complex(), 64)
+	case reflect.Complex128:
+		return complexVal(v.Complex(), 128)
 	case reflect.Bool:
-		return BoolVal(val.Interface())
-	case reflect.Ptr, reflect.Interface:
-		return ReferenceVal(val.Interface())
+		return &BoolValue{Val: v.Bool(), JSONType: boolType}
+	case reflect.String:
+		return stringVal(v, b)
 	case reflect.Struct:
-		return StructVal(val.Interface())
+		return w.structVal(v, b)
+	case reflect.Ptr, reflect.Interface, reflect.UnsafePointer:
+		return w.referenceVal(v, b)
 	case reflect.Array, reflect.Slice:
-		return ArrayVal(val.Interface())
-	case reflect.String:
-		return StringVal(val.Interface())
+		return w.arrayVal(v, b)
+	case reflect.Map:
+		return w.mapVal(v, b)
+	case reflect.Chan:
+		return &ChanValue{TypName: typ.String(), Len: v.Len(), Cap: v.Cap(), Nil: v.IsNil(), JSONType: chanType}
+	case reflect.Func:
+		f := &FuncValue{TypName: typ.String(), Nil: v.IsNil(), JSONType: funcType}
+		if fn := runtime.FuncForPC(v.Pointer()); !f.Nil && fn != nil {
+			f.Name = fn.Name()
+		}
+		return f
 	default:
-		//panic(fmt.Errorf("%v has unidentified Kind %v", i, vType.Kind()))
-		return nil
+		panic(fmt.Errorf("%v has unidentified Kind %v", typ, v.Kind()))
+	}
+}
+
+func (w *walker) structVal(v reflect.Value, b Budget) *StructValue {
+	typ := v.Type()
+	name := typ.Name()
+	if name == "" {
+		name = typ.String()
+	}
+	fields := make([]Field, 0, v.NumField())
+	for i := 0; i < v.NumField(); i++ {
+		f := typ.Field(i)
+		fields = append(fields, Field{
+			Name:     f.Name,
+			Val:      w.value(v.Field(i), b),
+			exported: f.PkgPath == "",
+		})
+	}
+	return &StructValue{TypName: name, Fields: fields, val: iface(v), JSONType: structType}
+}
+
+func (w *walker) referenceVal(v reflect.Value, b Budget) *ReferenceValue {
+	r := &ReferenceValue{
+		val:      iface(v),
+		Typename: v.Type().String(),
+		ValKind:  kinds[v.Kind()],
+		JSONType: referenceType,
+	}
+	switch v.Kind() {
+	case reflect.UnsafePointer:
+		r.Nil = v.Pointer() == 0
+		return r
+	case reflect.Interface:
+		r.Nil = v.IsNil()
+		if !r.Nil {
+			r.Elem = w.value(v.Elem(), b)
+		}
+		return r
+	}
+	r.Nil = v.IsNil()
+	if r.Nil {
+		return r
+	}
+	at := visit{ptr: v.Pointer(), typ: v.Type()}
+	if w.path[at] {
+		r.Cycle = true
+		return r
+	}
+	w.path[at] = true
+	r.Elem = w.value(v.Elem(), b)
+	delete(w.path, at)
+	return r
+}
+
+func (w *walker) arrayVal(v reflect.Value, b Budget) *ArrayValue {
+	a := &ArrayValue{
+		ElemType: v.Type().Elem().String(),
+		val:      iface(v),
+		Len:      v.Len(),
+		Slice:    v.Kind() == reflect.Slice,
+		Nil:      v.Kind() == reflect.Slice && v.IsNil(),
+		JSONType: arrayType,
+	}
+	n := a.Len
+	if n > b.Elems {
+		n = b.Elems
+	}
+	a.Val = make([]Value, n)
+	for k := range a.Val {
+		a.Val[k] = w.value(v.Index(k), b)
+	}
+	return a
+}
+
+func (w *walker) mapVal(v reflect.Value, b Budget) *MapValue {
+	m := &MapValue{TypName: v.Type().String(), Len: v.Len(), Nil: v.IsNil(), JSONType: mapType}
+	entries := leastEntries(v.MapRange(), b.Elems)
+	m.Keys = make([]Value, 0, len(entries))
+	m.Vals = make([]Value, 0, len(entries))
+	for _, e := range entries {
+		m.Keys = append(m.Keys, w.value(e.key, b))
+		m.Vals = append(m.Vals, w.value(e.val, b))
+	}
+	return m
+}
+
+type mapEntry struct {
+	key, val reflect.Value
+}
+
+// leastEntries is the (at most) n entries of the map with the least keys
+// in order (see compareKeys). The map is walked once keeping only the n
+// entries selected so far, they are selected before they are copied.
+func leastEntries(iter *reflect.MapIter, n int) []mapEntry {
+	least := make([]mapEntry, 0, n)
+	for iter.Next() {
+		k := iter.Key()
+		if len(least) == n && (n == 0 || compareKeys(k, least[n-1].key) >= 0) {
+			continue
+		}
+		i := sort.Search(len(least), func(i int) bool {
+			return compareKeys(k, least[i].key) < 0
+		})
+		if len(least) < n {
+			least = append(least, mapEntry{})
+		}
+		copy(least[i+1:], least[i:])
+		least[i] = mapEntry{key: k, val: iter.Value()}
+	}
+	return least
+}
+
+// compareKeys orders map keys: numbers, strings and booleans by their
+// values, pointers and channels by their addresses, structs and arrays by
+// their fields or elements and interfaces by their dynamic types (nil
+// first) and then their values.
+func compareKeys(a, b reflect.Value) int {
+	if a.Type() != b.Type() {
+		return strings.Compare(a.Type().String(), b.Type().String())
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareInts(a.Int(), b.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return compareUints(a.Uint(), b.Uint())
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float())
+	case reflect.Complex64, reflect.Complex128:
+		x, y := a.Complex(), b.Complex()
+		if c := compareFloats(real(x), real(y)); c != 0 {
+			return c
+		}
+		return compareFloats(imag(x), imag(y))
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case b.Bool():
+			return -1
+		}
+		return 1
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Chan:
+		return compareUints(uint64(a.Pointer()), uint64(b.Pointer()))
+	case reflect.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			if c := compareKeys(a.Field(i), b.Field(i)); c != 0 {
+				return c
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < a.Len(); i++ {
+			if c := compareKeys(a.Index(i), b.Index(i)); c != 0 {
+				return c
+			}
+		}
+	case reflect.Interface:
+		switch {
+		case a.IsNil() && b.IsNil():
+			return 0
+		case a.IsNil():
+			return -1
+		case b.IsNil():
+			return 1
+		}
+		return compareKeys(a.Elem(), b.Elem())
+	}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareFloats orders NaN before the numbers.
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	case a == b || (a != a && b != b):
+		return 0
+	case a != a:
+		return -1
 	}
-	panic("This statement should be unreachable")
+	return 1
 }
@@ -0,0 +1,182 @@
+package dgtypes
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+type node struct {
+	Name string
+	Next *node
+	tags map[string]float64
+}
+
+func roundTrip(t *testing.T, v Value) Value {
+	bs, err := json.Marshal(&Param{Name: "v", Val: v})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p Param
+	if err := json.Unmarshal(bs, &p); err != nil {
+		t.Fatal(err)
+	}
+	return p.Val
+}
+
+func TestNewValRoundTrip(t *testing.T) {
+	var nilErr error
+	ch := make(chan int, 3)
+	ch <- 1
+	values := []interface{}{
+		int8(-3), uint64(math.MaxUint64), 2.5, float32(-1), math.NaN(), math.Inf(-1),
+		complex(1, -2), "hello", true, nilErr, []int{1, 2}, []int(nil), [2]string{"a", "b"},
+		map[string]int{"b": 2, "a": 1}, ch, TestNewValRoundTrip,
+		&node{Name: "x", tags: map[string]float64{"w": .5}},
+	}
+	for _, i := range values {
+		v := NewVal(i)
+		got := roundTrip(t, v)
+		if got.String() != v.String() || got.Kind() != v.Kind() {
+			t.Errorf("%v (%v) was loaded as %v (%v)", v, v.Kind(), got, got.Kind())
+		}
+		if d := Dissimilar(v, got); d != 0 {
+			t.Errorf("%v was dissimilar (%v) from itself loaded", v, d)
+		}
+	}
+}
+
+func TestNewValCycle(t *testing.T) {
+	a := &node{Name: "a"}
+	a.Next = &node{Name: "b", Next: a}
+	v := NewVal(a).(*ReferenceValue)
+	b := v.Elem.(*StructValue).Fields[1].Val.(*ReferenceValue)
+	back := b.Elem.(*StructValue).Fields[1].Val.(*ReferenceValue)
+	if !back.Cycle || back.Elem != nil {
+		t.Errorf("the pointer back to a should have been a cycle, was %v", back)
+	}
+	if got := roundTrip(t, v); got.String() != v.String() {
+		t.Errorf("%v was loaded as %v", v, got)
+	}
+}
+
+func TestNewValBudget(t *testing.T) {
+	Budgets["[]int"] = Budget{Depth: 2, Elems: 2, String: 1}
+	defer delete(Budgets, "[]int")
+	v := NewVal([]int{1, 2, 3}).(*ArrayValue)
+	if len(v.Val) != 2 || v.Len != 3 {
+		t.Errorf("expected 2 of 3 elements got %v", v)
+	}
+	s := NewVal(string(make([]byte, 1000))).(*StringValue)
+	if len(s.Val) != DefaultBudget.String || s.Len != 1000 {
+		t.Errorf("expected the string cut to %v bytes got %v of %v", DefaultBudget.String, len(s.Val), s.Len)
+	}
+	deep := &node{Name: "0"}
+	for i := 0; i < 2*Depth; i++ {
+		deep = &node{Next: deep}
+	}
+	var at Value = NewVal(deep)
+	for {
+		if r, ok := at.(*ReferenceValue); ok {
+			at = r.Elem
+		} else if s, ok := at.(*StructValue); ok {
+			at = s.Fields[1].Val
+		} else {
+			break
+		}
+	}
+	if _, elided := at.(*ElidedValue); !elided {
+		t.Errorf("expected the value past the depth to be elided got %v", at)
+	}
+}
+
+// Only the entries with the least keys of a map are copied, in order.
+func TestNewValMapBudget(t *testing.T) {
+	Budgets["map[int]string"] = Budget{Depth: 2, Elems: 3, String: 8}
+	defer delete(Budgets, "map[int]string")
+	m := make(map[int]string)
+	for i := 100; i > -100; i-- {
+		m[i] = "x"
+	}
+	v := NewVal(m).(*MapValue)
+	if len(v.Keys) != 3 || len(v.Vals) != 3 || v.Len != 200 {
+		t.Fatalf("expected 3 of 200 entries got %v", v)
+	}
+	for i, k := range v.Keys {
+		if k.String() != strconv.Itoa(i-99) {
+			t.Errorf("expected key %d to be %d got %v", i, i-99, k)
+		}
+	}
+	type key struct {
+		A string
+		B interface{}
+	}
+	keys := map[key]int{
+		{"b", nil}: 4,
+		{"a", 2}:   2,
+		{"a", "z"}: 3,
+		{"a", 1}:   1,
+		{"a", nil}: 0,
+	}
+	least := leastEntries(reflect.ValueOf(keys).MapRange(), 4)
+	expected := []key{{"a", nil}, {"a", 1}, {"a", 2}, {"a", "z"}}
+	if len(least) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, least)
+	}
+	for i, e := range least {
+		if e.key.Interface().(key) != expected[i] || e.val.Interface().(int) != i {
+			t.Errorf("expected entry %d to be %v: %d got %v: %v", i, expected[i], i, e.key, e.val)
+		}
+	}
+}
+
+// A type's budget is not renewed by the values of the type nested in it,
+// so a list longer than the budget is cut at its depth.
+func TestNewValRecursiveBudget(t *testing.T) {
+	const depth = 6
+	Budgets["*dgtypes.node"] = Budget{Depth: depth, Elems: 2, String: 8}
+	defer delete(Budgets, "*dgtypes.node")
+	list := &node{Name: "last"}
+	for i := 0; i < 4*depth; i++ {
+		list = &node{Name: strconv.Itoa(i), Next: list}
+	}
+	levels := 0
+	var at Value = NewVal(list)
+	for {
+		if r, ok := at.(*ReferenceValue); ok {
+			at = r.Elem
+		} else if s, ok := at.(*StructValue); ok {
+			at = s.Fields[1].Val
+		} else {
+			break
+		}
+		levels++
+	}
+	if _, elided := at.(*ElidedValue); !elided || levels != depth {
+		t.Errorf("expected the list to be elided after %d levels got %v after %d", depth, at, levels)
+	}
+}
+
+func TestNumberDissimilar(t *testing.T) {
+	cases := []struct {
+		a, b, d float64
+	}{
+		{1, 1, 0},
+		{1, -1, 1},
+		{1, 3, .5},
+		{math.NaN(), math.NaN(), 0},
+		{math.NaN(), 1, 1},
+		{math.Inf(1), 1, 1},
+	}
+	for _, c := range cases {
+		if d := NumberDissimilar(c.a, c.b); d != c.d {
+			t.Errorf("NumberDissimilar(%v, %v) = %v expected %v", c.a, c.b, d, c.d)
+		}
+	}
+	a, b := NewVal(uint8(200)), NewVal(uint8(100))
+	if a.Dissimilar(b) != b.Dissimilar(a) {
+		t.Errorf("Dissimilar of %v and %v was not symmetric", a, b)
+	}
+}
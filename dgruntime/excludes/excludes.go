@@ -1,46 +1,214 @@
 package excludes
 
 import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
 	"strings"
 )
 
-var excludedPackages = map[string]bool{
-	"fmt":              true,
-	"net":              true,
-	"runtime":          true,
-	"strings":          true,
-	"sync":             true,
-	"strconv":          true,
-	"io":               true,
-	"os":               true,
-	"unsafe":           true,
-	"errors":           true,
-	"internal/race":    true,
-	"math":             true,
-	"syscall":          true,
-	"time":             true,
-	"reflect":          true,
-	"unicode":          true,
-	"sort":             true,
-	"hash":             true,
-	"hash/fnv":         true,
-	"encoding/json":    true,
-	"encoding/binary":  true,
-	"bufio":            true,
-	"bytes":            true,
-	"path":             true,
-	"path/filepath":    true,
-	"encoding/base64":  true,
-	"internal":         true,
-	"internal/cpu":     true,
-	"dgruntime":        true,
-	"dgruntime/dgtype": true,
-}
+// required packages are never instrumented. They are the dgruntime and
+// the standard library packages it depends on (transitively) to record a
+// profile: instrumenting them would have the runtime call back into
+// itself. The list holds those packages and no others, so it only grows
+// when the dgruntime imports something new. TestRequired checks the list
+// against go list -deps in both directions: every package dgruntime
+// depends on is required and every pattern matches one of them.
+var required = mustCompile(
+	"dgruntime/...",
+	"internal/...",
+	"runtime/...",
+	"unsafe",
+	"bufio",
+	"bytes",
+	"cmp",
+	"compress/flate",
+	"compress/gzip",
+	"context",
+	"encoding",
+	"encoding/base32",
+	"encoding/base64",
+	"encoding/binary",
+	"encoding/hex",
+	"encoding/json/...",
+	"errors",
+	"fmt",
+	"hash",
+	"hash/crc32",
+	"io",
+	"io/fs",
+	"iter",
+	"math",
+	"math/bits",
+	"math/rand",
+	"os",
+	"os/signal",
+	"path",
+	"reflect",
+	"slices",
+	"sort",
+	"strconv",
+	"strings",
+	"sync",
+	"sync/atomic",
+	"syscall",
+	"time",
+	"unicode",
+	"unicode/utf16",
+	"unicode/utf8",
+)
 
+// defaults are not instrumented unless a user supplied include pattern
+// matches them.
+var defaults = mustCompile(
+	"net/...",
+)
+
+var (
+	includes []*regexp.Regexp
+	excludes []*regexp.Regexp
+)
+
+// ExcludedPkg reports whether the package with the given import path
+// should be left uninstrumented. Required packages are always excluded.
+// Otherwise the --include patterns take precedence over the --exclude
+// patterns which take precedence over the defaults.
 func ExcludedPkg(pkg string) bool {
-	parts := strings.Split(pkg, "/")
-	if len(parts) > 0 && excludedPackages[parts[0]] {
+	switch {
+	case matchAny(required, pkg):
+		return true
+	case matchAny(includes, pkg):
+		return false
+	case matchAny(excludes, pkg):
 		return true
 	}
-	return excludedPackages[pkg]
+	return matchAny(defaults, pkg)
+}
+
+// Included reports whether a user supplied include pattern matches the
+// package (which is then instrumented unless it is required).
+func Included(pkg string) bool {
+	return matchAny(includes, pkg)
+}
+
+// Include adds patterns for packages to instrument even if they are
+// excluded by default.
+func Include(patterns ...string) error {
+	res, err := compile(patterns)
+	if err != nil {
+		return err
+	}
+	includes = append(includes, res...)
+	return nil
+}
+
+// Exclude adds patterns for packages which should not be instrumented.
+func Exclude(patterns ...string) error {
+	res, err := compile(patterns)
+	if err != nil {
+		return err
+	}
+	excludes = append(excludes, res...)
+	return nil
+}
+
+// Reset drops the include and exclude patterns added so far.
+func Reset() {
+	includes = nil
+	excludes = nil
+}
+
+// LoadConfig reads include and exclude patterns from a file. Each non
+// blank line is either a comment starting with # or a directive:
+//
+//	include net/http
+//	exclude github.com/*/vendor/...
+func LoadConfig(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for line := 1; s.Scan(); line++ {
+		fields := strings.Fields(s.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return fmt.Errorf("%v:%v: expected `include <pattern>` or `exclude <pattern>`", path, line)
+		}
+		switch fields[0] {
+		case "include":
+			err = Include(fields[1])
+		case "exclude":
+			err = Exclude(fields[1])
+		default:
+			err = fmt.Errorf("unknown directive %q", fields[0])
+		}
+		if err != nil {
+			return fmt.Errorf("%v:%v: %v", path, line, err)
+		}
+	}
+	return s.Err()
+}
+
+func matchAny(res []*regexp.Regexp, pkg string) bool {
+	for _, re := range res {
+		if re.MatchString(pkg) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustCompile(patterns ...string) []*regexp.Regexp {
+	res, err := compile(patterns)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, 0, len(patterns))
+	for _, pattern := range patterns {
+		re, err := Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+// Compile turns a package pattern into a regular expression matching
+// whole import paths. A * or ? matches within one path element while
+// ... matches any string, including slashes. As with the go tool a
+// trailing /... also matches the parent so net/... matches net.
+func Compile(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, fmt.Errorf("empty package pattern")
+	}
+	suffix := ""
+	if strings.HasSuffix(pattern, "/...") {
+		pattern = strings.TrimSuffix(pattern, "/...")
+		suffix = "(/.*)?"
+	}
+	var re []string
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "..."):
+			re = append(re, ".*")
+			i += 2
+		case pattern[i] == '*':
+			re = append(re, "[^/]*")
+		case pattern[i] == '?':
+			re = append(re, "[^/]")
+		default:
+			re = append(re, regexp.QuoteMeta(pattern[i:i+1]))
+		}
+	}
+	return regexp.Compile("^" + strings.Join(re, "") + suffix + "$")
 }
@@ -0,0 +1,107 @@
+package excludes
+
+import (
+	"go/parser"
+	"go/token"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// stdImports are the standard library packages imported by the files
+// (of any build tag, but not the tests) of the dgruntime package in dir
+// and the dgruntime packages it imports.
+func stdImports(t *testing.T, dir string, seen map[string]bool, imports map[string]bool) {
+	if seen[dir] {
+		return
+	}
+	seen[dir] = true
+	files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(token.NewFileSet(), file, nil, parser.ImportsOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, spec := range f.Imports {
+			path, err := strconv.Unquote(spec.Path.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.HasPrefix(path, "dgruntime/") {
+				stdImports(t, filepath.Join("..", strings.TrimPrefix(path, "dgruntime/")), seen, imports)
+			} else {
+				imports[path] = true
+			}
+		}
+	}
+}
+
+// TestRequired checks that every standard library package the dgruntime
+// depends on is required and that nothing else is.
+func TestRequired(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go tool on the PATH")
+	}
+	imports := make(map[string]bool)
+	stdImports(t, "..", make(map[string]bool), imports)
+	args := []string{"list", "-deps", "-f", "{{if .Standard}}{{.ImportPath}}{{end}}"}
+	for pkg := range imports {
+		args = append(args, pkg)
+	}
+	sort.Strings(args[4:])
+	output, err := exec.Command("go", args...).Output()
+	if err != nil {
+		t.Fatalf("go %v: %v", strings.Join(args, " "), err)
+	}
+	deps := strings.Fields(string(output))
+	for _, pkg := range deps {
+		if !matchAny(required, pkg) {
+			t.Errorf("the dgruntime depends on %v but it is not required", pkg)
+		}
+	}
+	for _, re := range required {
+		if re.MatchString("dgruntime") {
+			continue
+		}
+		found := false
+		for _, pkg := range deps {
+			found = found || re.MatchString(pkg)
+		}
+		if !found {
+			t.Errorf("%v is required but the dgruntime does not depend on it", re)
+		}
+	}
+}
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		pattern string
+		pkg     string
+		matches bool
+	}{
+		{"net/...", "net", true},
+		{"net/...", "net/http", true},
+		{"net/...", "netx", false},
+		{"github.com/*/vendor/...", "github.com/x/vendor/y", true},
+		{"github.com/*/vendor/...", "github.com/x/y/vendor/z", false},
+		{"encoding/j?on", "encoding/json", true},
+	}
+	for _, c := range cases {
+		re, err := Compile(c.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if re.MatchString(c.pkg) != c.matches {
+			t.Errorf("expected %q matching %q to be %v", c.pattern, c.pkg, c.matches)
+		}
+	}
+}
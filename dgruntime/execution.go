@@ -3,23 +3,46 @@ package dgruntime
 import (
 	"dgruntime/dgtypes"
 	"fmt"
-	"io"
 	"os"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
+// goroutineShards is the number of shards the goroutine states are
+// spread over. Lookups only contend with goroutines in the same shard.
+const goroutineShards = 64
+
+// mergeBatch is the most goroutines the merger merges under one lock of
+// Execution.m.
+const mergeBatch = 256
+
 type Execution struct {
-	m          sync.Mutex
-	Goroutines []*Goroutine
-	Profile    *dgtypes.Profile
-	OutputDir  string
-	mergeCh    chan *Goroutine
-	async      sync.WaitGroup
-	fails      []*Failure
-	failed     map[string]bool
+	m         sync.Mutex
+	shards    [goroutineShards]goroutineShard
+	Profile   *dgtypes.Profile
+	OutputDir string
+	mergeMu   sync.RWMutex
+	mergeCh   chan *Goroutine
+	closed    bool
+	async     sync.WaitGroup
+	fails     []*Failure
+	failed    map[string]bool
+	trace     *tracer
+	segments  int
+	chans     chanTable
+
+	stopCheckpoints chan struct{}
+	checkpoints     sync.WaitGroup
+	cutting         int32 // live goroutines are being cut (see Goroutine.lockOwn)
+}
+
+// goroutineShard holds the live goroutines whose ids map to it.
+type goroutineShard struct {
+	m          sync.RWMutex
+	goroutines map[int64]*Goroutine
 }
 
 type Failure struct {
@@ -34,17 +57,14 @@ func (f *Failure) String() string {
 }
 
 var execMu sync.Mutex
+var execOnce sync.Once
 var exec *Execution
 
 func execCheck() {
-	if exec == nil {
-		execMu.Lock()
-		if exec == nil {
-			exec = newExecution()
-		}
+	execOnce.Do(func() {
+		exec = newExecution()
 		runtime.SetFinalizer(exec, shutdown)
-		execMu.Unlock()
-	}
+	})
 }
 
 func pjoin(parts ...string) string {
@@ -62,40 +82,77 @@ func newExecution() *Execution {
 	e := &Execution{
 		Profile:   dgtypes.NewProfile(),
 		OutputDir: outputDir,
-		mergeCh:   make(chan *Goroutine, 15),
+		mergeCh:   make(chan *Goroutine, mergeBatch),
 		failed:    make(map[string]bool),
 	}
-	e.growGoroutines()
-	go func() {
-		e.async.Add(1)
-		for g := range e.mergeCh {
-			e.merge(g)
-		}
-		e.async.Done()
-	}()
+	for i := range e.shards {
+		e.shards[i].goroutines = make(map[int64]*Goroutine)
+	}
+	if os.Getenv("DGTRACE") != "" {
+		e.trace = newTracer(pjoin(outputDir, "flow-trace"))
+	}
+	e.async.Add(1)
+	go e.merger()
+	e.startCheckpoints()
 	return e
 }
 
+func (e *Execution) shard(id int64) *goroutineShard {
+	return &e.shards[uint64(id)%goroutineShards]
+}
+
+// Goroutine gets the state of the goroutine with the given id, creating
+// it on the goroutine's first call.
 func (e *Execution) Goroutine(id int64) *Goroutine {
-	for id >= int64(len(e.Goroutines)) {
-		e.m.Lock()
-		for id >= int64(len(e.Goroutines)) {
-			e.growGoroutines()
+	s := e.shard(id)
+	s.m.RLock()
+	g := s.goroutines[id]
+	s.m.RUnlock()
+	if g != nil {
+		return g
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if g = s.goroutines[id]; g == nil {
+		// Println(fmt.Sprintf("new goroutine %d", id))
+		g = newGoroutine(id)
+		s.goroutines[id] = g
+		if e.trace != nil {
+			e.trace.GoroutineStart(id)
 		}
-		e.m.Unlock()
 	}
-	if e.Goroutines[id] == nil {
-		e.m.Lock()
-		if e.Goroutines[id] == nil {
-			// Println(fmt.Sprintf("new goroutine %d", id))
-			e.Goroutines[id] = newGoroutine(id)
+	return g
+}
+
+func (e *Execution) removeGoroutine(id int64) {
+	s := e.shard(id)
+	s.m.Lock()
+	delete(s.goroutines, id)
+	s.m.Unlock()
+}
+
+// goroutines lists the live goroutines.
+func (e *Execution) goroutines() []*Goroutine {
+	var gs []*Goroutine
+	for i := range e.shards {
+		s := &e.shards[i]
+		s.m.RLock()
+		for _, g := range s.goroutines {
+			gs = append(gs, g)
 		}
-		e.m.Unlock()
+		s.m.RUnlock()
 	}
-	return e.Goroutines[id]
+	return gs
 }
 
 func (e *Execution) Fail(fnName string, bbid int, pos string) {
+	id := goid()
+	if e.trace != nil {
+		e.trace.Fail(id, fnName, bbid, pos)
+	}
+	if g := e.Goroutine(id); g.Segment != nil {
+		g.Segment.Failed = true
+	}
 	e.m.Lock()
 	if !e.failed[pos] {
 		e.failed[pos] = true
@@ -108,54 +165,48 @@ func (e *Execution) Fail(fnName string, bbid int, pos string) {
 	e.m.Unlock()
 }
 
-func (e *Execution) growGoroutines() {
-	n := make([]*Goroutine, (len(e.Goroutines)+1)*2)
-	copy(n, e.Goroutines)
-	// for i := len(e.Goroutines); i < len(n); i++ {
-	// 	n[i] = newGoroutine(int64(i))
-	// }
-	e.Goroutines = n
-}
-
+// Merge queues a closed goroutine to be merged into the profile by the
+// merger. Goroutines which exit after shutdown are dropped.
 func (e *Execution) Merge(g *Goroutine) {
+	e.mergeMu.RLock()
+	defer e.mergeMu.RUnlock()
+	if e.closed {
+		return
+	}
 	e.mergeCh <- g
 }
 
-func (e *Execution) merge(g *Goroutine) {
+// merger merges the queued goroutines into the profile in batches so
+// the program's goroutines rarely wait on Execution.m.
+func (e *Execution) merger() {
+	defer e.async.Done()
+	batch := make([]*Goroutine, 0, mergeBatch)
+	for g := range e.mergeCh {
+		batch = append(batch[:0], g)
+	fill:
+		for len(batch) < mergeBatch {
+			select {
+			case g, ok := <-e.mergeCh:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, g)
+			default:
+				break fill
+			}
+		}
+		e.merge(batch)
+	}
+}
+
+func (e *Execution) merge(batch []*Goroutine) {
 	e.m.Lock()
 	defer e.m.Unlock()
-	if !g.Closed {
-		return
-	}
-	e.Profile.CallCount += g.CallCount
-	for _, fn := range g.Funcs {
-		if x, has := e.Profile.Funcs[fn.FuncPc]; has {
-			x.Merge(fn)
-		} else {
-			e.Profile.Funcs[fn.FuncPc] = fn
+	for _, g := range batch {
+		if g.Closed {
+			g.mergeInto(e.Profile)
 		}
 	}
-	for call, count := range g.Calls {
-		e.Profile.Calls[call] += count
-	}
-	for edge, count := range g.Flows {
-		e.Profile.Flows[edge] += count
-	}
-	for be, pos := range g.Positions {
-		e.Profile.Positions[be] = pos
-	}
-	for be, dur := range g.Durations {
-		e.Profile.Durations[be] += dur
-	}
-	for funcName, instances := range g.Inputs {
-		e.Profile.Inputs[funcName] = append(e.Profile.Inputs[funcName], instances...)
-	}
-	for funcName, instances := range g.Outputs {
-		e.Profile.Outputs[funcName] = append(e.Profile.Outputs[funcName], instances...)
-	}
-	for typeName, typ := range g.Types {
-		e.Profile.Types[typeName] = typ
-	}
 }
 
 func shutdown(e *Execution) {
@@ -165,82 +216,36 @@ func shutdown(e *Execution) {
 	if e == nil {
 		return
 	}
-	for _, g := range e.Goroutines {
-		if g == nil {
-			continue
-		}
-		g.m.Lock()
-		if !g.Closed && len(g.Calls) > 0 {
-			g.m.Unlock()
+	e.mergeMu.RLock()
+	closed := e.closed
+	e.mergeMu.RUnlock()
+	if closed {
+		return
+	}
+	e.stopCheckpointing()
+	atomic.StoreInt32(&e.cutting, 1)
+	for _, g := range e.goroutines() {
+		g.lockRunning()
+		// a checkpoint may have cut the calls but not the later flows
+		open := !g.Closed && (len(g.Calls) > 0 || len(g.Flows) > 0 || g.Segment != nil)
+		g.m.Unlock()
+		if open {
 			g.Exit()
 		}
 	}
+	if e.trace != nil {
+		fmt.Println("closing trace:", pjoin(e.OutputDir, "flow-trace"))
+		e.trace.Close()
+	}
+	e.mergeMu.Lock()
+	e.closed = true
 	close(e.mergeCh)
+	e.mergeMu.Unlock()
 	e.async.Wait()
 	e.m.Lock()
 	defer e.m.Unlock()
-
-	if !e.Profile.Empty() {
-		fnPath := pjoin(e.OutputDir, "functions.json")
-		fmt.Println("writing functions to:", fnPath)
-		fn, err := os.Create(fnPath)
-		if err != nil {
-			panic(err)
-		}
-		defer fn.Close()
-		e.Profile.WriteFunctions(fn)
-
-		dotPath := pjoin(e.OutputDir, "flow-graph.dot")
-		fmt.Println("writing flow-graph to:", dotPath)
-		dot, err := os.Create(dotPath)
-		if err != nil {
-			panic(err)
-		}
-		defer dot.Close()
-		e.Profile.WriteDotty(dot)
-
-		txtPath := pjoin(e.OutputDir, "flow-graph.txt")
-		fmt.Println("writing flow-graph to:", txtPath)
-		txt, err := os.Create(txtPath)
-		if err != nil {
-			panic(err)
-		}
-		defer txt.Close()
-		e.Profile.WriteSimple(txt)
-	}
-
-	if len(e.Profile.Inputs) > 0 {
-		files := []string{"object-profiles.json"}
-		writeOut(e, files[0], e.Profile.SerializeProfs)
-	}
-
-	if len(e.fails) > 0 {
-		failPath := pjoin(e.OutputDir, "failures")
-		fmt.Printf("The program registered %v failures\n", len(e.fails))
-		fmt.Println("writing failures to:", failPath)
-		fout, err := os.Create(failPath)
-		if err != nil {
-			panic(err)
-		}
-		defer fout.Close()
-		for _, f := range e.fails {
-			fmt.Printf("fail: %v\n", f)
-			_, err := fmt.Fprintln(fout, f)
-			if err != nil {
-				panic(err)
-			}
-		}
-	}
-	fmt.Println("done shutting down")
-}
-
-func writeOut(e *Execution, filename string, serializeFunc func(io.Writer)) {
-	filePath := pjoin(e.OutputDir, filename)
-	fmt.Println("writing to:", filePath)
-	fout, err := os.Create(filePath)
-	if err != nil {
+	if err := e.writeProfile(true); err != nil {
 		panic(err)
 	}
-	defer fout.Close()
-	serializeFunc(fout)
+	fmt.Println("done shutting down")
 }
@@ -0,0 +1,82 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+)
+
+// The stress test needs goroutine ids without the patched runtime, run
+// it with:
+//
+//	go test -race -tags dgstock dgruntime
+
+const stressPos = "execution_test.go"
+
+// stressed is instrumented by hand as if it were
+//
+//	func stressed(n int) {
+//		for i := 0; i < n; i++ {
+//		}
+//	}
+func stressed(n int) {
+	EnterFunc("dgruntime.stressed", stressPos, [][]int{{1}, {1, 2}, {}}, []int{1, 2, 2})
+	defer ExitFunc("dgruntime.stressed")
+	for i := 0; i < n; i++ {
+		EnterBlk(1, stressPos)
+	}
+	EnterBlk(2, stressPos)
+}
+
+func TestConcurrentGoroutines(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dgruntime-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("DGPROF", dir)
+	execCheck()
+
+	const waves = 10
+	const goroutines = 200
+	const loops = 50
+	for w := 0; w < waves; w++ {
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				stressed(loops)
+			}()
+		}
+		wg.Wait()
+	}
+	Shutdown()
+
+	p := exec.Profile
+	calls := waves * goroutines
+	if p.CallCount != calls {
+		t.Errorf("expected %d calls got %d", calls, p.CallCount)
+	}
+	if len(p.Funcs) != 1 {
+		t.Fatalf("expected one function got %v", p.Funcs)
+	}
+	for fpc, f := range p.Funcs {
+		if f.Calls != calls {
+			t.Errorf("expected %v to be called %d times got %d", f.Name, calls, f.Calls)
+		}
+		loop := dgtypes.BlkEntrance{In: fpc, BasicBlockId: 1}
+		if n := p.Flows[dgtypes.FlowEdge{Src: loop, Targ: loop}]; n != calls*(loops-1) {
+			t.Errorf("expected the loop to be taken %d times got %d", calls*(loops-1), n)
+		}
+		exit := dgtypes.BlkEntrance{In: fpc, BasicBlockId: 2}
+		if n := p.Flows[dgtypes.FlowEdge{Src: loop, Targ: exit}]; n != calls {
+			t.Errorf("expected the loop to exit %d times got %d", calls, n)
+		}
+	}
+	if gs := exec.goroutines(); len(gs) != 0 {
+		t.Errorf("expected every goroutine to be removed got %d", len(gs))
+	}
+}
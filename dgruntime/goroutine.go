@@ -2,52 +2,251 @@ package dgruntime
 
 import (
 	"dgruntime/dgtypes"
+	"math/rand"
+	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type Goroutine struct {
-	m         sync.Mutex
-	GoID      int64
-	Closed    bool
-	Inputs    map[string][]dgtypes.ObjectProfile
-	Outputs   map[string][]dgtypes.ObjectProfile
-	Types     map[string]dgtypes.Type
-	Stack     []*dgtypes.FuncCall
-	Calls     map[dgtypes.Call]int
-	Flows     map[dgtypes.FlowEdge]int
-	Funcs     map[uintptr]*dgtypes.Function
-	Positions map[dgtypes.BlkEntrance]string
-	Durations map[dgtypes.BlkEntrance]time.Duration
-	CallCount int
+	m              sync.Mutex
+	GoID           int64
+	Closed         bool
+	Inputs         map[string][]dgtypes.ObjectProfile
+	Outputs        map[string][]dgtypes.ObjectProfile
+	Exits          map[string][]dgtypes.Exit
+	Types          map[string]dgtypes.Type
+	Stack          []*dgtypes.FuncCall
+	Calls          map[dgtypes.Call]int
+	Flows          map[dgtypes.FlowEdge]int
+	Spawns         map[dgtypes.FlowEdge]int
+	Comms          map[dgtypes.FlowEdge]int
+	Channels       map[dgtypes.ChanComm]int
+	Panics         map[dgtypes.FlowEdge]int
+	Recovers       map[dgtypes.FlowEdge]int
+	Panicked       map[dgtypes.PanicSite]int
+	Predicates     map[dgtypes.Predicate]int
+	Funcs          map[uintptr]*dgtypes.Function
+	Positions      map[dgtypes.BlkEntrance]string
+	Durations      map[dgtypes.BlkEntrance]time.Duration
+	CallCount      int
+	Segment        *Segment
+	ctxs           []*callCtx // the calling contexts of the Stack
+	stacks         map[stackBlk]int
+	stackCalls     map[stackBlk]int
+	stackDurations map[stackBlk]time.Duration
+	operandValues  map[dgtypes.Predicate]int // operand values of each site (see operands)
+	spawned        bool                      // started by an instrumented go statement
+	spawnedAt      dgtypes.BlkEntrance       // the block of the go statement
+	crashes        bool                      // nothing uninstrumented can recover its panics
+	unwinding      *panicking                // the panic the goroutine is unwinding
+	panicType      string                    // the type of the value it last panicked with
+	recovered      int                       // the depth of the call which recovered it
+	skip           int                       // entrances left to skip (dgtypes.SampledLevel)
+	rand           *rand.Rand                // for dgtypes.Instrumentation.SampleRate
+	busy           int32                     // updating without g.m (see lockOwn)
 }
 
 func newGoroutine(id int64) *Goroutine {
 	g := &Goroutine{
-		Inputs:    make(map[string][]dgtypes.ObjectProfile),
-		Outputs:   make(map[string][]dgtypes.ObjectProfile),
-		Types:     make(map[string]dgtypes.Type),
-		GoID:      id,
-		Stack:     make([]*dgtypes.FuncCall, 0, 10),
-		Calls:     make(map[dgtypes.Call]int),
-		Funcs:     make(map[uintptr]*dgtypes.Function),
-		Flows:     make(map[dgtypes.FlowEdge]int),
-		Positions: make(map[dgtypes.BlkEntrance]string),
-		Durations: make(map[dgtypes.BlkEntrance]time.Duration),
+		GoID:  id,
+		Stack: make([]*dgtypes.FuncCall, 0, 10),
 	}
+	g.resetCounts()
 	g.Stack = append(g.Stack, &dgtypes.FuncCall{
 		Name: "<entry>",
 	})
+	g.ctxs = append(g.ctxs, newCallCtx())
 	return g
 }
 
+func (g *Goroutine) resetCounts() {
+	g.Inputs = make(map[string][]dgtypes.ObjectProfile)
+	g.Outputs = make(map[string][]dgtypes.ObjectProfile)
+	g.Exits = make(map[string][]dgtypes.Exit)
+	g.Types = make(map[string]dgtypes.Type)
+	g.Calls = make(map[dgtypes.Call]int)
+	g.Funcs = make(map[uintptr]*dgtypes.Function)
+	g.Flows = make(map[dgtypes.FlowEdge]int)
+	g.Spawns = make(map[dgtypes.FlowEdge]int)
+	g.Comms = make(map[dgtypes.FlowEdge]int)
+	g.Channels = make(map[dgtypes.ChanComm]int)
+	g.Panics = make(map[dgtypes.FlowEdge]int)
+	g.Recovers = make(map[dgtypes.FlowEdge]int)
+	g.Panicked = make(map[dgtypes.PanicSite]int)
+	g.Predicates = make(map[dgtypes.Predicate]int)
+	g.operandValues = make(map[dgtypes.Predicate]int)
+	g.Positions = make(map[dgtypes.BlkEntrance]string)
+	g.Durations = make(map[dgtypes.BlkEntrance]time.Duration)
+	g.stacks = make(map[stackBlk]int)
+	g.stackCalls = make(map[stackBlk]int)
+	g.stackDurations = make(map[stackBlk]time.Duration)
+	g.CallCount = 0
+}
+
+// lockOwn is called by the goroutine itself before it updates its state
+// in EnterBlk, EnterFunc and ExitFunc. It only locks g.m while another
+// goroutine is cutting the live goroutines (see lockRunning), otherwise it
+// marks g busy. It reports whether it locked g.m.
+func (g *Goroutine) lockOwn() bool {
+	atomic.StoreInt32(&g.busy, 1)
+	if atomic.LoadInt32(&exec.cutting) == 0 {
+		return false
+	}
+	atomic.StoreInt32(&g.busy, 0)
+	g.m.Lock()
+	return true
+}
+
+// unlockOwn undoes lockOwn.
+func (g *Goroutine) unlockOwn(locked bool) {
+	if locked {
+		g.m.Unlock()
+	} else {
+		atomic.StoreInt32(&g.busy, 0)
+	}
+}
+
+// lockRunning locks g, which may still be running, from another
+// goroutine. Execution.cutting must be set: g.m is locked and then the
+// update g started before it saw cutting (if any) is waited for. Every
+// later update of g locks g.m until cutting is cleared.
+func (g *Goroutine) lockRunning() {
+	g.m.Lock()
+	for atomic.LoadInt32(&g.busy) != 0 {
+		runtime.Gosched()
+	}
+}
+
+// cut moves everything the goroutine has recorded so far into a new
+// closed Goroutine (ready to be merged) and leaves g with empty counts
+// and its stack intact.
+func (g *Goroutine) cut() *Goroutine {
+	g.m.Lock()
+	defer g.m.Unlock()
+	return g.cutLocked()
+}
+
+// cutLocked is cut with g.m held.
+func (g *Goroutine) cutLocked() *Goroutine {
+	c := &Goroutine{
+		GoID:       g.GoID,
+		Closed:     true,
+		Inputs:     g.Inputs,
+		Outputs:    g.Outputs,
+		Exits:      g.Exits,
+		Types:      g.Types,
+		Calls:      g.Calls,
+		Flows:      g.Flows,
+		Spawns:     g.Spawns,
+		Comms:      g.Comms,
+		Channels:   g.Channels,
+		Panics:     g.Panics,
+		Recovers:   g.Recovers,
+		Panicked:   g.Panicked,
+		Predicates: g.Predicates,
+		Funcs:      g.Funcs,
+		Positions:  g.Positions,
+		Durations:  g.Durations,
+		CallCount:  g.CallCount,
+
+		stacks:         g.stacks,
+		stackCalls:     g.stackCalls,
+		stackDurations: g.stackDurations,
+	}
+	g.resetCounts()
+	return c
+}
+
+// stackFuncs adds the functions on the stack, which have not exited and
+// so have no dgtypes.Function yet, to funcs so their blocks are named
+// correctly.
+func stackFuncs(funcs map[uintptr]*dgtypes.Function, stack []*dgtypes.FuncCall) {
+	for _, fc := range stack {
+		if _, has := funcs[fc.FuncPc]; has {
+			continue
+		}
+		dcdp := make([]map[int]bool, len(fc.CFG))
+		for i := range dcdp {
+			dcdp[i] = make(map[int]bool)
+		}
+		funcs[fc.FuncPc] = &dgtypes.Function{
+			Name:   fc.Name,
+			FuncPc: fc.FuncPc,
+			CFG:    fc.CFG,
+			IPDom:  fc.IPDom,
+			DynCDP: dcdp,
+		}
+	}
+}
+
+func (g *Goroutine) mergeInto(p *dgtypes.Profile) {
+	p.CallCount += g.CallCount
+	for _, fn := range g.Funcs {
+		if x, has := p.Funcs[fn.FuncPc]; has {
+			x.Merge(fn)
+		} else {
+			p.Funcs[fn.FuncPc] = fn
+		}
+	}
+	for call, count := range g.Calls {
+		p.Calls[call] += count
+	}
+	for edge, count := range g.Flows {
+		p.Flows[edge] += count
+	}
+	for edge, count := range g.Spawns {
+		p.Spawns[edge] += count
+	}
+	for edge, count := range g.Comms {
+		p.Comms[edge] += count
+	}
+	for c, count := range g.Channels {
+		p.Channels[c] += count
+	}
+	for edge, count := range g.Panics {
+		p.Panics[edge] += count
+	}
+	for edge, count := range g.Recovers {
+		p.Recovers[edge] += count
+	}
+	for site, count := range g.Panicked {
+		p.Panicked[site] += count
+	}
+	p.MergePredicates(g.Predicates)
+	for be, pos := range g.Positions {
+		p.Positions[be] = pos
+	}
+	for be, dur := range g.Durations {
+		p.Durations[be] += dur
+	}
+	for funcName, instances := range g.Inputs {
+		p.Inputs[funcName] = append(p.Inputs[funcName], instances...)
+	}
+	for funcName, instances := range g.Outputs {
+		p.Outputs[funcName] = append(p.Outputs[funcName], instances...)
+	}
+	for funcName, exits := range g.Exits {
+		p.Exits[funcName] = append(p.Exits[funcName], exits...)
+	}
+	for typeName, typ := range g.Types {
+		p.Types[typeName] = typ
+	}
+	g.mergeStacks(p)
+}
+
 func (g *Goroutine) Exit() {
+	if g.Segment != nil {
+		exec.endSegment(g)
+	}
 	g.m.Lock()
 	defer g.m.Unlock()
 	g.Closed = true
-	exec.m.Lock()
-	exec.Goroutines[g.GoID] = nil
-	exec.m.Unlock()
+	if exec.trace != nil {
+		exec.trace.GoroutineExit(g.GoID)
+	}
+	exec.removeGoroutine(g.GoID)
 	exec.Merge(g)
 	// Println(fmt.Sprintf("exit goroutine %d", g.GoID))
 }
@@ -0,0 +1,154 @@
+// This file defines the cheaper variants of EnterFunc and EnterBlk which
+// `dynagrok instrument --level` generates calls to.
+
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"math"
+	"math/rand"
+	"time"
+	"unsafe"
+)
+
+// SetLevel records the level the program was instrumented at. The
+// instrumenter calls it from an init function in each instrumented
+// package when the level is not dgtypes.FullLevel.
+func SetLevel(level, every int, rate float64) {
+	execCheck()
+	exec.m.Lock()
+	defer exec.m.Unlock()
+	if every < 1 {
+		every = 1
+	}
+	exec.Profile.Instrumentation = dgtypes.Instrumentation{
+		Level:       dgtypes.Level(level),
+		SampleEvery: every,
+		SampleRate:  rate,
+	}
+}
+
+// EnterFuncNoCD is EnterFunc for dgtypes.NoCDLevel.
+func EnterFuncNoCD(name, pos string, cfg [][]int, ipdom []int) {
+	execCheck()
+	fpc := funcEntry(unsafe.Pointer(&name))
+	enterFunc(dgtypes.NewFuncCallNoCD(name, fpc, cfg, ipdom, time.Now()), name, pos, cfg, ipdom)
+}
+
+// EnterFuncNoDurations is EnterFunc for dgtypes.NoDurationsLevel.
+func EnterFuncNoDurations(name, pos string, cfg [][]int, ipdom []int) {
+	execCheck()
+	fpc := funcEntry(unsafe.Pointer(&name))
+	enterFunc(dgtypes.NewFuncCall(name, fpc, cfg, ipdom, time.Time{}), name, pos, cfg, ipdom)
+}
+
+// EnterFuncFast is EnterFunc for dgtypes.CountsLevel and
+// dgtypes.SampledLevel.
+func EnterFuncFast(name, pos string, cfg [][]int, ipdom []int) {
+	execCheck()
+	fpc := funcEntry(unsafe.Pointer(&name))
+	enterFunc(dgtypes.NewFuncCallNoCD(name, fpc, cfg, ipdom, time.Time{}), name, pos, cfg, ipdom)
+}
+
+// EnterBlkNoCD is EnterBlk without the dynamic control dependence.
+func EnterBlkNoCD(bbid int, pos string) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	fc := g.Stack[len(g.Stack)-1]
+	start := fc.LastTime
+	last := g.flow(fc, bbid, pos)
+	fc.LastTime = time.Now()
+	g.Durations[last] += fc.LastTime.Sub(start)
+	g.spentIn(last, fc.LastTime.Sub(start))
+	if exec.trace != nil {
+		exec.trace.EnterBlk(g.GoID, bbid, pos)
+	}
+}
+
+// EnterBlkNoDurations is EnterBlk without the block durations.
+func EnterBlkNoDurations(bbid int, pos string) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	fc := g.Stack[len(g.Stack)-1]
+	g.flow(fc, bbid, pos)
+	fc.EnterBlk(bbid)
+	if exec.trace != nil {
+		exec.trace.EnterBlk(g.GoID, bbid, pos)
+	}
+}
+
+// EnterBlkFast only counts the flow edge into the block.
+func EnterBlkFast(bbid int, pos string) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	g.flow(g.Stack[len(g.Stack)-1], bbid, pos)
+	if exec.trace != nil {
+		exec.trace.EnterBlk(g.GoID, bbid, pos)
+	}
+}
+
+// EnterBlkSampled counts the flow edge into the block for one in every
+// SampleEvery entrances (or with probability SampleRate). The skipped
+// entrances only move the goroutine to the block.
+func EnterBlkSampled(bbid int, pos string) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	fc := g.Stack[len(g.Stack)-1]
+	if g.skip > 0 {
+		g.skip--
+		fc.Last = dgtypes.BlkEntrance{In: fc.FuncPc, BasicBlockId: bbid}
+		return
+	}
+	g.skip = g.nextSkip(exec.Profile.Instrumentation)
+	g.flow(fc, bbid, pos)
+	if exec.trace != nil {
+		exec.trace.EnterBlk(g.GoID, bbid, pos)
+	}
+}
+
+// EnterBlkFromCondLevel is EnterBlkFromCond for the other levels. level
+// is a dgtypes.Level.
+func EnterBlkFromCondLevel(level, bbid int, pos string) bool {
+	switch dgtypes.Level(level) {
+	case dgtypes.NoCDLevel:
+		EnterBlkNoCD(bbid, pos)
+	case dgtypes.NoDurationsLevel:
+		EnterBlkNoDurations(bbid, pos)
+	case dgtypes.CountsLevel:
+		EnterBlkFast(bbid, pos)
+	case dgtypes.SampledLevel:
+		EnterBlkSampled(bbid, pos)
+	default:
+		EnterBlk(bbid, pos)
+	}
+	return true
+}
+
+// flow moves the call fc to the block bbid and counts the flow edge. It
+// returns the block fc was in. g.m must be held.
+func (g *Goroutine) flow(fc *dgtypes.FuncCall, bbid int, pos string) (last dgtypes.BlkEntrance) {
+	last = fc.Last
+	cur := dgtypes.BlkEntrance{In: fc.FuncPc, BasicBlockId: bbid}
+	fc.Last = cur
+	g.Flows[dgtypes.FlowEdge{Src: last, Targ: cur}]++
+	g.Positions[cur] = pos
+	g.enteredIn(cur)
+	return last
+}
+
+// nextSkip is the number of block entrances to skip before the next
+// sample. With a rate the gaps between samples are geometrically
+// distributed.
+func (g *Goroutine) nextSkip(inst dgtypes.Instrumentation) int {
+	if inst.SampleRate <= 0 || inst.SampleRate >= 1 {
+		return inst.SampleEvery - 1
+	}
+	if g.rand == nil {
+		g.rand = rand.New(rand.NewSource(time.Now().UnixNano() ^ g.GoID))
+	}
+	return int(math.Log(1-g.rand.Float64()) / math.Log(1-inst.SampleRate))
+}
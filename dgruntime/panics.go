@@ -0,0 +1,162 @@
+// This file classifies how the instrumented calls exit: by returning, by
+// being unwound by a panic or by returning after one of their deferred
+// calls recovered a panic. Panics are observed without recovering them
+// so they keep their values and stacks.
+
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// panicking is a panic which is unwinding a goroutine's stack.
+type panicking struct {
+	site    dgtypes.PanicSite
+	unwound int // the depth of the outermost call unwound so far
+	// the failure reported if the panic reaches the outermost call
+	fnName string
+	pos    string
+}
+
+// ExitFuncWith is ExitFunc for the deferred closure the instrumenter
+// generates:
+//
+//	__dgreturned := false
+//	defer func() { dgruntime.ExitFuncWith(name, __dgreturned) }()
+//
+// where __dgreturned is set once the results of a return statement are
+// evaluated (or the body ends). A call which did not return is unwound
+// by a panic, unless runtime.Goexit (eg. t.FailNow) is running its
+// deferred calls. The panic is reported as a failure when it reaches the
+// goroutine's outermost call. A panic an instrumented caller recovers is
+// not a failure.
+func ExitFuncWith(name string, returned bool) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	unwinding := !returned && deferredBy(1) != "runtime.Goexit"
+	if exitFunc(g, name, unwinding) && unwinding && g.crashes {
+		// the goroutine was started by an instrumented go statement so
+		// the panic will crash the program. Write the profile first.
+		Shutdown()
+	}
+}
+
+// PanicValue wraps the values the instrumented program panics with:
+//
+//	panic(dgruntime.PanicValue(v))
+//
+// so the type of v is known when the panic is observed.
+func PanicValue(v interface{}) interface{} {
+	execCheck()
+	g := exec.Goroutine(goid())
+	g.m.Lock()
+	defer g.m.Unlock()
+	g.panicType = fmt.Sprintf("%T", v)
+	return v
+}
+
+// Recovered wraps the calls to recover in the instrumented program:
+//
+//	dgruntime.Recovered(recover())
+//
+// When r is not nil the call whose deferred call recovered the panic
+// exits as recovered.
+func Recovered(r interface{}) interface{} {
+	if r == nil {
+		return nil
+	}
+	execCheck()
+	g := exec.Goroutine(goid())
+	g.m.Lock()
+	defer g.m.Unlock()
+	// the top of the stack is the deferred call and below it the call
+	// which deferred it.
+	depth := len(g.Stack) - 2
+	if depth < 1 {
+		return r
+	}
+	g.recovered = depth
+	if g.unwinding == nil {
+		// recovered before the call which panicked exited
+		g.panicType = fmt.Sprintf("%T", r)
+		g.panicked(g.Stack[depth], depth+1)
+	}
+	return r
+}
+
+// deferredBy names what ran the deferred call skip frames above its
+// caller: "runtime.gopanic", "runtime.Goexit" or "" for a return. The
+// runtime frames between the deferred call and the call which deferred
+// it tell them apart.
+func deferredBy(skip int) string {
+	pcs := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip+2, pcs)])
+	frames.Next() // the deferred call
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "runtime.") {
+			return ""
+		}
+		switch frame.Function {
+		case "runtime.gopanic", "runtime.Goexit":
+			return frame.Function
+		}
+		if !more {
+			return ""
+		}
+	}
+}
+
+// exits classifies the exit of the call fc at depth in the stack and
+// returns the edges its exit edge should be counted in and its label. The
+// first call unwound by a panic records where it panicked. g.m must be
+// held.
+func (g *Goroutine) exits(fc *dgtypes.FuncCall, depth int, unwinding bool) (map[dgtypes.FlowEdge]int, string) {
+	if g.recovered == depth {
+		g.recovered = 0
+		g.unwinding = nil
+		return g.Recovers, dgtypes.RecoverLabel
+	}
+	if unwinding {
+		if g.unwinding == nil {
+			g.panicked(fc, depth)
+		}
+		g.unwinding.unwound = depth
+		return g.Panics, dgtypes.PanicLabel
+	}
+	if g.unwinding != nil && depth < g.unwinding.unwound {
+		// a call the dgruntime cannot see recovered the panic
+		g.unwinding = nil
+	}
+	return g.Flows, ""
+}
+
+// panicked starts unwinding a panic in the block fc is in. The panic
+// value's type is the one PanicValue (or Recovered) saw last.
+func (g *Goroutine) panicked(fc *dgtypes.FuncCall, unwound int) {
+	typ := g.panicType
+	if typ == "" {
+		typ = dgtypes.UnknownPanic
+	}
+	g.panicType = ""
+	site := dgtypes.PanicSite{Blk: fc.Last, Type: typ}
+	g.unwinding = &panicking{
+		site:    site,
+		unwound: unwound,
+		fnName:  fc.Name,
+		pos:     g.Positions[fc.Last],
+	}
+	g.Panicked[site]++
+	if exec.trace != nil {
+		exec.trace.Panic(g.GoID, site)
+	}
+}
+
+// Unwinding reports whether the deferred call which called it was run by
+// a panic (rather than by a return or runtime.Goexit). See dgtest.Segment.
+func Unwinding() bool {
+	return deferredBy(1) == "runtime.gopanic"
+}
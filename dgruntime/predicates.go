@@ -0,0 +1,183 @@
+// This file defines the calls `dynagrok instrument --predicates` wraps
+// around the conditions of if and for statements and those
+// `dynagrok objectstate --predicates` adds after calls and assignments.
+
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// Branch records that the condition expr at site evaluated to cond and
+// returns cond.
+func Branch(site, expr string, cond bool) bool {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	g.branch(site, expr, cond)
+	return cond
+}
+
+// BranchOperands is Branch for a condition which compares the simple
+// operands x and y. Their values are recorded as well, bounded for each
+// site by the goroutine (see operands) and by the merges (see
+// dgtypes.Profile.MergePredicates).
+func BranchOperands(site, expr string, cond bool, x, y interface{}) bool {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	g.branch(site, expr, cond)
+	g.operands(dgtypes.Predicate{
+		Kind:  dgtypes.OperandsPredicate,
+		Site:  site,
+		Expr:  expr,
+		Value: operandValue(x) + ", " + operandValue(y),
+	})
+	return cond
+}
+
+// operands records the operands predicate. Once the goroutine has
+// dgtypes.MaxOperandValues values for the site the new ones are counted
+// as dgtypes.OtherOperands. g must be locked (see lockOwn).
+func (g *Goroutine) operands(pred dgtypes.Predicate) {
+	if _, has := g.Predicates[pred]; !has {
+		other := pred
+		other.Value = dgtypes.OtherOperands
+		if g.operandValues[other] >= dgtypes.MaxOperandValues {
+			pred = other
+		} else {
+			g.operandValues[other]++
+		}
+	}
+	g.predicate(pred)
+}
+
+// branch records the branch predicate. g must be locked (see lockOwn).
+func (g *Goroutine) branch(site, expr string, cond bool) {
+	g.predicate(dgtypes.Predicate{
+		Kind:  dgtypes.BranchPredicate,
+		Site:  site,
+		Expr:  expr,
+		Value: strconv.FormatBool(cond),
+	})
+}
+
+// predicate records that pred held. g must be locked (see lockOwn).
+func (g *Goroutine) predicate(pred dgtypes.Predicate) {
+	g.Predicates[pred]++
+	if exec.trace != nil {
+		exec.trace.Predicate(g.GoID, pred)
+	}
+}
+
+// operandValue formats the operand with its strings quoted.
+func operandValue(v interface{}) string {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.String {
+		return strconv.Quote(rv.String())
+	}
+	return fmt.Sprint(v)
+}
+
+// A Local is a variable in scope at a site instrumented by
+// `dynagrok objectstate --predicates` and its value.
+type Local struct {
+	Name string
+	Val  interface{}
+}
+
+// ReturnPredicates records the sign of v (or whether it is nil), a result
+// of the call at site, and how it compares to the locals.
+func ReturnPredicates(site, expr string, v interface{}, locals ...Local) {
+	scalarPredicates(dgtypes.ReturnPredicate, site, expr, v, locals)
+}
+
+// AssignPredicates records the sign of v (or whether it is nil), the
+// value assigned to expr at site, and how it compares to the locals.
+func AssignPredicates(site, expr string, v interface{}, locals ...Local) {
+	scalarPredicates(dgtypes.AssignPredicate, site, expr, v, locals)
+}
+
+func scalarPredicates(kind, site, expr string, v interface{}, locals []Local) {
+	execCheck()
+	g := exec.Goroutine(goid())
+	defer g.unlockOwn(g.lockOwn())
+	g.predicate(dgtypes.Predicate{
+		Kind:  kind,
+		Site:  site,
+		Expr:  expr,
+		Value: sign(v),
+	})
+	for _, l := range locals {
+		if c, ok := compare(v, l.Val); ok {
+			g.predicate(dgtypes.Predicate{
+				Kind:  dgtypes.PairPredicate,
+				Site:  site,
+				Expr:  expr + ", " + l.Name,
+				Value: c,
+			})
+		}
+	}
+}
+
+// sign is "<0", "==0" or ">0" for a number (or "NaN") and "nil" or
+// "non-nil" for anything else.
+func sign(v interface{}) string {
+	if v == nil {
+		return "nil"
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan, reflect.Func:
+		if rv.IsNil() {
+			return "nil"
+		}
+		return "non-nil"
+	}
+	c, ok := compare(v, reflect.Zero(rv.Type()).Interface())
+	if !ok {
+		if isFloat(rv) {
+			return "NaN"
+		}
+		return "non-nil"
+	}
+	return c + "0"
+}
+
+// compare returns how ("<", "==" or ">") the number x compares to the
+// number y of the same type. It is false if they are not numbers or either
+// is NaN.
+func compare(x, y interface{}) (string, bool) {
+	rx, ry := reflect.ValueOf(x), reflect.ValueOf(y)
+	if !rx.IsValid() || !ry.IsValid() || rx.Kind() != ry.Kind() {
+		return "", false
+	}
+	var less, greater bool
+	switch rx.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		less, greater = rx.Int() < ry.Int(), rx.Int() > ry.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		less, greater = rx.Uint() < ry.Uint(), rx.Uint() > ry.Uint()
+	case reflect.Float32, reflect.Float64:
+		a, b := rx.Float(), ry.Float()
+		if a != a || b != b {
+			return "", false
+		}
+		less, greater = a < b, a > b
+	default:
+		return "", false
+	}
+	switch {
+	case less:
+		return "<", true
+	case greater:
+		return ">", true
+	}
+	return "==", true
+}
+
+func isFloat(rv reflect.Value) bool {
+	return rv.Kind() == reflect.Float32 || rv.Kind() == reflect.Float64
+}
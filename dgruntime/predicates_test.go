@@ -0,0 +1,189 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+)
+
+func TestSign(t *testing.T) {
+	var nilPtr *int
+	var nilErr error
+	cases := []struct {
+		v    interface{}
+		sign string
+	}{
+		{-3, "<0"},
+		{0, "==0"},
+		{uint8(7), ">0"},
+		{-0.5, "<0"},
+		{math.NaN(), "NaN"},
+		{nilErr, "nil"},
+		{errors.New("x"), "non-nil"},
+		{nilPtr, "nil"},
+		{new(int), "non-nil"},
+	}
+	for _, c := range cases {
+		if s := sign(c.v); s != c.sign {
+			t.Errorf("sign(%#v) = %q expected %q", c.v, s, c.sign)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		x, y interface{}
+		c    string
+		ok   bool
+	}{
+		{1, 2, "<", true},
+		{int64(2), int64(2), "==", true},
+		{uint(3), uint(2), ">", true},
+		{1.5, math.NaN(), "", false},
+		{1, int64(1), "", false},
+		{"a", "b", "", false},
+	}
+	for _, c := range cases {
+		if s, ok := compare(c.x, c.y); s != c.c || ok != c.ok {
+			t.Errorf("compare(%#v, %#v) = %q, %v expected %q, %v", c.x, c.y, s, ok, c.c, c.ok)
+		}
+	}
+}
+
+const predicatesPos = "predicates_test.go"
+
+// below is instrumented by hand (with --predicate-values) as if it were
+//
+//	func below(x, limit int) bool {
+//		if x < limit {
+//			return true
+//		}
+//		return false
+//	}
+func below(x, limit int) bool {
+	EnterFunc("dgruntime.below", predicatesPos, [][]int{{1, 2}, {3}, {3}, {}}, []int{3, 3, 3, 3})
+	defer ExitFunc("dgruntime.below")
+	if BranchOperands(predicatesPos, "x < limit", x < limit, x, limit) {
+		EnterBlk(1, predicatesPos)
+		return true
+	}
+	EnterBlk(2, predicatesPos)
+	return false
+}
+
+// Each goroutine compares its own operands. The operand values kept for
+// the site are bounded across the goroutines, the values kept first are
+// counted in full and the rest are counted as the other operands.
+func TestPredicates(t *testing.T) {
+	_, restore := testExecution(t)
+	defer restore()
+	const goroutines = 2 * dgtypes.MaxOperandValues
+	const limit = dgtypes.MaxOperandValues
+	var wg sync.WaitGroup
+	for k := 0; k < goroutines; k++ {
+		wg.Add(1)
+		go func(k int) {
+			defer wg.Done()
+			for j := 0; j <= k; j++ {
+				below(k, limit)
+			}
+		}(k)
+	}
+	wg.Wait()
+	shutdown(exec)
+
+	p := exec.Profile
+	var held, failed int
+	for k := 0; k < goroutines; k++ {
+		if k < limit {
+			held += k + 1
+		} else {
+			failed += k + 1
+		}
+	}
+	branch := dgtypes.Predicate{Kind: dgtypes.BranchPredicate, Site: predicatesPos, Expr: "x < limit"}
+	branch.Value = "true"
+	if n := p.Predicates[branch]; n != held {
+		t.Errorf("expected the condition to hold %d times got %d", held, n)
+	}
+	branch.Value = "false"
+	if n := p.Predicates[branch]; n != failed {
+		t.Errorf("expected the condition to fail %d times got %d", failed, n)
+	}
+	kept := 0
+	total := 0
+	pred := dgtypes.Predicate{Kind: dgtypes.OperandsPredicate, Site: predicatesPos, Expr: "x < limit"}
+	for k := 0; k < goroutines; k++ {
+		pred.Value = fmt.Sprintf("%d, %d", k, limit)
+		if n, has := p.Predicates[pred]; has {
+			kept++
+			total += n
+			if n != k+1 {
+				t.Errorf("expected the operands %v %d times got %d", pred.Value, k+1, n)
+			}
+		}
+	}
+	if kept != dgtypes.MaxOperandValues {
+		t.Errorf("expected %d operand values got %d", dgtypes.MaxOperandValues, kept)
+	}
+	pred.Value = dgtypes.OtherOperands
+	if n := p.Predicates[pred]; n != held+failed-total {
+		t.Errorf("expected the other operands %d times got %d", held+failed-total, n)
+	}
+}
+
+// belowAll is instrumented by hand as if it were
+//
+//	func belowAll(n int) {
+//		for k := 0; k < n; k++ {
+//			below(k, n)
+//			below(k, n)
+//		}
+//	}
+//
+// and calls check with its goroutine before it returns.
+func belowAll(n int, check func(g *Goroutine)) {
+	EnterFunc("dgruntime.belowAll", predicatesPos, [][]int{{1}, {1, 2}, {}}, []int{1, 2, 2})
+	defer ExitFunc("dgruntime.belowAll")
+	for k := 0; k < n; k++ {
+		EnterBlk(1, predicatesPos)
+		below(k, n)
+		below(k, n)
+	}
+	EnterBlk(2, predicatesPos)
+	check(exec.Goroutine(goid()))
+}
+
+// A goroutine keeps at most MaxOperandValues operand values for a site
+// itself, the rest are counted as the other operands before any merge.
+func TestPredicatesBounded(t *testing.T) {
+	_, restore := testExecution(t)
+	defer restore()
+	const values = 3 * dgtypes.MaxOperandValues
+	const others = 2 * (values - dgtypes.MaxOperandValues)
+	other := dgtypes.Predicate{Kind: dgtypes.OperandsPredicate, Site: predicatesPos, Expr: "x < limit", Value: dgtypes.OtherOperands}
+	belowAll(values, func(g *Goroutine) {
+		kept := 0
+		for pred, n := range g.Predicates {
+			if pred.Kind == dgtypes.OperandsPredicate && pred.Value != dgtypes.OtherOperands {
+				kept++
+				if n != 2 {
+					t.Errorf("expected the operands %v twice got %d", pred.Value, n)
+				}
+			}
+		}
+		if kept != dgtypes.MaxOperandValues {
+			t.Errorf("expected %d operand values got %d", dgtypes.MaxOperandValues, kept)
+		}
+		if n := g.Predicates[other]; n != others {
+			t.Errorf("expected the other operands %d times got %d", others, n)
+		}
+	})
+	shutdown(exec)
+	if n := exec.Profile.Predicates[other]; n != others {
+		t.Errorf("expected the profile to count the other operands %d times got %d", others, n)
+	}
+}
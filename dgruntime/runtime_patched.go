@@ -0,0 +1,23 @@
+//go:build !dgstock
+// +build !dgstock
+
+// This file binds dgruntime to the patched runtime in src/runtime. It is
+// used unless the instrumented program is built with the dgstock tag.
+
+package dgruntime
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// goid is the id of the current goroutine
+func goid() int64 {
+	return runtime.GoID()
+}
+
+// funcEntry finds the entry pc of the function which called the
+// dgruntime function whose first argument is arg0.
+func funcEntry(arg0 unsafe.Pointer) uintptr {
+	return runtime.FuncForPC(runtime.GetCallerPC(arg0)).Entry()
+}
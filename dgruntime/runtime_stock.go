@@ -0,0 +1,48 @@
+//go:build dgstock
+// +build dgstock
+
+// This file lets dgruntime run on an unmodified Go runtime. It is
+// selected by building the instrumented program with the dgstock tag.
+// It is slower than the patched runtime as the goroutine id has to be
+// read from the header of a stack trace.
+
+package dgruntime
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"unsafe"
+)
+
+var goroutinePrefix = []byte("goroutine ")
+
+// goid is the id of the current goroutine. It is parsed from the
+// "goroutine 123 [running]:" header runtime.Stack writes.
+func goid() int64 {
+	var buf [64]byte
+	n := runtime.Stack(buf[:], false)
+	b := bytes.TrimPrefix(buf[:n], goroutinePrefix)
+	if i := bytes.IndexByte(b, ' '); i >= 0 {
+		b = b[:i]
+	}
+	id, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		panic(fmt.Errorf("dynagrok could not parse the goroutine id from %q: %v", buf[:n], err))
+	}
+	return id
+}
+
+// funcEntry finds the entry pc of the function which called the
+// dgruntime function whose first argument is arg0. The argument is
+// unused; the stock runtime can only walk the stack.
+func funcEntry(arg0 unsafe.Pointer) uintptr {
+	// 0 is funcEntry, 1 is the dgruntime function, 2 is the instrumented
+	// function
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return 0
+	}
+	return runtime.FuncForPC(pc).Entry()
+}
@@ -0,0 +1,115 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A Segment is a labeled slice of a goroutine's execution (a test case or
+// a request) which gets its own profile. When the segment ends its flow
+// graph is written to $DGPROF/pass or $DGPROF/fail (depending on whether
+// a failure was reported during the segment) so the directories can be
+// handed straight to `dynagrok localize`.
+type Segment struct {
+	Name    string
+	Id      int
+	Failed  bool
+	Profile *dgtypes.Profile
+}
+
+// BeginSegment starts a new segment on the current goroutine. Everything
+// the goroutine records until EndSegment goes into the segment's profile
+// rather than the program's profile. A segment which is already open on
+// the goroutine is ended first.
+func BeginSegment(name string) {
+	execCheck()
+	exec.beginSegment(exec.Goroutine(goid()), name)
+}
+
+// EndSegment ends the current goroutine's segment and writes out its
+// flow graph. If the goroutine's outermost instrumented call already
+// returned (eg. the handler wrapped by dghttp) the goroutine exits too.
+func EndSegment() {
+	execCheck()
+	g := exec.Goroutine(goid())
+	if g.Segment == nil {
+		return
+	}
+	exec.endSegment(g)
+	if len(g.Stack) <= 1 {
+		g.Exit()
+	}
+}
+
+// FailSegment marks the current goroutine's segment as failed. The
+// Report* functions do this automatically.
+func FailSegment() {
+	execCheck()
+	if g := exec.Goroutine(goid()); g.Segment != nil {
+		g.Segment.Failed = true
+	}
+}
+
+func (e *Execution) beginSegment(g *Goroutine, name string) {
+	if g.Segment != nil {
+		e.endSegment(g)
+	}
+	e.Merge(g.cut())
+	profile := dgtypes.NewProfile()
+	e.m.Lock()
+	id := e.segments
+	e.segments++
+	profile.Instrumentation = e.Profile.Instrumentation
+	e.m.Unlock()
+	g.m.Lock()
+	g.Segment = &Segment{
+		Name:    name,
+		Id:      id,
+		Profile: profile,
+	}
+	g.m.Unlock()
+}
+
+func (e *Execution) endSegment(g *Goroutine) {
+	g.m.Lock()
+	s := g.Segment
+	g.Segment = nil
+	g.cutLocked().mergeInto(s.Profile)
+	stackFuncs(s.Profile.Funcs, g.Stack[1:])
+	g.m.Unlock()
+	e.writeSegment(s)
+}
+
+func (e *Execution) writeSegment(s *Segment) {
+	if s.Profile.Empty() {
+		return
+	}
+	dir := pjoin(e.OutputDir, "pass")
+	if s.Failed {
+		dir = pjoin(e.OutputDir, "fail")
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|0775); err != nil {
+		panic(fmt.Errorf("dynagrok's dgruntime could not make directory %v", dir))
+	}
+	path := pjoin(dir, fmt.Sprintf("%d-%v.txt", s.Id, segmentFileName(s.Name)))
+	fmt.Println("writing segment flow-graph to:", path)
+	f, err := os.Create(path)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+	s.Profile.WriteSimple(f)
+}
+
+func segmentFileName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '-', r == '.':
+			return r
+		default:
+			return '_'
+		}
+	}, name)
+}
@@ -0,0 +1,134 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"time"
+)
+
+// The most nodes of a goroutine's calling context tree and the deepest
+// call stack it keeps. The calls it has no room for are counted in a
+// single dgtypes.TruncatedSite context.
+const (
+	maxCtxNodes = 1 << 16
+	maxCtxDepth = dgtypes.MaxStackDepth
+)
+
+// callCtx is a node of a goroutine's calling context tree: the calls
+// made from the block site with the call stack of parent. The goroutine
+// keeps the context of each call on its stack and counts the blocks
+// entered by context, they become the dgtypes.StackBlk of the profile.
+type callCtx struct {
+	parent   *callCtx
+	site     dgtypes.BlkEntrance
+	depth    int
+	tree     *ctxTree
+	children map[dgtypes.BlkEntrance]*callCtx
+}
+
+// ctxTree is what the nodes of a calling context tree share.
+type ctxTree struct {
+	nodes     int
+	truncated *callCtx
+}
+
+// newCallCtx is the root of a new calling context tree.
+func newCallCtx() *callCtx {
+	return &callCtx{tree: &ctxTree{}}
+}
+
+// stacked reports whether the calling contexts are kept. They are only
+// kept at dgtypes.FullLevel, the cheaper levels skip the tree (and the
+// pprof profile falls back to a sample for each block).
+func stacked() bool {
+	return exec.Profile.Instrumentation.Level == dgtypes.FullLevel
+}
+
+// stackBlk is a block entered in a calling context.
+type stackBlk struct {
+	ctx *callCtx
+	blk dgtypes.BlkEntrance
+}
+
+// call is the context of the calls made from the block site. Only the
+// goroutine which owns the tree adds to it. Once the tree is full, or the
+// stack is too deep, the calls (and the calls they make) are in the
+// truncated context.
+func (c *callCtx) call(site dgtypes.BlkEntrance) *callCtx {
+	if n, has := c.children[site]; has {
+		return n
+	}
+	t := c.tree
+	if c == t.truncated {
+		return c
+	}
+	if t.nodes >= maxCtxNodes || c.depth >= maxCtxDepth {
+		if t.truncated == nil {
+			root := c
+			for root.parent != nil {
+				root = root.parent
+			}
+			t.truncated = &callCtx{parent: root, site: dgtypes.TruncatedSite, depth: 1, tree: t}
+		}
+		return t.truncated
+	}
+	if c.children == nil {
+		c.children = make(map[dgtypes.BlkEntrance]*callCtx)
+	}
+	n := &callCtx{parent: c, site: site, depth: c.depth + 1, tree: t}
+	c.children[site] = n
+	t.nodes++
+	return n
+}
+
+// stackKey is the dgtypes.StackKey of the context. The merges may call
+// it while the goroutine runs, it only reads the parents and the sites
+// which never change.
+func (c *callCtx) stackKey() string {
+	var sites []dgtypes.BlkEntrance
+	for n := c; n.parent != nil && len(sites) < dgtypes.MaxStackDepth; n = n.parent {
+		if n.site.In != 0 {
+			sites = append(sites, n.site)
+		}
+	}
+	return dgtypes.StackKey(sites)
+}
+
+// ctx is the context of the goroutine's current call.
+func (g *Goroutine) ctx() *callCtx {
+	return g.ctxs[len(g.ctxs)-1]
+}
+
+// enteredIn counts an entrance of the block in the current call's context.
+func (g *Goroutine) enteredIn(blk dgtypes.BlkEntrance) {
+	if stacked() {
+		g.stacks[stackBlk{g.ctx(), blk}]++
+	}
+}
+
+// spentIn adds the time spent in the block to the current call's context.
+func (g *Goroutine) spentIn(blk dgtypes.BlkEntrance, dur time.Duration) {
+	if stacked() {
+		g.stackDurations[stackBlk{g.ctx(), blk}] += dur
+	}
+}
+
+func (g *Goroutine) mergeStacks(p *dgtypes.Profile) {
+	keys := make(map[*callCtx]string)
+	key := func(sb stackBlk) dgtypes.StackBlk {
+		k, has := keys[sb.ctx]
+		if !has {
+			k = sb.ctx.stackKey()
+			keys[sb.ctx] = k
+		}
+		return dgtypes.StackBlk{Stack: k, Blk: sb.blk}
+	}
+	for sb, count := range g.stacks {
+		p.Stacks[key(sb)] += count
+	}
+	for sb, count := range g.stackCalls {
+		p.StackCalls[key(sb)] += count
+	}
+	for sb, dur := range g.stackDurations {
+		p.StackDurations[key(sb)] += dur
+	}
+}
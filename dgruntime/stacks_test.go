@@ -0,0 +1,172 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"testing"
+)
+
+// outer is instrumented by hand as if it were
+//
+//	func outer(n int) {
+//		looped(n)
+//		looped(n)
+//	}
+func outer(n int) {
+	EnterFunc("dgruntime.outer", stressPos, [][]int{{1}, {2}, {}}, []int{1, 2, 2})
+	defer ExitFunc("dgruntime.outer")
+	EnterBlk(1, stressPos)
+	looped(n)
+	looped(n)
+	EnterBlk(2, stressPos)
+}
+
+// The blocks are counted by the call stack they were entered with.
+func TestStacks(t *testing.T) {
+	_, restore := testExecution(t)
+	defer restore()
+	const loops = 5
+	outer(loops)
+	shutdown(exec)
+
+	p := exec.Profile
+	pcs := make(map[string]uintptr)
+	for pc, f := range p.Funcs {
+		pcs[f.Name] = pc
+	}
+	site := dgtypes.BlkEntrance{In: pcs["dgruntime.outer"], BasicBlockId: 1}
+	expected := map[dgtypes.StackBlk]int{
+		{Stack: "", Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.outer"]}}: 1,
+		{Stack: "", Blk: site}: 3, // entered and returned to twice
+		{Stack: "", Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.outer"], BasicBlockId: 2}}:                                             1,
+		{Stack: dgtypes.StackKey([]dgtypes.BlkEntrance{site}), Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.looped"]}}:                  2,
+		{Stack: dgtypes.StackKey([]dgtypes.BlkEntrance{site}), Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.looped"], BasicBlockId: 1}}: 2 * loops,
+		{Stack: dgtypes.StackKey([]dgtypes.BlkEntrance{site}), Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.looped"], BasicBlockId: 2}}: 2,
+	}
+	if len(p.Stacks) != len(expected) {
+		t.Errorf("expected %d stacks got %v", len(expected), p.Stacks)
+	}
+	for sb, count := range expected {
+		if p.Stacks[sb] != count {
+			t.Errorf("expected %v %d times got %d", sb, count, p.Stacks[sb])
+		}
+	}
+	entrances := make(map[dgtypes.BlkEntrance]int)
+	for e, count := range p.Flows {
+		entrances[e.Targ] += count
+	}
+	for sb, count := range p.Stacks {
+		entrances[sb.Blk] -= count
+	}
+	for blk, count := range entrances {
+		// the goroutine's entry is only returned to
+		if count != 0 && blk != (dgtypes.BlkEntrance{}) {
+			t.Errorf("the stacks of %v do not add up to its entrances (%d off)", blk, count)
+		}
+	}
+	calls := map[dgtypes.StackBlk]int{
+		{Stack: "", Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.outer"]}}:                                             1,
+		{Stack: dgtypes.StackKey([]dgtypes.BlkEntrance{site}), Blk: dgtypes.BlkEntrance{In: pcs["dgruntime.looped"]}}: 2,
+	}
+	if len(p.StackCalls) != len(calls) {
+		t.Errorf("expected %d calls by stack got %v", len(calls), p.StackCalls)
+	}
+	for sb, count := range calls {
+		if p.StackCalls[sb] != count {
+			t.Errorf("expected %v to be called %d times got %d", sb, count, p.StackCalls[sb])
+		}
+	}
+	if len(p.StackDurations) == 0 {
+		t.Error("no time was recorded by stack")
+	}
+}
+
+// deep is instrumented by hand as if it were
+//
+//	func deep(n int) {
+//		if n > 0 {
+//			deep(n - 1)
+//		}
+//	}
+func deep(n int) {
+	EnterFunc("dgruntime.deep", stressPos, [][]int{{1, 2}, {2}, {}}, []int{2, 2, 2})
+	defer ExitFunc("dgruntime.deep")
+	if n > 0 {
+		EnterBlk(1, stressPos)
+		deep(n - 1)
+	}
+	EnterBlk(2, stressPos)
+}
+
+// The calls below the deepest stack the tree keeps are all counted in the
+// truncated context.
+func TestStacksTruncated(t *testing.T) {
+	_, restore := testExecution(t)
+	defer restore()
+	const calls = 2*maxCtxDepth + 1
+	deep(calls - 1)
+	shutdown(exec)
+
+	p := exec.Profile
+	truncated := dgtypes.StackKey([]dgtypes.BlkEntrance{dgtypes.TruncatedSite})
+	total, inTruncated := 0, 0
+	for sb, count := range p.StackCalls {
+		if n := len(sb.Sites()); n > maxCtxDepth {
+			t.Errorf("expected at most %d call sites got %d", maxCtxDepth, n)
+		}
+		total += count
+		if sb.Stack == truncated {
+			inTruncated += count
+		}
+	}
+	if total != calls {
+		t.Errorf("expected %d calls by stack got %d", calls, total)
+	}
+	if expected := calls - maxCtxDepth; inTruncated != expected {
+		t.Errorf("expected %d calls in the truncated context got %d", expected, inTruncated)
+	}
+}
+
+// Once the tree is full every new call is in the single truncated context.
+func TestCallCtxFull(t *testing.T) {
+	root := newCallCtx()
+	for i := 0; i < maxCtxNodes; i++ {
+		root.call(dgtypes.BlkEntrance{In: 1, BasicBlockId: i})
+	}
+	kept := root.call(dgtypes.BlkEntrance{In: 1})
+	if kept.site != (dgtypes.BlkEntrance{In: 1}) {
+		t.Errorf("expected the existing context to be kept got %v", kept.site)
+	}
+	over := kept.call(dgtypes.BlkEntrance{In: 2})
+	if over.site != dgtypes.TruncatedSite || over.parent != root {
+		t.Fatalf("expected the truncated context got %v", over.site)
+	}
+	if root.call(dgtypes.BlkEntrance{In: 3}) != over || over.call(dgtypes.BlkEntrance{In: 4}) != over {
+		t.Error("expected a single truncated context")
+	}
+	if root.tree.nodes != maxCtxNodes {
+		t.Errorf("expected %d nodes got %d", maxCtxNodes, root.tree.nodes)
+	}
+	if key := over.stackKey(); key != dgtypes.StackKey([]dgtypes.BlkEntrance{dgtypes.TruncatedSite}) {
+		t.Errorf("expected the truncated stack got %v", key)
+	}
+}
+
+// The cheaper levels do not keep the calling contexts.
+func TestStacksLevels(t *testing.T) {
+	_, restore := testExecution(t)
+	defer restore()
+	exec.Profile.Instrumentation.Level = dgtypes.CountsLevel
+	outer(5)
+	shutdown(exec)
+
+	p := exec.Profile
+	if len(p.Flows) == 0 {
+		t.Fatal("no flows were recorded")
+	}
+	if len(p.Stacks) != 0 || len(p.StackCalls) != 0 || len(p.StackDurations) != 0 {
+		t.Errorf("expected no stacks got %v %v %v", p.Stacks, p.StackCalls, p.StackDurations)
+	}
+	if g := exec.Goroutine(goid()); g.ctx().tree.nodes != 0 {
+		t.Errorf("expected no calling contexts got %d", g.ctx().tree.nodes)
+	}
+}
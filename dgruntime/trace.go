@@ -0,0 +1,116 @@
+package dgruntime
+
+import (
+	"dgruntime/dgtypes"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// flushEvery is how often the trace is flushed to disk so a crash loses
+// at most this much of it.
+const flushEvery = 100 * time.Millisecond
+
+// tracer streams events to the trace file as they happen. It is enabled
+// by setting DGTRACE (the trace is written to $DGPROF/flow-trace).
+type tracer struct {
+	m      sync.Mutex
+	f      *os.File
+	w      *dgtypes.TraceWriter
+	closed bool
+	done   chan bool
+}
+
+func newTracer(path string) *tracer {
+	f, err := os.Create(path)
+	if err != nil {
+		panic(fmt.Errorf("dynagrok's dgruntime could not create the trace %v: %v", path, err))
+	}
+	w, err := dgtypes.NewTraceWriter(f)
+	if err != nil {
+		panic(fmt.Errorf("dynagrok's dgruntime could not write the trace %v: %v", path, err))
+	}
+	t := &tracer{
+		f:    f,
+		w:    w,
+		done: make(chan bool),
+	}
+	go t.flusher()
+	return t
+}
+
+func (t *tracer) flusher() {
+	ticker := time.NewTicker(flushEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.do(t.w.Flush)
+		case <-t.done:
+			return
+		}
+	}
+}
+
+func (t *tracer) do(write func() error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.closed {
+		return
+	}
+	if err := write(); err != nil {
+		panic(fmt.Errorf("dynagrok's dgruntime could not write the trace: %v", err))
+	}
+}
+
+func (t *tracer) EnterBlk(goid int64, bbid int, pos string) {
+	t.do(func() error { return t.w.EnterBlk(goid, bbid, pos) })
+}
+
+func (t *tracer) EnterFunc(goid int64, fpc uintptr, name, pos string, cfg [][]int, ipdom []int) {
+	t.do(func() error { return t.w.EnterFunc(goid, fpc, name, pos, cfg, ipdom) })
+}
+
+func (t *tracer) ExitFunc(goid int64, label string) {
+	t.do(func() error { return t.w.ExitFunc(goid, label) })
+}
+
+func (t *tracer) Spawned(goid int64, from dgtypes.BlkEntrance) {
+	t.do(func() error { return t.w.Spawned(goid, from) })
+}
+
+func (t *tracer) Comm(goid int64, c dgtypes.ChanComm) {
+	t.do(func() error { return t.w.Comm(goid, c) })
+}
+
+func (t *tracer) Panic(goid int64, site dgtypes.PanicSite) {
+	t.do(func() error { return t.w.Panic(goid, site) })
+}
+
+func (t *tracer) Predicate(goid int64, pred dgtypes.Predicate) {
+	t.do(func() error { return t.w.Predicate(goid, pred) })
+}
+
+func (t *tracer) GoroutineStart(goid int64) {
+	t.do(func() error { return t.w.GoroutineStart(goid) })
+}
+
+func (t *tracer) GoroutineExit(goid int64) {
+	t.do(func() error { return t.w.GoroutineExit(goid) })
+}
+
+func (t *tracer) Fail(goid int64, fnName string, bbid int, pos string) {
+	t.do(func() error { return t.w.Fail(goid, fnName, bbid, pos) })
+}
+
+func (t *tracer) Close() {
+	t.do(func() error {
+		close(t.done)
+		t.closed = true
+		if err := t.w.Flush(); err != nil {
+			return err
+		}
+		return t.f.Close()
+	})
+}
@@ -13,7 +13,7 @@ import (
 )
 
 const (
-	profilePath = "/tmp/dynagrok-profile/object-profiles.json"
+	profilePath = "/tmp/dynagrok-profile/object-profiles.bin"
 	failPath    = "fail"
 	passPath    = "pass"
 	numtests    = 1000
@@ -38,8 +38,11 @@ Option Flags
 			if len(args) != 1 {
 				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
 			}
-			pkgName := args[0]
-			program, err := cmd.LoadPkg(c, pkgName)
+			pkgName, pkgDir, err := cmd.ResolvePkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			program, err := cmd.LoadPkg(c, pkgDir, pkgName)
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
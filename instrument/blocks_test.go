@@ -4,9 +4,17 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/timtadh/data-structures/test"
+	"golang.org/x/tools/go/loader"
+
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 )
 
 func TestSanity(x *testing.T) {
@@ -47,12 +55,7 @@ func main() {
 	}
 }
 
-type mockDo struct {
-	Block []*[]ast.Stmt
-	Id    []int
-}
-
-// Should do() the empty block and then stop
+// An empty function has (at most) a single empty block
 func TestEmptyFunc(x *testing.T) {
 	t := (*test.T)(x)
 
@@ -69,17 +72,270 @@ func TestEmptyFunc(x *testing.T) {
 	}
 
 	if funcD, ok := f.Decls[0].(*ast.FuncDecl); ok {
-		mDo := mockDo{make([]*[]ast.Stmt, 0), make([]int, 0)}
+		cfg := analysis.BuildCFG(fset, "main", funcD, &funcD.Body.List)
+		t.Assert(len(cfg.Blocks) <= 1, "expected at most one block got %v", cfg)
+		//ast.Print(fset, f)
+	}
+}
+
+// parseFunc parses src and builds the CFG of its first function for an
+// instrumenter which only inserts EnterBlk calls.
+func parseFunc(t *test.T, src string) (*instrumenter, *analysis.CFG, *ast.FuncDecl) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "blocks.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := f.Decls[0].(*ast.FuncDecl)
+	i := &instrumenter{
+		program: &loader.Program{Fset: fset},
+		entered: make(map[int]bool),
+	}
+	return i, analysis.BuildCFG(fset, fn.Name.Name, fn, &fn.Body.List), fn
+}
 
-		blocks(&funcD.Body.List, nil, func(blk *[]ast.Stmt, id int) error {
-			mDo.Block = append(mDo.Block, blk)
-			mDo.Id = append(mDo.Id, id)
-			return nil
-		})
+// enters lists the blocks entered by the EnterBlk calls in the list.
+func enters(list []ast.Stmt) []int {
+	var ids []int
+	for _, stmt := range list {
+		if l, ok := stmt.(*ast.LabeledStmt); ok {
+			stmt = l.Stmt
+		}
+		if afterEnterBlk([]ast.Stmt{stmt}) == 0 {
+			continue
+		}
+		call := stmt.(*ast.ExprStmt).X.(*ast.CallExpr)
+		id, err := strconv.Atoi(call.Args[0].(*ast.BasicLit).Value)
+		if err != nil {
+			panic(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
 
-		if len(mDo.Block) > 1 {
-			t.Fail()
+func sameIds(a []int, b ...int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k := range a {
+		if a[k] != b[k] {
+			return false
 		}
-		//ast.Print(fset, f)
+	}
+	return true
+}
+
+// A range header is entered before the loop, before a continue and at
+// the end of the body.
+func TestHeadersRange(x *testing.T) {
+	t := (*test.T)(x)
+	i, cfg, fn := parseFunc(t, `
+package dummy
+func f(xs []int) {
+	for _, x := range xs {
+		if x > 0 {
+			continue
+		}
+		println(x)
+	}
+}
+`)
+	loop := fn.Body.List[0].(*ast.RangeStmt)
+	cont := loop.Body.List[0].(*ast.IfStmt)
+	h := cfg.Block(loop)
+	t.Assert(h != nil && h.Body == nil, "expected the range header to be a block of its own got %v", h)
+	t.Assert(i.headers(cfg, &fn.Body.List) == nil, "headers failed")
+	t.Assert(sameIds(enters(fn.Body.List), h.Id), "expected the header entered before the loop got %v", enters(fn.Body.List))
+	t.Assert(fn.Body.List[1] == loop, "expected the loop after its header")
+	t.Assert(sameIds(enters(cont.Body.List), h.Id), "expected the header entered before the continue got %v", enters(cont.Body.List))
+	last := loop.Body.List[len(loop.Body.List)-1:]
+	t.Assert(sameIds(enters(last), h.Id), "expected the header entered at the end of the body got %v", enters(loop.Body.List))
+	t.Assert(i.entered[h.Id], "the header was not marked entered")
+}
+
+// Each continue enters the header (or post) of the loop it continues: an
+// unlabeled one in a nested loop belongs to the nested loop, one in a
+// switch or select to the loop around it.
+func TestLoopBackContinues(x *testing.T) {
+	t := (*test.T)(x)
+	i, cfg, fn := parseFunc(t, `
+package dummy
+func f(xs []int) {
+outer:
+	for i := 0; i < len(xs); i++ {
+		for _, x := range xs {
+			if x == i {
+				continue outer
+			}
+			switch {
+			case x > i:
+				continue
+			}
+		}
+		select {
+		default:
+			if i > 3 {
+				continue
+			}
+		}
+	}
+}
+`)
+	outer := fn.Body.List[0].(*ast.LabeledStmt).Stmt.(*ast.ForStmt)
+	inner := outer.Body.List[0].(*ast.RangeStmt)
+	contOuter := inner.Body.List[0].(*ast.IfStmt)
+	contInner := inner.Body.List[1].(*ast.SwitchStmt).Body.List[0].(*ast.CaseClause)
+	contSelect := outer.Body.List[1].(*ast.SelectStmt).Body.List[0].(*ast.CommClause).Body[0].(*ast.IfStmt).Body
+	post := cfg.Block(outer.Post)
+	t.Assert(post != nil && post.Body == nil && *post.Stmts[0] == outer.Post, "expected the post to be a block of its own got %v", post)
+	h := cfg.Block(inner)
+	t.Assert(i.headers(cfg, &fn.Body.List) == nil, "headers failed")
+	t.Assert(sameIds(enters(contOuter.Body.List), post.Id), "continue outer should enter the post got %v", enters(contOuter.Body.List))
+	t.Assert(sameIds(enters(contInner.Body), h.Id), "continue in the range should enter its header got %v", enters(contInner.Body))
+	t.Assert(sameIds(enters(contSelect.List), post.Id), "continue in the select should enter the post got %v", enters(contSelect.List))
+	t.Assert(sameIds(enters(outer.Body.List), h.Id, post.Id), "expected the range header and the post in the outer body got %v", enters(outer.Body.List))
+	last := outer.Body.List[len(outer.Body.List)-1:]
+	t.Assert(sameIds(enters(last), post.Id), "expected the post entered at the end of the body")
+	t.Assert(jumps(contOuter.Body.List[len(contOuter.Body.List)-1]), "the continue should stay last")
+}
+
+// A function without results which falls off its end enters the empty
+// exit block. A function with results ends in a terminating statement.
+func TestFallsOff(x *testing.T) {
+	t := (*test.T)(x)
+	i, cfg, fn := parseFunc(t, `
+package dummy
+func f(x int) {
+	if x > 0 {
+		println(x)
+	}
+}
+`)
+	var exit *analysis.Block
+	for _, b := range cfg.Blocks {
+		if b.Id != 0 && len(b.Stmts) == 0 && len(b.Prev) > 0 && len(b.Next) == 0 {
+			exit = b
+		}
+	}
+	t.Assert(exit != nil, "expected an empty exit block in %v", cfg)
+	i.fallsOff(cfg, &fn.Body.List)
+	t.Assert(len(fn.Body.List) == 2, "expected one statement appended got %d", len(fn.Body.List))
+	t.Assert(sameIds(enters(fn.Body.List[1:]), exit.Id), "expected the exit block entered at the end got %v", enters(fn.Body.List))
+
+	i, cfg, fn = parseFunc(t, `
+package dummy
+func g(x int) int {
+	if x > 0 {
+		return x
+	}
+	return 0
+}
+`)
+	i.fallsOff(cfg, &fn.Body.List)
+	t.Assert(len(fn.Body.List) == 2, "expected nothing appended to a function with results")
+}
+
+// A switch is entered in its Init or, when it has one, in a block before
+// it so the Init runs in the block.
+func TestSwitchInit(x *testing.T) {
+	t := (*test.T)(x)
+	i, _, fn := parseFunc(t, `
+package dummy
+func f(x int) {
+	switch y := x; y {
+	case 1:
+	}
+	switch x {
+	}
+}
+`)
+	withInit := fn.Body.List[0].(*ast.SwitchStmt)
+	init := withInit.Init
+	withoutInit := fn.Body.List[1].(*ast.SwitchStmt)
+	err := i.exprInstrument(&analysis.Block{Id: 7, Stmts: []*ast.Stmt{&withInit.Init, &fn.Body.List[0]}})
+	t.Assert(err == nil, "exprInstrument failed %v", err)
+	blk, ok := fn.Body.List[0].(*ast.BlockStmt)
+	t.Assert(ok, "expected the switch in a block got %T", fn.Body.List[0])
+	t.Assert(sameIds(enters(blk.List), 7), "expected the block entered before the switch got %v", enters(blk.List))
+	t.Assert(blk.List[1] == withInit && withInit.Init == init, "expected the switch after the call with its Init")
+	err = i.exprInstrument(&analysis.Block{Id: 8, Stmts: []*ast.Stmt{&fn.Body.List[1]}})
+	t.Assert(err == nil, "exprInstrument failed %v", err)
+	t.Assert(withoutInit.Init != nil && sameIds(enters([]ast.Stmt{withoutInit.Init}), 8), "expected the block entered in the Init")
+}
+
+const labeledProgram = `package main
+
+import "fmt"
+
+func main() {
+	n := 0
+	xs := []int{1, 2}
+loop:
+	for i := 0; i < 2; i++ {
+		n++
+		if n > 100 {
+			continue loop
+		}
+	}
+	if n < 6 {
+		goto loop
+	}
+ranged:
+	for _, x := range xs {
+		if x > 5 {
+			break ranged
+		}
+		n += x
+	}
+	if n < 12 {
+		goto ranged
+	}
+	fmt.Println(n)
+}
+`
+
+// A goto to a labeled loop enters the block of the label and the loop's
+// header each time, the breaks and continues of the loop still work.
+func TestLabeledGoto(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": labeledProgram})
+	defer p.Close()
+	bin := p.build(".", false, &Options{CheckCoverage: true})
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "12") {
+		t.Errorf("expected the program to print 12 got:\n%s", output)
+	}
+	f, err := os.Open(filepath.Join(dgprof, "flow-graph.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the entrances of the blocks by their lines in main.go
+	entered := make(map[int]int)
+	for e, count := range prof.Flows {
+		parts := strings.Split(prof.Positions[e.Targ], ":")
+		if len(parts) < 3 || !strings.HasSuffix(parts[0], "main.go") {
+			continue
+		}
+		line, err := strconv.Atoi(parts[len(parts)-2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		entered[line] += count
+	}
+	// the blocks of the for's Init 3 times, its condition 9 times and its
+	// post 6 times
+	if entered[9] != 18 {
+		t.Errorf("expected the labeled for to be entered 18 times got %d (%v)", entered[9], entered)
+	}
+	if entered[19] != 6 {
+		t.Errorf("expected the range header to be entered 6 times got %d (%v)", entered[19], entered)
 	}
 }
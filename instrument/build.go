@@ -36,9 +36,22 @@ type binaryBuilder struct {
 	entry             string
 	_work, root, path string
 	output            string
+	gomod             string
+	test              bool
 }
 
 func BuildBinary(c *cmd.Config, keepWork bool, work, entryPkgName, output string, program *loader.Program) (_ string, err error) {
+	return buildBinary(c, keepWork, work, entryPkgName, output, program, false)
+}
+
+// BuildTestBinary is like BuildBinary but it compiles the test binary of
+// the entry package (go test -c). The program should have been loaded
+// with cmd.LoadPkgWithTests.
+func BuildTestBinary(c *cmd.Config, keepWork bool, work, entryPkgName, output string, program *loader.Program) (_ string, err error) {
+	return buildBinary(c, keepWork, work, entryPkgName, output, program, true)
+}
+
+func buildBinary(c *cmd.Config, keepWork bool, work, entryPkgName, output string, program *loader.Program, test bool) (_ string, err error) {
 	if work == "" {
 		work, err = ioutil.TempDir("", fmt.Sprintf("dynagrok-build-%v-", filepath.Base(entryPkgName)))
 		if err != nil {
@@ -58,10 +71,29 @@ func BuildBinary(c *cmd.Config, keepWork bool, work, entryPkgName, output string
 		root:         filepath.Join(work, "goroot"),
 		path:         filepath.Join(work, "gopath"),
 		output:       output,
+		test:         test,
+	}
+	if entry := program.Package(entryPkgName); entry != nil && len(entry.Files) > 0 {
+		dir := filepath.Dir(program.Fset.File(entry.Files[0].Pos()).Name())
+		if cmd.ModuleMode(c, dir) {
+			b.gomod, err = cmd.GoMod(c, dir)
+			if err != nil {
+				return "", err
+			}
+			return work, b.BuildModule()
+		}
 	}
 	return work, b.Build()
 }
 
+// buildCmd is the go sub-command which compiles the entry package
+func (b *binaryBuilder) buildCmd() []string {
+	if b.test {
+		return []string{"test", "-c"}
+	}
+	return []string{"build"}
+}
+
 func (b *binaryBuilder) basePaths() paths {
 	basePaths := make([]string, 0, 10)
 	basePaths = append(basePaths, b.buildContext.GOROOT)
@@ -95,6 +127,9 @@ func (ps paths) PrefixedBy(s string) string {
 }
 
 func (b *binaryBuilder) Build() error {
+	if b.config.StockRuntime {
+		return b.BuildStock()
+	}
 	_, err := os.Stat(filepath.Join(b.root, "src"))
 	if err != nil && os.IsNotExist(err) {
 		err = b.copyDir(
@@ -134,38 +169,64 @@ func (b *binaryBuilder) Build() error {
 	}
 	basePaths := b.basePaths()
 	anyStdlib := false
-	for pkgType, pkgInfo := range b.program.AllPackages {
+	for _, pkgInfo := range b.packages() {
 		// if pkgInfo.Cgo {
 		// 	continue
 		// }
-		if excludes.ExcludedPkg(pkgInfo.Pkg.Path()) {
-			continue
-		}
-		stdlib, root, err := b.createDir(basePaths, pkgType, pkgInfo.Files)
+		stdlib, err := b.writePkg(basePaths, pkgInfo.Pkg, pkgInfo)
 		if err != nil {
 			return err
 		}
 		if stdlib {
 			anyStdlib = true
 		}
-		// errors.Logf("DEBUG", "%v -> %v", pkgInfo, root)
-		for _, f := range pkgInfo.Files {
-			to := filepath.Join(root, basePaths.TrimPrefix(b.program.Fset.File(f.Pos()).Name()))
-			// errors.Logf("DEBUG", "%v -> %v", b.program.Fset.File(f.Pos()).Name(), to)
-			fout, err := os.Create(to)
-			if err != nil {
-				return err
-			}
-			err = config.Fprint(fout, b.program.Fset, f)
-			fout.Close()
-			if err != nil {
-				return errors.Errorf("Could not serialize tree at %v tree %v error: %v", to, f, err)
-			}
-		}
 	}
 	return b.goBuild(anyStdlib)
 }
 
+// packages lists the packages to write to the work dir. External test
+// packages come last as they share a directory with the package they
+// test and must not clobber its instrumented files.
+func (b *binaryBuilder) packages() []*loader.PackageInfo {
+	pkgs := make([]*loader.PackageInfo, 0, len(b.program.AllPackages))
+	var xtests []*loader.PackageInfo
+	for _, pkgInfo := range b.program.AllPackages {
+		if excludes.ExcludedPkg(pkgInfo.Pkg.Path()) {
+			continue
+		}
+		if strings.HasSuffix(pkgInfo.Pkg.Path(), "_test") {
+			xtests = append(xtests, pkgInfo)
+		} else {
+			pkgs = append(pkgs, pkgInfo)
+		}
+	}
+	return append(pkgs, xtests...)
+}
+
+// writePkg copies the package's directory into the work dir and then
+// overwrites its go files with the (instrumented) trees in the program.
+func (b *binaryBuilder) writePkg(basePaths paths, pkgType *types.Package, pkgInfo *loader.PackageInfo) (stdlib bool, err error) {
+	stdlib, root, err := b.createDir(basePaths, pkgType, pkgInfo.Files)
+	if err != nil {
+		return false, err
+	}
+	// errors.Logf("DEBUG", "%v -> %v", pkgInfo, root)
+	for _, f := range pkgInfo.Files {
+		to := filepath.Join(root, basePaths.TrimPrefix(b.program.Fset.File(f.Pos()).Name()))
+		// errors.Logf("DEBUG", "%v -> %v", b.program.Fset.File(f.Pos()).Name(), to)
+		fout, err := os.Create(to)
+		if err != nil {
+			return false, err
+		}
+		err = config.Fprint(fout, b.program.Fset, f)
+		fout.Close()
+		if err != nil {
+			return false, errors.Errorf("Could not serialize tree at %v tree %v error: %v", to, f, err)
+		}
+	}
+	return stdlib, nil
+}
+
 func (b *binaryBuilder) noEnv() []string {
 	return []string{
 		fmt.Sprintf("PATH=%v", os.Getenv("PATH")),
@@ -307,7 +368,7 @@ func (b *binaryBuilder) goBuild(stdlib bool) error {
 			return err
 		}
 	}
-	c := exec.Command(goBin, "build", "-o", b.output, b.entry)
+	c := exec.Command(goBin, append(b.buildCmd(), "-o", b.output, b.entry)...)
 	c.Env = b.goEnv()
 	fmt.Fprintln(os.Stderr, strings.Join(c.Env, " "), c.Path, strings.Join(c.Args[1:], " "))
 	output, err := c.CombinedOutput()
@@ -316,14 +377,17 @@ func (b *binaryBuilder) goBuild(stdlib bool) error {
 }
 
 func (b *binaryBuilder) createDir(basePaths paths, pkg *types.Package, pkgFiles []*ast.File) (stdlib bool, root string, err error) {
+	// external test packages (pkg_test) live in the directory of the
+	// package they test
+	pkgPath := strings.TrimSuffix(pkg.Path(), "_test")
 	var src string
 	for _, path := range basePaths {
-		if _, err := os.Stat(filepath.Join(path, "src", pkg.Path())); err == nil {
+		if _, err := os.Stat(filepath.Join(path, "src", pkgPath)); err == nil {
 			src = path
 			break
 		}
 	}
-	srcDir, err := os.Open(filepath.Join(src, "src", pkg.Path()))
+	srcDir, err := os.Open(filepath.Join(src, "src", pkgPath))
 	if err != nil {
 		return false, "", err
 	}
@@ -337,7 +401,7 @@ func (b *binaryBuilder) createDir(basePaths paths, pkg *types.Package, pkgFiles
 		root = b.root
 		stdlib = true
 	}
-	err = os.MkdirAll(filepath.Join(root, "src", pkg.Path()), os.ModeDir|os.ModeTemporary|0775)
+	err = os.MkdirAll(filepath.Join(root, "src", pkgPath), os.ModeDir|os.ModeTemporary|0775)
 	if err != nil {
 		return false, "", err
 	}
@@ -346,11 +410,16 @@ func (b *binaryBuilder) createDir(basePaths paths, pkg *types.Package, pkgFiles
 			continue
 		}
 		name := f.Name()
-		from, err := os.Open(filepath.Join(src, "src", pkg.Path(), name))
+		if pkgPath != pkg.Path() {
+			if _, err := os.Stat(filepath.Join(root, "src", pkgPath, name)); err == nil {
+				continue
+			}
+		}
+		from, err := os.Open(filepath.Join(src, "src", pkgPath, name))
 		if err != nil {
 			return false, "", err
 		}
-		to, err := os.Create(filepath.Join(root, "src", pkg.Path(), name))
+		to, err := os.Create(filepath.Join(root, "src", pkgPath, name))
 		if err != nil {
 			from.Close()
 			return false, "", err
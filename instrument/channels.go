@@ -0,0 +1,508 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// chans records channel communication (see dgruntime.ChanSend). The
+// runtime pairs a send with the receive of the same value so the value
+// sent is recorded before the send:
+//
+//	ch <- x
+//
+// becomes
+//
+//	{
+//		var __dgv int = x
+//		dgruntime.ChanSend(ch, "ch chan int", __dgv)
+//		ch <- __dgv
+//	}
+//
+// and the value received is recorded after the receive:
+//
+//	v := <-ch
+//
+// becomes
+//
+//	v, __dgok1 := <-ch
+//	dgruntime.ChanRecv(ch, "ch chan int", v, __dgok1)
+//
+// The calls get the channel again so a channel which is not named by a
+// variable or field is evaluated into __dgch first. Select cases and
+// ranges over a channel are recorded at the start of their bodies (when
+// the channel is named). Receives nested in other expressions are
+// wrapped by mkRecvWrapper. Finally the calls of the builtin close are
+// replaced with dgruntime.ChanClose.
+func (i *instrumenter) chans(pkg *loader.PackageInfo, fnBody *[]ast.Stmt) error {
+	err := analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for j := 0; j < len(*blk); j++ {
+			stmt := (*blk)[j]
+			label, _ := stmt.(*ast.LabeledStmt)
+			if label != nil {
+				stmt = label.Stmt
+			}
+			replace := func(s ast.Stmt) {
+				if label != nil {
+					label.Stmt = s
+				} else {
+					(*blk)[j] = s
+				}
+			}
+			recv := directRecv(stmt)
+			i.nestedRecvs(pkg, stmt, recv)
+			switch s := stmt.(type) {
+			case *ast.SendStmt:
+				if b := i.mkSendBlock(pkg, s); b != nil {
+					replace(b)
+				}
+			case *ast.ExprStmt:
+				if recv == nil {
+					break
+				}
+				if b := i.mkRecvBlock(pkg, recv, nil); b != nil {
+					replace(b)
+				}
+			case *ast.AssignStmt:
+				if recv == nil {
+					break
+				}
+				if s.Tok == token.DEFINE {
+					if call := i.mkRecvDefine(pkg, s, recv); call != nil {
+						*blk = Insert(nil, nil, *blk, j+1, call)
+						j++
+					}
+				} else if b := i.mkRecvBlock(pkg, recv, s.Lhs); b != nil {
+					replace(b)
+				}
+			case *ast.SelectStmt:
+				for _, c := range s.Body.List {
+					i.chanCase(pkg, c.(*ast.CommClause))
+				}
+			case *ast.RangeStmt:
+				i.chanRange(pkg, s)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	i.closes(pkg, *fnBody)
+	return nil
+}
+
+// chanRecv returns the receive operation the expression is (if it is
+// one).
+func chanRecv(expr ast.Expr) *ast.UnaryExpr {
+	if recv, ok := unparen(expr).(*ast.UnaryExpr); ok && recv.Op == token.ARROW {
+		return recv
+	}
+	return nil
+}
+
+// commRecv returns the receive of a receive statement: `<-ch`,
+// `v, ok := <-ch` or `v, ok = <-ch`.
+func commRecv(stmt ast.Stmt) *ast.UnaryExpr {
+	switch s := stmt.(type) {
+	case *ast.ExprStmt:
+		return chanRecv(s.X)
+	case *ast.AssignStmt:
+		if len(s.Rhs) == 1 && (s.Tok == token.DEFINE || s.Tok == token.ASSIGN) {
+			return chanRecv(s.Rhs[0])
+		}
+	}
+	return nil
+}
+
+// directRecv is commRecv for the receive statements in a statement list
+// which chans rewrites. An assignment is rewritten only if its left hand
+// side can be assigned after the receive without changing what it
+// assigns.
+func directRecv(stmt ast.Stmt) *ast.UnaryExpr {
+	recv := commRecv(stmt)
+	if s, ok := stmt.(*ast.AssignStmt); ok && recv != nil && s.Tok == token.ASSIGN {
+		for _, lhs := range s.Lhs {
+			if !pureExpr(lhs) && !isBlank(lhs) {
+				return nil
+			}
+		}
+	}
+	return recv
+}
+
+func isBlank(expr ast.Expr) bool {
+	id, ok := expr.(*ast.Ident)
+	return ok && id.Name == "_"
+}
+
+// chanSite names the channel at a send or receive by its expression and
+// type. The channel type is returned as well.
+func (i *instrumenter) chanSite(pkg *loader.PackageInfo, ch ast.Expr) (string, *types.Chan, bool) {
+	typ := pkg.Info.TypeOf(ch)
+	if typ == nil {
+		return "", nil, false
+	}
+	c, ok := typ.Underlying().(*types.Chan)
+	if !ok {
+		return "", nil, false
+	}
+	site := types.ExprString(ch) + " " + types.TypeString(typ, types.RelativeTo(pkg.Pkg))
+	return strconv.Quote(site), c, true
+}
+
+// typeString spells the type as the current file names it. It is false
+// if the file cannot name it (its package is not imported or it is
+// declared inside a function).
+func (i *instrumenter) typeString(pkg *loader.PackageInfo, typ types.Type) (string, bool) {
+	if named, ok := typ.(*types.Named); ok {
+		obj := named.Obj()
+		if obj.Pkg() != nil && obj.Parent() != obj.Pkg().Scope() {
+			return "", false
+		}
+	}
+	spelled := true
+	s := types.TypeString(typ, i.qualifier(pkg, &spelled))
+	return s, spelled
+}
+
+// constExpr reports whether the expression is a constant or nil and so
+// may be evaluated again.
+func constExpr(pkg *loader.PackageInfo, expr ast.Expr) bool {
+	tv, has := pkg.Info.Types[expr]
+	return has && (tv.Value != nil || tv.IsNil())
+}
+
+// nestedRecvs wraps the receives in the statement's expressions (but not
+// in its blocks or function literals) with mkRecvWrapper. skip is the
+// receive of a receive statement which is recorded by the statement. The
+// receives of comma-ok assignments and declarations are not recorded.
+func (i *instrumenter) nestedRecvs(pkg *loader.PackageInfo, stmt ast.Stmt, skip *ast.UnaryExpr) {
+	commaOk := make(map[*ast.UnaryExpr]bool)
+	astutil.Apply(stmt, func(c *astutil.Cursor) bool {
+		switch n := c.Node().(type) {
+		case *ast.FuncLit, *ast.BlockStmt, *ast.CaseClause, *ast.CommClause:
+			return false
+		case *ast.AssignStmt:
+			if len(n.Lhs) == 2 && len(n.Rhs) == 1 {
+				if recv := chanRecv(n.Rhs[0]); recv != nil {
+					commaOk[recv] = true
+				}
+			}
+		case *ast.ValueSpec:
+			if len(n.Names) == 2 && len(n.Values) == 1 {
+				if recv := chanRecv(n.Values[0]); recv != nil {
+					commaOk[recv] = true
+				}
+			}
+		}
+		return true
+	}, func(c *astutil.Cursor) bool {
+		recv, ok := c.Node().(*ast.UnaryExpr)
+		if !ok || recv.Op != token.ARROW || recv == skip || commaOk[recv] {
+			return true
+		}
+		if w := i.mkRecvWrapper(pkg, recv); w != nil {
+			c.Replace(w)
+		}
+		return true
+	})
+}
+
+// mkRecvWrapper records a receive nested in an expression:
+//
+//	f(<-ch)
+//
+// becomes
+//
+//	f(func(__dgv int) int {
+//		dgruntime.ChanRecv(ch, "ch chan int", __dgv, true)
+//		return __dgv
+//	}(<-ch))
+//
+// It returns nil if the channel is not named or the element type cannot
+// be spelled in the current file.
+func (i *instrumenter) mkRecvWrapper(pkg *loader.PackageInfo, recv *ast.UnaryExpr) ast.Expr {
+	if !pureExpr(recv.X) {
+		return nil
+	}
+	site, c, ok := i.chanSite(pkg, recv.X)
+	if !ok {
+		return nil
+	}
+	typ, ok := i.typeString(pkg, c.Elem())
+	if !ok {
+		return nil
+	}
+	s := fmt.Sprintf("func(__dgv %v) %v { dgruntime.ChanRecv(%v, %v, __dgv, true); return __dgv }(nil)",
+		typ, typ, types.ExprString(recv.X), site)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(recv.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkRecvWrapper (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[0] = recv
+	return call
+}
+
+// mkSendBlock records a send statement. The value is evaluated into a
+// __dgv of the element type unless it is a constant. When the element
+// type cannot be spelled in the current file __dgv gets the value's type,
+// unless the value may be untyped, then nil is returned.
+func (i *instrumenter) mkSendBlock(pkg *loader.PackageInfo, s *ast.SendStmt) ast.Stmt {
+	site, c, ok := i.chanSite(pkg, s.Chan)
+	if !ok {
+		return nil
+	}
+	var value ast.Stmt
+	v := i.constValue(pkg, c, s.Value)
+	if !constExpr(pkg, s.Value) {
+		if typ, ok := i.typeString(pkg, c.Elem()); ok {
+			t, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(s.Pos()).Name(), typ, parser.Mode(0))
+			if err != nil {
+				panic(fmt.Errorf("mkSendBlock (%v) error: %v", typ, err))
+			}
+			value = &ast.DeclStmt{Decl: &ast.GenDecl{
+				Tok: token.VAR,
+				Specs: []ast.Spec{&ast.ValueSpec{
+					Names:  []*ast.Ident{ast.NewIdent("__dgv")},
+					Type:   t,
+					Values: []ast.Expr{s.Value},
+				}},
+			}}
+		} else {
+			switch s.Value.(type) {
+			case *ast.BinaryExpr, *ast.UnaryExpr:
+				// may be an untyped comparison or shift
+				return nil
+			}
+			value = define(idents("__dgv"), s.Value)
+		}
+		v = "__dgv"
+		s.Value = ast.NewIdent("__dgv")
+	}
+	var list []ast.Stmt
+	ch := types.ExprString(s.Chan)
+	if !pureExpr(s.Chan) {
+		list = append(list, define(idents("__dgch"), s.Chan))
+		s.Chan = ast.NewIdent("__dgch")
+		ch = "__dgch"
+	}
+	if value != nil {
+		list = append(list, value)
+	}
+	list = append(list, i.mkChanCall(s.Arrow, "ChanSend", ch, site, v), s)
+	return &ast.BlockStmt{List: list}
+}
+
+// constValue is the source of a value sent on the channel. A constant is
+// converted to the element type (when it can be spelled) so it is passed
+// to dgruntime.ChanSend as the value the channel holds.
+func (i *instrumenter) constValue(pkg *loader.PackageInfo, c *types.Chan, value ast.Expr) string {
+	v := types.ExprString(value)
+	if !constExpr(pkg, value) {
+		return v
+	}
+	if typ, ok := i.typeString(pkg, c.Elem()); ok {
+		return fmt.Sprintf("(%v)(%v)", typ, v)
+	}
+	return v
+}
+
+// mkRecvBlock records a receive statement. The value received (and
+// whether the channel was open) are received into temporaries, recorded
+// and then assigned to lhs.
+func (i *instrumenter) mkRecvBlock(pkg *loader.PackageInfo, recv *ast.UnaryExpr, lhs []ast.Expr) ast.Stmt {
+	site, _, ok := i.chanSite(pkg, recv.X)
+	if !ok {
+		return nil
+	}
+	var list []ast.Stmt
+	ch := types.ExprString(recv.X)
+	if !pureExpr(recv.X) {
+		list = append(list, define(idents("__dgch"), recv.X))
+		recv.X = ast.NewIdent("__dgch")
+		ch = "__dgch"
+	}
+	list = append(list,
+		define(idents("__dgv", "__dgok"), recv),
+		i.mkChanCall(recv.Pos(), "ChanRecv", ch, site, "__dgv", "__dgok"),
+	)
+	if len(lhs) > 0 {
+		list = append(list, &ast.AssignStmt{
+			Lhs: lhs,
+			Tok: token.ASSIGN,
+			Rhs: idents("__dgv", "__dgok")[:len(lhs)],
+		})
+	}
+	return &ast.BlockStmt{List: list}
+}
+
+// mkRecvDefine records a receive which defines variables. The blank
+// variables (and the missing ok) are given names so the call after the
+// statement can get them.
+func (i *instrumenter) mkRecvDefine(pkg *loader.PackageInfo, s *ast.AssignStmt, recv *ast.UnaryExpr) ast.Stmt {
+	if !pureExpr(recv.X) {
+		return nil
+	}
+	site, _, ok := i.chanSite(pkg, recv.X)
+	if !ok {
+		return nil
+	}
+	v, okName := i.recvTemps(s)
+	return i.mkChanCall(recv.Pos(), "ChanRecv", types.ExprString(recv.X), site, v, okName)
+}
+
+// recvTemps names the blank variables of a receive which defines
+// variables and adds an ok variable if it has none. The temporaries are
+// numbered as they are declared in the scope of the receive.
+func (i *instrumenter) recvTemps(s *ast.AssignStmt) (v, ok string) {
+	if len(s.Lhs) == 1 {
+		s.Lhs = append(s.Lhs, ast.NewIdent("_"))
+	}
+	names := []string{"__dgv", "__dgok"}
+	for k, lhs := range s.Lhs {
+		if isBlank(lhs) {
+			i.temps++
+			s.Lhs[k] = ast.NewIdent(fmt.Sprintf("%v%d", names[k], i.temps))
+		}
+		names[k] = s.Lhs[k].(*ast.Ident).Name
+	}
+	return names[0], names[1]
+}
+
+// chanCase records the communication of a select case at the start of
+// its body. Only cases on named channels (sending a named or constant
+// value) are recorded.
+func (i *instrumenter) chanCase(pkg *loader.PackageInfo, clause *ast.CommClause) {
+	if clause.Comm == nil {
+		return
+	}
+	i.nestedRecvs(pkg, clause.Comm, commRecv(clause.Comm))
+	var calls []ast.Stmt
+	switch comm := clause.Comm.(type) {
+	case *ast.SendStmt:
+		if !pureExpr(comm.Chan) || !(pureExpr(comm.Value) || constExpr(pkg, comm.Value)) {
+			return
+		}
+		site, c, ok := i.chanSite(pkg, comm.Chan)
+		if !ok {
+			return
+		}
+		calls = append(calls, i.mkChanCall(clause.Case, "ChanSend", types.ExprString(comm.Chan), site, i.constValue(pkg, c, comm.Value)))
+	case *ast.ExprStmt:
+		recv := commRecv(comm)
+		if recv == nil || !pureExpr(recv.X) {
+			return
+		}
+		site, _, ok := i.chanSite(pkg, recv.X)
+		if !ok {
+			return
+		}
+		clause.Comm = define(idents("__dgv", "__dgok"), comm.X)
+		calls = append(calls, i.mkChanCall(clause.Case, "ChanRecv", types.ExprString(recv.X), site, "__dgv", "__dgok"))
+	case *ast.AssignStmt:
+		recv := commRecv(comm)
+		if recv == nil || !pureExpr(recv.X) {
+			return
+		}
+		site, _, ok := i.chanSite(pkg, recv.X)
+		if !ok {
+			return
+		}
+		ch := types.ExprString(recv.X)
+		if comm.Tok == token.DEFINE {
+			v, okName := i.recvTemps(comm)
+			calls = append(calls, i.mkChanCall(clause.Case, "ChanRecv", ch, site, v, okName))
+			break
+		}
+		clause.Comm = define(idents("__dgv", "__dgok"), comm.Rhs[0])
+		calls = append(calls,
+			&ast.AssignStmt{Lhs: comm.Lhs, Tok: token.ASSIGN, Rhs: idents("__dgv", "__dgok")[:len(comm.Lhs)]},
+			i.mkChanCall(clause.Case, "ChanRecv", ch, site, "__dgv", "__dgok"),
+		)
+	}
+	at := afterEnterBlk(clause.Body)
+	for k, call := range calls {
+		clause.Body = Insert(nil, nil, clause.Body, at+k, call)
+	}
+}
+
+// chanRange records each value a range over a named channel receives at
+// the start of its body. A range without a (named) key gets one.
+func (i *instrumenter) chanRange(pkg *loader.PackageInfo, s *ast.RangeStmt) {
+	if !pureExpr(s.X) {
+		return
+	}
+	site, _, ok := i.chanSite(pkg, s.X)
+	if !ok {
+		return
+	}
+	key := "__dgv"
+	switch {
+	case s.Key == nil || isBlank(s.Key):
+		s.Key = ast.NewIdent(key)
+		s.Tok = token.DEFINE
+	case pureExpr(s.Key):
+		key = types.ExprString(s.Key)
+	default:
+		return
+	}
+	call := i.mkChanCall(s.For, "ChanRecv", types.ExprString(s.X), site, key, "true")
+	s.Body.List = Insert(nil, nil, s.Body.List, afterEnterBlk(s.Body.List), call)
+}
+
+// closes replaces the calls of the builtin close in the function body
+// (but not in the function literals inside it) with dgruntime.ChanClose
+// which closes the channel and drops its unmatched receives.
+func (i *instrumenter) closes(pkg *loader.PackageInfo, fnBody []ast.Stmt) {
+	for _, stmt := range fnBody {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch e := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if ident, ok := unparen(e.Fun).(*ast.Ident); ok {
+					if b, ok := pkg.Info.Uses[ident].(*types.Builtin); ok && b.Name() == "close" {
+						e.Fun = &ast.SelectorExpr{
+							X:   &ast.Ident{NamePos: ident.Pos(), Name: "dgruntime"},
+							Sel: ast.NewIdent("ChanClose"),
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+}
+
+func (i *instrumenter) mkChanCall(pos token.Pos, fn string, args ...string) ast.Stmt {
+	s := fmt.Sprintf("dgruntime.%v(%v)", fn, strings.Join(args, ", "))
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkChanCall (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+func define(lhs []ast.Expr, rhs ast.Expr) ast.Stmt {
+	return &ast.AssignStmt{Lhs: lhs, Tok: token.DEFINE, Rhs: []ast.Expr{rhs}}
+}
+
+func idents(names ...string) []ast.Expr {
+	exprs := make([]ast.Expr, 0, len(names))
+	for _, name := range names {
+		exprs = append(exprs, ast.NewIdent(name))
+	}
+	return exprs
+}
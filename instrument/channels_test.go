@@ -0,0 +1,221 @@
+package instrument
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+const chansProgram = `package main
+
+import "fmt"
+
+func produce(ch chan int, base int, done chan bool) {
+	for k := 0; k < 3; k++ {
+		ch <- base + k
+	}
+	done <- true
+}
+
+func sum(a, b int) int {
+	return a + b
+}
+
+func main() {
+	nums := make(chan int, 6)
+	done := make(chan bool)
+	go produce(nums, 0, done)
+	go produce(nums, 10, done)
+	<-done
+	<-done
+	close(nums)
+	total := 0
+	total = sum(total, <-nums)
+	for v := range nums {
+		total += v
+	}
+	quit := make(chan struct{})
+	out := make(chan string, 1)
+	select {
+	case out <- "x":
+	case <-quit:
+	}
+	s := <-out
+	fmt.Println(total, s)
+}
+`
+
+// Each receive is paired with the send of the value it received, from
+// either producer on the buffered channel, including the receive nested
+// in a call and those after the close.
+func TestChans(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": chansProgram})
+	defer p.Close()
+	bin := p.build(".", false, &Options{Channels: true})
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "36 x") {
+		t.Errorf("expected the program to print 36 x got:\n%s", output)
+	}
+	f, err := os.Open(filepath.Join(dgprof, "flow-graph.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// line returns the line of the block in main.go
+	line := func(blk dgtypes.BlkEntrance) int {
+		parts := strings.Split(prof.Positions[blk], ":")
+		if len(parts) < 3 {
+			t.Fatalf("no position for %v", blk)
+		}
+		n, err := strconv.Atoi(parts[len(parts)-2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	inProduce := func(blk dgtypes.BlkEntrance) bool { return line(blk) >= 5 && line(blk) <= 10 }
+	inMain := func(blk dgtypes.BlkEntrance) bool { return line(blk) >= 16 }
+	type chans struct{ send, recv string }
+	expected := map[chans]struct {
+		count    int
+		src, dst func(dgtypes.BlkEntrance) bool
+	}{
+		{"ch chan int", "nums chan int"}:       {6, inProduce, inMain},
+		{"done chan bool", "done chan bool"}:   {2, inProduce, inMain},
+		{"out chan string", "out chan string"}: {1, inMain, inMain},
+	}
+	counts := make(map[chans]int)
+	comms := 0
+	for c, count := range prof.Channels {
+		k := chans{c.Send, c.Recv}
+		e, has := expected[k]
+		if !has {
+			t.Errorf("unexpected channel %v", c)
+			continue
+		}
+		if !e.src(c.Edge.Src) || !e.dst(c.Edge.Targ) {
+			t.Errorf("%v connects the wrong blocks: %v -> %v", k, prof.Positions[c.Edge.Src], prof.Positions[c.Edge.Targ])
+		}
+		if prof.Comms[c.Edge] == 0 {
+			t.Errorf("the edge of %v is not a comm", c)
+		}
+		counts[k] += count
+		comms += count
+	}
+	for k, e := range expected {
+		if counts[k] != e.count {
+			t.Errorf("expected %d comms on %v got %d", e.count, k, counts[k])
+		}
+	}
+	total := 0
+	for _, count := range prof.Comms {
+		total += count
+	}
+	if total != comms {
+		t.Errorf("expected the %d comms of the channels got %d", comms, total)
+	}
+}
+
+const chanFormsProgram = `package main
+
+import "fmt"
+
+type box struct {
+	ch chan int
+}
+
+func get(b *box) chan int {
+	return b.ch
+}
+
+func main() {
+	b := &box{ch: make(chan int, 16)}
+	var x, y int
+	var ok bool
+	get(b) <- 1
+	b.ch <- 1 << 1
+	big := uint(2)
+	b.ch <- 1 << big
+loop:
+	b.ch <- 3
+	<-get(b)
+	x = <-b.ch
+	x, ok = <-b.ch
+	_, ok = <-b.ch
+	b.ch <- 9
+	v, _ := <-b.ch
+	b.ch <- 5
+	b.ch <- 6
+	b.ch <- 7
+	select {
+	case y = <-b.ch:
+	}
+	select {
+	case _, ok = <-b.ch:
+	}
+	select {
+	case <-b.ch:
+	}
+	bools := make(chan bool, 1)
+	bools <- x < y
+	if <-bools {
+		x++
+	}
+	close(b.ch)
+	for range b.ch {
+	}
+	if x < 0 {
+		goto loop
+	}
+	fmt.Println(x, y, v, ok)
+}
+`
+
+// Every form of send and receive statement is rewritten to code which
+// compiles and records the communication.
+func TestChanForms(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": chanFormsProgram})
+	defer p.Close()
+	bin := p.build(".", false, &Options{Channels: true})
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "5 5 9 true") {
+		t.Errorf("expected the program to print 4 5 3 true got:\n%s", output)
+	}
+	f, err := os.Open(filepath.Join(dgprof, "flow-graph.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for c, count := range prof.Channels {
+		counts[c.Send+" -> "+c.Recv] += count
+	}
+	expected := map[string]int{
+		"get(b) chan int -> get(b) chan int": 1,
+		"b.ch chan int -> b.ch chan int":     7,
+		"bools chan bool -> bools chan bool": 1,
+	}
+	for k, count := range expected {
+		if counts[k] != count {
+			t.Errorf("expected %d comms %v got %d (%v)", count, k, counts[k], counts)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package instrument
 import (
 	"fmt"
 	"path/filepath"
+	"regexp"
+	"strconv"
 )
 
 import (
@@ -11,57 +13,245 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 )
 
+type Options struct {
+	Output   string
+	Work     string
+	KeepWork bool
+	Filter   *Filter
+	Channels bool
+	// ExitFuncs are terminating functions (in addition to
+	// DefaultExitFuncs) before which the dgruntime is shut down.
+	ExitFuncs []string
+	// CheckCoverage makes instrumenting fail when a reachable block of
+	// an instrumented function has no EnterBlk call.
+	CheckCoverage bool
+	// Predicates records the value of each if and for condition.
+	// PredicateValues also records the operand values of the conditions
+	// which compare simple operands.
+	Predicates      bool
+	PredicateValues bool
+	dgtypes.Instrumentation
+}
+
 func NewCommand(c *cmd.Config) cmd.Runnable {
+	var o Options
+	bin := NewBinaryCommand(c, &o)
+	test := NewTestCommand(c, &o)
+	return cmd.Concat(
+		NewOptionParser(c, &o),
+		cmd.Commands(map[string]cmd.Runnable{
+			"":          bin,
+			test.Name(): test,
+		}),
+	)
+}
+
+func NewOptionParser(c *cmd.Config, o *Options) cmd.Runnable {
 	return cmd.Cmd(
 		"instrument",
-		`[options] <pkg>`,
+		`[options]`,
 		`
 Option Flags
     -h,--help                         Show this message
     -o,--output=<path>                Output file to create (defaults to pkg-name.instr)
     -w,--work=<path>                  Work directory to use (defaults to tempdir)
     --keep-work                       Keep the work directory
+    --only-func=<regex>               Only instrument the blocks of functions
+                                      whose name matches <regex>
+    --only-file=<regex>               Only instrument the blocks of functions in
+                                      files whose path matches <regex>
+    --skip-func=<regex>               Do not instrument the blocks of functions
+                                      whose name matches <regex>
+    --level=<level>                   What to record on entering a block:
+                                        full (default): counts, durations and
+                                          dynamic control dependence
+                                        no-cd: counts and durations
+                                        no-durations: counts and control dependence
+                                        counts: flow counts only
+                                        sampled: flow counts for a sample
+    --sample-every=<n>                Sample every <n>th block entrance
+                                      (implies --level=sampled, default 100)
+    --sample-rate=<p>                 Sample each block entrance with
+                                      probability <p> (implies --level=sampled)
+    --channels                        Record channel sends and receives so the
+                                      profile has communicates-with edges
+    --exit-func=<name>                Also shut the dgruntime down before calls
+                                      to the function <name> which ends the
+                                      program (may be repeated)
+    --check-coverage                  Fail if a block of the control flow graph
+                                      of an instrumented function was left
+                                      uninstrumented (and list those blocks)
+    --predicates                      Record how often each if and for
+                                      condition was true and false
+    --predicate-values                Also record the operand values of the
+                                      conditions which compare variables,
+                                      fields or constants (implies --predicates)
+
+Functions which are not instrumented still appear as a single node in the
+call and flow graphs. Function names are of the form pkg/path.Func,
+(*pkg/path.Type).Method or pkg/path.Func$1 for closures.
+
+The dgruntime writes the profile when main returns and before the program
+ends by calling os.Exit, syscall.Exit or log.Fatal* (or a Logger's Fatal*).
+--exit-func names are of the form pkg/path.Func or (*pkg/path.Type).Method.
 `,
 		"o:w:",
 		[]string{
 			"output=",
 			"work=",
 			"keep-work",
+			"only-func=",
+			"only-file=",
+			"skip-func=",
+			"level=",
+			"sample-every=",
+			"sample-rate=",
+			"channels",
+			"exit-func=",
+			"check-coverage",
+			"predicates",
+			"predicate-values",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			fmt.Println(c)
-			output := ""
-			keepWork := false
-			work := ""
 			for _, oa := range optargs {
 				switch oa.Opt() {
 				case "-o", "--output":
-					output = oa.Arg()
+					o.Output = oa.Arg()
 				case "-w", "--work":
-					work = oa.Arg()
+					o.Work = oa.Arg()
 				case "-k", "--keep-work":
-					keepWork = true
+					o.KeepWork = true
+				case "--only-func", "--only-file", "--skip-func":
+					re, err := regexp.Compile(oa.Arg())
+					if err != nil {
+						return nil, cmd.Usage(r, 4, "Bad regex for %v: %v", oa.Opt(), err)
+					}
+					if o.Filter == nil {
+						o.Filter = new(Filter)
+					}
+					switch oa.Opt() {
+					case "--only-func":
+						o.Filter.OnlyFunc = re
+					case "--only-file":
+						o.Filter.OnlyFile = re
+					case "--skip-func":
+						o.Filter.SkipFunc = re
+					}
+				case "--channels":
+					o.Channels = true
+				case "--exit-func":
+					o.ExitFuncs = append(o.ExitFuncs, oa.Arg())
+				case "--check-coverage":
+					o.CheckCoverage = true
+				case "--predicates":
+					o.Predicates = true
+				case "--predicate-values":
+					o.Predicates = true
+					o.PredicateValues = true
+				case "--level":
+					level, err := dgtypes.ParseLevel(oa.Arg())
+					if err != nil {
+						return nil, cmd.Usage(r, 4, err.Error())
+					}
+					o.Level = level
+				case "--sample-every":
+					n, err := strconv.Atoi(oa.Arg())
+					if err != nil || n < 1 {
+						return nil, cmd.Usage(r, 4, "Expected a positive int for %v got %v", oa.Opt(), oa.Arg())
+					}
+					o.Level = dgtypes.SampledLevel
+					o.SampleEvery = n
+				case "--sample-rate":
+					p, err := strconv.ParseFloat(oa.Arg(), 64)
+					if err != nil || p <= 0 || p > 1 {
+						return nil, cmd.Usage(r, 4, "Expected a probability in (0, 1] for %v got %v", oa.Opt(), oa.Arg())
+					}
+					o.Level = dgtypes.SampledLevel
+					o.SampleRate = p
 				}
 			}
+			if o.Level == dgtypes.SampledLevel && o.SampleEvery == 0 && o.SampleRate == 0 {
+				o.SampleEvery = 100
+			}
+			return args, nil
+		})
+}
+
+func NewBinaryCommand(c *cmd.Config, o *Options) cmd.Runnable {
+	return cmd.Cmd(
+		"",
+		`<pkg>`,
+		`
+Instrument the main package <pkg> and build it.
+`,
+		"",
+		[]string{},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			if len(args) != 1 {
 				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
 			}
-			pkgName := args[0]
+			pkgName, pkgDir, err := cmd.ResolvePkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			output := o.Output
 			if output == "" {
 				output = fmt.Sprintf("%v.instr", filepath.Base(pkgName))
 			}
 			fmt.Println("instrumenting", pkgName)
-			program, err := cmd.LoadPkg(c, pkgName)
+			program, err := cmd.LoadPkg(c, pkgDir, pkgName)
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			err = Instrument(pkgName, program, o)
+			if err != nil {
+				return nil, cmd.Errorf(7, err.Error())
+			}
+			_, err = BuildBinary(c, o.KeepWork, o.Work, pkgName, output, program)
+			if err != nil {
+				return nil, cmd.Errorf(8, err.Error())
+			}
+			return nil, nil
+		})
+}
+
+func NewTestCommand(c *cmd.Config, o *Options) cmd.Runnable {
+	return cmd.Cmd(
+		"test",
+		`<pkg>`,
+		`
+Instrument <pkg> along with its _test.go files and build its test binary
+(defaults to pkg-name.test.instr). Each TestXxx run by the binary writes its
+flow graph to $DGPROF/pass or $DGPROF/fail, ready for "dynagrok localize".
+`,
+		"",
+		[]string{},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			if len(args) != 1 {
+				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
+			}
+			pkgName, pkgDir, err := cmd.ResolvePkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
+			output := o.Output
+			if output == "" {
+				output = fmt.Sprintf("%v.test.instr", filepath.Base(pkgName))
+			}
+			fmt.Println("instrumenting tests of", pkgName)
+			program, err := cmd.LoadPkgWithTests(c, pkgDir, pkgName)
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
-			err = Instrument(pkgName, program)
+			err = InstrumentTests(pkgName, program, o)
 			if err != nil {
 				return nil, cmd.Errorf(7, err.Error())
 			}
-			_, err = BuildBinary(c, keepWork, work, pkgName, output, program)
+			_, err = BuildTestBinary(c, o.KeepWork, o.Work, pkgName, output, program)
 			if err != nil {
 				return nil, cmd.Errorf(8, err.Error())
 			}
@@ -0,0 +1,215 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/types"
+	"strconv"
+	"strings"
+
+	"github.com/timtadh/dynagrok/analysis"
+	"golang.org/x/tools/go/loader"
+)
+
+// DefaultExitFuncs are the functions which terminate the program without
+// running the deferred calls. They are named as by types.Func.FullName.
+var DefaultExitFuncs = []string{
+	"os.Exit",
+	"syscall.Exit",
+	"log.Fatal",
+	"log.Fatalf",
+	"log.Fatalln",
+	"(*log.Logger).Fatal",
+	"(*log.Logger).Fatalf",
+	"(*log.Logger).Fatalln",
+}
+
+func defaultExitFuncs() map[string]bool {
+	funcs := make(map[string]bool, len(DefaultExitFuncs))
+	for _, name := range DefaultExitFuncs {
+		funcs[name] = true
+	}
+	return funcs
+}
+
+// exits makes the program shut the dgruntime down before it calls one of
+// the exit functions (see DefaultExitFuncs and Options.ExitFuncs). Each
+// reference to an exit function, whether it is called or taken as a
+// (method) value, is wrapped:
+//
+//	os.Exit(code)
+//
+// becomes
+//
+//	func(__dgexit func(code int)) func(code int) {
+//		return func(a0 int) {
+//			dgruntime.Shutdown()
+//			__dgexit(a0)
+//		}
+//	}(os.Exit)(code)
+//
+// The exit functions are recognized by their types.Func so renamed
+// imports are handled. When the function's type cannot be spelled in the
+// file the dgruntime is shut down before the statement instead.
+func (i *instrumenter) exits(pkg *loader.PackageInfo, cfg *analysis.CFG, fnBody *[]ast.Stmt) error {
+	wrapped := make(map[ast.Expr]bool)
+	return analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for j := 0; j < len(*blk); j++ {
+			stmt := (*blk)[j]
+			shutdown := false
+			wrap := func(n ast.Node) {
+				for _, slot := range exprSlots(n) {
+					if wrapped[*slot] || !i.isExitFunc(pkg, *slot) {
+						continue
+					}
+					wrapped[*slot] = true
+					if w := i.mkExitWrapper(pkg, *slot); w != nil {
+						*slot = w
+					} else {
+						shutdown = true
+					}
+				}
+			}
+			wrap(stmt)
+			if decl, ok := stmt.(*ast.DeclStmt); ok {
+				if gen, ok := decl.Decl.(*ast.GenDecl); ok {
+					for _, spec := range gen.Specs {
+						wrap(spec)
+					}
+				}
+			}
+			err := analysis.Exprs(stmt, func(expr ast.Expr) error {
+				wrap(expr)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if shutdown {
+				*blk = Insert(cfg, nil, *blk, j, i.mkShutdownNow(stmt.Pos()))
+				j++
+			}
+		}
+		return nil
+	})
+}
+
+// exprSlots lists the places in the node which hold an expression that
+// may be a reference to a function.
+func exprSlots(n ast.Node) []*ast.Expr {
+	var slots []*ast.Expr
+	list := func(exprs []ast.Expr) {
+		for k := range exprs {
+			slots = append(slots, &exprs[k])
+		}
+	}
+	switch x := n.(type) {
+	case *ast.CallExpr:
+		slots = append(slots, &x.Fun)
+		list(x.Args)
+	case *ast.ParenExpr:
+		slots = append(slots, &x.X)
+	case *ast.CompositeLit:
+		list(x.Elts)
+	case *ast.KeyValueExpr:
+		slots = append(slots, &x.Value)
+	case *ast.AssignStmt:
+		list(x.Rhs)
+	case *ast.ReturnStmt:
+		list(x.Results)
+	case *ast.SendStmt:
+		slots = append(slots, &x.Value)
+	case *ast.ValueSpec:
+		list(x.Values)
+	}
+	return slots
+}
+
+// isExitFunc reports whether the expression refers to one of the exit
+// functions.
+func (i *instrumenter) isExitFunc(pkg *loader.PackageInfo, expr ast.Expr) bool {
+	var id *ast.Ident
+	switch e := expr.(type) {
+	case *ast.Ident:
+		id = e
+	case *ast.SelectorExpr:
+		id = e.Sel
+	default:
+		return false
+	}
+	f, ok := pkg.Info.Uses[id].(*types.Func)
+	return ok && i.exitFuncs[f.FullName()]
+}
+
+// mkExitWrapper wraps the reference to an exit function in a function
+// of the same type which shuts the dgruntime down first. It returns nil
+// if the type cannot be spelled in the current file.
+func (i *instrumenter) mkExitWrapper(pkg *loader.PackageInfo, expr ast.Expr) ast.Expr {
+	sig, ok := pkg.Info.TypeOf(expr).(*types.Signature)
+	if !ok {
+		return nil
+	}
+	spelled := true
+	qual := i.qualifier(pkg, &spelled)
+	params := make([]string, 0, sig.Params().Len())
+	args := make([]string, 0, sig.Params().Len())
+	for k := 0; k < sig.Params().Len(); k++ {
+		typ := types.TypeString(sig.Params().At(k).Type(), qual)
+		arg := fmt.Sprintf("a%d", k)
+		if sig.Variadic() && k == sig.Params().Len()-1 {
+			typ = "..." + types.TypeString(sig.Params().At(k).Type().(*types.Slice).Elem(), qual)
+			args = append(args, arg+"...")
+		} else {
+			args = append(args, arg)
+		}
+		params = append(params, fmt.Sprintf("%v %v", arg, typ))
+	}
+	results := ""
+	ret := ""
+	if sig.Results().Len() > 0 {
+		results = " " + types.TypeString(sig.Results(), qual)
+		ret = "return "
+	}
+	typ := types.TypeString(sig, qual)
+	if !spelled {
+		return nil
+	}
+	s := fmt.Sprintf("func(__dgexit %v) %v { return func(%v)%v { dgruntime.Shutdown(); %v__dgexit(%v) } }(nil)",
+		typ, typ, strings.Join(params, ", "), results, ret, strings.Join(args, ", "))
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(expr.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkExitWrapper (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[0] = expr
+	return call
+}
+
+// qualifier names the packages as the current file imports them. spelled
+// is set to false if a package is not imported by the file.
+func (i *instrumenter) qualifier(pkg *loader.PackageInfo, spelled *bool) types.Qualifier {
+	return func(p *types.Package) string {
+		if p == pkg.Pkg {
+			return ""
+		}
+		for _, imp := range i.currentFile.Imports {
+			path, err := strconv.Unquote(imp.Path.Value)
+			if err != nil || (path != p.Path() && !strings.HasSuffix(p.Path(), "/vendor/"+path)) {
+				continue
+			}
+			if imp.Name == nil {
+				return p.Name()
+			}
+			switch imp.Name.Name {
+			case ".":
+				return ""
+			case "_":
+				continue
+			}
+			return imp.Name.Name
+		}
+		*spelled = false
+		return p.Name()
+	}
+}
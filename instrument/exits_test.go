@@ -0,0 +1,74 @@
+package instrument
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const exitsProgram = `package main
+
+import (
+	"fmt"
+	"log"
+	sys "os"
+)
+
+func work(n int) int {
+	if n > 0 {
+		return n + work(n-1)
+	}
+	return 0
+}
+
+// die terminates the program without running the deferred calls and
+// without calling one of the exit functions dynagrok knows.
+func die() {
+	p, _ := sys.FindProcess(sys.Getpid())
+	p.Kill()
+	select {}
+}
+
+func main() {
+	fmt.Println(work(3))
+	switch sys.Args[1] {
+	case "exit":
+		sys.Exit(3)
+	case "value":
+		exit := sys.Exit
+		exit(4)
+	case "logger":
+		l := log.New(sys.Stderr, "", 0)
+		fatal := l.Fatalf
+		fatal("bye %d", 5)
+	case "die":
+		die()
+	}
+}
+`
+
+// The exit functions are recognized by their types, through a renamed
+// import and as function and method values, and --exit-func adds to them.
+// The dgruntime is shut down (and the profile written) before each one.
+func TestExits(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": exitsProgram})
+	defer p.Close()
+	written := func(bin, arg string) bool {
+		dgprof, output, err := p.run(bin, nil, arg)
+		if err == nil {
+			t.Fatalf("expected %v to exit with an error:\n%s", arg, output)
+		}
+		_, err = os.Stat(filepath.Join(dgprof, "flow-graph.txt"))
+		return err == nil
+	}
+	bin := p.build(".", false, &Options{ExitFuncs: []string{"example.com/m.die"}})
+	for _, arg := range []string{"exit", "value", "logger", "die"} {
+		if !written(bin, arg) {
+			t.Errorf("no profile was written before the %v exit", arg)
+		}
+	}
+	bin = p.build(".", false, nil)
+	if written(bin, "die") {
+		t.Error("die was treated as an exit function without --exit-func")
+	}
+}
@@ -0,0 +1,34 @@
+package instrument
+
+import (
+	"regexp"
+)
+
+// Filter scopes the instrumentation to a subset of the functions in the
+// instrumented packages. Functions which are filtered out become opaque:
+// they still enter and exit the dgruntime (so they show up as a single
+// node in the call and flow graphs) but their basic blocks are not
+// recorded. A nil *Filter instruments every function.
+type Filter struct {
+	OnlyFunc *regexp.Regexp // only instrument functions matching
+	OnlyFile *regexp.Regexp // only instrument functions in matching files
+	SkipFunc *regexp.Regexp // do not instrument functions matching
+}
+
+// Instrument reports whether the blocks of the function fnName in the
+// file fileName should be instrumented.
+func (f *Filter) Instrument(fnName, fileName string) bool {
+	if f == nil {
+		return true
+	}
+	if f.OnlyFunc != nil && !f.OnlyFunc.MatchString(fnName) {
+		return false
+	}
+	if f.OnlyFile != nil && !f.OnlyFile.MatchString(fileName) {
+		return false
+	}
+	if f.SkipFunc != nil && f.SkipFunc.MatchString(fnName) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package instrument
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+var filterProgram = map[string]string{
+	"a.go": `package main
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func sign(x int) int {
+	if x < 0 {
+		return -1
+	} else if x > 0 {
+		return 1
+	}
+	return 0
+}
+`,
+	"b.go": `package main
+
+func larger(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+`,
+	"main.go": `package main
+
+import "fmt"
+
+func main() {
+	fmt.Println(abs(-3), sign(-3), larger(2, 5))
+}
+`,
+}
+
+// blocks are the blocks of the function the profile's flows enter.
+func blocks(prof *dgtypes.Profile, fn *dgtypes.Function) map[int]bool {
+	blks := make(map[int]bool)
+	for e := range prof.Flows {
+		for _, b := range []dgtypes.BlkEntrance{e.Src, e.Targ} {
+			if b.In == fn.FuncPc {
+				blks[b.BasicBlockId] = true
+			}
+		}
+	}
+	return blks
+}
+
+// The filters select the functions whose blocks are recorded. The others
+// still run (with an opaque body) and are called, but record no blocks.
+func TestFilter(t *testing.T) {
+	cases := []struct {
+		name         string
+		filter       *Filter
+		instrumented []string
+	}{
+		{"only-func", &Filter{OnlyFunc: regexp.MustCompile(`\.abs$`)}, []string{"abs"}},
+		{"only-file", &Filter{OnlyFile: regexp.MustCompile(`/b\.go$`)}, []string{"larger"}},
+		{"skip-func", &Filter{SkipFunc: regexp.MustCompile(`\.(sign|main)$`)}, []string{"abs", "larger"}},
+	}
+	for _, c := range cases {
+		files := make(map[string]string)
+		for name, src := range filterProgram {
+			files[name] = src
+		}
+		p := newProgram(t, files)
+		bin := p.build(".", false, &Options{Filter: c.filter})
+		dgprof, output, err := p.run(bin, nil)
+		if err != nil {
+			p.Close()
+			t.Fatalf("%v %v:\n%s", c.name, err, output)
+		}
+		if !strings.HasPrefix(string(output), "3 -1 5\n") {
+			t.Errorf("%v expected the program to print 3 -1 5 got:\n%s", c.name, output)
+		}
+		prof := p.profile(dgprof)
+		fns := functions(prof)
+		instrumented := make(map[string]bool)
+		for _, name := range c.instrumented {
+			instrumented[name] = true
+		}
+		for _, name := range []string{"abs", "sign", "larger", "main"} {
+			fn := fns["example.com/m."+name]
+			if fn == nil || fn.Calls != 1 {
+				t.Errorf("%v expected %v to be called once got %v", c.name, name, fn)
+				continue
+			}
+			blks := blocks(prof, fn)
+			if instrumented[name] && len(blks) <= 1 {
+				t.Errorf("%v expected the blocks of %v to be recorded got %v", c.name, name, blks)
+			} else if !instrumented[name] && len(blks) > 1 {
+				t.Errorf("%v expected no blocks of the filtered %v got %v", c.name, name, blks)
+			}
+		}
+		p.Close()
+	}
+}
@@ -0,0 +1,177 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/token"
+
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// headers instruments the blocks which do not start a statement list so
+// the EnterBlk call cannot go at their start:
+//
+//   - the header of a range loop is entered before the loop and after
+//     each iteration
+//   - the post statement of a for loop (when it is a block of its own) is
+//     entered after each iteration
+//   - a for loop without a condition and with an empty body is entered in
+//     its body
+//   - a select case without a body is entered in its (new) body
+//
+// "After each iteration" means at the end of the loop's body and before
+// each continue of the loop. It runs after the blocks which start a
+// statement list have been instrumented.
+func (i *instrumenter) headers(cfg *analysis.CFG, fnBody *[]ast.Stmt) error {
+	return analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for j := 0; j < len(*blk); j++ {
+			stmt := (*blk)[j]
+			label := ""
+			l, labeled := stmt.(*ast.LabeledStmt)
+			if labeled {
+				label = l.Label.Name
+				stmt = l.Stmt
+			}
+			switch s := stmt.(type) {
+			case *ast.RangeStmt:
+				h := cfg.Block(s)
+				if h == nil || h.Body != nil {
+					continue
+				}
+				i.loopBack(cfg, h, s.Body, label)
+				enter := i.mkEnterBlk(blkPos(cfg, h), h.Id)
+				if labeled {
+					// before the loop (see labeledEnter)
+					enter = i.labeledEnter(*fnBody, *blk, j, enter)
+				}
+				*blk = Insert(cfg, h, *blk, j, enter)
+				j++
+			case *ast.ForStmt:
+				if h := cfg.Block(s); h != nil && h.Body == nil && s.Cond == nil {
+					s.Body.List = Insert(cfg, h, s.Body.List, 0, i.mkEnterBlk(blkPos(cfg, h), h.Id))
+				}
+				if s.Post == nil {
+					continue
+				}
+				if p := cfg.Block(s.Post); p != nil && p.Body == nil && *p.Stmts[0] == s.Post {
+					i.loopBack(cfg, p, s.Body, label)
+				}
+			case *ast.SelectStmt:
+				for _, c := range s.Body.List {
+					clause := c.(*ast.CommClause)
+					if clause.Comm == nil || len(clause.Body) > 0 {
+						continue
+					}
+					if b := cfg.Block(clause.Comm); b != nil && b.Body == nil {
+						clause.Body = Insert(cfg, b, clause.Body, 0, i.mkEnterBlk(blkPos(cfg, b), b.Id))
+					}
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// loopBack enters the block b at the end of the loop's body and before
+// each continue of the loop.
+func (i *instrumenter) loopBack(cfg *analysis.CFG, b *analysis.Block, body *ast.BlockStmt, label string) {
+	i.beforeContinues(cfg, b, &body.List, label, false)
+	if n := len(body.List); n == 0 || !jumps(body.List[n-1]) {
+		body.List = Insert(cfg, b, body.List, n, i.mkEnterBlk(blkPos(cfg, b), b.Id))
+	}
+}
+
+// beforeContinues enters the block b before each continue in the list
+// which continues the loop labeled label. An unlabeled continue in a
+// nested loop belongs to the nested loop.
+func (i *instrumenter) beforeContinues(cfg *analysis.CFG, b *analysis.Block, list *[]ast.Stmt, label string, nested bool) {
+	for j := 0; j < len(*list); j++ {
+		stmt := (*list)[j]
+		if l, ok := stmt.(*ast.LabeledStmt); ok {
+			stmt = l.Stmt
+		}
+		switch s := stmt.(type) {
+		case *ast.BranchStmt:
+			if s.Tok != token.CONTINUE {
+				continue
+			}
+			if (s.Label == nil && !nested) || (s.Label != nil && s.Label.Name == label) {
+				*list = Insert(cfg, b, *list, j, i.mkEnterBlk(blkPos(cfg, b), b.Id))
+				j++
+			}
+		case *ast.BlockStmt:
+			i.beforeContinues(cfg, b, &s.List, label, nested)
+		case *ast.IfStmt:
+			i.beforeContinues(cfg, b, &s.Body.List, label, nested)
+			if s.Else != nil {
+				// the else is a block or an if, neither is a continue
+				i.beforeContinues(cfg, b, &[]ast.Stmt{s.Else}, label, nested)
+			}
+		case *ast.ForStmt:
+			i.beforeContinues(cfg, b, &s.Body.List, label, true)
+		case *ast.RangeStmt:
+			i.beforeContinues(cfg, b, &s.Body.List, label, true)
+		case *ast.SwitchStmt:
+			for _, c := range s.Body.List {
+				i.beforeContinues(cfg, b, &c.(*ast.CaseClause).Body, label, nested)
+			}
+		case *ast.TypeSwitchStmt:
+			for _, c := range s.Body.List {
+				i.beforeContinues(cfg, b, &c.(*ast.CaseClause).Body, label, nested)
+			}
+		case *ast.SelectStmt:
+			for _, c := range s.Body.List {
+				i.beforeContinues(cfg, b, &c.(*ast.CommClause).Body, label, nested)
+			}
+		}
+	}
+}
+
+// jumps reports whether control never continues past the statement.
+func jumps(stmt ast.Stmt) bool {
+	if l, ok := stmt.(*ast.LabeledStmt); ok {
+		stmt = l.Stmt
+	}
+	switch stmt.(type) {
+	case *ast.ReturnStmt, *ast.BranchStmt:
+		return true
+	}
+	return false
+}
+
+// fallsOff enters the empty block the function ends in when control falls
+// off the end of the function body.
+func (i *instrumenter) fallsOff(cfg *analysis.CFG, fnBody *[]ast.Stmt) {
+	if cfg.Type.Results.NumFields() > 0 {
+		// the body ends with a terminating statement
+		return
+	}
+	for _, b := range cfg.Blocks {
+		if b.Id != 0 && len(b.Stmts) == 0 && len(b.Prev) > 0 && len(b.Next) == 0 {
+			*fnBody = Insert(cfg, b, *fnBody, len(*fnBody), i.mkEnterBlk(blkPos(cfg, b), b.Id))
+		}
+	}
+}
+
+// uninstrumented lists the reachable blocks of the function (other than
+// the entry block which EnterFunc covers) without an EnterBlk call.
+func (i *instrumenter) uninstrumented(cfg *analysis.CFG) []string {
+	var missing []string
+	for _, b := range cfg.Blocks {
+		if b.Id == 0 || len(b.Prev) == 0 || i.entered[b.Id] {
+			continue
+		}
+		p := cfg.FSet.Position(blkPos(cfg, b))
+		missing = append(missing, fmt.Sprintf("%v blk-%d at %v", cfg.Name, b.Id, p))
+	}
+	return missing
+}
+
+// blkPos is the position of the block's first statement. Empty blocks
+// are placed at the closing brace of the function.
+func blkPos(cfg *analysis.CFG, b *analysis.Block) token.Pos {
+	if len(b.Stmts) > 0 {
+		return (*b.Stmts[0]).Pos()
+	}
+	return cfg.Fn.End() - 1
+}
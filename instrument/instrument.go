@@ -8,12 +8,15 @@ import (
 	"go/ast"
 	"go/parser"
 	"go/token"
+	"go/types"
 	"sort"
 	"strconv"
 	"strings"
+	"unicode"
 
 	"github.com/timtadh/data-structures/errors"
 	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 	"github.com/timtadh/dynagrok/dgruntime/excludes"
 	"golang.org/x/tools/go/ast/astutil"
 	"golang.org/x/tools/go/loader"
@@ -22,10 +25,33 @@ import (
 type instrumenter struct {
 	program     *loader.Program
 	entry       string
+	tests       bool
+	filter      *Filter
+	inst        dgtypes.Instrumentation
+	channels    bool
+	exitFuncs   map[string]bool
 	currentFile *ast.File
+	currentPkg  *loader.PackageInfo
+	// entered holds the blocks of the current function which have an
+	// EnterBlk call.
+	entered       map[int]bool
+	checkCoverage bool
+	uncovered     []string
+	// predicates wraps the conditions in dgruntime.Branch calls (see
+	// mkBranch).
+	predicates      bool
+	predicateValues bool
+	// temps numbers the temporaries chans declares beside the variables
+	// of a receive (see recvTemps).
+	temps int
 }
 
-func Instrument(entryPkgName string, program *loader.Program) (err error) {
+// Instrument inserts the dgruntime instrumentation into every function of
+// the non-excluded packages of the program. Functions rejected by
+// o.Filter are instrumented as opaque single block functions. o.Level
+// selects the dgruntime calls which are inserted. A nil o instruments
+// everything at the full level.
+func Instrument(entryPkgName string, program *loader.Program, o *Options) (err error) {
 	entry := program.Package(entryPkgName)
 	if entry == nil {
 		return errors.Errorf("The entry package was not found in the loaded program")
@@ -34,12 +60,48 @@ func Instrument(entryPkgName string, program *loader.Program) (err error) {
 		return errors.Errorf("The entry package was not main")
 	}
 	i := &instrumenter{
-		program: program,
-		entry:   entryPkgName,
+		program:   program,
+		entry:     entryPkgName,
+		exitFuncs: defaultExitFuncs(),
 	}
+	i.configure(o)
 	return i.instrument()
 }
 
+// InstrumentTests instruments a program loaded with its tests (see
+// cmd.LoadPkgWithTests). The entry package does not need to be main.
+// Every TestXxx function begins a dgruntime segment so each test writes
+// its own flow graph into $DGPROF/pass or $DGPROF/fail.
+func InstrumentTests(entryPkgName string, program *loader.Program, o *Options) (err error) {
+	entry := program.Package(entryPkgName)
+	if entry == nil {
+		return errors.Errorf("The entry package was not found in the loaded program")
+	}
+	i := &instrumenter{
+		program:   program,
+		entry:     entryPkgName,
+		tests:     true,
+		exitFuncs: defaultExitFuncs(),
+	}
+	i.configure(o)
+	return i.instrument()
+}
+
+func (i *instrumenter) configure(o *Options) {
+	if o == nil {
+		return
+	}
+	i.filter = o.Filter
+	i.inst = o.Instrumentation
+	i.channels = o.Channels
+	i.checkCoverage = o.CheckCoverage
+	i.predicates = o.Predicates
+	i.predicateValues = o.PredicateValues
+	for _, name := range o.ExitFuncs {
+		i.exitFuncs[name] = true
+	}
+}
+
 func (i *instrumenter) instrument() (err error) {
 	for _, pkg := range i.program.AllPackages {
 		// if pkg.Cgo {
@@ -48,9 +110,12 @@ func (i *instrumenter) instrument() (err error) {
 		if excludes.ExcludedPkg(pkg.Pkg.Path()) {
 			continue
 		}
+		setLevel := i.inst.Level != dgtypes.FullLevel
 		for _, fileAst := range pkg.Files {
 			i.currentFile = fileAst
+			i.currentPkg = pkg
 			hadFunc := false
+			hadTest := false
 			err = analysis.Functions(pkg, fileAst, func(fn ast.Node, fnName string) error {
 				hadFunc = true
 				switch x := fn.(type) {
@@ -58,7 +123,17 @@ func (i *instrumenter) instrument() (err error) {
 					if x.Body == nil {
 						return nil
 					}
-					return i.fnBody(pkg, fnName, fn, &x.Body.List)
+					err := i.fnBody(pkg, fnName, fn, &x.Body.List)
+					if err != nil {
+						return err
+					}
+					if i.tests && i.isTestFunc(pkg, x) {
+						hadTest = true
+						begin, end := i.mkSegment(x)
+						x.Body.List = Insert(nil, nil, x.Body.List, 0, begin)
+						x.Body.List = Insert(nil, nil, x.Body.List, afterExitFunc(x.Body.List), end)
+					}
+					return nil
 				case *ast.FuncLit:
 					if x.Body == nil {
 						return nil
@@ -75,13 +150,30 @@ func (i *instrumenter) instrument() (err error) {
 			// instrumentation added
 			if hadFunc {
 				astutil.AddImport(i.program.Fset, fileAst, "dgruntime")
+				if setLevel {
+					fileAst.Decls = append(fileAst.Decls, i.mkSetLevel(fileAst.Pos()))
+					setLevel = false
+				}
+			}
+			if hadTest {
+				astutil.AddImport(i.program.Fset, fileAst, "dgruntime/dgtest")
 			}
 		}
 	}
+	if len(i.uncovered) > 0 {
+		for _, u := range i.uncovered {
+			fmt.Println("uninstrumented:", u)
+		}
+		return errors.Errorf("%d blocks were not instrumented", len(i.uncovered))
+	}
 	return nil
 }
 func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.Node, fnBody *[]ast.Stmt) error {
+	if !i.filter.Instrument(fnName, i.program.Fset.File(fnAst.Pos()).Name()) {
+		return i.opaqueBody(pkg, fnName, fnAst, fnBody)
+	}
 	cfg := analysis.BuildCFG(i.program.Fset, fnName, fnAst, fnBody)
+	i.entered = make(map[int]bool)
 	if true {
 		// first collect the instrumentation points (IPs)
 		// build a map from lexical blocks to a sequence of IPs
@@ -127,11 +219,16 @@ func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.
 				// If the insertion point for the instrumentation is a LabeledStmt
 				// then we have two special cases
 				case *ast.LabeledStmt:
-					switch stmt.Stmt.(type) {
-					case *ast.ForStmt, *ast.SwitchStmt, *ast.SelectStmt, *ast.TypeSwitchStmt, *ast.RangeStmt:
+					switch inner := stmt.Stmt.(type) {
+					case *ast.SwitchStmt:
+						i.labeledSwitch(cfg, b, body, pos, &inner.Init)
+					case *ast.TypeSwitchStmt:
+						i.labeledSwitch(cfg, b, body, pos, &inner.Init)
+					case *ast.ForStmt, *ast.SelectStmt, *ast.RangeStmt:
 						// if it is one of the statements which allow labeled breaks/continues
-						// then we can't insert instrumentation here. (But, don't worry we can insert
-						// it inside of these statements so very little is lost).
+						// then the label must stay on the statement. The instrumentation goes
+						// before it (see labeledEnter).
+						*body = Insert(cfg, b, *body, b.StartsAt, i.labeledEnter(*fnBody, *body, b.StartsAt, i.mkEnterBlk(pos, b.Id)))
 					default:
 						// Otherwise, in order to ensure our instrumentation is called first
 						// (before any function calls) we need to replace the inner portion
@@ -147,34 +244,37 @@ func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.
 				}
 			}
 		}
+		// Then the blocks which do not start a statement list: loop headers, for
+		// loop posts and select cases without a body.
+		err := i.headers(cfg, fnBody)
+		if err != nil {
+			return err
+		}
+		i.fallsOff(cfg, fnBody)
+		if i.checkCoverage {
+			i.uncovered = append(i.uncovered, i.uninstrumented(cfg)...)
+		}
 		// Finally, we need to check for the existence of an os.Exit call and insert a
 		// shutdown hook for Dyangrok if it exists.
-		err := analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
-			for j := 0; j < len(*blk); j++ {
-				pos := (*blk)[j].Pos()
-				switch stmt := (*blk)[j].(type) {
-				default:
-					err := analysis.Exprs(stmt, func(expr ast.Expr) error {
-						switch e := expr.(type) {
-						case *ast.SelectorExpr:
-							if ident, ok := e.X.(*ast.Ident); ok {
-								if ident.Name == "os" && e.Sel.Name == "Exit" {
-									*blk = Insert(cfg, nil, *blk, j, i.mkShutdownNow(pos))
-									j++
-								}
-							}
-						}
-						return nil
-					})
-					if err != nil {
-						return err
-					}
-				}
-			}
-			return nil
-		})
+		err = i.exits(pkg, cfg, fnBody)
+		if err != nil {
+			return err
+		}
+		err = i.spawns(pkg, fnBody)
 		if err != nil {
-			return nil
+			return err
+		}
+		if i.channels {
+			err = i.chans(pkg, fnBody)
+			if err != nil {
+				return err
+			}
+		}
+		i.recovers(pkg, *fnBody)
+		i.panicValues(pkg, *fnBody)
+		i.returns(pkg, cfg.Type, fnBody)
+		if i.predicates {
+			i.branches(*fnBody)
 		}
 	}
 	pdt := cfg.PostDominators()
@@ -184,8 +284,10 @@ func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.
 		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 0, i.mkCfg(fnAst.Pos(), cfg, cfgName))
 		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 1, i.mkIdom(fnAst.Pos(), pdt, ipdomName))
 		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 2, i.mkEnterFunc(fnAst.Pos(), fnName, cfgName, ipdomName))
-		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 3, i.mkExitFunc(fnAst.Pos(), fnName))
-		if pkg.Pkg.Path() == i.entry && fnName == fmt.Sprintf("%v.main", pkg.Pkg.Path()) {
+		flag, exit := i.mkExitFunc(fnAst.Pos(), fnName)
+		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 3, flag)
+		*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 4, exit)
+		if i.isMain(pkg, fnName) {
 			*fnBody = Insert(cfg, cfg.Blocks[0], *fnBody, 0, i.mkShutdown(fnAst.Pos()))
 		}
 	} else {
@@ -194,19 +296,213 @@ func (i *instrumenter) fnBody(pkg *loader.PackageInfo, fnName string, fnAst ast.
 		*fnBody = Insert(cfg, emptyBlk, *fnBody, 0, i.mkCfg(fnAst.Pos(), cfg, cfgName))
 		*fnBody = Insert(cfg, emptyBlk, *fnBody, 1, i.mkIdom(fnAst.Pos(), pdt, ipdomName))
 		*fnBody = Insert(cfg, emptyBlk, *fnBody, 2, i.mkEnterFunc(fnAst.Pos(), fnName, cfgName, ipdomName))
-		*fnBody = Insert(cfg, emptyBlk, *fnBody, 3, i.mkExitFunc(fnAst.Pos(), fnName))
-		if pkg.Pkg.Path() == i.entry && fnName == fmt.Sprintf("%v.main", pkg.Pkg.Path()) {
+		flag, exit := i.mkExitFunc(fnAst.Pos(), fnName)
+		*fnBody = Insert(cfg, emptyBlk, *fnBody, 3, flag)
+		*fnBody = Insert(cfg, emptyBlk, *fnBody, 4, exit)
+		if i.isMain(pkg, fnName) {
 			*fnBody = Insert(cfg, emptyBlk, *fnBody, 0, i.mkShutdown(fnAst.Pos()))
 		}
 	}
 	return nil
 }
 
+// opaqueBody instruments a function excluded by the Filter. The function
+// enters the dgruntime with a CFG of a single block so calls through it
+// still connect the flow graph without recording its blocks.
+func (i *instrumenter) opaqueBody(pkg *loader.PackageInfo, fnName string, fnAst ast.Node, fnBody *[]ast.Stmt) error {
+	err := i.exits(pkg, nil, fnBody)
+	if err != nil {
+		return err
+	}
+	err = i.spawns(pkg, fnBody)
+	if err != nil {
+		return err
+	}
+	if i.channels {
+		err = i.chans(pkg, fnBody)
+		if err != nil {
+			return err
+		}
+	}
+	i.recovers(pkg, *fnBody)
+	i.panicValues(pkg, *fnBody)
+	i.returns(pkg, funcType(fnAst), fnBody)
+	flag, exit := i.mkExitFunc(fnAst.Pos(), fnName)
+	*fnBody = Insert(nil, nil, *fnBody, 0, i.mkEnterFunc(fnAst.Pos(), fnName, "[][]int{{}}", "[]int{0}"))
+	*fnBody = Insert(nil, nil, *fnBody, 1, flag)
+	*fnBody = Insert(nil, nil, *fnBody, 2, exit)
+	if i.isMain(pkg, fnName) {
+		*fnBody = Insert(nil, nil, *fnBody, 0, i.mkShutdown(fnAst.Pos()))
+	}
+	return nil
+}
+
+// spawns replaces each go statement with one which records a spawn edge
+// from the statement's block to the first block of the new goroutine:
+//
+//	go f(x, y)
+//
+// becomes
+//
+//	{
+//		__dgf, __dga0, __dga1 := f, x, y
+//		__dgspawn := dgruntime.Spawn()
+//		go func() {
+//			dgruntime.Spawned(__dgspawn)
+//			__dgf(__dga0, __dga1)
+//		}()
+//	}
+//
+// so the function and its arguments are still evaluated by the spawning
+// goroutine. Functions, constants and untyped arguments are left in place.
+func (i *instrumenter) spawns(pkg *loader.PackageInfo, fnBody *[]ast.Stmt) error {
+	return analysis.Blocks(fnBody, nil, func(blk *[]ast.Stmt, id int) error {
+		for j, stmt := range *blk {
+			switch s := stmt.(type) {
+			case *ast.GoStmt:
+				(*blk)[j] = i.mkSpawn(pkg, s)
+			case *ast.LabeledStmt:
+				if g, ok := s.Stmt.(*ast.GoStmt); ok {
+					s.Stmt = i.mkSpawn(pkg, g)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// spawnTemp reports whether the expression must be evaluated into a
+// temporary before the goroutine starts.
+func (i *instrumenter) spawnTemp(pkg *loader.PackageInfo, expr ast.Expr) bool {
+	switch e := unparen(expr).(type) {
+	case *ast.FuncLit:
+		return false
+	case *ast.Ident:
+		switch pkg.Info.Uses[e].(type) {
+		case *types.Func, *types.Builtin, *types.Nil:
+			return false
+		}
+	case *ast.SelectorExpr:
+		if _, ok := pkg.Info.Uses[e.Sel].(*types.Func); ok && pkg.Info.Selections[e] == nil {
+			// a qualified function: pkg.Func
+			return false
+		}
+	}
+	tv, has := pkg.Info.Types[expr]
+	if !has {
+		return true
+	}
+	if tv.Value != nil || tv.IsNil() || tv.IsType() {
+		return false
+	}
+	if b, ok := tv.Type.(*types.Basic); ok && b.Info()&types.IsUntyped != 0 {
+		return false
+	}
+	return true
+}
+
+// recovers wraps the calls to recover in the function body (but not in
+// the function literals inside it, they are instrumented on their own)
+// in dgruntime.Recovered so the call which recovered a panic is known.
+func (i *instrumenter) recovers(pkg *loader.PackageInfo, fnBody []ast.Stmt) {
+	for _, stmt := range fnBody {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch e := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if ident, ok := unparen(e.Fun).(*ast.Ident); ok {
+					if b, ok := pkg.Info.Uses[ident].(*types.Builtin); ok && b.Name() == "recover" {
+						i.mkRecovered(e)
+						return false
+					}
+				}
+			}
+			return true
+		})
+	}
+}
+
+func pureExpr(expr ast.Expr) bool {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		return e.Name != "_"
+	case *ast.SelectorExpr:
+		return pureExpr(e.X)
+	case *ast.ParenExpr:
+		return pureExpr(e.X)
+	}
+	return false
+}
+
+// afterEnterBlk is the index after the dgruntime.EnterBlk call (if any)
+// at the start of a block.
+func afterEnterBlk(list []ast.Stmt) int {
+	if len(list) == 0 {
+		return 0
+	}
+	if s, ok := list[0].(*ast.ExprStmt); ok && isEnterBlk(s.X) {
+		return 1
+	}
+	return 0
+}
+
+// isEnterBlk reports whether the expression is a call of one of the
+// dgruntime.EnterBlk functions.
+func isEnterBlk(expr ast.Expr) bool {
+	if call, ok := expr.(*ast.CallExpr); ok {
+		if sel, ok := call.Fun.(*ast.SelectorExpr); ok {
+			if x, ok := sel.X.(*ast.Ident); ok && x.Name == "dgruntime" && strings.HasPrefix(sel.Sel.Name, "EnterBlk") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unparen(expr ast.Expr) ast.Expr {
+	for {
+		p, ok := expr.(*ast.ParenExpr)
+		if !ok {
+			return expr
+		}
+		expr = p.X
+	}
+}
+
+func (i *instrumenter) isMain(pkg *loader.PackageInfo, fnName string) bool {
+	return pkg.Pkg.Path() == i.entry && fnName == fmt.Sprintf("%v.main", pkg.Pkg.Path())
+}
+
+// isTestFunc reports whether fn is a `func TestXxx(*testing.T)` in a
+// _test.go file.
+func (i *instrumenter) isTestFunc(pkg *loader.PackageInfo, fn *ast.FuncDecl) bool {
+	if !strings.HasSuffix(i.program.Fset.File(fn.Pos()).Name(), "_test.go") {
+		return false
+	}
+	if fn.Recv != nil || fn.Name.Name == "TestMain" || !strings.HasPrefix(fn.Name.Name, "Test") {
+		return false
+	}
+	if rest := fn.Name.Name[len("Test"):]; rest != "" && unicode.IsLower([]rune(rest)[0]) {
+		return false
+	}
+	params := fn.Type.Params.List
+	if len(params) != 1 || len(params[0].Names) > 1 {
+		return false
+	}
+	typ := pkg.Info.TypeOf(params[0].Type)
+	return typ != nil && typ.String() == "*testing.T"
+}
+
 func (i *instrumenter) exprInstrument(b *analysis.Block) error {
 	if len(b.Stmts) <= 0 {
 		return nil
 	}
 	s := b.Stmts[0]
+	if len(b.Stmts) > 1 && *s != nil && initOf(*b.Stmts[1]) == *s {
+		// the block starts with the Init of an else if
+		s = b.Stmts[1]
+	}
 	// This is a list of all statement types.
 	// More may be instrumentable in this fashion than are shown
 	switch stmt := (*s).(type) {
@@ -226,11 +522,18 @@ func (i *instrumenter) exprInstrument(b *analysis.Block) error {
 	case *ast.IfStmt:
 		stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b.Id)
 	case *ast.ForStmt:
-		stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b.Id)
+		if stmt.Cond != nil {
+			stmt.Cond = i.mkEnterBlkCond(stmt, stmt.Cond, b.Id)
+		}
+		// a for without a condition is entered in its body (see headers)
 	case *ast.RangeStmt:
+		// see headers
 	case *ast.SelectStmt:
+		// see headers
 	case *ast.TypeSwitchStmt:
+		i.switchInit(s, &stmt.Init, b.Id)
 	case *ast.SwitchStmt:
+		i.switchInit(s, &stmt.Init, b.Id)
 	case *ast.CaseClause:
 		panic(fmt.Errorf("Unexpected case clause %T %v", stmt, stmt))
 	case *ast.CommClause:
@@ -241,6 +544,108 @@ func (i *instrumenter) exprInstrument(b *analysis.Block) error {
 	return nil
 }
 
+// initOf returns the Init statement of an if, for or switch.
+func initOf(s ast.Stmt) ast.Stmt {
+	switch x := s.(type) {
+	case *ast.IfStmt:
+		return x.Init
+	case *ast.ForStmt:
+		return x.Init
+	case *ast.SwitchStmt:
+		return x.Init
+	case *ast.TypeSwitchStmt:
+		return x.Init
+	}
+	return nil
+}
+
+// switchInit instruments the block which starts with the (type) switch
+// in the slot s. The switch's Init is used when it is free, otherwise the
+// switch is put in a block after the instrumentation so it is still
+// entered before the Init runs.
+func (i *instrumenter) switchInit(s *ast.Stmt, init *ast.Stmt, bbid int) {
+	if *init == nil {
+		*init = i.mkEnterBlk((*s).Pos(), bbid)
+		return
+	}
+	*s = &ast.BlockStmt{
+		Lbrace: (*s).Pos(),
+		List:   []ast.Stmt{i.mkEnterBlk((*s).Pos(), bbid), *s},
+		Rbrace: (*s).End(),
+	}
+}
+
+// labeledEnter returns the EnterBlk call enter for the block which starts
+// with list[j], a labeled loop or select. The call goes before the
+// statement. When the function has gotos to the label they must run the
+// call, so the label is moved to the call and the statement, when it is
+// broken or continued by the label, gets a label of its own:
+//
+//	L:
+//		for ... { continue L }
+//		...
+//		goto L
+//
+// becomes
+//
+//	L:
+//		dgruntime.EnterBlk(...)
+//	__dgL:
+//		for ... { continue __dgL }
+//		...
+//		goto L
+func (i *instrumenter) labeledEnter(fnBody, list []ast.Stmt, j int, enter ast.Stmt) ast.Stmt {
+	l := list[j].(*ast.LabeledStmt)
+	// branches lists the gotos (or the breaks and continues) to the label,
+	// a function literal has labels of its own.
+	branches := func(stmts []ast.Stmt, gotos bool) []*ast.BranchStmt {
+		var found []*ast.BranchStmt
+		for _, stmt := range stmts {
+			ast.Inspect(stmt, func(n ast.Node) bool {
+				switch s := n.(type) {
+				case *ast.FuncLit:
+					return false
+				case *ast.BranchStmt:
+					if s.Label != nil && s.Label.Name == l.Label.Name && (s.Tok == token.GOTO) == gotos {
+						found = append(found, s)
+					}
+				}
+				return true
+			})
+		}
+		return found
+	}
+	if len(branches(fnBody, true)) == 0 {
+		return enter
+	}
+	if inner := branches([]ast.Stmt{l.Stmt}, false); len(inner) > 0 {
+		name := "__dg" + l.Label.Name
+		for _, s := range inner {
+			s.Label = &ast.Ident{NamePos: s.Label.Pos(), Name: name}
+		}
+		list[j] = &ast.LabeledStmt{
+			Label: &ast.Ident{NamePos: l.Label.Pos(), Name: name},
+			Colon: l.Colon,
+			Stmt:  l.Stmt,
+		}
+	} else {
+		list[j] = l.Stmt
+	}
+	return &ast.LabeledStmt{Label: l.Label, Colon: l.Colon, Stmt: enter}
+}
+
+// labeledSwitch instruments the block which starts with a labeled
+// (type) switch. The switch's Init is used when it is free, otherwise the
+// instrumentation goes before the label.
+func (i *instrumenter) labeledSwitch(cfg *analysis.CFG, b *analysis.Block, body *[]ast.Stmt, pos token.Pos, init *ast.Stmt) {
+	if *init != nil {
+		*body = Insert(cfg, b, *body, b.StartsAt, i.mkEnterBlk(pos, b.Id))
+		return
+	}
+	*init = i.mkEnterBlk(pos, b.Id)
+	cfg.AddAllToBlk(b, *init)
+}
+
 func Insert(cfg *analysis.CFG, cfgBlk *analysis.Block, blk []ast.Stmt, j int, stmt ast.Stmt) []ast.Stmt {
 	if cfg != nil {
 		if cfgBlk == nil {
@@ -312,9 +717,27 @@ func (i *instrumenter) mkDeferPrint(pos token.Pos, data string) ast.Stmt {
 	return &ast.DeferStmt{Call: e.(*ast.CallExpr)}
 }
 
+// enterFuncs and enterBlks are the dgruntime functions called at each
+// dgtypes.Level.
+var enterFuncs = map[dgtypes.Level]string{
+	dgtypes.FullLevel:        "EnterFunc",
+	dgtypes.NoCDLevel:        "EnterFuncNoCD",
+	dgtypes.NoDurationsLevel: "EnterFuncNoDurations",
+	dgtypes.CountsLevel:      "EnterFuncFast",
+	dgtypes.SampledLevel:     "EnterFuncFast",
+}
+
+var enterBlks = map[dgtypes.Level]string{
+	dgtypes.FullLevel:        "EnterBlk",
+	dgtypes.NoCDLevel:        "EnterBlkNoCD",
+	dgtypes.NoDurationsLevel: "EnterBlkNoDurations",
+	dgtypes.CountsLevel:      "EnterBlkFast",
+	dgtypes.SampledLevel:     "EnterBlkSampled",
+}
+
 func (i *instrumenter) mkEnterFunc(pos token.Pos, name, cfg, ipdom string) ast.Stmt {
 	p := i.program.Fset.Position(pos)
-	s := fmt.Sprintf("dgruntime.EnterFunc(%v, %v, %v, %v)", strconv.Quote(name), strconv.Quote(p.String()), cfg, ipdom)
+	s := fmt.Sprintf("dgruntime.%v(%v, %v, %v, %v)", enterFuncs[i.inst.Level], strconv.Quote(name), strconv.Quote(p.String()), cfg, ipdom)
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
 		panic(fmt.Errorf("mkEnterFunc (%v) error: %v", s, err))
@@ -322,13 +745,46 @@ func (i *instrumenter) mkEnterFunc(pos token.Pos, name, cfg, ipdom string) ast.S
 	return &ast.ExprStmt{e}
 }
 
-func (i *instrumenter) mkExitFunc(pos token.Pos, name string) ast.Stmt {
-	s := fmt.Sprintf("func() { dgruntime.ExitFunc(%v) }()", strconv.Quote(name))
+// mkSetLevel makes an init function which tells the dgruntime the level
+// the package was instrumented at.
+func (i *instrumenter) mkSetLevel(pos token.Pos) ast.Decl {
+	s := fmt.Sprintf("dgruntime.SetLevel(%d, %d, %v)", i.inst.Level, i.inst.SampleEvery, i.inst.SampleRate)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSetLevel (%v) error: %v", s, err))
+	}
+	return &ast.FuncDecl{
+		Name: ast.NewIdent("init"),
+		Type: &ast.FuncType{Params: &ast.FieldList{}},
+		Body: &ast.BlockStmt{List: []ast.Stmt{&ast.ExprStmt{e}}},
+	}
+}
+
+// mkExitFunc makes `__dgreturned := false`, the flag set by the returns
+// of the function (see returns), and the deferred dgruntime.ExitFuncWith
+// call which gets it.
+func (i *instrumenter) mkExitFunc(pos token.Pos, name string) (flag, deferred ast.Stmt) {
+	s := fmt.Sprintf("func() { __dgreturned := false; defer func() { dgruntime.ExitFuncWith(%v, __dgreturned) }() }", strconv.Quote(name))
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
 		panic(fmt.Errorf("mkExitFunc (%v) error: %v", s, err))
 	}
-	return &ast.DeferStmt{Call: e.(*ast.CallExpr)}
+	body := e.(*ast.FuncLit).Body
+	return body.List[0], body.List[1]
+}
+
+// mkRecovered turns the call to recover into
+// dgruntime.Recovered(recover()). The call is changed in place as it can
+// be anywhere in an expression.
+func (i *instrumenter) mkRecovered(call *ast.CallExpr) {
+	s := "dgruntime.Recovered"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(call.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkRecovered (%v) error: %v", s, err))
+	}
+	recover := &ast.CallExpr{Fun: call.Fun, Lparen: call.Lparen, Rparen: call.Rparen}
+	call.Fun = e
+	call.Args = []ast.Expr{recover}
 }
 
 func (i *instrumenter) mkShutdown(pos token.Pos) ast.Stmt {
@@ -349,9 +805,109 @@ func (i *instrumenter) mkShutdownNow(pos token.Pos) ast.Stmt {
 	return &ast.ExprStmt{e}
 }
 
+// mkSegment makes `dynagrokEndSegment := dgtest.Segment(t)`, which begins
+// the segment of the test function fn before it enters the dgruntime,
+// and `defer dynagrokEndSegment()`. The defer must run before the
+// ExitFuncWith one (see afterExitFunc), which ends any segment still open
+// when the goroutine's outermost call exits, before the test is known to
+// have failed. It names the *testing.T parameter if the test left it
+// unnamed.
+func (i *instrumenter) mkSegment(fn *ast.FuncDecl) (begin, end ast.Stmt) {
+	param := fn.Type.Params.List[0]
+	if len(param.Names) == 0 || param.Names[0].Name == "_" {
+		param.Names = []*ast.Ident{ast.NewIdent("dynagrokT")}
+	}
+	s := fmt.Sprintf("dgtest.Segment(%v)", param.Names[0].Name)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(fn.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSegment (%v) error: %v", s, err))
+	}
+	begin = &ast.AssignStmt{
+		Lhs: []ast.Expr{ast.NewIdent("dynagrokEndSegment")},
+		Tok: token.DEFINE,
+		Rhs: []ast.Expr{e},
+	}
+	end = &ast.DeferStmt{Call: &ast.CallExpr{Fun: ast.NewIdent("dynagrokEndSegment")}}
+	return begin, end
+}
+
+// funcType is the type of the function declaration or literal.
+func funcType(fn ast.Node) *ast.FuncType {
+	switch x := fn.(type) {
+	case *ast.FuncDecl:
+		return x.Type
+	case *ast.FuncLit:
+		return x.Type
+	}
+	return nil
+}
+
+// afterExitFunc is the index in an instrumented function body after the
+// deferred ExitFuncWith call, the first defer of the body.
+func afterExitFunc(list []ast.Stmt) int {
+	for j, stmt := range list {
+		if _, ok := stmt.(*ast.DeferStmt); ok {
+			return j + 1
+		}
+	}
+	return 0
+}
+
+func (i *instrumenter) mkSpawn(pkg *loader.PackageInfo, stmt *ast.GoStmt) ast.Stmt {
+	var lhs, rhs []ast.Expr
+	temp := func(name string, expr ast.Expr) ast.Expr {
+		if !i.spawnTemp(pkg, expr) {
+			return expr
+		}
+		lhs = append(lhs, ast.NewIdent(name))
+		rhs = append(rhs, expr)
+		return ast.NewIdent(name)
+	}
+	call := &ast.CallExpr{
+		Fun:      temp("__dgf", stmt.Call.Fun),
+		Args:     make([]ast.Expr, 0, len(stmt.Call.Args)),
+		Ellipsis: stmt.Call.Ellipsis,
+	}
+	for j, arg := range stmt.Call.Args {
+		call.Args = append(call.Args, temp(fmt.Sprintf("__dga%d", j), arg))
+	}
+	parse := func(s string) ast.Expr {
+		e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(stmt.Pos()).Name(), s, parser.Mode(0))
+		if err != nil {
+			panic(fmt.Errorf("mkSpawn (%v) error: %v", s, err))
+		}
+		return e
+	}
+	var list []ast.Stmt
+	if len(lhs) > 0 {
+		list = append(list, &ast.AssignStmt{Lhs: lhs, Tok: token.DEFINE, Rhs: rhs})
+	}
+	list = append(list,
+		&ast.AssignStmt{
+			Lhs: []ast.Expr{ast.NewIdent("__dgspawn")},
+			Tok: token.DEFINE,
+			Rhs: []ast.Expr{parse("dgruntime.Spawn()")},
+		},
+		&ast.GoStmt{
+			Go: stmt.Go,
+			Call: &ast.CallExpr{
+				Fun: &ast.FuncLit{
+					Type: &ast.FuncType{Params: &ast.FieldList{}},
+					Body: &ast.BlockStmt{List: []ast.Stmt{
+						&ast.ExprStmt{X: parse("dgruntime.Spawned(__dgspawn)")},
+						&ast.ExprStmt{X: call},
+					}},
+				},
+			},
+		},
+	)
+	return &ast.BlockStmt{List: list}
+}
+
 func (i *instrumenter) mkEnterBlk(pos token.Pos, bbid int) ast.Stmt {
+	i.entered[bbid] = true
 	p := i.program.Fset.Position(pos)
-	s := fmt.Sprintf("dgruntime.EnterBlk(%d, %v)", bbid, strconv.Quote(p.String()))
+	s := fmt.Sprintf("dgruntime.%v(%d, %v)", enterBlks[i.inst.Level], bbid, strconv.Quote(p.String()))
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
 		panic(fmt.Errorf("mkEnterBlk (%v) error: %v", s, err))
@@ -360,6 +916,7 @@ func (i *instrumenter) mkEnterBlk(pos token.Pos, bbid int) ast.Stmt {
 }
 
 func (i *instrumenter) mkEnterBlkCond(stmt ast.Stmt, expr ast.Expr, bbid int) ast.Expr {
+	i.entered[bbid] = true
 	var pos token.Pos
 	if expr != nil {
 		pos = expr.Pos()
@@ -368,6 +925,9 @@ func (i *instrumenter) mkEnterBlkCond(stmt ast.Stmt, expr ast.Expr, bbid int) as
 	}
 	p := i.program.Fset.Position(pos)
 	enterStr := fmt.Sprintf("dgruntime.EnterBlkFromCond(%d, %v)", bbid, strconv.Quote(p.String()))
+	if i.inst.Level != dgtypes.FullLevel {
+		enterStr = fmt.Sprintf("dgruntime.EnterBlkFromCondLevel(%d, %d, %v)", i.inst.Level, bbid, strconv.Quote(p.String()))
+	}
 	enter, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), enterStr, parser.Mode(0))
 	if err != nil {
 		panic(err)
@@ -0,0 +1,97 @@
+package instrument
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+var levelsProgram = map[string]string{
+	"main.go": `package main
+
+import "fmt"
+
+func collatz(n int) int {
+	steps := 0
+	for n != 1 {
+		if n%2 == 0 {
+			n /= 2
+		} else {
+			n = 3*n + 1
+		}
+		steps++
+	}
+	return steps
+}
+
+func main() {
+	total := 0
+	for i := 1; i <= 1000; i++ {
+		total += collatz(i)
+	}
+	fmt.Println(total)
+}
+`,
+}
+
+// entrances is the number of block entrances the profile's flows count
+// within the functions. The calls and returns are counted at every level.
+func entrances(prof *dgtypes.Profile) int {
+	total := 0
+	for e, count := range prof.Flows {
+		if e.Src.In == e.Targ.In {
+			total += count
+		}
+	}
+	return total
+}
+
+// The cheaper levels record the same calls. The counts level counts every
+// block entrance but records no durations and the sampled level counts
+// about one in SampleEvery entrances.
+func TestLevels(t *testing.T) {
+	p := newProgram(t, levelsProgram)
+	defer p.Close()
+	profiles := make(map[dgtypes.Level]*dgtypes.Profile)
+	for _, inst := range []dgtypes.Instrumentation{
+		{Level: dgtypes.FullLevel},
+		{Level: dgtypes.CountsLevel},
+		{Level: dgtypes.SampledLevel, SampleEvery: 10},
+	} {
+		bin := p.build(".", false, &Options{Instrumentation: inst})
+		dgprof, output, err := p.run(bin, nil)
+		if err != nil {
+			t.Fatalf("%v %v:\n%s", inst, err, output)
+		}
+		if !strings.HasPrefix(string(output), "59542\n") {
+			t.Errorf("%v expected the program to print 59542 got:\n%s", inst, output)
+		}
+		prof := p.profile(dgprof)
+		if prof.Instrumentation.String() != inst.String() {
+			t.Errorf("expected the profile to be labeled %v got %v", inst, prof.Instrumentation)
+		}
+		if fn := functions(prof)["example.com/m.collatz"]; fn == nil || fn.Calls != 1000 {
+			t.Errorf("%v expected collatz to be called 1000 times got %v", inst, fn)
+		}
+		profiles[inst.Level] = prof
+	}
+	full := profiles[dgtypes.FullLevel]
+	if len(full.Durations) == 0 {
+		t.Errorf("expected the full level to record durations")
+	}
+	counts := profiles[dgtypes.CountsLevel]
+	if len(counts.Durations) != 0 {
+		t.Errorf("expected the counts level to record no durations")
+	}
+	if entrances(counts) != entrances(full) {
+		t.Errorf("expected the counts level to count all %v entrances got %v", entrances(full), entrances(counts))
+	}
+	sampled := profiles[dgtypes.SampledLevel]
+	if len(sampled.Durations) != 0 {
+		t.Errorf("expected the sampled level to record no durations")
+	}
+	if n, expected := entrances(sampled), entrances(full)/10; n < expected-10 || n > expected+10 {
+		t.Errorf("expected the sampled level to count about %v entrances got %v", expected, n)
+	}
+}
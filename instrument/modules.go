@@ -0,0 +1,151 @@
+package instrument
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+// BuildModule builds the instrumented program with the module aware go
+// tool. Rather than copying GOROOT and the GOPATH into the work dir the
+// instrumented files are written to the work dir and swapped in for the
+// originals with `go build -overlay`. The dgruntime is copied into the
+// work dir as its own module and required by an overlaid go.mod.
+//
+// Like BuildStock the GOROOT is left alone. The standard library is not
+// instrumented (its packages can't import dgruntime, which is not in
+// std) and dgruntime can only be built against the stock runtime, as
+// the patched runtime in src/runtime is for a go which predates modules.
+// So a module is only built when --stock-runtime was given.
+func (b *binaryBuilder) BuildModule() error {
+	if b.gomod == "" {
+		return errors.Errorf("could not find the go.mod for %v", b.entry)
+	}
+	if !b.config.StockRuntime {
+		return errors.Errorf("%v is in a module (%v), which can only be built with the stock runtime: pass --stock-runtime", b.entry, b.gomod)
+	}
+	goroot, err := b.goroot()
+	if err != nil {
+		return err
+	}
+	overlay := make(map[string]string)
+	dgruntime := filepath.Join(b._work, "dgruntime")
+	err = b.copyDir(filepath.Join(b.config.DGPATH, "dgruntime"), dgruntime)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(dgruntime, "go.mod"), []byte("module dgruntime\n"), 0664)
+	if err != nil {
+		return err
+	}
+	files := filepath.Join(b._work, "overlay")
+	for _, pkgInfo := range b.program.AllPackages {
+		if excludes.ExcludedPkg(pkgInfo.Pkg.Path()) {
+			continue
+		}
+		if len(pkgInfo.Files) > 0 && inGoroot(goroot, b.program.Fset.File(pkgInfo.Files[0].Pos()).Name()) {
+			if err := stdIncluded(pkgInfo.Pkg.Path()); err != nil {
+				return err
+			}
+			errors.Logf("INFO", "not instrumenting %v, the stock runtime can't rebuild the std lib", pkgInfo.Pkg.Path())
+			continue
+		}
+		for _, f := range pkgInfo.Files {
+			from := b.program.Fset.File(f.Pos()).Name()
+			dir := filepath.Join(files, fmt.Sprintf("%x", sha1.Sum([]byte(filepath.Dir(from)))))
+			err := os.MkdirAll(dir, os.ModeDir|os.ModeTemporary|0775)
+			if err != nil {
+				return err
+			}
+			to := filepath.Join(dir, filepath.Base(from))
+			fout, err := os.Create(to)
+			if err != nil {
+				return err
+			}
+			err = config.Fprint(fout, b.program.Fset, f)
+			fout.Close()
+			if err != nil {
+				return errors.Errorf("Could not serialize tree at %v tree %v error: %v", to, f, err)
+			}
+			overlay[from] = to
+		}
+	}
+	gomod, err := b.requireDgruntime(dgruntime)
+	if err != nil {
+		return err
+	}
+	overlay[b.gomod] = gomod
+	return b.goBuildModule(overlay)
+}
+
+func (b *binaryBuilder) goroot() (string, error) {
+	if b.config.GOROOT != "" {
+		return b.config.GOROOT, nil
+	}
+	output, err := cmd.GoCmd(b.config, "", "env", "GOROOT").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// inGoroot reports whether the file is part of the standard library (or
+// the go tool) in goroot.
+func inGoroot(goroot, file string) bool {
+	src := filepath.Join(goroot, "src") + string(filepath.Separator)
+	return strings.HasPrefix(filepath.Clean(file), src)
+}
+
+// requireDgruntime writes a copy of the main module's go.mod which
+// requires the dgruntime module and replaces it with the copy in the
+// work dir.
+func (b *binaryBuilder) requireDgruntime(dgruntime string) (string, error) {
+	mod, err := ioutil.ReadFile(b.gomod)
+	if err != nil {
+		return "", err
+	}
+	gomod := filepath.Join(b._work, "go.mod")
+	mod = append(mod, []byte(fmt.Sprintf("\nrequire dgruntime v0.0.0\n\nreplace dgruntime => %v\n", dgruntime))...)
+	err = ioutil.WriteFile(gomod, mod, 0664)
+	if err != nil {
+		return "", err
+	}
+	return gomod, nil
+}
+
+func (b *binaryBuilder) goBuildModule(overlay map[string]string) error {
+	overlayPath := filepath.Join(b._work, "overlay.json")
+	f, err := os.Create(overlayPath)
+	if err != nil {
+		return err
+	}
+	err = json.NewEncoder(f).Encode(struct{ Replace map[string]string }{overlay})
+	f.Close()
+	if err != nil {
+		return err
+	}
+	output, err := filepath.Abs(b.output)
+	if err != nil {
+		return err
+	}
+	args := append(b.buildCmd(), "-mod=mod", fmt.Sprintf("-overlay=%v", overlayPath), "-tags", stockTag)
+	args = append(args, "-o", output, b.entry)
+	c := cmd.GoCmd(b.config, filepath.Dir(b.gomod), args...)
+	fmt.Fprintln(os.Stderr, "cd", c.Dir, "&&", c.Path, strings.Join(c.Args[1:], " "))
+	out, err := c.CombinedOutput()
+	fmt.Fprintln(os.Stderr, string(out))
+	return err
+}
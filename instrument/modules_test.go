@@ -0,0 +1,68 @@
+package instrument
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+// A module is only built against the stock runtime, which has to be asked
+// for.
+func TestModuleNeedsStockRuntime(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": "package main\n\nfunc main() {}\n"})
+	defer p.Close()
+	c := p.config()
+	c.StockRuntime = false
+	pkgName, pkgDir, err := cmd.ResolvePkg(c, p.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := cmd.LoadPkg(c, pkgDir, pkgName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Instrument(pkgName, program, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = BuildBinary(c, false, "", pkgName, filepath.Join(p.dir, "prog.instr"), program)
+	if err == nil || !strings.Contains(err.Error(), "--stock-runtime") {
+		t.Fatalf("expected an error asking for --stock-runtime got %v", err)
+	}
+}
+
+// The stock runtime can't instrument the standard library, so asking for
+// a std package is an error rather than a silent no-op.
+func TestIncludeStd(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": `package main
+
+import "net/url"
+
+func main() {
+	println(url.QueryEscape("a b"))
+}
+`})
+	defer p.Close()
+	if err := excludes.Include("net/url"); err != nil {
+		t.Fatal(err)
+	}
+	defer excludes.Reset()
+	c := p.config()
+	pkgName, pkgDir, err := cmd.ResolvePkg(c, p.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := cmd.LoadPkg(c, pkgDir, pkgName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Instrument(pkgName, program, &Options{}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = BuildBinary(c, false, "", pkgName, filepath.Join(p.dir, "prog.instr"), program)
+	if err == nil || !strings.Contains(err.Error(), "net/url") {
+		t.Fatalf("expected an error about the included net/url got %v", err)
+	}
+}
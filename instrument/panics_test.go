@@ -0,0 +1,132 @@
+package instrument
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+const panicsProgram = `package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func index(xs []int) int {
+	return xs[3]
+}
+
+func explode() {
+	panic(errors.New("boom"))
+}
+
+func safe() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered %v", r)
+		}
+	}()
+	explode()
+	return nil
+}
+
+func quit() {
+	runtime.Goexit()
+}
+
+func main() {
+	fmt.Println(safe())
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		quit()
+	}()
+	<-done
+	switch os.Args[1] {
+	case "index":
+		index(nil)
+	case "nil":
+		panic(nil)
+	}
+}
+`
+
+// A panic is observed without being recovered: a recovered panic is not
+// a failure, an unrecovered one is reported once it reaches main and
+// crashes the program with its own stack.
+func TestPanics(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": panicsProgram})
+	defer p.Close()
+	bin := p.build(".", false, nil)
+	load := func(dgprof string) *dgtypes.Profile {
+		f, err := os.Open(filepath.Join(dgprof, "flow-graph.txt"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		prof, err := dgtypes.LoadSimple(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return prof
+	}
+	panicked := func(prof *dgtypes.Profile) map[string]int {
+		types := make(map[string]int)
+		for site, count := range prof.Panicked {
+			types[site.Type] += count
+		}
+		return types
+	}
+
+	dgprof, output, err := p.run(bin, nil, "recover")
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	if !strings.Contains(string(output), "recovered boom") {
+		t.Errorf("expected the panic to be recovered got:\n%s", output)
+	}
+	prof := load(dgprof)
+	if types := panicked(prof); len(types) != 1 || types["*errors.errorString"] != 1 {
+		t.Errorf("expected the one *errors.errorString panic got %v", types)
+	}
+	if len(prof.Recovers) != 1 {
+		t.Errorf("expected the exit of safe to be a recovery got %v", prof.Recovers)
+	}
+	if len(prof.Panics) != 1 {
+		t.Errorf("expected only the exit of explode to be unwound got %v", prof.Panics)
+	}
+	if _, err := os.Stat(filepath.Join(dgprof, "failures")); err == nil {
+		t.Error("a recovered panic (or a Goexit) was reported as a failure")
+	}
+
+	for _, arg := range []string{"index", "nil"} {
+		dgprof, output, err = p.run(bin, nil, arg)
+		if err == nil {
+			t.Fatalf("expected %v to crash:\n%s", arg, output)
+		}
+		if strings.Contains(string(output), "[recovered") {
+			t.Errorf("the %v panic was recovered and panicked again:\n%s", arg, output)
+		}
+		prof = load(dgprof)
+		if types := panicked(prof); types["*errors.errorString"] != 1 || len(types) != 2 {
+			t.Errorf("expected the recovered panic and the %v panic got %v", arg, types)
+		}
+		failures, err := ioutil.ReadFile(filepath.Join(dgprof, "failures"))
+		if err != nil {
+			t.Fatalf("expected the %v panic to be reported as a failure: %v", arg, err)
+		}
+		if n := strings.Count(strings.TrimSpace(string(failures)), "\n") + 1; n != 1 {
+			t.Errorf("expected one failure got %d:\n%s", n, failures)
+		}
+	}
+	if !strings.Contains(string(output), "main.main") {
+		t.Errorf("expected the stack of the panic got:\n%s", output)
+	}
+}
@@ -0,0 +1,137 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strconv"
+
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// branches wraps the condition of every if and for statement in the
+// function body (but not in the function literals inside it, they are
+// instrumented on their own) in a dgruntime.Branch call. It runs after
+// the blocks have been instrumented so a condition may already be
+// `dgruntime.EnterBlkFromCond(...) && cond`, then only cond is wrapped.
+func (i *instrumenter) branches(fnBody []ast.Stmt) {
+	wrap := func(cond *ast.Expr) {
+		if *cond == nil {
+			return
+		}
+		if and, ok := (*cond).(*ast.BinaryExpr); ok && and.Op == token.LAND && isEnterBlk(and.X) {
+			and.Y = i.mkBranch(and.Y)
+		} else {
+			*cond = i.mkBranch(*cond)
+		}
+	}
+	for _, stmt := range fnBody {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch s := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.IfStmt:
+				wrap(&s.Cond)
+			case *ast.ForStmt:
+				wrap(&s.Cond)
+			}
+			return true
+		})
+	}
+}
+
+// mkBranch wraps the condition in a dgruntime.Branch call which records
+// whether it was true or false. With --predicate-values a comparison of
+// simple operands is wrapped in dgruntime.BranchOperands which records
+// the values of the operands as well.
+func (i *instrumenter) mkBranch(cond ast.Expr) ast.Expr {
+	fset := i.program.Fset
+	pos := cond.Pos()
+	site := strconv.Quote(fset.Position(pos).String())
+	expr := strconv.Quote(analysis.FmtNode(fset, cond))
+	s := fmt.Sprintf("dgruntime.Branch(%v, %v, true)", site, expr)
+	if x, y, ok := i.operands(cond); ok {
+		s = fmt.Sprintf("dgruntime.BranchOperands(%v, %v, true, %v, %v)", site, expr, x, y)
+	}
+	e, err := parser.ParseExprFrom(fset, fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkBranch (%v) error: %v", s, err))
+	}
+	call := e.(*ast.CallExpr)
+	call.Args[2] = cond
+	return call
+}
+
+// operands returns the source of the operands of a condition which
+// compares two simple operands of basic types. The operands are
+// evaluated a second time for the BranchOperands call so they must not
+// have side effects. A constant operand is converted to the type of the
+// other operand so an untyped constant is passed as that type.
+func (i *instrumenter) operands(cond ast.Expr) (x, y string, ok bool) {
+	if !i.predicateValues || i.currentPkg == nil {
+		return "", "", false
+	}
+	cmp, is := unparen(cond).(*ast.BinaryExpr)
+	if !is {
+		return "", "", false
+	}
+	switch cmp.Op {
+	case token.EQL, token.NEQ, token.LSS, token.LEQ, token.GTR, token.GEQ:
+	default:
+		return "", "", false
+	}
+	if !simple(cmp.X) || !simple(cmp.Y) {
+		return "", "", false
+	}
+	xt, xc := i.basic(cmp.X)
+	yt, yc := i.basic(cmp.Y)
+	if xt == nil || yt == nil || (xc && yc) {
+		return "", "", false
+	}
+	fset := i.program.Fset
+	x, y = analysis.FmtNode(fset, cmp.X), analysis.FmtNode(fset, cmp.Y)
+	if xc {
+		x = fmt.Sprintf("%v(%v)", yt.Name(), x)
+	} else if yc {
+		y = fmt.Sprintf("%v(%v)", xt.Name(), y)
+	}
+	return x, y, true
+}
+
+// basic returns the basic type underlying the type of the expression (or
+// nil) and whether the expression is a constant.
+func (i *instrumenter) basic(e ast.Expr) (*types.Basic, bool) {
+	tv, has := i.currentPkg.Info.Types[e]
+	if !has || tv.Type == nil {
+		return nil, false
+	}
+	b, is := tv.Type.Underlying().(*types.Basic)
+	if !is || b.Kind() == types.UntypedNil || b.Kind() == types.UnsafePointer {
+		return nil, false
+	}
+	return b, tv.Value != nil
+}
+
+// simple reports whether the expression is a variable, a field, a
+// constant or a literal which can be evaluated again without side
+// effects.
+func simple(e ast.Expr) bool {
+	switch x := e.(type) {
+	case *ast.Ident:
+		return x.Name != "_"
+	case *ast.BasicLit:
+		return true
+	case *ast.ParenExpr:
+		return simple(x.X)
+	case *ast.SelectorExpr:
+		return simple(x.X)
+	case *ast.UnaryExpr:
+		switch x.Op {
+		case token.ADD, token.SUB, token.NOT, token.XOR:
+			return simple(x.X)
+		}
+	}
+	return false
+}
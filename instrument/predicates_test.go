@@ -0,0 +1,91 @@
+package instrument
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+const predicatesProgram = `package main
+
+import "fmt"
+
+func classify(x int) string {
+	if x < 0 {
+		return "neg"
+	} else if x == 0 {
+		return "zero"
+	}
+	return "pos"
+}
+
+func main() {
+	n := 0
+	for i := -2; i < 3; i++ {
+		fmt.Println(classify(i))
+		n++
+	}
+	long := func(s string) bool {
+		if len(s) > 3 {
+			return true
+		}
+		return false
+	}
+	if long("pos") && n > 4 {
+		fmt.Println("done")
+	}
+}
+`
+
+// Every if and for condition records its value, the conditions of the
+// entry blocks, of an else if and of a function literal as well, and the
+// comparisons of simple operands record the operands.
+func TestPredicates(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": predicatesProgram})
+	defer p.Close()
+	bin := p.build(".", false, &Options{Predicates: true, PredicateValues: true})
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	f, err := os.Open(filepath.Join(dgprof, "flow-graph.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the counts by kind, expression and value
+	counts := make(map[[3]string]int)
+	for pred, count := range prof.Predicates {
+		counts[[3]string{pred.Kind, pred.Expr, pred.Value}] += count
+	}
+	expected := map[[3]string]int{
+		{dgtypes.BranchPredicate, "x < 0", "true"}:                 2,
+		{dgtypes.BranchPredicate, "x < 0", "false"}:                3,
+		{dgtypes.BranchPredicate, "x == 0", "true"}:                1,
+		{dgtypes.BranchPredicate, "x == 0", "false"}:               2,
+		{dgtypes.BranchPredicate, "i < 3", "true"}:                 5,
+		{dgtypes.BranchPredicate, "i < 3", "false"}:                1,
+		{dgtypes.BranchPredicate, "len(s) > 3", "false"}:           1,
+		{dgtypes.BranchPredicate, `long("pos") && n > 4`, "false"}: 1,
+		{dgtypes.OperandsPredicate, "x < 0", "-2, 0"}:              1,
+		{dgtypes.OperandsPredicate, "x < 0", "2, 0"}:               1,
+		{dgtypes.OperandsPredicate, "x == 0", "0, 0"}:              1,
+		{dgtypes.OperandsPredicate, "i < 3", "3, 3"}:               1,
+	}
+	for key, count := range expected {
+		if counts[key] != count {
+			t.Errorf("expected %v %d times got %d", key, count, counts[key])
+		}
+	}
+	for key := range counts {
+		if key[0] == dgtypes.OperandsPredicate && key[1] == "len(s) > 3" {
+			t.Errorf("expected no operands for %v", key)
+		}
+	}
+}
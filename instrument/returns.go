@@ -0,0 +1,138 @@
+package instrument
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/ast/astutil"
+	"golang.org/x/tools/go/loader"
+
+	"github.com/timtadh/dynagrok/analysis"
+)
+
+// returns sets the __dgreturned flag mkExitFunc declares when the
+// function returns so the deferred dgruntime.ExitFuncWith can tell a call
+// unwound by a panic without recovering the panic. The flag is set after
+// the results are evaluated, as a panic while evaluating them unwinds the
+// call:
+//
+//	return f(x), y
+//
+// becomes
+//
+//	{
+//		var __dgr0 T0
+//		var __dgr1 T1
+//		__dgr0, __dgr1 = f(x), y
+//		__dgreturned = true
+//		return __dgr0, __dgr1
+//	}
+//
+// Results which are names or constants are returned as they are. The
+// flag is also set at the end of a body without results. The return
+// statements of the function literals inside the body are left to their
+// own instrumentation.
+func (i *instrumenter) returns(pkg *loader.PackageInfo, fnType *ast.FuncType, fnBody *[]ast.Stmt) {
+	var results []string
+	if fnType.Results != nil {
+		for _, field := range fnType.Results.List {
+			typ := analysis.FmtNode(i.program.Fset, field.Type)
+			for k := 0; k < len(field.Names) || k == 0; k++ {
+				results = append(results, typ)
+			}
+		}
+	}
+	for j := range *fnBody {
+		(*fnBody)[j] = astutil.Apply((*fnBody)[j], func(c *astutil.Cursor) bool {
+			switch n := c.Node().(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.ReturnStmt:
+				c.Replace(i.mkReturned(pkg, n, results))
+				return false
+			}
+			return true
+		}, nil).(ast.Stmt)
+	}
+	if len(results) == 0 {
+		*fnBody = Insert(nil, nil, *fnBody, len(*fnBody), i.mkSetReturned(fnType.Pos()))
+	}
+}
+
+// mkReturned sets __dgreturned before the return statement returns (see
+// returns).
+func (i *instrumenter) mkReturned(pkg *loader.PackageInfo, ret *ast.ReturnStmt, results []string) ast.Stmt {
+	simple := true
+	for _, r := range ret.Results {
+		if _, ok := r.(*ast.Ident); !ok && !constExpr(pkg, r) {
+			simple = false
+		}
+	}
+	if simple {
+		return &ast.BlockStmt{List: []ast.Stmt{i.mkSetReturned(ret.Pos()), ret}}
+	}
+	fset := i.program.Fset
+	vars := make([]string, 0, len(results))
+	s := "func() {\n"
+	for j, typ := range results {
+		vars = append(vars, fmt.Sprintf("__dgr%d", j))
+		s += fmt.Sprintf("var %v %v\n", vars[j], typ)
+	}
+	s += strings.Join(vars, ", ") + " = __dgresults\n"
+	s += "__dgreturned = true\n"
+	s += "}"
+	e, err := parser.ParseExprFrom(fset, fset.File(ret.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkReturned (%v) error: %v", s, err))
+	}
+	blk := e.(*ast.FuncLit).Body
+	assign := blk.List[len(results)].(*ast.AssignStmt)
+	assign.Rhs = ret.Results
+	ret.Results = make([]ast.Expr, 0, len(assign.Lhs))
+	for _, v := range assign.Lhs {
+		ret.Results = append(ret.Results, &ast.Ident{NamePos: ret.Pos(), Name: v.(*ast.Ident).Name})
+	}
+	blk.List = append(blk.List, ret)
+	return blk
+}
+
+func (i *instrumenter) mkSetReturned(pos token.Pos) ast.Stmt {
+	s := "func() { __dgreturned = true }"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkSetReturned (%v) error: %v", s, err))
+	}
+	return e.(*ast.FuncLit).Body.List[0]
+}
+
+// panicValues wraps the values the function body (but not the function
+// literals inside it) panics with in dgruntime.PanicValue so the type of
+// the panic is known without recovering it.
+func (i *instrumenter) panicValues(pkg *loader.PackageInfo, fnBody []ast.Stmt) {
+	for _, stmt := range fnBody {
+		ast.Inspect(stmt, func(n ast.Node) bool {
+			switch e := n.(type) {
+			case *ast.FuncLit:
+				return false
+			case *ast.CallExpr:
+				if ident, ok := unparen(e.Fun).(*ast.Ident); ok && len(e.Args) == 1 {
+					if b, ok := pkg.Info.Uses[ident].(*types.Builtin); ok && b.Name() == "panic" {
+						v := e.Args[0]
+						e.Args[0] = &ast.CallExpr{
+							Fun: &ast.SelectorExpr{
+								X:   &ast.Ident{NamePos: v.Pos(), Name: "dgruntime"},
+								Sel: ast.NewIdent("PanicValue"),
+							},
+							Args: []ast.Expr{v},
+						}
+					}
+				}
+			}
+			return true
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package instrument
+
+import (
+	"go/build"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// program is a module (example.com/m) of the files (by their paths in
+// the module) which is instrumented, built and run by the tests.
+type program struct {
+	t     *testing.T
+	dir   string
+	files map[string]string
+}
+
+func newProgram(t *testing.T, files map[string]string) *program {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go tool on the PATH")
+	}
+	if testing.Short() {
+		t.Skip("builds an instrumented program")
+	}
+	dir, err := ioutil.TempDir("", "dynagrok-instrument-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["go.mod"] = "module example.com/m\n"
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0775); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(src), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &program{t: t, dir: dir, files: files}
+}
+
+func (p *program) Close() {
+	os.RemoveAll(p.dir)
+}
+
+// config is the cmd.Config of the dynagrok tree this test runs in.
+func (p *program) config() *cmd.Config {
+	dgpath, err := filepath.Abs("..")
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return &cmd.Config{DGPATH: dgpath, StockRuntime: true}
+}
+
+// build instruments the package (a dir in the module) and builds it, or
+// its test binary, with the options. It returns the binary.
+func (p *program) build(pkg string, tests bool, o *Options) string {
+	c := p.config()
+	pkgName, pkgDir, err := cmd.ResolvePkg(c, filepath.Join(p.dir, pkg))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if o == nil {
+		o = &Options{}
+	}
+	output := filepath.Join(p.dir, "prog.instr")
+	if tests {
+		program, err := cmd.LoadPkgWithTests(c, pkgDir, pkgName)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if err := InstrumentTests(pkgName, program, o); err != nil {
+			p.t.Fatal(err)
+		}
+		if _, err := BuildTestBinary(c, false, "", pkgName, output, program); err != nil {
+			p.t.Fatal(err)
+		}
+		return output
+	}
+	program, err := cmd.LoadPkg(c, pkgDir, pkgName)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := Instrument(pkgName, program, o); err != nil {
+		p.t.Fatal(err)
+	}
+	if _, err := BuildBinary(c, false, "", pkgName, output, program); err != nil {
+		p.t.Fatal(err)
+	}
+	return output
+}
+
+// buildGopath instruments the package from the program's gopath dir (in
+// GOPATH mode) and builds it with the stock runtime. The dgruntime of this
+// tree is linked into the gopath so the package may import it.
+func (p *program) buildGopath(pkg string, o *Options) string {
+	gomod := os.Getenv("GO111MODULE")
+	os.Setenv("GO111MODULE", "off")
+	defer os.Setenv("GO111MODULE", gomod)
+	tags := build.Default.BuildTags
+	build.Default.BuildTags = append(tags, stockTag)
+	defer func() { build.Default.BuildTags = tags }()
+	c := p.config()
+	goroot, err := exec.Command("go", "env", "GOROOT").Output()
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	c.GOROOT = strings.TrimSpace(string(goroot))
+	c.GOPATH = filepath.Join(p.dir, "gopath")
+	err = os.Symlink(filepath.Join(c.DGPATH, "dgruntime"), filepath.Join(c.GOPATH, "src", "dgruntime"))
+	if err != nil && !os.IsExist(err) {
+		p.t.Fatal(err)
+	}
+	if o == nil {
+		o = &Options{}
+	}
+	program, err := cmd.LoadPkg(c, "", pkg)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := Instrument(pkg, program, o); err != nil {
+		p.t.Fatal(err)
+	}
+	output := filepath.Join(p.dir, "prog.instr")
+	if _, err := BuildBinary(c, false, "", pkg, output, program); err != nil {
+		p.t.Fatal(err)
+	}
+	return output
+}
+
+// run runs the binary with its profiles written to a new dir, which it
+// returns with the output of the binary and its exit error.
+func (p *program) run(bin string, env []string, args ...string) (dgprof string, output []byte, err error) {
+	dgprof = filepath.Join(p.dir, "dgprof")
+	os.RemoveAll(dgprof)
+	if err := os.MkdirAll(dgprof, 0775); err != nil {
+		p.t.Fatal(err)
+	}
+	c := exec.Command(bin, args...)
+	c.Env = append(append(os.Environ(), "DGPROF="+dgprof), env...)
+	output, err = c.CombinedOutput()
+	return dgprof, output, err
+}
+
+// glob is the files matching the pattern in dir.
+func (p *program) glob(dir, pattern string) []string {
+	matches, err := filepath.Glob(filepath.Join(dir, pattern))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return matches
+}
+
+// profile loads the flow graph the binary wrote to dgprof.
+func (p *program) profile(dgprof string) *dgtypes.Profile {
+	return p.load(filepath.Join(dgprof, "flow-graph.txt"))
+}
+
+// load loads a flow graph (or segment) written by the binary.
+func (p *program) load(path string) *dgtypes.Profile {
+	f, err := os.Open(path)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return prof
+}
+
+// functions are the profiled functions by their names.
+func functions(prof *dgtypes.Profile) map[string]*dgtypes.Function {
+	fns := make(map[string]*dgtypes.Function)
+	for _, fn := range prof.Funcs {
+		fns[fn.Name] = fn
+	}
+	return fns
+}
@@ -0,0 +1,173 @@
+package instrument
+
+import (
+	"strings"
+	"testing"
+)
+
+// Each test writes its segment to pass/ or fail/, even though the test
+// function is its goroutine's outermost instrumented call.
+func TestSegments(t *testing.T) {
+	p := newProgram(t, map[string]string{
+		"lib/lib.go": `package lib
+
+func Abs(x int) int {
+	if x < 0 {
+		return x
+	}
+	return x
+}
+`,
+		"lib/lib_test.go": `package lib
+
+import "testing"
+
+func TestPositive(t *testing.T) {
+	if Abs(1) != 1 {
+		t.Fatal("Abs(1) != 1")
+	}
+}
+
+func TestNegative(t *testing.T) {
+	if Abs(-1) != 1 {
+		t.Error("Abs(-1) != 1")
+	}
+}
+
+func TestPanics(t *testing.T) {
+	var xs []int
+	Abs(xs[0])
+}
+`,
+	})
+	defer p.Close()
+	bin := p.build("lib", true, nil)
+	dgprof, output, err := p.run(bin, nil, "-test.run", "TestPositive|TestNegative")
+	if err == nil {
+		t.Fatalf("expected TestNegative to fail:\n%s", output)
+	}
+	if pass := p.glob(dgprof, "pass/*-TestPositive.txt"); len(pass) != 1 {
+		t.Errorf("expected the segment of TestPositive in pass/ got %v\n%s", pass, output)
+	}
+	if fail := p.glob(dgprof, "fail/*-TestNegative.txt"); len(fail) != 1 {
+		t.Errorf("expected the segment of TestNegative in fail/ got %v\n%s", fail, output)
+	}
+	if pass := p.glob(dgprof, "pass/*-TestNegative.txt"); len(pass) != 0 {
+		t.Errorf("the segment of TestNegative is also in pass/: %v", pass)
+	}
+	dgprof, output, err = p.run(bin, nil, "-test.run", "TestPanics")
+	if err == nil {
+		t.Fatalf("expected TestPanics to fail:\n%s", output)
+	}
+	if fail := p.glob(dgprof, "fail/*-TestPanics.txt"); len(fail) != 1 {
+		t.Errorf("expected the segment of TestPanics in fail/ got %v\n%s", fail, output)
+	}
+}
+
+// Parallel tests run on their own goroutines at the same time, each
+// segment only holds the blocks of its own test.
+func TestParallelSegments(t *testing.T) {
+	p := newProgram(t, map[string]string{
+		"lib/lib.go": `package lib
+
+func Even(x int) bool {
+	return x%2 == 0
+}
+
+func Odd(x int) bool {
+	return x%2 == 1
+}
+`,
+		"lib/lib_test.go": `package lib
+
+import "testing"
+
+func TestEven(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < 1000; i++ {
+		Even(i)
+	}
+}
+
+func TestOdd(t *testing.T) {
+	t.Parallel()
+	for i := 0; i < 1000; i++ {
+		Odd(i)
+	}
+}
+`,
+	})
+	defer p.Close()
+	bin := p.build("lib", true, nil)
+	dgprof, output, err := p.run(bin, nil, "-test.run", "TestEven|TestOdd", "-test.parallel", "2")
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	for test, fn := range map[string]string{"TestEven": "Even", "TestOdd": "Odd"} {
+		paths := p.glob(dgprof, "pass/*-"+test+".txt")
+		if len(paths) != 1 {
+			t.Fatalf("expected the segment of %v in pass/ got %v\n%s", test, paths, output)
+		}
+		fns := functions(p.load(paths[0]))
+		if f := fns["example.com/m/lib."+fn]; f == nil || f.Calls != 1000 {
+			t.Errorf("expected %v to call %v 1000 times got %v", test, fn, f)
+		}
+		for name := range fns {
+			if strings.HasPrefix(name, "example.com/m/lib.") && name != "example.com/m/lib."+fn && !strings.HasPrefix(name, "example.com/m/lib.Test") {
+				t.Errorf("the segment of %v holds %v", test, name)
+			}
+		}
+	}
+}
+
+// Each request handled by dghttp gets its own segment, failed if it
+// responded with a 5xx status.
+func TestHTTPSegments(t *testing.T) {
+	p := newProgram(t, map[string]string{
+		"gopath/src/example.com/server/main.go": `package main
+
+import (
+	"dgruntime/dghttp"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+)
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/fail" {
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func main() {
+	s := httptest.NewServer(dghttp.Handler(http.HandlerFunc(handle)))
+	defer s.Close()
+	for _, path := range []string{"/ok", "/fail"} {
+		resp, err := http.Get(s.URL + path)
+		if err != nil {
+			panic(err)
+		}
+		resp.Body.Close()
+		fmt.Println(path, resp.StatusCode)
+	}
+}
+`,
+	})
+	defer p.Close()
+	bin := p.buildGopath("example.com/server", nil)
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	for dir, name := range map[string]string{"pass": "GET__ok", "fail": "GET__fail"} {
+		paths := p.glob(dgprof, dir+"/*-"+name+".txt")
+		if len(paths) != 1 {
+			t.Fatalf("expected the segment %v in %v/ got %v\n%s", name, dir, paths, output)
+		}
+		if f := functions(p.load(paths[0]))["example.com/server.handle"]; f == nil || f.Calls != 1 {
+			t.Errorf("expected the segment %v to call handle once got %v", name, f)
+		}
+	}
+}
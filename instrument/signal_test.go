@@ -0,0 +1,62 @@
+package instrument
+
+import (
+	"bufio"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// A program stopped by a signal still writes out its profile.
+func TestSignalDump(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": `package main
+
+import "fmt"
+
+func sum(n int) int {
+	s := 0
+	for i := 0; i < n; i++ {
+		s += i
+	}
+	return s
+}
+
+func main() {
+	fmt.Println(sum(3), sum(4))
+	fmt.Println("ready")
+	select {}
+}
+`})
+	defer p.Close()
+	bin := p.build(".", false, nil)
+	dgprof := filepath.Join(p.dir, "dgprof")
+	if err := os.MkdirAll(dgprof, 0775); err != nil {
+		t.Fatal(err)
+	}
+	c := exec.Command(bin)
+	c.Env = append(os.Environ(), "DGPROF="+dgprof)
+	out, err := c.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Start(); err != nil {
+		t.Fatal(err)
+	}
+	lines := bufio.NewScanner(out)
+	for lines.Scan() && lines.Text() != "ready" {
+	}
+	if err := c.Process.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	for lines.Scan() {
+	}
+	if err := c.Wait(); err == nil {
+		t.Error("expected the signal to stop the program with an error")
+	}
+	fn := functions(p.profile(dgprof))["example.com/m.sum"]
+	if fn == nil || fn.Calls != 2 {
+		t.Errorf("expected the profile to hold 2 calls of sum got %v", fn)
+	}
+}
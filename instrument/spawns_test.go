@@ -0,0 +1,94 @@
+package instrument
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+const spawnsProgram = `package main
+
+import "fmt"
+
+func work(n int, done chan int) {
+	done <- n * n
+}
+
+func next(n int) int {
+	return n + 1
+}
+
+func main() {
+	done := make(chan int)
+	for i := 0; i < 3; i++ {
+		go work(i, done)
+	}
+	if n := 4; n > 2 {
+		go work(next(n), done)
+	}
+	go func() {
+		work(10, done)
+	}()
+	total := 0
+	for i := 0; i < 5; i++ {
+		total += <-done
+	}
+	fmt.Println(total)
+}
+`
+
+// Each go statement records a spawn edge from its block to the first
+// block of the new goroutine rather than a call from the spawning
+// function. The arguments are still evaluated by the spawning goroutine.
+func TestSpawns(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": spawnsProgram})
+	defer p.Close()
+	bin := p.build(".", false, nil)
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	if !strings.HasPrefix(string(output), "130\n") {
+		t.Errorf("expected the program to print 130 got:\n%s", output)
+	}
+	prof := p.profile(dgprof)
+	fns := functions(prof)
+	main, work, next := fns["example.com/m.main"], fns["example.com/m.work"], fns["example.com/m.next"]
+	if main == nil || work == nil || next == nil {
+		t.Fatalf("expected main, work and next to be profiled got %v", fns)
+	}
+	lit := fns["example.com/m.main$0"]
+	if lit == nil {
+		t.Fatalf("expected the function literal to be profiled got %v", fns)
+	}
+	spawns := make(map[uintptr][]dgtypes.FlowEdge)
+	for e, count := range prof.Spawns {
+		if e.Src.In != main.FuncPc || e.Targ.BasicBlockId != 0 {
+			t.Errorf("expected every spawn to be from main into a first block got %v", e)
+		}
+		if e.Targ.In == work.FuncPc && count == 3 {
+			// the go statement in the loop comes first
+			spawns[e.Targ.In] = append([]dgtypes.FlowEdge{e}, spawns[e.Targ.In]...)
+		} else {
+			spawns[e.Targ.In] = append(spawns[e.Targ.In], e)
+		}
+	}
+	if s := spawns[work.FuncPc]; len(s) != 2 || prof.Spawns[s[0]] != 3 || prof.Spawns[s[1]] != 1 || s[0].Src == s[1].Src {
+		t.Errorf("expected work to be spawned 3 times from the loop and once from the if got %v", s)
+	}
+	if s := spawns[lit.FuncPc]; len(s) != 1 || prof.Spawns[s[0]] != 1 {
+		t.Errorf("expected the function literal to be spawned once got %v", s)
+	}
+	for e, count := range prof.Flows {
+		if e.Targ.In != work.FuncPc || e.Targ.BasicBlockId != 0 {
+			continue
+		}
+		if e.Src.In != lit.FuncPc || count != 1 {
+			t.Errorf("expected work to only be called by the function literal got %v %v", e, count)
+		}
+	}
+	if count := prof.Calls[dgtypes.Call{Caller: main.FuncPc, Callee: next.FuncPc}]; count != 1 {
+		t.Errorf("expected main to call next (evaluating the argument) once got %v", count)
+	}
+}
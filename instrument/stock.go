@@ -0,0 +1,66 @@
+package instrument
+
+import (
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+import (
+	"github.com/timtadh/data-structures/errors"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
+)
+
+// stockTag is the build tag which selects dgruntime's bindings to the
+// unmodified runtime (see dgruntime/runtime_stock.go)
+const stockTag = "dgstock"
+
+// stdIncluded is an error if the standard library package was asked for
+// with --include, as the stock runtime builds can't instrument it.
+func stdIncluded(pkg string) error {
+	if excludes.Included(pkg) {
+		return errors.Errorf("%v matches an --include pattern but the standard library can't be instrumented with the stock runtime (or in a module)", pkg)
+	}
+	return nil
+}
+
+// BuildStock builds the instrumented program from a GOPATH with the
+// unmodified go tool. The GOROOT is not copied or rebuilt so the
+// standard library is never instrumented. dgruntime is placed in the
+// work GOPATH rather than in the GOROOT.
+func (b *binaryBuilder) BuildStock() error {
+	err := b.copyDir(
+		filepath.Join(b.config.DGPATH, "dgruntime"),
+		filepath.Join(b.path, "src", "dgruntime"),
+	)
+	if err != nil {
+		return err
+	}
+	basePaths := b.basePaths()
+	for _, pkgInfo := range b.packages() {
+		pkgPath := pkgInfo.Pkg.Path()
+		if bp, err := b.buildContext.Import(pkgPath, "", build.FindOnly); err == nil && bp.Goroot {
+			if err := stdIncluded(pkgPath); err != nil {
+				return err
+			}
+			errors.Logf("INFO", "not instrumenting %v, the stock runtime can't rebuild the std lib", pkgPath)
+			continue
+		}
+		_, err := b.writePkg(basePaths, pkgInfo.Pkg, pkgInfo)
+		if err != nil {
+			return err
+		}
+	}
+	c := cmd.GoCmd(b.config, "", append(b.buildCmd(), "-tags", stockTag, "-o", b.output, b.entry)...)
+	c.Env = append(c.Env, fmt.Sprintf("GOPATH=%v", b.path), "GO111MODULE=off")
+	fmt.Fprintln(os.Stderr, "GOPATH="+b.path, c.Path, strings.Join(c.Args[1:], " "))
+	output, err := c.CombinedOutput()
+	fmt.Fprintln(os.Stderr, string(output))
+	return err
+}
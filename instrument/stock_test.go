@@ -0,0 +1,46 @@
+package instrument
+
+import (
+	"strings"
+	"testing"
+)
+
+// A GOPATH package is built with the stock go tool (and the dgstock
+// dgruntime) and profiled without the patched runtime.
+func TestStockRuntime(t *testing.T) {
+	p := newProgram(t, map[string]string{
+		"gopath/src/example.com/g/main.go": `package main
+
+import "fmt"
+
+func double(x int) int {
+	if x < 0 {
+		return -2 * x
+	}
+	return 2 * x
+}
+
+func main() {
+	fmt.Println(double(-3), double(4))
+}
+`,
+	})
+	defer p.Close()
+	bin := p.buildGopath("example.com/g", nil)
+	dgprof, output, err := p.run(bin, nil)
+	if err != nil {
+		t.Fatalf("%v:\n%s", err, output)
+	}
+	if !strings.HasPrefix(string(output), "6 8\n") {
+		t.Errorf("expected the program to print 6 8 got:\n%s", output)
+	}
+	prof := p.profile(dgprof)
+	fns := functions(prof)
+	fn, has := fns["example.com/g.double"]
+	if !has {
+		t.Fatalf("expected example.com/g.double to be profiled got %v", fns)
+	}
+	if fn.Calls != 2 {
+		t.Errorf("expected 2 calls of example.com/g.double got %d", fn.Calls)
+	}
+}
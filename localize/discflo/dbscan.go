@@ -158,7 +158,9 @@ func noNan(x float64) interface{} {
 }
 
 type DbScan struct {
-	clusters []cluster
+	nodes    []*clusterNode
+	ids      [][]int   // the clusters (of indices into nodes)
+	clusters []cluster // the nodes of the ids, built when read (see clustered)
 	items    int
 	epsilon  float64
 	seen     map[string]bool
@@ -182,13 +184,35 @@ func (r *DbScan) Add(n *mine.SearchNode) error {
 		return err
 	}
 	r.items++
-	r.clusters = add(r.clusters, cn, r.epsilon, labelSimilarity)
+	r.nodes = append(r.nodes, cn)
+	r.ids = AddToClusters(r.ids, len(r.nodes)-1, r.epsilon, func(a, b int) float64 {
+		return labelSimilarity(r.nodes[a], r.nodes[b])
+	})
+	r.clusters = nil
 	return nil
 }
 
+// clustered is the clusters of nodes, rebuilt from the ids only when they
+// are read after an Add.
+func (r *DbScan) clustered() []cluster {
+	if r.clusters != nil {
+		return r.clusters
+	}
+	r.clusters = make([]cluster, 0, len(r.ids))
+	for _, ids := range r.ids {
+		c := make(cluster, 0, len(ids))
+		for _, id := range ids {
+			c = append(c, r.nodes[id])
+		}
+		r.clusters = append(r.clusters, c)
+	}
+	return r.clusters
+}
+
 func (r *DbScan) Clusters() []*Cluster {
-	clstrs := make([]*Cluster, 0, len(r.clusters))
-	for _, cluster := range r.clusters {
+	clusters := r.clustered()
+	clstrs := make([]*Cluster, 0, len(clusters))
+	for _, cluster := range clusters {
 		clstr := make([]*mine.SearchNode, 0, len(cluster))
 		sum := 0.0
 		for _, cn := range cluster {
@@ -214,8 +238,9 @@ func (r *DbScan) WriteClusters(dir string) error {
 	enc := json.NewEncoder(f)
 	enc.SetEscapeHTML(false)
 	enc.SetIndent("", "")
-	random := make([]cluster, rand.Intn(int(float64(len(r.clusters))*1.2))+2)
-	for i, cluster := range r.clusters {
+	clusters := r.clustered()
+	random := make([]cluster, rand.Intn(int(float64(len(clusters))*1.2))+2)
+	for i, cluster := range clusters {
 		for _, cn := range cluster {
 			x := map[string]interface{}{
 				"cluster": i,
@@ -239,18 +264,19 @@ func (r *DbScan) metrics(filePath string, random []cluster) error {
 		return err
 	}
 	defer f.Close()
+	clusters := r.clustered()
 	enc := json.NewEncoder(f)
 	enc.SetEscapeHTML(false)
 	enc.SetIndent("", "")
-	if len(r.clusters) >= r.items || len(r.clusters) <= 1 {
+	if len(clusters) >= r.items || len(clusters) <= 1 {
 		x := map[string]interface{}{
 			"items":    r.items,
-			"clusters": len(r.clusters),
+			"clusters": len(clusters),
 		}
 		return enc.Encode(x)
 	}
-	intraLabel := intradist(r.clusters, labelSimilarity)
-	interLabel := interdist(r.clusters, labelSimilarity)
+	intraLabel := intradist(clusters, labelSimilarity)
+	interLabel := interdist(clusters, labelSimilarity)
 	intraLabelRand := intradist(random, labelSimilarity)
 	interLabelRand := interdist(random, labelSimilarity)
 	stderr := func(a, b float64) float64 {
@@ -259,8 +285,8 @@ func (r *DbScan) metrics(filePath string, random []cluster) error {
 	x := map[string]interface{}{
 		"items": r.items,
 		"cluster-metrics": map[string]interface{}{
-			"count":                len(r.clusters),
-			"label-correlation":    noNan(correlation(r.clusters, labelSimilarity)),
+			"count":                len(clusters),
+			"label-correlation":    noNan(correlation(clusters, labelSimilarity)),
 			"label-intra-distance": noNan(intraLabel),
 			"label-inter-distance": noNan(interLabel),
 			"label-distance-ratio": noNan(intraLabel / interLabel),
@@ -273,8 +299,8 @@ func (r *DbScan) metrics(filePath string, random []cluster) error {
 			"label-distance-ratio": noNan(intraLabelRand / interLabelRand),
 		},
 		"standard-error": map[string]interface{}{
-			"count":                noNan(stderr(float64(len(r.clusters)), float64(len(random)))),
-			"label-correlation":    noNan(stderr(correlation(r.clusters, labelSimilarity), correlation(random, labelSimilarity))),
+			"count":                noNan(stderr(float64(len(clusters)), float64(len(random)))),
+			"label-correlation":    noNan(stderr(correlation(clusters, labelSimilarity), correlation(random, labelSimilarity))),
 			"label-intra-distance": noNan(stderr(intraLabel, intraLabelRand)),
 			"label-inter-distance": noNan(stderr(interLabel, interLabelRand)),
 			"label-distance-ratio": noNan(stderr(intraLabel/interLabel, intraLabelRand/interLabelRand)),
@@ -284,7 +310,7 @@ func (r *DbScan) metrics(filePath string, random []cluster) error {
 	if err != nil && strings.Contains(err.Error(), "NaN") {
 		x := map[string]interface{}{
 			"items":    r.items,
-			"clusters": len(r.clusters),
+			"clusters": len(clusters),
 		}
 		return enc.Encode(x)
 	} else if err != nil {
@@ -293,14 +319,19 @@ func (r *DbScan) metrics(filePath string, random []cluster) error {
 	return nil
 }
 
-func add(clusters []cluster, cn *clusterNode, epsilon float64, sim func(a, b *clusterNode) float64) []cluster {
+// AddToClusters is the step of DbScan which adds an item to the clusters
+// (lists of the indices of the items). The item joins the cluster of the
+// nearest item within epsilon of it (as measured by dist) and the other
+// clusters with an item within epsilon are merged into that one. An item
+// with none near it starts a new cluster.
+func AddToClusters(clusters [][]int, item int, epsilon float64, dist func(a, b int) float64) [][]int {
 	near := set.NewSortedSet(len(clusters))
 	min_near := -1
 	min_sim := -1.0
-	var min_item *clusterNode = nil
+	min_item := -1
 	for i := len(clusters) - 1; i >= 0; i-- {
 		for _, b := range clusters[i] {
-			s := sim(cn, b)
+			s := dist(item, b)
 			if s <= epsilon {
 				near.Add(types.Int(i))
 				if min_near == -1 || s < min_sim {
@@ -312,12 +343,12 @@ func add(clusters []cluster, cn *clusterNode, epsilon float64, sim func(a, b *cl
 		}
 	}
 	if near.Size() <= 0 {
-		return append(clusters, cluster{cn})
+		return append(clusters, []int{item})
 	}
 	if false {
-		errors.Logf("DBSCAN", "%v %v %v", min_sim, cn.n, min_item.n)
+		errors.Logf("DBSCAN", "%v %v %v", min_sim, item, min_item)
 	}
-	clusters[min_near] = append(clusters[min_near], cn)
+	clusters[min_near] = append(clusters[min_near], item)
 	prev := -1
 	for x, next := near.ItemsInReverse()(); next != nil; x, next = next() {
 		cur := int(x.(types.Int))
@@ -330,7 +361,7 @@ func add(clusters []cluster, cn *clusterNode, epsilon float64, sim func(a, b *cl
 	return clusters
 }
 
-func remove(list []cluster, i int) []cluster {
+func remove(list [][]int, i int) [][]int {
 	if i >= len(list) {
 		panic(fmt.Errorf("out of range (i (%v) >= len(list) (%v))", i, len(list)))
 	} else if i < 0 {
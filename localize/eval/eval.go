@@ -3,12 +3,14 @@ package eval
 import (
 	"fmt"
 	"math"
+	"os"
 	"runtime"
 	"strings"
 
 	"github.com/timtadh/dynagrok/localize/discflo"
 	"github.com/timtadh/dynagrok/localize/fault"
 	"github.com/timtadh/dynagrok/localize/lattice"
+	"github.com/timtadh/dynagrok/localize/locavore"
 	"github.com/timtadh/dynagrok/localize/mine"
 	"github.com/timtadh/dynagrok/localize/mine/opts"
 )
@@ -17,6 +19,12 @@ type FaultIdentifier interface {
 	Fault(color int) *fault.Fault
 }
 
+// A FunctionFaultIdentifier also identifies the faults in a function, for
+// the methods which rank whole functions (see FunctionRankListEval).
+type FunctionFaultIdentifier interface {
+	FunctionFault(fnName string) *fault.Fault
+}
+
 type Evaluator struct {
 	parallelism       int
 	lattice           *lattice.Lattice
@@ -95,6 +103,15 @@ func (e *Evaluator) Fault(color int) *fault.Fault {
 	return e.fi.Fault(color)
 }
 
+// FunctionFault is the fault in the function. It is an error if the
+// FaultIdentifier cannot identify faults by function.
+func (e *Evaluator) FunctionFault(fnName string) (*fault.Fault, error) {
+	if ffi, ok := e.fi.(FunctionFaultIdentifier); ok {
+		return ffi.FunctionFault(fnName), nil
+	}
+	return nil, fmt.Errorf("%T cannot identify the faults in a function", e.fi)
+}
+
 type DynagrokFaultIdentifier struct {
 	faults  []*fault.Fault
 	lattice *lattice.Lattice
@@ -117,6 +134,15 @@ func (d *DynagrokFaultIdentifier) Fault(color int) *fault.Fault {
 	return nil
 }
 
+func (d *DynagrokFaultIdentifier) FunctionFault(fnName string) *fault.Fault {
+	for _, f := range d.faults {
+		if fnName == f.FnName {
+			return f
+		}
+	}
+	return nil
+}
+
 type Defect4J_FaultIdentifier struct {
 	faults  []*fault.Fault
 	lattice *lattice.Lattice
@@ -177,6 +203,64 @@ func Discflo(o *discflo.Options, s mine.ScoreFunc) [][]ColorScore {
 	return groups
 }
 
+// Locavore ranks the functions by the causal effect locavore estimates
+// from their object profiles.
+func Locavore(okPath, failPath string, o *locavore.Options) ([]mine.ScoredLocations, error) {
+	ranked, err := locavore.LocalizeFiles(okPath, failPath, o)
+	if err != nil {
+		return nil, err
+	}
+	return ranked.Group(), nil
+}
+
+// LocavoreRanked reads the functions ranked by locavore (the JSON it
+// writes with --output).
+func LocavoreRanked(path string) ([]mine.ScoredLocations, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ranked, err := locavore.ReadRanked(f)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read the locavore ranking: %v, error: %v", path, err)
+	}
+	return ranked.Group(), nil
+}
+
+// FunctionRankListEval is RankListEval for a ranking of whole functions
+// (rather than blocks). The rank of a function counts the functions, so
+// it is not comparable with the rank of a block. It is an error if the
+// faults cannot be identified by function (see FunctionFault).
+func (e *Evaluator) FunctionRankListEval(methodName, scoreName string, groups []mine.ScoredLocations) (EvalResults, error) {
+	sum := 0
+	var min *RankListEvalResult
+	for _, group := range groups {
+		for _, l := range group {
+			f, err := e.FunctionFault(l.FnName)
+			if err != nil {
+				return nil, err
+			}
+			if f != nil {
+				loc := l.Location
+				r := &RankListEvalResult{
+					MethodName:     methodName,
+					ScoreName:      scoreName,
+					RankScore:      float64(sum) + float64(len(group))/2,
+					Suspiciousness: l.Score,
+					LocalizedFault: f,
+					Loc:            &loc,
+				}
+				if min == nil || r.RankScore < min.RankScore {
+					min = r
+				}
+			}
+		}
+		sum += len(group)
+	}
+	return EvalResults{min}, nil
+}
+
 func (e *Evaluator) RankListEval(methodName, scoreName string, groups [][]ColorScore) (results EvalResults) {
 	sum := 0
 	var min *RankListEvalResult
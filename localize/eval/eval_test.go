@@ -0,0 +1,104 @@
+package eval
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timtadh/dynagrok/localize/fault"
+	"github.com/timtadh/dynagrok/localize/locavore"
+	"github.com/timtadh/dynagrok/localize/mine"
+)
+
+func ranking() mine.ScoredLocations {
+	return locavore.Rank(map[string]float64{
+		"main.a": .9,
+		"main.b": .5,
+		"main.c": .5,
+		"main.d": .1,
+	})
+}
+
+// The rankings locavore writes are read back in the same order.
+func TestLocavoreRanked(t *testing.T) {
+	dir, err := ioutil.TempDir("", "eval")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "localized.json")
+	var buf bytes.Buffer
+	if err := locavore.WriteRanked(&buf, ranking()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	groups, err := LocavoreRanked(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{{"main.a"}, {"main.b", "main.c"}, {"main.d"}}
+	if len(groups) != len(expected) {
+		t.Fatalf("expected %d groups got %d:\n%v", len(expected), len(groups), groups)
+	}
+	for i, names := range expected {
+		if len(groups[i]) != len(names) {
+			t.Fatalf("expected group %d to be %v got:\n%v", i, names, groups[i])
+		}
+		for j, name := range names {
+			l := groups[i][j]
+			if l.FnName != name || l.Label != name || l.Color != -1 || l.BasicBlockId != -1 {
+				t.Errorf("expected %v at %d, %d got:\n%v", name, i, j, l)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LocavoreRanked(path); err == nil {
+		t.Error("expected an error reading a truncated ranking")
+	}
+}
+
+// A function is ranked at the middle of its group, counting the functions
+// of the groups before it.
+func TestFunctionRankListEval(t *testing.T) {
+	cases := []struct {
+		fnName string
+		rank   float64
+	}{
+		{"main.a", .5},
+		{"main.c", 2},
+		{"main.d", 3.5},
+	}
+	for _, c := range cases {
+		faults := []*fault.Fault{{FnName: c.fnName, BasicBlockId: 2}}
+		e := NewEvaluator(nil, NewDynagrokFaultIdentifier(nil, faults))
+		results, err := e.FunctionRankListEval("locavore", "causal-effect", ranking().Group())
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := results[0].(*RankListEvalResult)
+		if r == nil {
+			t.Fatalf("expected %v to be ranked", c.fnName)
+		}
+		if r.RankScore != c.rank || r.LocalizedFault != faults[0] || r.Loc.FnName != c.fnName {
+			t.Errorf("expected %v at rank %v got:\n%v", c.fnName, c.rank, r)
+		}
+	}
+	e := NewEvaluator(nil, NewDynagrokFaultIdentifier(nil, []*fault.Fault{{FnName: "main.e"}}))
+	results, err := e.FunctionRankListEval("locavore", "causal-effect", ranking().Group())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := results[0].(*RankListEvalResult); r != nil {
+		t.Errorf("expected no fault to be ranked got:\n%v", r)
+	}
+	e = NewEvaluator(nil, NewDefect4J_FaultIdentifier(nil, []*fault.Fault{{Position: "a/B.java:3"}}))
+	if _, err := e.FunctionRankListEval("locavore", "causal-effect", ranking().Group()); err == nil {
+		t.Error("expected an error identifying the defect4j faults by function")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"io/ioutil"
 	"strconv"
+	"strings"
 )
 
 import (
@@ -20,15 +21,17 @@ type DotLoader struct {
 	Labels  *Labels
 	Info    *Info
 	Attrs   VertexAttrs
+	opts    loadOptions
 	vidxs   map[int]int
 }
 
-func LoadDot(info *Info, labels *Labels, attrs VertexAttrs, input io.Reader) (*Indices, error) {
+func LoadDot(info *Info, labels *Labels, attrs VertexAttrs, input io.Reader, opts ...LoadOption) (*Indices, error) {
 	l := &DotLoader{
 		Builder: Build(100, 1000),
 		Labels:  labels,
 		Attrs:   attrs,
 		Info:    info,
+		opts:    newLoadOptions(opts),
 		vidxs:   make(map[int]int),
 	}
 	return l.load(input)
@@ -75,6 +78,11 @@ func (l *DotLoader) addVertex(id int, color int, label string, attrs map[string]
 			}
 		}
 		l.Info.Add(color, block, fnName, position)
+		if panicked, has := attrs["panicked"]; has {
+			for _, typ := range strings.Split(panicked.(string), ",") {
+				l.Info.AddPanic(color, typ)
+			}
+		}
 	}
 	return nil
 }
@@ -185,5 +193,8 @@ func (p *dotParse) loadEdge(n *combos.Node) (err error) {
 			break
 		}
 	}
+	if p.loader.opts.drop[label] {
+		return nil
+	}
 	return p.loader.addEdge(sid, tid, p.loader.Labels.Color(label), label)
 }
@@ -17,6 +17,8 @@ type Info struct {
 	Positions map[int]string
 	FnNames   map[int]string
 	BBIds     map[int]int
+	Levels    map[string]bool
+	Panics    map[int]map[string]bool
 }
 
 func NewInfo() *Info {
@@ -24,6 +26,8 @@ func NewInfo() *Info {
 		Positions: make(map[int]string),
 		FnNames:   make(map[int]string),
 		BBIds:     make(map[int]int),
+		Levels:    make(map[string]bool),
+		Panics:    make(map[int]map[string]bool),
 	}
 }
 
@@ -35,24 +39,100 @@ func (i *Info) Add(color, bbid int, fnName, pos string) {
 	i.lock.Unlock()
 }
 
+// AddLevel records the instrumentation level (see dgtypes.Level) a loaded
+// graph was collected at.
+func (i *Info) AddLevel(level string) {
+	i.lock.Lock()
+	i.Levels[level] = true
+	i.lock.Unlock()
+}
+
+// AddPanic records that the vertices with the given color panicked with
+// a value of the type typ.
+func (i *Info) AddPanic(color int, typ string) {
+	i.lock.Lock()
+	if i.Panics[color] == nil {
+		i.Panics[color] = make(map[string]bool)
+	}
+	i.Panics[color][typ] = true
+	i.lock.Unlock()
+}
+
 func (i Info) Get(color int) (bbid int, fnName, pos string) {
 	i.lock.Lock()
 	defer i.lock.Unlock()
 	return i.BBIds[color], i.FnNames[color], i.Positions[color]
 }
 
+// SpawnLabel is the label of the edges from a go statement to the first
+// block of the goroutine it started (see dgtypes.SpawnLabel).
+const SpawnLabel = "spawn"
+
+// CommLabel is the label of the communicates-with edges from a channel
+// send to the matching receive (see dgtypes.CommLabel).
+const CommLabel = "comm"
+
+// PanicLabel is the label of the exit edges of the calls unwound by a
+// panic (see dgtypes.PanicLabel).
+const PanicLabel = "panic"
+
+// RecoverLabel is the label of the exit edges of the calls which
+// recovered a panic (see dgtypes.RecoverLabel).
+const RecoverLabel = "recover"
+
+// A LoadOption changes how the profiles are loaded.
+type LoadOption func(*loadOptions)
+
+type loadOptions struct {
+	drop map[string]bool
+}
+
+// DropEdges leaves the edges with the given labels out of the loaded
+// graphs.
+func DropEdges(labels ...string) LoadOption {
+	return func(o *loadOptions) {
+		if o.drop == nil {
+			o.drop = make(map[string]bool)
+		}
+		for _, label := range labels {
+			o.drop[label] = true
+		}
+	}
+}
+
+// DropSpawns leaves the goroutine spawn edges out of the loaded graphs.
+func DropSpawns() LoadOption {
+	return DropEdges(SpawnLabel)
+}
+
+// DropComms leaves the channel communicates-with edges out of the loaded
+// graphs.
+func DropComms() LoadOption {
+	return DropEdges(CommLabel)
+}
+
+func newLoadOptions(opts []LoadOption) loadOptions {
+	var o loadOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 type SimpleLoader struct {
 	Builder *Builder
 	Labels  *Labels
 	Info    *Info
+	opts    loadOptions
 	vidxs   map[int]int
 }
 
-func LoadSimple(info *Info, labels *Labels, input io.Reader) (*Indices, error) {
+func LoadSimple(info *Info, labels *Labels, input io.Reader, opts ...LoadOption) (*Indices, error) {
 	l := &SimpleLoader{
 		Builder: Build(100, 1000),
 		Labels:  labels,
 		Info:    info,
+		opts:    newLoadOptions(opts),
 		vidxs:   make(map[int]int),
 	}
 	return l.load(input)
@@ -70,15 +150,37 @@ func (l *SimpleLoader) load(input io.Reader) (*Indices, error) {
 		kind, rest := split[0], split[1:]
 		switch kind {
 		case "start-graph":
+		case "version", "function", "call", "channel", "predicate":
+			// the format version (see dgtypes.ProfileVersion), the
+			// functions and calls, the channels of the comm edges and
+			// the predicates are not part of the graph
 		case "end-graph":
 			graph++
+		case "level":
+			err := l.level(rest)
+			if err != nil {
+				return nil, err
+			}
 		case "vertex":
 			err := l.vertex(rest)
 			if err != nil {
 				return nil, err
 			}
 		case "edge":
-			err := l.edge(rest)
+			err := l.edge(rest, "")
+			if err != nil {
+				return nil, err
+			}
+		case "panicked":
+			err := l.panicked(rest)
+			if err != nil {
+				return nil, err
+			}
+		case SpawnLabel, CommLabel, PanicLabel, RecoverLabel:
+			if l.opts.drop[kind] {
+				continue
+			}
+			err := l.edge(rest, kind)
 			if err != nil {
 				return nil, err
 			}
@@ -93,6 +195,52 @@ func (l *SimpleLoader) load(input io.Reader) (*Indices, error) {
 	return NewIndices(l.Builder, 0), nil
 }
 
+func (l *SimpleLoader) level(rest []string) error {
+	if len(rest) != 1 {
+		return errors.Errorf("line in unexpected format: `%v`", rest)
+	}
+	tokens, err := l.tokens(rest[0])
+	if err != nil {
+		return err
+	}
+	if len(tokens) < 1 {
+		return errors.Errorf("line in unexpected format (expected a level): `%v`", tokens)
+	}
+	level, err := strconv.Unquote(tokens[0])
+	if err != nil {
+		return err
+	}
+	l.Info.AddLevel(level)
+	return nil
+}
+
+func (l *SimpleLoader) panicked(rest []string) error {
+	if len(rest) != 1 {
+		return errors.Errorf("line in unexpected format: `%v`", rest)
+	}
+	tokens, err := l.tokens(rest[0])
+	if err != nil {
+		return err
+	}
+	if len(tokens) < 2 {
+		return errors.Errorf("line in unexpected format (expected 2 tokens): `%v`", tokens)
+	}
+	id, err := strconv.Atoi(tokens[0])
+	if err != nil {
+		return err
+	}
+	typ, err := strconv.Unquote(tokens[1])
+	if err != nil {
+		return err
+	}
+	vidx, has := l.vidxs[id]
+	if !has {
+		return errors.Errorf("unknown vertex id %v", id)
+	}
+	l.Info.AddPanic(l.Builder.V[vidx].Color, typ)
+	return nil
+}
+
 func (l *SimpleLoader) vertex(rest []string) error {
 	if len(rest) != 1 {
 		return errors.Errorf("line in unexpected format: `%v`", rest)
@@ -128,7 +276,7 @@ func (l *SimpleLoader) vertex(rest []string) error {
 	return nil
 }
 
-func (l *SimpleLoader) edge(rest []string) error {
+func (l *SimpleLoader) edge(rest []string, label string) error {
 	if len(rest) != 1 {
 		return errors.Errorf("line in unexpected format: `%v`", rest)
 	}
@@ -147,7 +295,7 @@ func (l *SimpleLoader) edge(rest []string) error {
 	if err != nil {
 		return err
 	}
-	return l.addEdge(src, targ)
+	return l.addEdge(src, targ, label)
 }
 
 func (l *SimpleLoader) tokens(s string) ([]string, error) {
@@ -193,13 +341,13 @@ func (l *SimpleLoader) addVertex(id, color, bbid int, fnName, pos string) {
 	l.Info.Add(color, bbid, fnName, pos)
 }
 
-func (l *SimpleLoader) addEdge(sid, tid int) error {
+func (l *SimpleLoader) addEdge(sid, tid int, label string) error {
 	if sidx, has := l.vidxs[sid]; !has {
 		return errors.Errorf("unknown src id %v", tid)
 	} else if tidx, has := l.vidxs[tid]; !has {
 		return errors.Errorf("unknown targ id %v", tid)
 	} else {
-		l.Builder.AddEdge(&l.Builder.V[sidx], &l.Builder.V[tidx], l.Labels.Color(""))
+		l.Builder.AddEdge(&l.Builder.V[sidx], &l.Builder.V[tidx], l.Labels.Color(label))
 	}
 	return nil
 }
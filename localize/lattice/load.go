@@ -10,7 +10,7 @@ import (
 	"github.com/timtadh/dynagrok/localize/lattice/digraph"
 )
 
-func Load(failPath, okPath []string) (l *Lattice, err error) {
+func Load(failPath, okPath []string, opts ...digraph.LoadOption) (l *Lattice, err error) {
 	failFile, failClose, err := cmd.Inputs(failPath)
 	if err != nil {
 		return nil, fmt.Errorf("Could not read profiles from failed executions: %v\n%v", failPath, err)
@@ -21,10 +21,10 @@ func Load(failPath, okPath []string) (l *Lattice, err error) {
 		return nil, fmt.Errorf("Could not read profiles from successful executions: %v\n%v", okPath, err)
 	}
 	defer okClose()
-	return LoadFrom(failFile, okFile)
+	return LoadFrom(failFile, okFile, opts...)
 }
 
-func LoadDot(failPath, okPath []string) (l *Lattice, err error) {
+func LoadDot(failPath, okPath []string, opts ...digraph.LoadOption) (l *Lattice, err error) {
 	failFile, failClose, err := cmd.Inputs(failPath)
 	if err != nil {
 		return nil, fmt.Errorf("Could not read profiles from failed executions: %v\n%v", failPath, err)
@@ -35,16 +35,16 @@ func LoadDot(failPath, okPath []string) (l *Lattice, err error) {
 		return nil, fmt.Errorf("Could not read profiles from successful executions: %v\n%v", okPath, err)
 	}
 	defer okClose()
-	return LoadFromDot(failFile, okFile)
+	return LoadFromDot(failFile, okFile, opts...)
 }
 
-func LoadFrom(failFile, okFile io.Reader) (l *Lattice, err error) {
+func LoadFrom(failFile, okFile io.Reader, opts ...digraph.LoadOption) (l *Lattice, err error) {
 	return NewLattice(func(l *Lattice) error {
-		fail, err := digraph.LoadSimple(l.Info, l.Labels, failFile)
+		fail, err := digraph.LoadSimple(l.Info, l.Labels, failFile, opts...)
 		if err != nil {
 			return fmt.Errorf("Could not load profiles from failed executions\n%v", err)
 		}
-		ok, err := digraph.LoadSimple(l.Info, l.Labels, okFile)
+		ok, err := digraph.LoadSimple(l.Info, l.Labels, okFile, opts...)
 		if err != nil {
 			return fmt.Errorf("Could not load profiles from successful executions\n%v", err)
 		}
@@ -54,13 +54,13 @@ func LoadFrom(failFile, okFile io.Reader) (l *Lattice, err error) {
 	})
 }
 
-func LoadFromDot(failFile, okFile io.Reader) (l *Lattice, err error) {
+func LoadFromDot(failFile, okFile io.Reader, opts ...digraph.LoadOption) (l *Lattice, err error) {
 	return NewLattice(func(l *Lattice) error {
-		fail, err := digraph.LoadDot(l.Info, l.Labels, l.NodeAttrs, failFile)
+		fail, err := digraph.LoadDot(l.Info, l.Labels, l.NodeAttrs, failFile, opts...)
 		if err != nil {
 			return fmt.Errorf("Could not load profiles from failed executions\n%v", err)
 		}
-		ok, err := digraph.LoadDot(l.Info, l.Labels, l.NodeAttrs, okFile)
+		ok, err := digraph.LoadDot(l.Info, l.Labels, l.NodeAttrs, okFile, opts...)
 		if err != nil {
 			return fmt.Errorf("Could not load profiles from successful executions\n%v", err)
 		}
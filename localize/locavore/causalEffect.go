@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 	"log"
+	"math"
 	"os"
 )
 
 type CausalEstimator struct {
+	opts *Options
 	// defined at init
 	ok    []dgtypes.Clusterable
 	fail  []dgtypes.Clusterable
@@ -25,39 +27,78 @@ type CausalEstimator struct {
 type Individual struct {
 	cov       dgtypes.Clusterable
 	treatment dgtypes.Clusterable
-	outcome   bool // true if pass, false is fail
+	outcome   bool         // true if pass, false is fail
+	exit      dgtypes.Exit // the return (or panic) which produced treatment
 }
 
 func (i *Individual) Dissimilar(o dgtypes.Clusterable) float64 {
 	if other, ok := o.(*Individual); ok {
-		return i.treatment.Dissimilar(other.treatment)
+		return math.Max(i.treatment.Dissimilar(other.treatment), exitDissimilar(i.exit, other.exit))
 	}
 	panic("Expected another *Individual to be passed to Dissimilar")
 }
 
-func covDissimilar(ind dgtypes.Clusterable, o dgtypes.Clusterable) float64 {
+// treatmentDissimilar is the dissimilarity of the treatments (outputs) of
+// the individuals by the metric of the options. Outputs produced by
+// different exits are at least as dissimilar as the exits.
+func (c *CausalEstimator) treatmentDissimilar(ind dgtypes.Clusterable, o dgtypes.Clusterable) float64 {
 	if i, ok := ind.(*Individual); ok {
 		if other, ok := o.(*Individual); ok {
-			return i.cov.Dissimilar(other.cov)
+			return math.Max(c.opts.dissimilar(i.treatment, other.treatment), exitDissimilar(i.exit, other.exit))
+		}
+	}
+	panic("Expected another *Individual to be passed to Dissimilar")
+}
+
+// exitDissimilar is 0 for the same exit, 1/2 for returns at different
+// sites and 1 when only one of the calls panicked.
+func exitDissimilar(a, b dgtypes.Exit) float64 {
+	switch {
+	case a.Panicked != b.Panicked:
+		return 1
+	case a.Site != b.Site:
+		return .5
+	}
+	return 0
+}
+
+// covDissimilar is the dissimilarity of the covariates (inputs) of the
+// individuals by the metric of the options.
+func (c *CausalEstimator) covDissimilar(ind dgtypes.Clusterable, o dgtypes.Clusterable) float64 {
+	if i, ok := ind.(*Individual); ok {
+		if other, ok := o.(*Individual); ok {
+			return c.opts.dissimilar(i.cov, other.cov)
 		}
 	}
 	panic("Expected another *Individual to be passed to Dissimilar")
 }
 
 func (i *Individual) String() string {
-	return fmt.Sprintf("{In: %v, Out: %v, Outcome: %v}", i.cov, i.treatment, i.outcome)
+	return fmt.Sprintf("{In: %v, Out: %v, Exit: %v, Outcome: %v}", i.cov, i.treatment, i.exit, i.outcome)
 }
 
-func CausalEffect(okf dgtypes.FuncProfile, failf dgtypes.FuncProfile, numbins int) ([]dgtypes.Clusterable, [][]float64, error) {
+// exit is how the call of the i'th output of f exited (profiles from
+// before the exits were recorded have none).
+func exit(f dgtypes.FuncProfile, i int) dgtypes.Exit {
+	if i < len(f.Exits) {
+		return f.Exits[i]
+	}
+	return dgtypes.Exit{}
+}
+
+// CausalEffect estimates the causal effect of each treatment (cluster of
+// the outputs) of the function on the outcome, with the metric and
+// clustering of the options.
+func CausalEffect(okf dgtypes.FuncProfile, failf dgtypes.FuncProfile, o *Options) ([]dgtypes.Clusterable, [][]float64, error) {
 	var ok, fail []dgtypes.Clusterable = make([]dgtypes.Clusterable, 0), make([]dgtypes.Clusterable, 0)
 	for i := range okf.In {
 		if len(okf.Out) != 0 {
-			ok = append(ok, &Individual{cov: okf.In[i], treatment: okf.Out[i], outcome: true})
+			ok = append(ok, &Individual{cov: okf.In[i], treatment: okf.Out[i], outcome: true, exit: exit(okf, i)})
 		}
 	}
 	for i := range failf.In {
 		if len(failf.Out) != 0 {
-			fail = append(fail, &Individual{cov: failf.In[i], treatment: failf.Out[i], outcome: false})
+			fail = append(fail, &Individual{cov: failf.In[i], treatment: failf.Out[i], outcome: false, exit: exit(failf, i)})
 		}
 	}
 	profs := append(ok, fail...)
@@ -71,11 +112,12 @@ func CausalEffect(okf dgtypes.FuncProfile, failf dgtypes.FuncProfile, numbins in
 	// Step 1:   Bin the inputs
 	// Step 1.5: Bin the outputs
 	C := CausalEstimator{
+		opts:  o,
 		ok:    ok,
 		fail:  fail,
 		profs: profs,
 	}
-	C.bin(numbins)
+	C.bin()
 	// Step 2: {optional} Propensity scoring
 	// Step 3: Matching outputs with different outcomes, based on covariant
 	//	similarity
@@ -88,22 +130,17 @@ func CausalEffect(okf dgtypes.FuncProfile, failf dgtypes.FuncProfile, numbins in
 	// Step 4: ??
 }
 
-func (c *CausalEstimator) bin(numbins int) {
-	c.inBins, c.inMedoids = KMedoidsFunc(numbins, c.profs, covDissimilar)
-	c.outBins, c.outMedoids = KMedoids(numbins, c.profs)
+// bin clusters the inputs and the outputs (the clusters include their
+// medoids).
+func (c *CausalEstimator) bin() {
+	c.inBins, c.inMedoids = c.opts.Clustering(c.opts, c.profs, c.covDissimilar)
+	c.outBins, c.outMedoids = c.opts.Clustering(c.opts, c.profs, c.treatmentDissimilar)
 	//for i := range c.outBins {
 	//	fmt.Printf("Medoid: %v\n", c.outMedoids[0])
 	//	for j := range c.outBins[i] {
 	//		fmt.Printf("\t%d: %v\n", j, c.outBins[i][j])
 	//	}
 	//}
-	log.Printf("Adding medoids to their respective clusters...")
-	for i, j := range c.inMedoids {
-		c.inBins[i] = append(c.inBins[i], j)
-	}
-	for i, j := range c.outMedoids {
-		c.outBins[i] = append(c.inBins[i], j)
-	}
 	//	fmt.Printf("%v ouput medoids: %v\n", len(c.outMedoids), c.outMedoids)
 	//fmt.Printf("%v output clusters: %v\n", len(c.outBins), c.outBins)
 }
@@ -169,7 +206,7 @@ func (c *CausalEstimator) mCov(individual dgtypes.Clusterable, tlevel int) int {
 		min := 2.0
 		matchindex := -1
 		for i := range c.outBins[tlevel] {
-			dist := c.cov(i, tlevel).Dissimilar(ind.cov)
+			dist := c.opts.dissimilar(c.cov(i, tlevel), ind.cov)
 			if dist < min {
 				min = dist
 				matchindex = i
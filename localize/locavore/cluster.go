@@ -44,6 +44,12 @@ func KMedoidsFunc(numClusters int, nodes []dgtypes.Clusterable, f func(dgtypes.C
 		}
 		cost = newcost
 		updateMedoids(clusters, medoids, f)
+		// the medoids swapped places with members of the clusters, so the
+		// nodes are now the members
+		nodes = make([]dgtypes.Clusterable, 0, len(nodes))
+		for _, cluster := range clusters {
+			nodes = append(nodes, cluster...)
+		}
 		clusters = assignToMedoids(medoids, nodes, f)
 		newcost = totalCost(clusters, medoids, f)
 	}
@@ -5,6 +5,7 @@ import (
 	"testing"
 
 	"github.com/timtadh/data-structures/test"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 )
 
 type Vec struct {
@@ -12,17 +13,21 @@ type Vec struct {
 	y int
 }
 
-func (v Vec) Dissimilar(o Clusterable) float64 {
+func (v Vec) Dissimilar(o dgtypes.Clusterable) float64 {
 	if v2, ok := o.(Vec); ok {
 		return math.Abs(float64(v.x-v2.x)) + math.Abs(float64(v.y-v2.y))
 	}
 	return math.Inf(1)
 }
 
-var TestVecs []Clusterable
+func vecDissimilar(a, b dgtypes.Clusterable) float64 {
+	return a.Dissimilar(b)
+}
+
+var TestVecs []dgtypes.Clusterable
 
 func initialize() {
-	TestVecs = []Clusterable{Vec{0, 10},
+	TestVecs = []dgtypes.Clusterable{Vec{0, 10},
 		Vec{10, 0},
 		Vec{10, 10},
 		Vec{10, 1},
@@ -33,31 +38,82 @@ func initialize() {
 func TestAssignToMedoids(x *testing.T) {
 	t := (*test.T)(x)
 	initialize()
-	medoids := make([]Clusterable, 3)
+	medoids := make([]dgtypes.Clusterable, 3)
 	medoids[0] = TestVecs[0]
 	medoids[1] = TestVecs[1]
 	medoids[2] = TestVecs[2]
 	TestVecs = TestVecs[3:]
 
-	clusters := assignToMedoids(medoids, TestVecs)
-	nodes, ok := clusters[medoids[2]]
-	t.Assert(ok && len(nodes) == 2, "assignToMedoids is not working as expected: %v", clusters)
+	clusters := assignToMedoids(medoids, TestVecs, vecDissimilar)
+	t.Assert(len(clusters[2]) == 2, "assignToMedoids is not working as expected: %v", clusters)
 }
 
 func TestSwap(x *testing.T) {
 	t := (*test.T)(x)
 	initialize()
-	medoid := TestVecs[2]
-	nodes := TestVecs[4:]
+	medoids := []dgtypes.Clusterable{TestVecs[2]}
+	clusters := [][]dgtypes.Clusterable{TestVecs[4:]}
 
-	clusters := make(map[Clusterable][]Clusterable)
-	clusters[medoid] = nodes
-	cost := clusterCost(medoid, nodes)
+	cost := clusterCost(medoids[0], clusters[0], vecDissimilar)
 	t.Assert(cost == 3, "cost of %f  unexpected: %v", cost, clusters)
-	swapCluster(medoid, nodes[0], clusters)
-
-	medoid, nodes[0] = nodes[0], medoid
+	swapCluster(0, 0, 0, clusters, medoids)
 
-	cost = clusterCost(medoid, nodes)
+	cost = clusterCost(medoids[0], clusters[0], vecDissimilar)
 	t.Assert(cost == 2, "Lower cost of %f unexpected: %v", cost, clusters)
 }
+
+// groups are two groups of vectors far apart, interleaved.
+func groups(n int) ([]dgtypes.Clusterable, map[dgtypes.Clusterable]int) {
+	nodes := make([]dgtypes.Clusterable, 0, 2*n)
+	group := make(map[dgtypes.Clusterable]int)
+	for i := 0; i < n; i++ {
+		a := Vec{i % 3, i / 3}
+		b := Vec{1000 + i%3, 1000 + i/3}
+		nodes = append(nodes, a, b)
+		group[a] = 0
+		group[b] = 1
+	}
+	return nodes, group
+}
+
+// Every clustering separates the two groups, each cluster holding its
+// medoid.
+func TestClusterings(t *testing.T) {
+	cases := []struct {
+		clustering string
+		nodes      int
+	}{
+		{"kmedoids", 6},
+		{"dbscan", 6},
+		{"hierarchical", 6},
+		{"hierarchical", MaxHierarchicalNodes},
+	}
+	for _, c := range cases {
+		o := DefaultOptions()
+		o.Bins = 2
+		o.Epsilon = 2
+		nodes, group := groups(c.nodes)
+		clusters, medoids := Clusterings[c.clustering](o, nodes, vecDissimilar)
+		if len(clusters) != 2 || len(medoids) != 2 {
+			t.Errorf("%v expected 2 clusters of %d nodes got %d (and %d medoids)", c.clustering, len(nodes), len(clusters), len(medoids))
+			continue
+		}
+		seen := make(map[dgtypes.Clusterable]bool)
+		for i, cluster := range clusters {
+			hasMedoid := false
+			for _, n := range cluster {
+				if group[n] != group[cluster[0]] {
+					t.Errorf("%v mixed %v and %v in cluster %d", c.clustering, n, cluster[0], i)
+				}
+				hasMedoid = hasMedoid || n == medoids[i]
+				seen[n] = true
+			}
+			if !hasMedoid {
+				t.Errorf("%v cluster %d does not hold its medoid %v", c.clustering, i, medoids[i])
+			}
+		}
+		if len(seen) != len(nodes) {
+			t.Errorf("%v clustered %d of %d nodes", c.clustering, len(seen), len(nodes))
+		}
+	}
+}
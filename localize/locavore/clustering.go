@@ -0,0 +1,149 @@
+package locavore
+
+import (
+	"math/rand"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/discflo"
+)
+
+// A Clustering clusters the nodes by their dissimilarity (dis). It returns
+// the clusters, each including its medoid, and the medoids.
+type Clustering func(o *Options, nodes []dgtypes.Clusterable, dis func(a, b dgtypes.Clusterable) float64) ([][]dgtypes.Clusterable, []dgtypes.Clusterable)
+
+// Clusterings are the clustering algorithms locavore can bin the inputs
+// and outputs of a function with.
+var Clusterings = map[string]Clustering{
+	"kmedoids":     KMedoidsClustering,
+	"dbscan":       DbScanClustering,
+	"hierarchical": HierarchicalClustering,
+}
+
+// ClusteringDescriptions describe the Clusterings (for --clusterings).
+var ClusteringDescriptions = map[string]string{
+	"kmedoids":     "k-medoids into --numbins clusters (the default)",
+	"dbscan":       "DBSCAN, nodes within --epsilon of each other share a cluster",
+	"hierarchical": "average linkage agglomerative clustering into --numbins clusters",
+}
+
+// KMedoidsClustering is KMedoidsFunc into o.Bins clusters.
+func KMedoidsClustering(o *Options, nodes []dgtypes.Clusterable, dis func(a, b dgtypes.Clusterable) float64) ([][]dgtypes.Clusterable, []dgtypes.Clusterable) {
+	clusters, medoids := KMedoidsFunc(o.Bins, nodes, dis)
+	for i, m := range medoids {
+		clusters[i] = append(clusters[i], m)
+	}
+	return clusters, medoids
+}
+
+// DbScanClustering clusters the nodes with the DBSCAN of discflo (see
+// discflo.AddToClusters) with o.Epsilon.
+func DbScanClustering(o *Options, nodes []dgtypes.Clusterable, dis func(a, b dgtypes.Clusterable) float64) ([][]dgtypes.Clusterable, []dgtypes.Clusterable) {
+	var ids [][]int
+	for i := range nodes {
+		ids = discflo.AddToClusters(ids, i, o.Epsilon, func(a, b int) float64 {
+			return dis(nodes[a], nodes[b])
+		})
+	}
+	return withMedoids(nodes, ids, dis)
+}
+
+// MaxHierarchicalNodes bounds the nodes HierarchicalClustering merges, its
+// time is cubic (and its memory quadratic) in their number.
+const MaxHierarchicalNodes = 256
+
+// HierarchicalClustering merges the closest clusters (by their average
+// dissimilarity) until there are o.Bins of them. Of more than
+// MaxHierarchicalNodes nodes only a (seeded, so repeatable) random sample
+// is merged, the others join the cluster of the nearest medoid.
+func HierarchicalClustering(o *Options, nodes []dgtypes.Clusterable, dis func(a, b dgtypes.Clusterable) float64) ([][]dgtypes.Clusterable, []dgtypes.Clusterable) {
+	if len(nodes) <= MaxHierarchicalNodes {
+		return hierarchical(o, nodes, dis)
+	}
+	sampled := make([]bool, len(nodes))
+	for _, i := range rand.New(rand.NewSource(int64(len(nodes)))).Perm(len(nodes))[:MaxHierarchicalNodes] {
+		sampled[i] = true
+	}
+	sample := make([]dgtypes.Clusterable, 0, MaxHierarchicalNodes)
+	rest := make([]dgtypes.Clusterable, 0, len(nodes)-MaxHierarchicalNodes)
+	for i, n := range nodes {
+		if sampled[i] {
+			sample = append(sample, n)
+		} else {
+			rest = append(rest, n)
+		}
+	}
+	clusters, medoids := hierarchical(o, sample, dis)
+	for i, c := range assignToMedoids(medoids, rest, dis) {
+		clusters[i] = append(clusters[i], c...)
+	}
+	return clusters, medoids
+}
+
+func hierarchical(o *Options, nodes []dgtypes.Clusterable, dis func(a, b dgtypes.Clusterable) float64) ([][]dgtypes.Clusterable, []dgtypes.Clusterable) {
+	ids := make([][]int, 0, len(nodes))
+	dist := make([][]float64, len(nodes))
+	for i := range nodes {
+		ids = append(ids, []int{i})
+		dist[i] = make([]float64, len(nodes))
+		for j := 0; j < i; j++ {
+			dist[i][j] = dis(nodes[i], nodes[j])
+			dist[j][i] = dist[i][j]
+		}
+	}
+	// dist[i][j] is the average dissimilarity of clusters i and j (updated
+	// as they merge), a merged cluster keeps the lower index and the higher
+	// is emptied
+	live := len(ids)
+	for live > o.Bins && live > 1 {
+		mi, mj := -1, -1
+		for i := range ids {
+			for j := i + 1; j < len(ids) && len(ids[i]) > 0; j++ {
+				if len(ids[j]) > 0 && (mi < 0 || dist[i][j] < dist[mi][mj]) {
+					mi, mj = i, j
+				}
+			}
+		}
+		ni, nj := float64(len(ids[mi])), float64(len(ids[mj]))
+		for k := range ids {
+			if k != mi && k != mj && len(ids[k]) > 0 {
+				dist[mi][k] = (ni*dist[mi][k] + nj*dist[mj][k]) / (ni + nj)
+				dist[k][mi] = dist[mi][k]
+			}
+		}
+		ids[mi] = append(ids[mi], ids[mj]...)
+		ids[mj] = nil
+		live--
+	}
+	clusters := make([][]int, 0, live)
+	for _, c := range ids {
+		if len(c) > 0 {
+			clusters = append(clusters, c)
+		}
+	}
+	return withMedoids(nodes, clusters, dis)
+}
+
+// withMedoids is the clusters of nodes (by their indices) and the medoid
+// of each, the member least dissimilar from the others.
+func withMedoids(nodes []dgtypes.Clusterable, ids [][]int, dis func(a, b dgtypes.Clusterable) float64) ([][]dgtypes.Clusterable, []dgtypes.Clusterable) {
+	clusters := make([][]dgtypes.Clusterable, 0, len(ids))
+	medoids := make([]dgtypes.Clusterable, 0, len(ids))
+	for _, c := range ids {
+		cluster := make([]dgtypes.Clusterable, 0, len(c))
+		for _, i := range c {
+			cluster = append(cluster, nodes[i])
+		}
+		medoid := 0
+		minCost := -1.0
+		for i := range cluster {
+			cost := clusterCost(cluster[i], cluster, dis)
+			if minCost < 0 || cost < minCost {
+				medoid = i
+				minCost = cost
+			}
+		}
+		clusters = append(clusters, cluster)
+		medoids = append(medoids, cluster[medoid])
+	}
+	return clusters, medoids
+}
@@ -1,6 +1,9 @@
 package locavore
 
 import (
+	"fmt"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -19,56 +22,117 @@ func NewCommand(c *cmd.Config) cmd.Runnable {
 		`[options] <failing-profiles> <succeeding-profiles>`,
 		`
 
-<failing-profiles> should be a file containing object profiles from
-                   failed executions of an instrumented copy of the program
-                   under test (PUT).
+<failing-profiles> should be a file or a directory of *.bin files containing
+                   object profiles (object-profiles.bin) from failed
+                   executions of an instrumented copy of the program under
+                   test (PUT).
 
-<succeeding-profiles> should be a file containing object profiles from
-                      successful executions of an instrumented copy of the
-                      program under test (PUT).
+<succeeding-profiles> should be a file or a directory of *.bin files
+                      containing object profiles from successful executions
+                      of an instrumented copy of the program under test
+                      (PUT).
+
+The profiles are read one batch of functions at a time so they do not have to
+fit in memory.
 
 Option Flags
     -h,--help                         Show this message
     -o,--output=<path>                Output file to create (defaults to localized.json)
+                                      holding the functions ranked by their
+                                      suspiciousness (as JSON)
+    -b,--numbins=<int>                Number of bins to cluster the inputs and
+                                      outputs of a function into (default 10)
+    -m,--metric=<metric>              How to measure the dissimilarity of the
+                                      inputs (and outputs) of two calls
+                                      (default dissimilar)
+    --metrics                         List the metrics available
+    -c,--clustering=<clustering>      How to cluster the inputs and outputs
+                                      (default kmedoids)
+    --clusterings                     List the clusterings available
+    -e,--epsilon=<float>              Largest dissimilarity of neighbors for
+                                      the dbscan clustering (default .1)
 `,
-		"o:b:",
+		"o:b:m:c:e:",
 		[]string{
 			"output=",
 			"numbins=",
+			"metric=",
+			"metrics",
+			"clustering=",
+			"clusterings",
+			"epsilon=",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			output := "localized.json"
-			binstring := "10"
+			o := DefaultOptions()
 			for _, oa := range optargs {
 				switch oa.Opt() {
 				case "-o", "--output":
 					output = oa.Arg()
 				case "-b", "--numbins":
-					binstring = oa.Arg()
+					bins, err := strconv.Atoi(oa.Arg())
+					if err != nil || bins <= 0 {
+						return nil, cmd.Errorf(2, "Expected a positive int argument for --numbins, received: [%v]", oa.Arg())
+					}
+					o.Bins = bins
+				case "-e", "--epsilon":
+					epsilon, err := strconv.ParseFloat(oa.Arg(), 64)
+					if err != nil || epsilon < 0 {
+						return nil, cmd.Errorf(2, "Expected a non-negative float argument for --epsilon, received: [%v]", oa.Arg())
+					}
+					o.Epsilon = epsilon
+				case "--metrics":
+					fmt.Println("\nNames of Dissimilarity Metrics:")
+					for _, name := range sortedNames(MetricDescriptions) {
+						fmt.Printf("  - %v : %v\n", name, MetricDescriptions[name])
+					}
+					return nil, cmd.Errorf(0, "")
+				case "-m", "--metric":
+					if m, has := Metrics[oa.Arg()]; has {
+						o.Metric = m
+						o.MetricName = oa.Arg()
+					} else {
+						return nil, cmd.Errorf(1, "Metric '%v' is not supported. (use --metrics to get a list)", oa.Arg())
+					}
+				case "--clusterings":
+					fmt.Println("\nNames of Clusterings:")
+					for _, name := range sortedNames(ClusteringDescriptions) {
+						fmt.Printf("  - %v : %v\n", name, ClusteringDescriptions[name])
+					}
+					return nil, cmd.Errorf(0, "")
+				case "-c", "--clustering":
+					if c, has := Clusterings[oa.Arg()]; has {
+						o.Clustering = c
+						o.ClusteringName = oa.Arg()
+					} else {
+						return nil, cmd.Errorf(1, "Clustering '%v' is not supported. (use --clusterings to get a list)", oa.Arg())
+					}
 				}
 			}
-			_ = output
-			var binum int
-			if bins, err := strconv.Atoi(binstring); err != nil {
-				return nil, cmd.Errorf(2, "Expected int argument for --numbins, received: [%v]", binstring)
-			} else {
-				binum = bins
-			}
 			if len(args) != 2 {
 				return nil, cmd.Usage(r, 2, "Expected exactly 2 arguments for successful/failing test profiles got: [%v]", strings.Join(args, ", "))
 			}
-			failFile, failClose, err := cmd.Input(args[0])
+			ranked, err := LocalizeFiles(args[1], args[0], o)
 			if err != nil {
-				return nil, cmd.Errorf(2, "Could not read profiles from failed executions: %v\n%v", args[0], err)
+				return nil, cmd.Errorf(2, "Could not read the object profiles: %v", err)
 			}
-			defer failClose()
-			okFile, okClose, err := cmd.Input(args[1])
+			ouf, err := os.Create(output)
 			if err != nil {
-				return nil, cmd.Errorf(2, "Could not read profiles from successful executions: %v\n%v", args[1], err)
+				return nil, cmd.Errorf(1, "Could not create output file: %v, error: %v", output, err)
+			}
+			defer ouf.Close()
+			if err := WriteRanked(ouf, ranked); err != nil {
+				return nil, cmd.Errorf(1, "Could not write output file: %v, error: %v", output, err)
 			}
-			defer okClose()
-			types, ok, fail := ParseProfiles(okFile, failFile)
-			Localize(ok, fail, types, binum)
 			return nil, nil
 		})
 }
+
+func sortedNames(descriptions map[string]string) []string {
+	names := make([]string, 0, len(descriptions))
+	for name := range descriptions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -1,13 +1,59 @@
 package locavore
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"sort"
 
 	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/mine"
 )
 
+// DefaultBins is the number of bins the inputs and outputs are clustered
+// into unless told otherwise.
+const DefaultBins = 10
+
+// DefaultEpsilon is the largest dissimilarity of neighbors for the dbscan
+// clustering unless told otherwise.
+const DefaultEpsilon = .1
+
+// Options choose how the inputs and outputs of the functions are compared
+// and clustered.
+type Options struct {
+	Bins           int     // clusters for kmedoids and hierarchical
+	Epsilon        float64 // for dbscan
+	Metric         Metric
+	MetricName     string
+	Clustering     Clustering
+	ClusteringName string
+}
+
+// DefaultOptions cluster with k-medoids into DefaultBins bins by the
+// Dissimilar methods of the values.
+func DefaultOptions() *Options {
+	return &Options{
+		Bins:           DefaultBins,
+		Epsilon:        DefaultEpsilon,
+		Metric:         Metrics["dissimilar"],
+		MetricName:     "dissimilar",
+		Clustering:     Clusterings["kmedoids"],
+		ClusteringName: "kmedoids",
+	}
+}
+
+// dissimilar is the dissimilarity of the profiles by o.Metric.
+func (o *Options) dissimilar(a, b dgtypes.Clusterable) float64 {
+	x, xok := a.(dgtypes.ObjectProfile)
+	y, yok := b.(dgtypes.ObjectProfile)
+	if xok && yok && o.Metric != nil {
+		return x.DissimilarFunc(y, o.Metric)
+	}
+	return a.Dissimilar(b)
+}
+
 // Compile takes a list of passing FuncProfiles and a list of failing
 // FuncProfiles. It returns these lists, after appending together profiles which
 // are defined on the same funcName.
@@ -26,6 +72,7 @@ func collateProf(profiles []dgtypes.FuncProfile) []dgtypes.FuncProfile {
 				}
 				ret[i].In = append(ret[i].In, prof.In...)
 				ret[i].Out = append(ret[i].Out, prof.Out...)
+				ret[i].Exits = append(ret[i].Exits, prof.Exits...)
 				break
 			}
 		}
@@ -36,23 +83,82 @@ func collateProf(profiles []dgtypes.FuncProfile) []dgtypes.FuncProfile {
 	return ret
 }
 
-func Localize(okf []dgtypes.FuncProfile, failf []dgtypes.FuncProfile, types []dgtypes.Type, numbins int) {
+// Localize ranks the functions profiled in both okf and failf by their
+// suspiciousness.
+func Localize(okf []dgtypes.FuncProfile, failf []dgtypes.FuncProfile, types []dgtypes.Type, o *Options) mine.ScoredLocations {
 	suspiciousness := make(map[string]float64)
+	localize(okf, failf, o, suspiciousness)
+	printSuspiciousness(suspiciousness)
+	return Rank(suspiciousness)
+}
+
+// Rank lists the functions from the most to the least suspicious. The
+// locations are whole functions so they have no basic block (or color),
+// both are -1.
+func Rank(suspiciousness map[string]float64) mine.ScoredLocations {
+	names := make([]string, 0, len(suspiciousness))
+	for name := range suspiciousness {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ranked := make(mine.ScoredLocations, 0, len(names))
+	for _, name := range names {
+		ranked = append(ranked, &mine.ScoredLocation{
+			Location: mine.Location{
+				Color:        -1,
+				FnName:       name,
+				BasicBlockId: -1,
+				Label:        name,
+			},
+			Score: suspiciousness[name],
+		})
+	}
+	ranked.Sort()
+	return ranked
+}
+
+// WriteRanked writes the ranked functions as a JSON list.
+func WriteRanked(w io.Writer, ranked mine.ScoredLocations) error {
+	bits, err := json.MarshalIndent(ranked, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(bits))
+	return err
+}
+
+// ReadRanked reads the ranked functions WriteRanked wrote.
+func ReadRanked(r io.Reader) (mine.ScoredLocations, error) {
+	var ranked mine.ScoredLocations
+	if err := json.NewDecoder(r).Decode(&ranked); err != nil {
+		return nil, err
+	}
+	ranked.Sort()
+	return ranked, nil
+}
+
+// localize scores the functions profiled in both okf and failf.
+func localize(okf []dgtypes.FuncProfile, failf []dgtypes.FuncProfile, o *Options, suspiciousness map[string]float64) {
 	okf, failf = Collate(okf, failf)
 	for _, okprof := range okf {
 		for _, failprof := range failf {
 			if okprof.FuncName == failprof.FuncName {
 				fmt.Println("")
 				log.Printf("--- Attempting to calculate causal effect for %s ---", okprof.FuncName)
-				treatments, pairwiseEffects, err := CausalEffect(okprof, failprof, numbins)
-				if err == nil {
-					log.Printf("--- Succesfully calculated causal effect for %s ---", okprof.FuncName)
+				treatments, pairwiseEffects, err := CausalEffect(okprof, failprof, o)
+				if err != nil {
+					log.Printf("--- Could not calculate causal effect for %s, skipping it: %v ---", okprof.FuncName, err)
+					continue
 				}
+				log.Printf("--- Succesfully calculated causal effect for %s ---", okprof.FuncName)
 				suspiciousness[okprof.FuncName] = Suspiciousness(pairwiseEffects)
 				_ = treatments
 			}
 		}
 	}
+}
+
+func printSuspiciousness(suspiciousness map[string]float64) {
 	// TODO print Max-value suspiciousness as well. That will work better for
 	// certain faults
 	// TODO create test driver for some empty-list bug fault.
@@ -60,7 +166,6 @@ func Localize(okf []dgtypes.FuncProfile, failf []dgtypes.FuncProfile, types []dg
 	log.Printf("--- Finished calculating causal effect ---")
 	log.Printf("Printing scores...")
 	printScores(suspiciousness)
-
 }
 
 // Suspiciousness takes a matrix of causal effect pairs and computes some metric
@@ -0,0 +1,18 @@
+package locavore
+
+import (
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// A function whose causal effect can not be estimated is not scored.
+func TestLocalizeSkipsErrors(t *testing.T) {
+	okf := []dgtypes.FuncProfile{{FuncName: "main.f"}}
+	failf := []dgtypes.FuncProfile{{FuncName: "main.f"}}
+	suspiciousness := make(map[string]float64)
+	localize(okf, failf, &Options{}, suspiciousness)
+	if s, has := suspiciousness["main.f"]; has {
+		t.Errorf("expected main.f not to be scored got %v", s)
+	}
+}
@@ -0,0 +1,255 @@
+package locavore
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// A Metric measures the dissimilarity of two values (of the same param)
+// between 0 (the same) and 1 (entirely different).
+type Metric func(a, b dgtypes.Value) float64
+
+// Metrics are the dissimilarity metrics locavore can cluster (and match)
+// the inputs and outputs of a function with.
+var Metrics = map[string]Metric{
+	"dissimilar": dgtypes.Dissimilar,
+	"edit":       EditDissimilar,
+	"numeric":    NumericDissimilar,
+	"jaccard":    JaccardDissimilar,
+}
+
+// MetricDescriptions describe the Metrics (for --metrics).
+var MetricDescriptions = map[string]string{
+	"dissimilar": "the Dissimilar method of the values (the default)",
+	"edit":       "tree edit distance of the values, relative to their sizes",
+	"numeric":    "mean relative difference of the numbers in the values",
+	"jaccard":    "Jaccard distance of the sets of fields reachable in the values",
+}
+
+// {{{ edit distance
+
+// tree is a value as a labeled, ordered tree for EditDissimilar.
+type tree struct {
+	label string // the kind and type of the value
+	leaf  string // the value of a scalar
+	kids  []*tree
+	size  int
+}
+
+func newTree(v dgtypes.Value) *tree {
+	t := &tree{size: 1}
+	if v == nil {
+		t.label = "<nil>"
+		return t
+	}
+	t.label = fmt.Sprintf("%T %v", v, v.TypeName())
+	kids := children(v)
+	if kids == nil {
+		t.leaf = v.String()
+	}
+	for _, kid := range kids {
+		k := newTree(kid)
+		t.kids = append(t.kids, k)
+		t.size += k.size
+	}
+	return t
+}
+
+// children are the values a composite value holds (nil for a scalar).
+func children(v dgtypes.Value) []dgtypes.Value {
+	switch x := v.(type) {
+	case *dgtypes.StructValue:
+		kids := make([]dgtypes.Value, 0, len(x.Fields))
+		for _, f := range x.Fields {
+			kids = append(kids, f.Val)
+		}
+		return kids
+	case *dgtypes.ReferenceValue:
+		if x.Elem == nil {
+			return []dgtypes.Value{}
+		}
+		return []dgtypes.Value{x.Elem}
+	case *dgtypes.ArrayValue:
+		return append([]dgtypes.Value{}, x.Val...)
+	case *dgtypes.MapValue:
+		kids := make([]dgtypes.Value, 0, len(x.Keys)+len(x.Vals))
+		for i := range x.Keys {
+			kids = append(kids, x.Keys[i])
+			if i < len(x.Vals) {
+				kids = append(kids, x.Vals[i])
+			}
+		}
+		return kids
+	}
+	return nil
+}
+
+// EditDissimilar is the (top-down, Selkow) tree edit distance of the
+// values, counting a node inserted, deleted or relabeled as 1, divided by
+// the sum of their sizes.
+func EditDissimilar(a, b dgtypes.Value) float64 {
+	x, y := newTree(a), newTree(b)
+	return float64(editDistance(x, y)) / float64(x.size+y.size)
+}
+
+func editDistance(x, y *tree) int {
+	if x.label != y.label {
+		return x.size + y.size
+	}
+	cost := 0
+	if x.leaf != y.leaf {
+		cost = 1
+	}
+	// the edit distance of the sequences of children, a child inserted or
+	// deleted costs its size
+	prev := make([]int, len(y.kids)+1)
+	cur := make([]int, len(y.kids)+1)
+	for j, k := range y.kids {
+		prev[j+1] = prev[j] + k.size
+	}
+	for _, xk := range x.kids {
+		cur[0] = prev[0] + xk.size
+		for j, yk := range y.kids {
+			cur[j+1] = min3(
+				prev[j+1]+xk.size,
+				cur[j]+yk.size,
+				prev[j]+editDistance(xk, yk))
+		}
+		prev, cur = cur, prev
+	}
+	return cost + prev[len(y.kids)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// }}}
+
+// {{{ numeric distance
+
+// NumericDissimilar is the mean (see dgtypes.NumberDissimilar) difference
+// of the numbers in the values, matched by their paths through the
+// values. A number only one value has counts 1. Values without numbers
+// fall back to dgtypes.Dissimilar.
+func NumericDissimilar(a, b dgtypes.Value) float64 {
+	x, y := make(map[string]float64), make(map[string]float64)
+	numbers(a, "", x)
+	numbers(b, "", y)
+	if len(x) == 0 && len(y) == 0 {
+		return dgtypes.Dissimilar(a, b)
+	}
+	n := len(x)
+	for path := range y {
+		if _, has := x[path]; !has {
+			n++
+		}
+	}
+	distance := 0.0
+	for path, i := range x {
+		if j, has := y[path]; has {
+			distance += dgtypes.NumberDissimilar(i, j)
+		} else {
+			distance++
+		}
+	}
+	for path := range y {
+		if _, has := x[path]; !has {
+			distance++
+		}
+	}
+	return distance / float64(n)
+}
+
+// numbers collects the numbers in v by their paths.
+func numbers(v dgtypes.Value, path string, nums map[string]float64) {
+	switch x := v.(type) {
+	case *dgtypes.IntValue, *dgtypes.FloatValue:
+		nums[path] = reflect.ValueOf(x.Value()).Convert(reflect.TypeOf(float64(0))).Float()
+	case *dgtypes.ComplexValue:
+		numbers(x.Real, path+".real", nums)
+		numbers(x.Imag, path+".imag", nums)
+	case *dgtypes.StructValue:
+		for _, f := range x.Fields {
+			numbers(f.Val, path+"."+f.Name, nums)
+		}
+	case *dgtypes.ReferenceValue:
+		numbers(x.Elem, path+"*", nums)
+	case *dgtypes.ArrayValue:
+		for i, e := range x.Val {
+			numbers(e, fmt.Sprintf("%v[%d]", path, i), nums)
+		}
+	case *dgtypes.MapValue:
+		for i, k := range x.Keys {
+			if i < len(x.Vals) {
+				numbers(x.Vals[i], fmt.Sprintf("%v[%v]", path, k), nums)
+			}
+		}
+	}
+}
+
+// }}}
+
+// {{{ Jaccard distance
+
+// JaccardDissimilar is the Jaccard distance of the sets of the (non nil)
+// fields reachable in the values, by their paths and types.
+func JaccardDissimilar(a, b dgtypes.Value) float64 {
+	x, y := make(map[string]bool), make(map[string]bool)
+	fields(a, "", x)
+	fields(b, "", y)
+	union := len(x)
+	intersection := 0
+	for f := range y {
+		if x[f] {
+			intersection++
+		} else {
+			union++
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return 1 - float64(intersection)/float64(union)
+}
+
+// fields collects the paths (and types) of the values reachable from v.
+// The elements of an array, slice or map share a path.
+func fields(v dgtypes.Value, path string, set map[string]bool) {
+	if v == nil {
+		return
+	}
+	if r, ok := v.(dgtypes.Reference); ok && r.IsNil() {
+		return
+	}
+	set[path+" "+v.TypeName()] = true
+	switch x := v.(type) {
+	case *dgtypes.StructValue:
+		for _, f := range x.Fields {
+			fields(f.Val, path+"."+f.Name, set)
+		}
+	case *dgtypes.ReferenceValue:
+		fields(x.Elem, path+"*", set)
+	case *dgtypes.ArrayValue:
+		for _, e := range x.Val {
+			fields(e, path+"[]", set)
+		}
+	case *dgtypes.MapValue:
+		for _, k := range x.Keys {
+			fields(k, path+"{}", set)
+		}
+		for _, e := range x.Vals {
+			fields(e, path+"[]", set)
+		}
+	}
+}
+
+// }}}
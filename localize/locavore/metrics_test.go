@@ -0,0 +1,80 @@
+package locavore
+
+import (
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+type point struct {
+	X, Y int
+	Name string
+}
+
+type labeled struct {
+	Label string
+	Next  *labeled
+}
+
+// Each metric is 0 for identical values, 1 for disjoint values and
+// between 0 and 1 otherwise.
+func TestMetrics(t *testing.T) {
+	values := []dgtypes.Value{
+		dgtypes.NewVal(point{1, 2, "a"}),
+		dgtypes.NewVal(point{1, 3, "a"}),
+		dgtypes.NewVal(point{-7, 200, "b"}),
+		dgtypes.NewVal(&labeled{"x", &labeled{"y", nil}}),
+		dgtypes.NewVal(&labeled{"x", nil}),
+		dgtypes.NewVal([]int{1, 2, 3}),
+		dgtypes.NewVal([]int{1}),
+		dgtypes.NewVal(map[string]int{"a": 1, "b": 2}),
+		dgtypes.NewVal(7),
+		dgtypes.NewVal(1.5),
+		dgtypes.NewVal("string"),
+		nil,
+	}
+	disjoint := []struct {
+		a, b dgtypes.Value
+	}{
+		{dgtypes.NewVal(point{1, 2, "a"}), dgtypes.NewVal(labeled{"x", nil})},
+		{dgtypes.NewVal(7), dgtypes.NewVal("string")},
+		{dgtypes.NewVal([]int{1}), dgtypes.NewVal([]string{"a"})},
+	}
+	for name, metric := range Metrics {
+		for i, a := range values {
+			if d := metric(a, a); d != 0 {
+				t.Errorf("%v expected %v to be 0 from itself got %v", name, a, d)
+			}
+			for j, b := range values {
+				d := metric(a, b)
+				if d < 0 || d > 1 || d != d {
+					t.Errorf("%v expected %v from %v (%d, %d) in [0, 1] got %v", name, a, b, i, j, d)
+				}
+			}
+		}
+		for _, c := range disjoint {
+			if d := metric(c.a, c.b); d != 1 {
+				t.Errorf("%v expected %v to be 1 from %v got %v", name, c.a, c.b, d)
+			}
+		}
+	}
+}
+
+// The metrics order the dissimilarity of similar values.
+func TestMetricsOrder(t *testing.T) {
+	cases := []struct {
+		metric       string
+		a, near, far dgtypes.Value
+	}{
+		{"edit", dgtypes.NewVal([]int{1, 2, 3}), dgtypes.NewVal([]int{1, 2, 4}), dgtypes.NewVal([]int{1})},
+		{"numeric", dgtypes.NewVal(point{1, 2, "a"}), dgtypes.NewVal(point{1, 3, "a"}), dgtypes.NewVal(point{-7, 200, "a"})},
+		{"jaccard", dgtypes.NewVal(&labeled{"x", &labeled{"y", nil}}), dgtypes.NewVal(&labeled{"z", &labeled{"w", nil}}), dgtypes.NewVal(&labeled{"x", nil})},
+	}
+	for _, c := range cases {
+		metric := Metrics[c.metric]
+		near, far := metric(c.a, c.near), metric(c.a, c.far)
+		if !(near < far) {
+			t.Errorf("%v expected %v nearer %v (%v) than %v (%v)", c.metric, c.near, c.a, near, c.far, far)
+		}
+	}
+}
@@ -1,45 +1,137 @@
 package locavore
 
 import (
-	"bufio"
-	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
 	"io"
-	"io/ioutil"
-	"log"
+	"sort"
 	"strings"
+
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/mine"
 )
 
+// batchSize bounds the size (encoded) of the profiles LocalizeFiles holds
+// in memory at once.
+const batchSize = 64 << 20
+
 // ParseProfiles takes two Readers, and parses and unserializes the profiles
 // that come from each of them.
-func ParseProfiles(ok io.Reader, fail io.Reader) ([]dgtypes.Type, []dgtypes.FuncProfile, []dgtypes.FuncProfile) {
-	typesok, parsedOk := parseProfile(ok)
-	typesfail, parsedFail := parseProfile(fail)
+func ParseProfiles(ok io.Reader, fail io.Reader) ([]dgtypes.Type, []dgtypes.FuncProfile, []dgtypes.FuncProfile, error) {
+	typesok, parsedOk, err := readProfiles(ok, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	typesfail, parsedFail, err := readProfiles(fail, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return append(typesok, typesfail...), parsedOk, parsedFail, nil
+}
 
-	types := append(dgtypes.UnserializeType(typesok).Types, dgtypes.UnserializeType(typesfail).Types...)
-	return types, unserializeFuncs(parsedOk), unserializeFuncs(parsedFail)
+// readProfiles reads the profiles of the functions wanted (or of every
+// function if wanted is nil). The others are skipped without decoding
+// them.
+func readProfiles(r io.Reader, wanted map[string]bool) ([]dgtypes.Type, []dgtypes.FuncProfile, error) {
+	var profs []dgtypes.FuncProfile
+	reader := dgtypes.NewObjectProfileReader(r)
+	for {
+		name, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if wanted != nil && !wanted[name] {
+			continue
+		}
+		prof, err := reader.Func()
+		if err != nil {
+			return nil, nil, err
+		}
+		profs = append(profs, prof)
+	}
+	return reader.Types(), profs, nil
 }
 
-// parseProfile returns a tuple containing the types defined
-// on line 1 of the file, and a list of each funcProfile string
-func parseProfile(r io.Reader) (string, []string) {
-	p := bufio.NewReader(r)
-	types, err := p.ReadString('\n')
+// LocalizeFiles is Localize for the profiles in the files (or
+// directories) at okPath and failPath. Rather than loading every profile
+// it reads the files once to find the functions profiled in both and
+// again for each batch of functions (see batchSize), so only the profiles
+// of the batch are held in memory.
+func LocalizeFiles(okPath, failPath string, o *Options) (mine.ScoredLocations, error) {
+	okSizes, err := functionSizes(okPath)
 	if err != nil {
-		log.Panic("Locavore: Error reading file")
+		return nil, err
 	}
-	content, err := ioutil.ReadAll(p)
+	failSizes, err := functionSizes(failPath)
 	if err != nil {
-		log.Panic("Locavore: Error reading file")
+		return nil, err
+	}
+	names := make([]string, 0, len(okSizes))
+	for name := range okSizes {
+		if _, has := failSizes[name]; has {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	suspiciousness := make(map[string]float64)
+	for len(names) > 0 {
+		batch := make(map[string]bool)
+		size := 0
+		for len(names) > 0 && (len(batch) == 0 || size+okSizes[names[0]]+failSizes[names[0]] <= batchSize) {
+			batch[names[0]] = true
+			size += okSizes[names[0]] + failSizes[names[0]]
+			names = names[1:]
+		}
+		okf, err := readFile(okPath, batch)
+		if err != nil {
+			return nil, err
+		}
+		failf, err := readFile(failPath, batch)
+		if err != nil {
+			return nil, err
+		}
+		localize(okf, failf, o, suspiciousness)
+	}
+	printSuspiciousness(suspiciousness)
+	return Rank(suspiciousness), nil
+}
+
+// functionSizes is the size of the profiles of each function in the file
+// (or directory).
+func functionSizes(path string) (map[string]int, error) {
+	input, closer, err := profilesInput(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closer()
+	sizes := make(map[string]int)
+	reader := dgtypes.NewObjectProfileReader(input)
+	for {
+		name, err := reader.Next()
+		if err == io.EOF {
+			return sizes, nil
+		} else if err != nil {
+			return nil, err
+		}
+		sizes[name] += reader.Size()
 	}
-	return types, strings.Split(strings.TrimSpace(string(content)), "\n")
 }
 
-// Unserializes each funcprofile
-func unserializeFuncs(profiles []string) (profs []dgtypes.FuncProfile) {
-	for _, s := range profiles {
-		object := dgtypes.UnserializeFunc(s)
-		profs = append(profs, object)
+func readFile(path string, wanted map[string]bool) ([]dgtypes.FuncProfile, error) {
+	input, closer, err := profilesInput(path)
+	if err != nil {
+		return nil, err
 	}
-	//log.Printf("%d profs: \n\t %v", len(profs), profs)
-	return profs
+	defer closer()
+	_, profs, err := readProfiles(input, wanted)
+	return profs, err
+}
+
+// profilesInput reads the object profiles in the file or the .bin (or
+// .bin.gz) files of the directory at path.
+func profilesInput(path string) (io.Reader, func(), error) {
+	return cmd.InputFiltered(path, func(name string) bool {
+		return strings.HasSuffix(strings.TrimSuffix(name, ".gz"), ".bin")
+	})
 }
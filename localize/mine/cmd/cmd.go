@@ -14,6 +14,7 @@ import (
 	"github.com/timtadh/data-structures/errors"
 	"github.com/timtadh/dynagrok/cmd"
 	"github.com/timtadh/dynagrok/localize/lattice"
+	"github.com/timtadh/dynagrok/localize/lattice/digraph"
 	"github.com/timtadh/dynagrok/localize/mine"
 	"github.com/timtadh/dynagrok/localize/mine/algoparsers"
 	evalcmd "github.com/timtadh/dynagrok/localize/mine/eval"
@@ -185,6 +186,10 @@ func NewOptionParser(c *cmd.Config, o *opts.Options) cmd.Runnable {
 --min-edges=<int>                 Minimum number of edges in a mined pattern
 --min-fails=<int>                 Minimum number of failures associated with
                                   each behavior.
+--drop-spawn-edges                Leave the goroutine spawn edges (go
+                                  statement -> goroutine) out of the profiles
+--drop-comm-edges                 Leave the channel communicates-with edges
+                                  (send -> receive) out of the profiles
 `,
 		"s:b:a:f:p:",
 		[]string{
@@ -198,6 +203,8 @@ func NewOptionParser(c *cmd.Config, o *opts.Options) cmd.Runnable {
 			"max-edges=",
 			"min-edges=",
 			"min-fails=",
+			"drop-spawn-edges",
+			"drop-comm-edges",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			ba, err := test.ParseArgs("<$stdin")
@@ -206,6 +213,7 @@ func NewOptionParser(c *cmd.Config, o *opts.Options) cmd.Runnable {
 			}
 			o.BinArgs = ba
 			profileFormat := "dot"
+			var loadOpts []digraph.LoadOption
 			var passingPaths []string
 			var failingPaths []string
 			for _, oa := range optargs {
@@ -273,6 +281,10 @@ func NewOptionParser(c *cmd.Config, o *opts.Options) cmd.Runnable {
 						return nil, cmd.Errorf(1, "Could not parse arg to `%v` expected an int (got %v). err: %v", oa.Opt(), oa.Arg(), err)
 					}
 					o.Opts = append(o.Opts, mine.MinFails(m))
+				case "--drop-spawn-edges":
+					loadOpts = append(loadOpts, digraph.DropSpawns())
+				case "--drop-comm-edges":
+					loadOpts = append(loadOpts, digraph.DropComms())
 				}
 			}
 			if len(failingPaths) < 1 {
@@ -296,19 +308,19 @@ func NewOptionParser(c *cmd.Config, o *opts.Options) cmd.Runnable {
 				}
 				o.Failing = failing
 				o.Passing = passing
-				o.Lattice, err = lattice.LoadFrom(failingProfiles, passingProfiles)
+				o.Lattice, err = lattice.LoadFrom(failingProfiles, passingProfiles, loadOpts...)
 				if err != nil {
 					return nil, cmd.Err(3, err)
 				}
 			} else {
 				switch profileFormat {
 				case "dot":
-					o.Lattice, err = lattice.LoadDot(failingPaths, passingPaths)
+					o.Lattice, err = lattice.LoadDot(failingPaths, passingPaths, loadOpts...)
 					if err != nil {
 						return nil, cmd.Err(3, err)
 					}
 				case "simple":
-					o.Lattice, err = lattice.Load(failingPaths, passingPaths)
+					o.Lattice, err = lattice.Load(failingPaths, passingPaths, loadOpts...)
 					if err != nil {
 						return nil, cmd.Err(3, err)
 					}
@@ -26,6 +26,8 @@ import (
 	"github.com/timtadh/dynagrok/cmd"
 	"github.com/timtadh/dynagrok/localize/eval"
 	"github.com/timtadh/dynagrok/localize/fault"
+	"github.com/timtadh/dynagrok/localize/lattice"
+	"github.com/timtadh/dynagrok/localize/locavore"
 	"github.com/timtadh/dynagrok/localize/mine"
 	"github.com/timtadh/dynagrok/localize/mine/opts"
 	"github.com/timtadh/getopt"
@@ -52,8 +54,23 @@ Option Flags
     --max-states-for-exact-htrank=<int>  Maximum number of states in the chain to use exact rank
                                          only applies when --htrank-method=auto
     --parallelism=<int>                  Number of cores to use for HTrank computation
+    --locavore-fails=<path>              Object profiles of the failing runs. With
+                                         --locavore-oks also evaluate the functions
+                                         ranked by locavore.
+    --locavore-oks=<path>                Object profiles of the successful runs
+    --locavore-ranked=<path>             Functions ranked by locavore (the JSON it
+                                         writes) to evaluate instead of the profiles
+    -b,--locavore-bins=<int>             Number of bins locavore clusters the inputs
+                                         and outputs of a function into (default 10)
+    -m,--locavore-metric=<metric>        How locavore measures the dissimilarity of
+                                         the inputs (and outputs) of two calls
+                                         (default dissimilar, see locavore --metrics)
+    -c,--locavore-clustering=<name>      How locavore clusters the inputs and outputs
+                                         (default kmedoids, see locavore --clusterings)
+    -e,--locavore-epsilon=<float>        Largest dissimilarity of neighbors for the
+                                         dbscan clustering of locavore (default .1)
 `,
-			"o:f:t:d:",
+			"o:f:t:d:b:m:c:e:",
 			[]string{
 				"output=",
 				"faults=",
@@ -62,11 +79,22 @@ Option Flags
 				"htrank-method=",
 				"max-states-for-exact-htrank=",
 				"parallelism=",
+				"locavore-fails=",
+				"locavore-oks=",
+				"locavore-ranked=",
+				"locavore-bins=",
+				"locavore-metric=",
+				"locavore-clustering=",
+				"locavore-epsilon=",
 			},
 			func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 				outputPath := ""
 				faultsPath := ""
 				dataSource := "dynagrok"
+				locavoreFails := ""
+				locavoreOks := ""
+				locavoreRanked := ""
+				locavoreOpts := locavore.DefaultOptions()
 				timeout := 120 * time.Second
 				evalOpts := make([]eval.EvaluatorOption, 0, 10)
 				for _, oa := range optargs {
@@ -110,8 +138,49 @@ Option Flags
 							return nil, cmd.Errorf(1, "Flag %v expected an int but got %q. err: %v", oa.Opt(), oa.Arg(), err)
 						}
 						evalOpts = append(evalOpts, eval.Parallelism(p))
+					case "--locavore-fails":
+						locavoreFails = oa.Arg()
+					case "--locavore-oks":
+						locavoreOks = oa.Arg()
+					case "--locavore-ranked":
+						locavoreRanked = oa.Arg()
+					case "-b", "--locavore-bins":
+						bins, err := strconv.Atoi(oa.Arg())
+						if err != nil || bins <= 0 {
+							return nil, cmd.Errorf(1, "Flag %v expected a positive int but got %q.", oa.Opt(), oa.Arg())
+						}
+						locavoreOpts.Bins = bins
+					case "-m", "--locavore-metric":
+						m, has := locavore.Metrics[oa.Arg()]
+						if !has {
+							return nil, cmd.Errorf(1, "Metric '%v' is not supported. (use locavore --metrics to get a list)", oa.Arg())
+						}
+						locavoreOpts.Metric = m
+						locavoreOpts.MetricName = oa.Arg()
+					case "-c", "--locavore-clustering":
+						c, has := locavore.Clusterings[oa.Arg()]
+						if !has {
+							return nil, cmd.Errorf(1, "Clustering '%v' is not supported. (use locavore --clusterings to get a list)", oa.Arg())
+						}
+						locavoreOpts.Clustering = c
+						locavoreOpts.ClusteringName = oa.Arg()
+					case "-e", "--locavore-epsilon":
+						epsilon, err := strconv.ParseFloat(oa.Arg(), 64)
+						if err != nil || epsilon < 0 {
+							return nil, cmd.Errorf(1, "Flag %v expected a non-negative float but got %q.", oa.Opt(), oa.Arg())
+						}
+						locavoreOpts.Epsilon = epsilon
 					}
 				}
+				if (locavoreFails == "") != (locavoreOks == "") {
+					return nil, cmd.Errorf(1, "The --locavore-fails and --locavore-oks flags must be given together")
+				}
+				if locavoreFails != "" && locavoreRanked != "" {
+					return nil, cmd.Errorf(1, "The --locavore-ranked flag cannot be given with the --locavore-fails and --locavore-oks flags")
+				}
+				if dataSource == "defect4j" && (locavoreFails != "" || locavoreRanked != "") {
+					return nil, cmd.Errorf(1, "The defect4j faults cannot be identified by function to evaluate locavore")
+				}
 				if faultsPath == "" {
 					return nil, cmd.Errorf(1, "You must supply the `-f` flag and give a path to the faults")
 				}
@@ -164,15 +233,15 @@ Option Flags
 					e := time.Now()
 					return nodes, e.Sub(s)
 				}
+				newEvaluator := func(lattice *lattice.Lattice) *eval.Evaluator {
+					if dataSource == "defect4j" {
+						return eval.NewEvaluator(lattice, eval.NewDefect4J_FaultIdentifier(lattice, faults), evalOpts...)
+					}
+					return eval.NewEvaluator(lattice, eval.NewDynagrokFaultIdentifier(lattice, faults), evalOpts...)
+				}
 				evaluate := func(m *mine.Miner, options *opts.Options, nodes []*mine.SearchNode, sflType, method, score, chain string) eval.EvalResults {
 					errors.Logf("INFO", "evaluating %v %v %v %v", sflType, method, score, chain)
-					lattice := options.Lattice
-					var evaluator *eval.Evaluator
-					if dataSource == "dynagrok" {
-						evaluator = eval.NewEvaluator(lattice, eval.NewDynagrokFaultIdentifier(lattice, faults), evalOpts...)
-					} else if dataSource == "defect4j" {
-						evaluator = eval.NewEvaluator(lattice, eval.NewDefect4J_FaultIdentifier(lattice, faults), evalOpts...)
-					}
+					evaluator := newEvaluator(options.Lattice)
 					var states map[int][]int
 					var P [][]float64
 					jumpPr := .5
@@ -300,6 +369,25 @@ Option Flags
 						}
 					}
 				}
+				if locavoreFails != "" || locavoreRanked != "" {
+					fmt.Println("Locavore")
+					var groups []mine.ScoredLocations
+					var err error
+					if locavoreRanked != "" {
+						groups, err = eval.LocavoreRanked(locavoreRanked)
+					} else {
+						groups, err = eval.Locavore(locavoreOks, locavoreFails, locavoreOpts)
+					}
+					if err != nil {
+						return nil, cmd.Err(1, err)
+					}
+					evaluator := newEvaluator(o.Lattice)
+					locavoreResults, err := evaluator.FunctionRankListEval("locavore", "causal-effect", groups)
+					if err != nil {
+						return nil, cmd.Err(1, err)
+					}
+					results = nonNilAppend(results, extractResult(locavoreResults))
+				}
 				fmt.Fprintln(ouf, results.String())
 				return args, nil
 			}),
@@ -0,0 +1,95 @@
+package predicates
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/mine"
+)
+
+// A ScoredPredicate is a predicate with the number of failing and
+// succeeding runs it held in and its suspiciousness score.
+type ScoredPredicate struct {
+	dgtypes.Predicate
+	Fails int
+	Oks   int
+	Score float64
+}
+
+type ScoredPredicates []*ScoredPredicate
+
+// Rank scores every predicate which held in at least one of the failing
+// runs. A predicate is counted once per run no matter how often it held
+// in the run.
+func Rank(fails, oks []*dgtypes.Profile, score mine.ScoreFunc) ScoredPredicates {
+	failCounts := runCounts(fails)
+	okCounts := runCounts(oks)
+	F := float64(len(fails))
+	O := float64(len(oks))
+	T := F + O
+	result := make(ScoredPredicates, 0, len(failCounts))
+	for pred, f := range failCounts {
+		o := okCounts[pred]
+		result = append(result, &ScoredPredicate{
+			Predicate: pred,
+			Fails:     f,
+			Oks:       o,
+			Score:     score(F/T, float64(f)/T, O/T, float64(o)/T),
+		})
+	}
+	result.Sort()
+	return result
+}
+
+// runCounts counts the runs each predicate held in.
+func runCounts(runs []*dgtypes.Profile) map[dgtypes.Predicate]int {
+	counts := make(map[dgtypes.Predicate]int)
+	for _, p := range runs {
+		for pred, count := range p.Predicates {
+			if count > 0 {
+				counts[pred]++
+			}
+		}
+	}
+	return counts
+}
+
+// Sort orders the predicates by descending score. Ties are ordered by
+// site, kind and value so the ranking is the same from run to run.
+func (r ScoredPredicates) Sort() {
+	sort.Slice(r, func(i, j int) bool {
+		a, b := r[i], r[j]
+		if a.Score != b.Score {
+			return a.Score > b.Score
+		}
+		if a.Site != b.Site {
+			return a.Site < b.Site
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Value < b.Value
+	})
+}
+
+func (p *ScoredPredicate) String() string {
+	return fmt.Sprintf(`scored predicate {
+    kind: %q,
+    position: %q,
+    expr: %q,
+    value: %q,
+    fails: %v,
+    oks: %v,
+    score: %v
+}`, p.Kind, p.Site, p.Expr, p.Value, p.Fails, p.Oks, p.Score)
+}
+
+func (r ScoredPredicates) String() string {
+	parts := make([]string, 0, len(r))
+	for _, p := range r {
+		parts = append(parts, p.String())
+	}
+	return strings.Join(parts, "\n")
+}
@@ -0,0 +1,58 @@
+package predicates
+
+import (
+	"math"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/localize/mine"
+)
+
+func run(counts map[dgtypes.Predicate]int) *dgtypes.Profile {
+	p := dgtypes.NewProfile()
+	for pred, count := range counts {
+		p.Predicates[pred] = count
+	}
+	return p
+}
+
+// The predicates which held in a failing run are ranked by the runs they
+// held in, no matter how often they held in each.
+func TestRank(t *testing.T) {
+	pred := func(site, value string) dgtypes.Predicate {
+		return dgtypes.Predicate{Kind: dgtypes.BranchPredicate, Site: site, Expr: "x < 0", Value: value}
+	}
+	always := pred("b.go:3:5", "true")
+	tied := pred("a.go:7:5", "true")
+	sometimes := pred("b.go:3:5", "false")
+	passing := pred("c.go:1:5", "true")
+	never := pred("c.go:1:5", "false")
+	fails := []*dgtypes.Profile{
+		run(map[dgtypes.Predicate]int{always: 5, tied: 1, sometimes: 2, never: 0}),
+		run(map[dgtypes.Predicate]int{always: 1, tied: 1}),
+	}
+	oks := []*dgtypes.Profile{
+		run(map[dgtypes.Predicate]int{sometimes: 1, passing: 3}),
+		run(map[dgtypes.Predicate]int{sometimes: 4, passing: 1, never: 2}),
+	}
+	ranked := Rank(fails, oks, mine.Scores["Precision"])
+	expected := []struct {
+		pred  dgtypes.Predicate
+		fails int
+		oks   int
+		score float64
+	}{
+		{tied, 2, 0, 1},
+		{always, 2, 0, 1},
+		{sometimes, 1, 2, 1.0 / 3},
+	}
+	if len(ranked) != len(expected) {
+		t.Fatalf("expected %d predicates got:\n%v", len(expected), ranked)
+	}
+	for i, e := range expected {
+		r := ranked[i]
+		if r.Predicate != e.pred || r.Fails != e.fails || r.Oks != e.oks || math.Abs(r.Score-e.score) > 1e-9 {
+			t.Errorf("expected %v (fails %d, oks %d, score %v) at %d got:\n%v", e.pred, e.fails, e.oks, e.score, i, r)
+		}
+	}
+}
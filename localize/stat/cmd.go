@@ -14,6 +14,8 @@ import (
 	"github.com/timtadh/dynagrok/cmd"
 	"github.com/timtadh/dynagrok/localize/lattice"
 	"github.com/timtadh/dynagrok/localize/mine"
+	"github.com/timtadh/dynagrok/localize/predicates"
+	"github.com/timtadh/dynagrok/profile"
 )
 
 type Options struct {
@@ -22,6 +24,7 @@ type Options struct {
 	Score      mine.ScoreFunc
 	ScoreName  string
 	OutputPath string
+	Predicates bool
 }
 
 func NewCommand(c *cmd.Config) cmd.Runnable {
@@ -52,20 +55,26 @@ Option Flags
     -h,--help                         Show this message
     -o,--output=<path>                Output file to create
                                       (defaults to standard output)
-    -s,--score=<score>              Statistical method to use
-    --scores                         List localization methods available
+    -s,--score=<score>                Statistical method to use
+    --scores                          List localization methods available
+    -p,--predicates                   Score the predicates recorded by
+                                      instrument --predicates or objectstate
+                                      --predicates rather than the blocks
 `,
-		"o:w:m:",
+		"o:s:p",
 		[]string{
 			"output=",
-			"method=",
-			"methods",
+			"score=",
+			"scores",
+			"predicates",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			for _, oa := range optargs {
 				switch oa.Opt() {
 				case "-o", "--output":
 					o.OutputPath = oa.Arg()
+				case "-p", "--predicates":
+					o.Predicates = true
 				case "--scores":
 					fmt.Println("\nNames of Suspicousness Scores (and Abbrevations):")
 					for name, abbrvs := range mine.ScoreNames {
@@ -82,7 +91,7 @@ Option Flags
 						o.Score = m
 						o.ScoreName = name
 					} else {
-						return nil, cmd.Errorf(1, "Localization method '%v' is not supported. (use --methods to get a list)", oa.Arg())
+						return nil, cmd.Errorf(1, "Localization method '%v' is not supported. (use --scores to get a list)", oa.Arg())
 					}
 				}
 			}
@@ -110,6 +119,18 @@ func NewRunner(c *cmd.Config, o *Options) cmd.Runnable {
 				}
 				defer ouf.Close()
 			}
+			if o.Predicates {
+				fails, err := profile.LoadAll([]string{o.FailsPath})
+				if err != nil {
+					return nil, cmd.Err(2, err)
+				}
+				oks, err := profile.LoadAll([]string{o.OksPath})
+				if err != nil {
+					return nil, cmd.Err(2, err)
+				}
+				fmt.Fprintln(ouf, predicates.Rank(fails, oks, o.Score))
+				return args, nil
+			}
 			l, err := lattice.Load([]string{o.FailsPath}, []string{o.OksPath})
 			if err != nil {
 				return nil, cmd.Err(2, err)
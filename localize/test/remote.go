@@ -23,10 +23,11 @@ import (
 )
 
 type Remote struct {
-	Config  *cmd.Config
-	Path    string
-	Timeout time.Duration
-	MaxMem  int // Maximum Resident Memory in Bytes
+	Config     *cmd.Config
+	Path       string
+	Timeout    time.Duration
+	MaxMem     int           // Maximum Resident Memory in Bytes
+	Checkpoint time.Duration // How often the profile is checkpointed (0 for Timeout/4)
 }
 
 type RemoteOption func(r *Remote)
@@ -43,6 +44,15 @@ func MaxMegabytes(megabytes int) RemoteOption {
 	}
 }
 
+// Checkpoint sets how often the instrumented program checkpoints its
+// profile (see dgruntime's DGCHECKPOINT) so a killed run still has one. A
+// negative duration turns checkpointing off.
+func Checkpoint(every time.Duration) RemoteOption {
+	return func(r *Remote) {
+		r.Checkpoint = every
+	}
+}
+
 func Config(c *cmd.Config) RemoteOption {
 	return func(r *Remote) {
 		r.Config = c
@@ -89,6 +99,13 @@ func (r *Remote) Env(dgprof string) []string {
 		fmt.Sprintf("HOME=%v", os.Getenv("HOME")),
 		fmt.Sprintf("DGPROF=%v", dgprof),
 	}
+	checkpoint := r.Checkpoint
+	if checkpoint == 0 {
+		checkpoint = r.Timeout / 4
+	}
+	if checkpoint > 0 {
+		env = append(env, fmt.Sprintf("DGCHECKPOINT=%v", checkpoint))
+	}
 	if r.Config != nil {
 		env = append(env, fmt.Sprintf("GOROOT=%v", r.Config.GOROOT))
 		env = append(env, fmt.Sprintf("GOPATH=%v", r.Config.GOPATH))
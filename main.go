@@ -11,11 +11,14 @@ import (
 
 import (
 	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/coverage"
+	"github.com/timtadh/dynagrok/dgruntime/excludes"
 	"github.com/timtadh/dynagrok/grok"
 	"github.com/timtadh/dynagrok/instrument"
 	"github.com/timtadh/dynagrok/localize"
 	"github.com/timtadh/dynagrok/mutate"
 	"github.com/timtadh/dynagrok/objectstate"
+	"github.com/timtadh/dynagrok/profile"
 )
 
 func main() {
@@ -28,6 +31,8 @@ func main() {
 	mut := mutate.NewCommand(&config)
 	loc := localize.NewCommand(&config)
 	obj := objectstate.NewCommand(&config)
+	prof := profile.NewCommand(&config)
+	cov := coverage.NewCommand(&config)
 	cmd.Main(cmd.Concat(
 		main,
 		cmd.Commands(map[string]cmd.Runnable{
@@ -36,6 +41,8 @@ func main() {
 			mut.Name():  mut,
 			loc.Name():  loc,
 			obj.Name():  obj,
+			prof.Name(): prof,
+			cov.Name():  cov,
 		}),
 	), &cleanup)
 }
@@ -50,6 +57,22 @@ Option Flags
     -r,--go-root=<path>               go root
     -g,--go-path=<path>               go path
     -d,--dynagrok-path=<path>         dynagrok path
+    --modules                         Load and build <pkg> as part of a module
+                                      (detected automatically from go.mod)
+    --stock-runtime                   Build with the unmodified go tool instead of
+                                      a go root with dynagrok's patched runtime
+    --include=<pattern>               Instrument packages matching <pattern> even
+                                      if they are excluded by default (eg. net/http)
+    --exclude=<pattern>               Do not instrument packages matching <pattern>
+                                      (eg. github.com/*/vendor/...)
+    --packages=<path>                 Read include/exclude patterns from <path>
+
+Package Patterns
+    A * matches within one element of an import path, ... matches anything
+    and a trailing /... also matches the parent (net/... matches net). The
+    dgruntime and the packages it depends on (fmt, sync, os, ...) are never
+    instrumented. Each line of a --packages file is a # comment or
+    "include <pattern>" or "exclude <pattern>".
 `,
 		"p:r:g:d:",
 		[]string{
@@ -57,12 +80,19 @@ Option Flags
 			"go-root=",
 			"go-path=",
 			"dynagrok-path=",
+			"modules",
+			"stock-runtime",
+			"include=",
+			"exclude=",
+			"packages=",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
 			GOROOT := os.Getenv("GOROOT")
 			GOPATH := os.Getenv("GOPATH")
 			DGPATH := os.Getenv("DGPATH")
 			cpuProfile := ""
+			modules := false
+			stockRuntime := false
 			for _, oa := range optargs {
 				switch oa.Opt() {
 				case "-p", "--cpu-profile":
@@ -73,6 +103,22 @@ Option Flags
 					DGPATH = oa.Arg()
 				case "-r", "--go-root":
 					GOROOT = oa.Arg()
+				case "--modules":
+					modules = true
+				case "--stock-runtime":
+					stockRuntime = true
+				case "--include":
+					if err := excludes.Include(oa.Arg()); err != nil {
+						return nil, cmd.Usage(r, 1, err.Error())
+					}
+				case "--exclude":
+					if err := excludes.Exclude(oa.Arg()); err != nil {
+						return nil, cmd.Usage(r, 1, err.Error())
+					}
+				case "--packages":
+					if err := excludes.LoadConfig(oa.Arg()); err != nil {
+						return nil, cmd.Usage(r, 1, err.Error())
+					}
 				}
 			}
 			if cpuProfile != "" {
@@ -90,9 +136,11 @@ Option Flags
 				*cleanup = clean
 			}
 			*c = cmd.Config{
-				GOROOT: GOROOT,
-				GOPATH: GOPATH,
-				DGPATH: DGPATH,
+				GOROOT:       GOROOT,
+				GOPATH:       GOPATH,
+				DGPATH:       DGPATH,
+				Modules:      modules,
+				StockRuntime: stockRuntime,
 			}
 			return args, nil
 		})
@@ -112,12 +112,15 @@ Option Flags
 			if len(args) != 1 {
 				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
 			}
-			pkgName := args[0]
+			pkgName, pkgDir, err := cmd.ResolvePkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
 			if output == "" {
 				output = fmt.Sprintf("%v.instr", filepath.Base(pkgName))
 			}
 			fmt.Println("mutating", pkgName)
-			program, err := cmd.LoadPkg(c, pkgName)
+			program, err := cmd.LoadPkg(c, pkgDir, pkgName)
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
@@ -126,7 +129,7 @@ Option Flags
 				return nil, cmd.Errorf(7, err.Error())
 			}
 			if addInstrumentation {
-				err = instrument.Instrument(pkgName, program)
+				err = instrument.Instrument(pkgName, program, nil)
 				if err != nil {
 					return nil, cmd.Errorf(8, err.Error())
 				}
@@ -24,13 +24,19 @@ Option Flags
     -o,--output=<path>                Output file to create (defaults to pkg-name.instr)
     -w,--work=<path>                  Work directory to use (defaults to tempdir)
 	-m,--method=<method-name>         Name of a specific method to profile
+    -p,--predicates                   Record the sign (or nil-ness) of the
+                                      numbers, errors and pointers returned
+                                      by calls and assigned to variables and
+                                      how the numbers compare to the other
+                                      locals of their type
     --keep-work                       Keep the work directory
 `,
-		"o:w:m:",
+		"o:w:m:p",
 		[]string{
 			"output=",
 			"work=",
 			"method=",
+			"predicates",
 			"keep-work",
 		},
 		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
@@ -39,6 +45,7 @@ Option Flags
 			keepWork := false
 			work := ""
 			method := ""
+			predicates := false
 			for _, oa := range optargs {
 				switch oa.Opt() {
 				case "-o", "--output":
@@ -47,6 +54,8 @@ Option Flags
 					work = oa.Arg()
 				case "-m", "--method":
 					method = oa.Arg()
+				case "-p", "--predicates":
+					predicates = true
 				case "-k", "--keep-work":
 					keepWork = true
 				}
@@ -54,21 +63,24 @@ Option Flags
 			if len(args) != 1 {
 				return nil, cmd.Usage(r, 5, "Expected one package name got %v", args)
 			}
-			pkgName := args[0]
+			pkgName, pkgDir, err := cmd.ResolvePkg(c, args[0])
+			if err != nil {
+				return nil, cmd.Usage(r, 6, err.Error())
+			}
 			if output == "" {
 				output = fmt.Sprintf("%v.instr", filepath.Base(pkgName))
 			}
-			program, err := cmd.LoadPkg(c, pkgName)
+			program, err := cmd.LoadPkg(c, pkgDir, pkgName)
 			if err != nil {
 				return nil, cmd.Usage(r, 6, err.Error())
 			}
 			fmt.Println("instrumenting for object-state", pkgName)
-			err = Instrument(pkgName, method, program)
+			err = Instrument(pkgName, method, predicates, program)
 			if err != nil {
 				return nil, cmd.Errorf(7, err.Error())
 			}
 			fmt.Println("instrumenting", pkgName)
-			err = instrument.Instrument(pkgName, program)
+			err = instrument.Instrument(pkgName, program, nil)
 			if err != nil {
 				return nil, cmd.Errorf(8, err.Error())
 			}
@@ -28,9 +28,13 @@ type instrumenter struct {
 	// TODO check if currentFile is what we want - iirc this is used to find
 	// import statements
 	currentFile *ast.File
+	currentPkg  *loader.PackageInfo
+	// record the predicates of returned and assigned values (see
+	// predicates.go)
+	recordPredicates bool
 }
 
-func Instrument(entryPkgName string, methodName string, program *loader.Program) (err error) {
+func Instrument(entryPkgName string, methodName string, predicates bool, program *loader.Program) (err error) {
 	entry := program.Package(entryPkgName)
 	if entry == nil {
 		return errors.Errorf("The entry package was not found in the loaded program")
@@ -39,9 +43,10 @@ func Instrument(entryPkgName string, methodName string, program *loader.Program)
 		return errors.Errorf("The entry package was not main")
 	}
 	i := &instrumenter{
-		program: program,
-		entry:   entryPkgName,
-		method:  methodName,
+		program:          program,
+		entry:            entryPkgName,
+		method:           methodName,
+		recordPredicates: predicates,
 	}
 	return i.instrument()
 }
@@ -54,6 +59,7 @@ func (i *instrumenter) instrument() (err error) {
 		if excludes.ExcludedPkg(pkg.Pkg.Path()) {
 			continue
 		}
+		i.currentPkg = pkg
 		for _, fileAst := range pkg.Files {
 			i.currentFile = fileAst
 			hadFunc := false
@@ -112,7 +118,6 @@ func (i *instrumenter) instrument() (err error) {
 
 func (i *instrumenter) function(fnName string, fnAst ast.Node, recv *[]*ast.Field, params *[]*ast.Field, results *[]*ast.Field, body *[]ast.Stmt) error {
 	inputs := []string{}
-	outputs := []string{}
 	for _, r := range *recv {
 		for _, name := range r.Names {
 			inputs = append(inputs, name.Name)
@@ -124,22 +129,9 @@ func (i *instrumenter) function(fnName string, fnAst ast.Node, recv *[]*ast.Fiel
 		}
 	}
 
-	// TODO You idiot, returns don't have to come at the end
-	// if the function has a return statement
-	if ret, ok := (*body)[len(*body)-1].(*ast.ReturnStmt); ok {
-		stmt, vars, varnames := i.mkAssignment(ret.Pos(), ret.Results)
-		*body = instrument.Insert(nil, nil, *body, len(*body)-1, stmt)
-		ret.Results = vars
-		outputs = append(outputs, varnames...)
-		*body = instrument.Insert(nil, nil, *body, len(*body)-1, i.mkMethodOutput(fnAst.Pos(), fnName, outputs))
-	} else {
-		// Otherwise check for named outputs
-		for _, output := range *results {
-			for _, name := range output.Names {
-				outputs = append(outputs, name.Name)
-				*body = instrument.Insert(nil, nil, *body, 1, i.mkDeferMethodOutput(fnAst.Pos(), fnName, outputs))
-			}
-		}
+	i.outputs(fnName, fnAst, *results, body)
+	if i.recordPredicates {
+		i.predicates(fnName, fnAst, body)
 	}
 
 	if len(inputs) != 0 {
@@ -149,87 +141,154 @@ func (i *instrumenter) function(fnName string, fnAst ast.Node, recv *[]*ast.Fiel
 	return nil
 }
 
-func (i instrumenter) mkMethodInput(pos token.Pos, name string, inputs []string) ast.Stmt {
-	p := i.program.Fset.Position(pos)
-	s := fmt.Sprintf("dgruntime.MethodInput(%s, %s", strconv.Quote(name), strconv.Quote(p.String()))
-	for _, input := range inputs {
-		s = fmt.Sprintf("%v, struct {Name string \nVal interface{}\n}{Name: \"%v\", Val: %v}", s, input, input)
+// outputs records the outputs of the function at each of its return
+// statements (found through its CFG) with the position of the return. A
+// call which is unwound by a panic records its named results (if any) as
+// its outputs with the position of the function. A function without
+// results records no values but still records how each call exited, a
+// return is added where it falls off the end of its body.
+func (i *instrumenter) outputs(fnName string, fnAst ast.Node, results []*ast.Field, body *[]ast.Stmt) {
+	fset := i.program.Fset
+	if n := len(*body); len(results) == 0 && (n == 0 || !isReturn((*body)[n-1])) {
+		*body = append(*body, &ast.ReturnStmt{Return: fnAst.End() - 1})
+	}
+	names := make([]string, 0, len(results))
+	types := make([]string, 0, len(results))
+	named := make([]string, 0, len(results))
+	for _, field := range results {
+		typ := analysis.FmtNode(fset, field.Type)
+		if len(field.Names) == 0 {
+			names = append(names, fmt.Sprintf("dynagrokV%d", len(names)))
+			types = append(types, typ)
+		}
+		for _, name := range field.Names {
+			if name.Name == "_" {
+				names = append(names, fmt.Sprintf("dynagrokV%d", len(names)))
+			} else {
+				names = append(names, name.Name)
+				named = append(named, name.Name)
+			}
+			types = append(types, typ)
+		}
+	}
+	cfg := analysis.BuildCFG(fset, fnName, fnAst, body)
+	for _, blk := range cfg.Blocks {
+		for _, stmt := range blk.Stmts {
+			if labeled, ok := (*stmt).(*ast.LabeledStmt); ok {
+				stmt = &labeled.Stmt
+			}
+			if ret, ok := (*stmt).(*ast.ReturnStmt); ok {
+				*stmt = i.mkReturnOutput(fnName, ret, names, types, named)
+			}
+		}
 	}
+	*body = instrument.Insert(nil, nil, *body, 0, i.mkPanicOutput(fnAst.Pos(), fnName, named))
+	*body = instrument.Insert(nil, nil, *body, 0, i.mkReturned(fnAst.Pos()))
+}
 
-	s = s + ")"
-	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+func isReturn(stmt ast.Stmt) bool {
+	if labeled, ok := stmt.(*ast.LabeledStmt); ok {
+		stmt = labeled.Stmt
+	}
+	_, ok := stmt.(*ast.ReturnStmt)
+	return ok
+}
+
+// mkReturnOutput replaces the return statement with a block which records
+// the values it returns before returning them:
+//
+//	{
+//		var dynagrokV0 T0
+//		var dynagrokV1 T1
+//		dynagrokV0, dynagrokV1 = <results>
+//		dynagrokReturned = true
+//		dgruntime.MethodOutput(name, <position of the return>, ...)
+//		return dynagrokV0, dynagrokV1
+//	}
+//
+// A bare return (of named results) records the named results.
+func (i *instrumenter) mkReturnOutput(fnName string, ret *ast.ReturnStmt, names, types, named []string) ast.Stmt {
+	fset := i.program.Fset
+	pos := ret.Pos()
+	s := "func() {\n"
+	outputs := named
+	vars := make([]string, 0, len(types))
+	if len(ret.Results) != 0 {
+		outputs = nil
+		for j, typ := range types {
+			vars = append(vars, fmt.Sprintf("dynagrokV%d", j))
+			s += fmt.Sprintf("var %v %v\n", vars[j], typ)
+		}
+		s += strings.Join(vars, ", ") + " = dynagrokResults\n"
+	}
+	s += "dynagrokReturned = true\n"
+	s += i.methodOutput("MethodOutput", pos, fnName, names, vars, outputs) + "\n"
+	s += "}"
+	e, err := parser.ParseExprFrom(fset, fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
-		panic(fmt.Errorf("mkMethodInput (%v) error: %v", s, err))
+		panic(fmt.Errorf("mkReturnOutput (%v) error: %v", s, err))
 	}
-	return &ast.ExprStmt{e}
+	blk := e.(*ast.FuncLit).Body
+	if len(ret.Results) != 0 {
+		assign := blk.List[len(types)].(*ast.AssignStmt)
+		assign.Rhs = ret.Results
+		ret.Results = make([]ast.Expr, 0, len(assign.Lhs))
+		for _, v := range assign.Lhs {
+			ret.Results = append(ret.Results, &ast.Ident{NamePos: ret.Pos(), Name: v.(*ast.Ident).Name})
+		}
+	}
+	blk.List = append(blk.List, ret)
+	return blk
 }
 
-func (i instrumenter) mkDeferMethodOutput(pos token.Pos, name string, inputs []string) ast.Stmt {
-	p := i.program.Fset.Position(pos)
-	s := fmt.Sprintf("func() { dgruntime.MethodOutput(%s, %s", strconv.Quote(name), strconv.Quote(p.String()))
-	for _, input := range inputs {
-		s = fmt.Sprintf("%v, struct {Name string \nVal interface{}\n}{Name: \"%v\", Val: %v}", s, input, input)
+// mkReturned declares the flag the return statements set so the deferred
+// call of mkPanicOutput can tell a call unwound by a panic.
+func (i *instrumenter) mkReturned(pos token.Pos) ast.Stmt {
+	s := "func() { dynagrokReturned := false }"
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkReturned (%v) error: %v", s, err))
 	}
+	return e.(*ast.FuncLit).Body.List[0]
+}
 
-	s = s + ") }()"
+// mkPanicOutput defers the call which records the outputs of a call that
+// did not return through one of its return statements.
+func (i *instrumenter) mkPanicOutput(pos token.Pos, name string, named []string) ast.Stmt {
+	s := fmt.Sprintf("func() { if !dynagrokReturned { %v } }()", i.methodOutput("MethodPanicked", pos, name, nil, nil, named))
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
-		panic(fmt.Errorf("mkMethodOutput (%v) error: %v", s, err))
+		panic(fmt.Errorf("mkPanicOutput (%v) error: %v", s, err))
 	}
 	return &ast.DeferStmt{Call: e.(*ast.CallExpr)}
 }
 
-func (i instrumenter) mkMethodOutput(pos token.Pos, name string, inputs []string) ast.Stmt {
+// methodOutput is the source of a call of fn (MethodOutput or
+// MethodPanicked). The outputs are either the vars (named by names) or
+// the named results.
+func (i *instrumenter) methodOutput(fn string, pos token.Pos, name string, names, vars, named []string) string {
 	p := i.program.Fset.Position(pos)
-	s := fmt.Sprintf("dgruntime.MethodOutput(%s, %s", strconv.Quote(name), strconv.Quote(p.String()))
-	for _, input := range inputs {
-		s = fmt.Sprintf("%v, struct {Name string \nVal interface{}\n}{Name: \"%v\", Val: %v}", s, input, input)
+	s := fmt.Sprintf("dgruntime.%v(%s, %s", fn, strconv.Quote(name), strconv.Quote(p.String()))
+	for j, v := range vars {
+		s = fmt.Sprintf("%v, struct {Name string \nVal interface{}\n}{Name: \"%v\", Val: %v}", s, names[j], v)
 	}
-	s = s + ")"
-	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
-	if err != nil {
-		panic(fmt.Errorf("mkMethodOutput (%v) error: %v", s, err))
+	for _, output := range named {
+		s = fmt.Sprintf("%v, struct {Name string \nVal interface{}\n}{Name: \"%v\", Val: %v}", s, output, output)
 	}
-	return &ast.ExprStmt{e}
+	return s + ")"
 }
 
-func (i instrumenter) mkAssignment(pos token.Pos, exprs []ast.Expr) (ast.Stmt, []ast.Expr, []string) {
-	s := ""
-	varnames := make([]string, len(exprs))
-	for i := range exprs {
-		if i != 0 {
-			s += ", "
-		}
-		varnames[i] = fmt.Sprintf("dynagrokV%d", i)
-		s += varnames[i]
-	}
-	s += ":="
-	for i := range exprs {
-		if i != 0 {
-			s += ", "
-		}
-		s += fmt.Sprintf("%v", i)
+func (i instrumenter) mkMethodInput(pos token.Pos, name string, inputs []string) ast.Stmt {
+	p := i.program.Fset.Position(pos)
+	s := fmt.Sprintf("dgruntime.MethodInput(%s, %s", strconv.Quote(name), strconv.Quote(p.String()))
+	for _, input := range inputs {
+		s = fmt.Sprintf("%v, struct {Name string \nVal interface{}\n}{Name: \"%v\", Val: %v}", s, input, input)
 	}
-	s = fmt.Sprintf("func() { %s }()", s)
+
+	s = s + ")"
 	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
 	if err != nil {
-		panic(fmt.Errorf("AssignStmt: %v error: %v", s, err))
-	}
-
-	var stmt ast.AssignStmt
-	if call, ok := e.(*ast.CallExpr); ok {
-		if fun, ok := call.Fun.(*ast.FuncLit); ok {
-			if assign, ok := fun.Body.List[0].(*ast.AssignStmt); ok {
-				stmt = *assign
-			}
-		}
-	}
-	for i, e := range exprs {
-		if id, ok := e.(*ast.Ident); ok {
-			id.NamePos = stmt.Rhs[i].Pos()
-		}
+		panic(fmt.Errorf("mkMethodInput (%v) error: %v", s, err))
 	}
-	stmt.Rhs = exprs
-
-	return &stmt, stmt.Lhs, varnames
+	return &ast.ExprStmt{e}
 }
@@ -0,0 +1,122 @@
+package objectstate
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+const outputsProgram = `package main
+
+import "fmt"
+
+func divmod(a, b int) (int, int) {
+	return a / b, a % b
+}
+
+func double(x int) (y int, ok bool) {
+	y = x * 2
+	if x < 0 {
+		return 0, false
+	}
+	ok = true
+	return
+}
+
+func boom(x int) (r int) {
+	r = x
+	if x > 0 {
+		panic("boom")
+	}
+	return x
+}
+
+func safe(x int) (r int) {
+	defer func() {
+		recover()
+	}()
+	return boom(x)
+}
+
+func main() {
+	q, m := divmod(7, 2)
+	y, ok := double(3)
+	_, neg := double(-1)
+	fmt.Println(q, m, y, ok, neg, safe(4))
+}
+`
+
+// output is an output of a call and how the call exited.
+type output struct {
+	values string // the outputs as name=value
+	site   string // the end of the position it exited at
+	panic  bool
+}
+
+func outputs(fn dgtypes.FuncProfile) []output {
+	outs := make([]output, 0, len(fn.Out))
+	for i, out := range fn.Out {
+		values := make([]string, 0, len(out))
+		for _, p := range out {
+			values = append(values, p.Name+"="+p.Val.String())
+		}
+		o := output{values: strings.Join(values, " ")}
+		if i < len(fn.Exits) {
+			site := fn.Exits[i].Site
+			o.site = site[strings.LastIndex(site, "/")+1:]
+			o.panic = fn.Exits[i].Panicked
+		}
+		outs = append(outs, o)
+	}
+	return outs
+}
+
+// The outputs of each call are recorded with the return statement it
+// exited through: the values returned, the named results of a bare
+// return and the named results of a call unwound by a panic (at the
+// position of the function).
+func TestOutputs(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": outputsProgram})
+	defer p.Close()
+	dgprof, printed := p.run(p.build(false))
+	if !strings.HasPrefix(string(printed), "3 1 6 true false 0\n") {
+		t.Errorf("expected the program to print 3 1 6 true false 0 got:\n%s", printed)
+	}
+	objects := p.objects(dgprof)
+	cases := []struct {
+		fn      string
+		outputs []output
+	}{
+		// multiple results
+		{"divmod", []output{{"dynagrokV0=3 dynagrokV1=1", "main.go:6:2", false}}},
+		// a bare return of the named results and a return of values
+		{"double", []output{
+			{"y=6 ok=true", "main.go:15:2", false},
+			{"y=0 ok=false", "main.go:12:3", false},
+		}},
+		// unwound by a panic
+		{"boom", []output{{"r=4", "main.go:18:1", true}}},
+		// recovered the panic of the call in its return statement
+		{"safe", []output{{"r=0", "main.go:26:1", true}}},
+		// no results, it falls off the end of its body
+		{"main", []output{{"", "main.go:38:1", false}}},
+	}
+	for _, c := range cases {
+		fn, has := objects["example.com/m."+c.fn]
+		if !has {
+			t.Errorf("expected the outputs of %v got %v", c.fn, objects)
+			continue
+		}
+		outs := outputs(fn)
+		if len(outs) != len(c.outputs) {
+			t.Errorf("expected %d outputs of %v got %v", len(c.outputs), c.fn, outs)
+			continue
+		}
+		for i, expected := range c.outputs {
+			if outs[i] != expected {
+				t.Errorf("expected the output %d of %v to be %v got %v", i, c.fn, expected, outs[i])
+			}
+		}
+	}
+}
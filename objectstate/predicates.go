@@ -0,0 +1,277 @@
+package objectstate
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"sort"
+	"strconv"
+)
+
+import (
+	"github.com/timtadh/dynagrok/analysis"
+	"github.com/timtadh/dynagrok/instrument"
+)
+
+var errorType = types.Universe.Lookup("error").Type()
+
+// predicates records the statistical debugging predicates of the
+// function (with --predicates). After each assignment to a number, an
+// error or a pointer it records the sign of the number (or whether the
+// error or pointer is nil) and how the number compares to the other
+// locals of its type in scope. The results of calls made for their side
+// effects are recorded the same way.
+func (i *instrumenter) predicates(fnName string, fnAst ast.Node, body *[]ast.Stmt) {
+	cfg := analysis.BuildCFG(i.program.Fset, fnName, fnAst, body)
+	defs := analysis.FindDefinitions(cfg, &i.currentPkg.Info)
+	i.predicateStmts(defs, body)
+}
+
+// predicateStmts instruments the statements of a block and the blocks
+// nested in them. Function literals are left to their own call of
+// predicates.
+func (i *instrumenter) predicateStmts(defs *analysis.Definitions, blk *[]ast.Stmt) {
+	for j := 0; j < len(*blk); j++ {
+		stmt := &(*blk)[j]
+		i.nestedStmts(defs, *stmt)
+		if labeled, ok := (*stmt).(*ast.LabeledStmt); ok {
+			stmt = &labeled.Stmt
+		}
+		switch s := (*stmt).(type) {
+		case *ast.AssignStmt:
+			lhs := make([]*ast.Ident, 0, len(s.Lhs))
+			for _, e := range s.Lhs {
+				if id, ok := e.(*ast.Ident); ok {
+					lhs = append(lhs, id)
+				}
+			}
+			kind := "AssignPredicates"
+			if len(s.Rhs) == 1 && i.isCall(s.Rhs[0]) {
+				kind = "ReturnPredicates"
+			}
+			for _, rec := range i.mkRecordValues(defs, kind, s.Pos(), s.End(), lhs) {
+				j++
+				*blk = instrument.Insert(nil, nil, *blk, j, rec)
+			}
+		case *ast.DeclStmt:
+			gen, ok := s.Decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				if len(vs.Values) == 0 {
+					continue
+				}
+				kind := "AssignPredicates"
+				if len(vs.Values) == 1 && i.isCall(vs.Values[0]) {
+					kind = "ReturnPredicates"
+				}
+				for _, rec := range i.mkRecordValues(defs, kind, vs.Pos(), s.End(), vs.Names) {
+					j++
+					*blk = instrument.Insert(nil, nil, *blk, j, rec)
+				}
+			}
+		case *ast.ExprStmt:
+			if results := i.mkRecordResults(defs, s); results != nil {
+				*stmt = results
+			}
+		}
+	}
+}
+
+// nestedStmts instruments the blocks nested in the statement.
+func (i *instrumenter) nestedStmts(defs *analysis.Definitions, stmt ast.Stmt) {
+	switch s := stmt.(type) {
+	case *ast.BlockStmt:
+		i.predicateStmts(defs, &s.List)
+	case *ast.LabeledStmt:
+		i.nestedStmts(defs, s.Stmt)
+	case *ast.IfStmt:
+		i.predicateStmts(defs, &s.Body.List)
+		if s.Else != nil {
+			i.nestedStmts(defs, s.Else)
+		}
+	case *ast.ForStmt:
+		i.predicateStmts(defs, &s.Body.List)
+	case *ast.RangeStmt:
+		i.predicateStmts(defs, &s.Body.List)
+	case *ast.SwitchStmt:
+		i.nestedStmts(defs, s.Body)
+	case *ast.TypeSwitchStmt:
+		i.nestedStmts(defs, s.Body)
+	case *ast.SelectStmt:
+		i.nestedStmts(defs, s.Body)
+	case *ast.CaseClause:
+		i.predicateStmts(defs, &s.Body)
+	case *ast.CommClause:
+		i.predicateStmts(defs, &s.Body)
+	}
+}
+
+// mkRecordValues makes a call of kind (ReturnPredicates or
+// AssignPredicates) for each of the idents which is a number, an error or
+// a pointer. scope is the position the locals are looked up at.
+func (i *instrumenter) mkRecordValues(defs *analysis.Definitions, kind string, pos, scope token.Pos, idents []*ast.Ident) []ast.Stmt {
+	stmts := make([]ast.Stmt, 0, len(idents))
+	for _, id := range idents {
+		if id.Name == "_" {
+			continue
+		}
+		typ := i.currentPkg.TypeOf(id)
+		if typ == nil || !(numeric(typ) || nillable(typ)) {
+			continue
+		}
+		stmts = append(stmts, i.mkRecord(defs, kind, pos, scope, id.Name, id.Name, typ))
+	}
+	return stmts
+}
+
+// mkRecordResults replaces a call whose results are dropped with a block
+// which assigns the results and records those which are numbers, errors
+// or pointers. It returns nil if there are none.
+//
+//	{ dynagrokR0, _ := f(); dgruntime.ReturnPredicates(...) }
+func (i *instrumenter) mkRecordResults(defs *analysis.Definitions, stmt *ast.ExprStmt) ast.Stmt {
+	call, ok := unparen(stmt.X).(*ast.CallExpr)
+	if !ok || !i.isCall(call) {
+		return nil
+	}
+	var results []types.Type
+	switch t := i.currentPkg.TypeOf(call).(type) {
+	case nil:
+		return nil
+	case *types.Tuple:
+		for j := 0; j < t.Len(); j++ {
+			results = append(results, t.At(j).Type())
+		}
+	default:
+		results = append(results, t)
+	}
+	fset := i.program.Fset
+	expr := analysis.FmtNode(fset, call)
+	lhs := make([]string, 0, len(results))
+	records := make([]string, 0, len(results))
+	for j, typ := range results {
+		if !numeric(typ) && !nillable(typ) {
+			lhs = append(lhs, "_")
+			continue
+		}
+		name := fmt.Sprintf("dynagrokR%d", j)
+		e := expr
+		if len(results) > 1 {
+			e = fmt.Sprintf("%v[%d]", expr, j)
+		}
+		lhs = append(lhs, name)
+		records = append(records, i.recordCall(defs, "ReturnPredicates", call.Pos(), call.Pos(), e, name, typ))
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	s := "func() {\n"
+	for j, name := range lhs {
+		if j != 0 {
+			s += ", "
+		}
+		s += name
+	}
+	s += " := dynagrokCall\n"
+	for _, r := range records {
+		s += r + "\n"
+	}
+	s += "}"
+	e, err := parser.ParseExprFrom(fset, fset.File(call.Pos()).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkRecordResults (%v) error: %v", s, err))
+	}
+	body := e.(*ast.FuncLit).Body
+	body.List[0].(*ast.AssignStmt).Rhs[0] = call
+	return body
+}
+
+// mkRecord makes the call recording the predicates of value (the source
+// of the value the predicates are about is expr).
+func (i *instrumenter) mkRecord(defs *analysis.Definitions, kind string, pos, scope token.Pos, expr, value string, typ types.Type) ast.Stmt {
+	s := i.recordCall(defs, kind, pos, scope, expr, value, typ)
+	e, err := parser.ParseExprFrom(i.program.Fset, i.program.Fset.File(pos).Name(), s, parser.Mode(0))
+	if err != nil {
+		panic(fmt.Errorf("mkRecord (%v) error: %v", s, err))
+	}
+	return &ast.ExprStmt{e}
+}
+
+func (i *instrumenter) recordCall(defs *analysis.Definitions, kind string, pos, scope token.Pos, expr, value string, typ types.Type) string {
+	p := i.program.Fset.Position(pos)
+	s := fmt.Sprintf("dgruntime.%v(%v, %v, %v", kind, strconv.Quote(p.String()), strconv.Quote(expr), value)
+	if numeric(typ) {
+		for _, local := range i.locals(defs, scope, typ) {
+			if local.Name() == value {
+				continue
+			}
+			s = fmt.Sprintf("%v, dgruntime.Local{Name: %v, Val: %v}", s, strconv.Quote(local.Name()), local.Name())
+		}
+	}
+	return s + ")"
+}
+
+// locals returns the variables of the function (see
+// analysis.FindDefinitions) of type typ which are in scope at pos.
+func (i *instrumenter) locals(defs *analysis.Definitions, pos token.Pos, typ types.Type) []*types.Var {
+	scope := i.currentPkg.Pkg.Scope().Innermost(pos)
+	if scope == nil {
+		return nil
+	}
+	locals := make([]*types.Var, 0, 10)
+	for _, obj := range defs.Objects() {
+		v, ok := obj.Object.(*types.Var)
+		if !ok || v.IsField() || v.Name() == "_" || !types.Identical(v.Type(), typ) {
+			continue
+		}
+		if _, o := scope.LookupParent(v.Name(), pos); o != v {
+			continue
+		}
+		locals = append(locals, v)
+	}
+	sort.Slice(locals, func(a, b int) bool {
+		return locals[a].Name() < locals[b].Name()
+	})
+	return locals
+}
+
+// isCall reports whether the expression is a call of a function (rather
+// than a conversion or a builtin).
+func (i *instrumenter) isCall(e ast.Expr) bool {
+	call, ok := unparen(e).(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	tv, has := i.currentPkg.Types[unparen(call.Fun)]
+	return has && !tv.IsType() && !tv.IsBuiltin()
+}
+
+// numeric reports whether the type is a real number.
+func numeric(t types.Type) bool {
+	b, ok := t.Underlying().(*types.Basic)
+	return ok && b.Info()&types.IsNumeric != 0 && b.Info()&types.IsComplex == 0
+}
+
+// nillable reports whether the type is error or a pointer.
+func nillable(t types.Type) bool {
+	if types.Identical(t, errorType) {
+		return true
+	}
+	_, ok := t.Underlying().(*types.Pointer)
+	return ok
+}
+
+func unparen(e ast.Expr) ast.Expr {
+	for {
+		p, ok := e.(*ast.ParenExpr)
+		if !ok {
+			return e
+		}
+		e = p.X
+	}
+}
@@ -0,0 +1,79 @@
+package objectstate
+
+import (
+	"strings"
+	"testing"
+)
+
+const predicatesProgram = `package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func half(x int) int {
+	return x / 2
+}
+
+func check(x int) error {
+	if x < 0 {
+		return errors.New("negative")
+	}
+	return nil
+}
+
+func main() {
+	n := 10
+	h := half(n)
+	d := n - 20
+	err := check(d)
+	half(d)
+	fmt.Println(h, d, err)
+}
+`
+
+// The sign of each returned and assigned number (or the nil-ness of an
+// error) is recorded, and how the numbers compare to the other locals of
+// their type in scope.
+func TestPredicates(t *testing.T) {
+	p := newProgram(t, map[string]string{"main.go": predicatesProgram})
+	defer p.Close()
+	dgprof, output := p.run(p.build(true))
+	if !strings.HasPrefix(string(output), "5 -10 negative\n") {
+		t.Errorf("expected the program to print 5 -10 negative got:\n%s", output)
+	}
+	// the predicates by their kind, expression and value
+	preds := make(map[[3]string]int)
+	for pred, count := range p.profile(dgprof).Predicates {
+		preds[[3]string{pred.Kind, pred.Expr, pred.Value}] += count
+	}
+	expected := map[[3]string]int{
+		{"return", "h", ">0"}:        1,
+		{"pair", "h, n", "<"}:        1,
+		{"assign", "n", ">0"}:        1,
+		{"assign", "d", "<0"}:        1,
+		{"pair", "d, h", "<"}:        1,
+		{"pair", "d, n", "<"}:        1,
+		{"return", "err", "non-nil"}: 1,
+		{"return", "half(d)", "<0"}:  1,
+		{"pair", "half(d), d", ">"}:  1,
+		{"pair", "half(d), h", "<"}:  1,
+		{"pair", "half(d), n", "<"}:  1,
+		// the results of Println (the bytes written and the error)
+		{"return", "fmt.Println(h, d, err)[0]", ">0"}:  1,
+		{"pair", "fmt.Println(h, d, err)[0], d", ">"}:  1,
+		{"pair", "fmt.Println(h, d, err)[0], h", ">"}:  1,
+		{"pair", "fmt.Println(h, d, err)[0], n", ">"}:  1,
+		{"return", "fmt.Println(h, d, err)[1]", "nil"}: 1,
+	}
+	for pred, count := range expected {
+		if preds[pred] != count {
+			t.Errorf("expected the predicate %v %d times got %d", pred, count, preds[pred])
+		}
+	}
+	// nothing else, the instrumentation's own variables in particular
+	if len(preds) != len(expected) {
+		t.Errorf("expected %d predicates got %v", len(expected), preds)
+	}
+}
@@ -0,0 +1,128 @@
+package objectstate
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+	"github.com/timtadh/dynagrok/instrument"
+)
+
+// program is a module (example.com/m) of the files which is instrumented
+// for its object states, built and run by the tests.
+type program struct {
+	t   *testing.T
+	dir string
+}
+
+func newProgram(t *testing.T, files map[string]string) *program {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("no go tool on the PATH")
+	}
+	if testing.Short() {
+		t.Skip("builds an instrumented program")
+	}
+	dir, err := ioutil.TempDir("", "dynagrok-objectstate-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["go.mod"] = "module example.com/m\n"
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return &program{t: t, dir: dir}
+}
+
+func (p *program) Close() {
+	os.RemoveAll(p.dir)
+}
+
+// build instruments the program the way `dynagrok objectstate` does (with
+// --predicates if predicates) and builds it. It returns the binary.
+func (p *program) build(predicates bool) string {
+	dgpath, err := filepath.Abs("..")
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	c := &cmd.Config{DGPATH: dgpath, StockRuntime: true}
+	pkgName, pkgDir, err := cmd.ResolvePkg(c, p.dir)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	program, err := cmd.LoadPkg(c, pkgDir, pkgName)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	if err := Instrument(pkgName, "", predicates, program); err != nil {
+		p.t.Fatal(err)
+	}
+	if err := instrument.Instrument(pkgName, program, nil); err != nil {
+		p.t.Fatal(err)
+	}
+	output := filepath.Join(p.dir, "prog.instr")
+	if _, err := instrument.BuildBinary(c, false, "", pkgName, output, program); err != nil {
+		p.t.Fatal(err)
+	}
+	return output
+}
+
+// run runs the binary with its profiles written to a new dir, which it
+// returns with the output of the binary.
+func (p *program) run(bin string) (dgprof string, output []byte) {
+	dgprof = filepath.Join(p.dir, "dgprof")
+	if err := os.MkdirAll(dgprof, 0775); err != nil {
+		p.t.Fatal(err)
+	}
+	c := exec.Command(bin)
+	c.Env = append(os.Environ(), "DGPROF="+dgprof)
+	output, err := c.CombinedOutput()
+	if err != nil {
+		p.t.Fatalf("%v:\n%s", err, output)
+	}
+	return dgprof, output
+}
+
+// profile loads the flow graph the binary wrote to dgprof.
+func (p *program) profile(dgprof string) *dgtypes.Profile {
+	f, err := os.Open(filepath.Join(dgprof, "flow-graph.txt"))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer f.Close()
+	prof, err := dgtypes.LoadSimple(f)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	return prof
+}
+
+// objects reads the object profiles the binary wrote to dgprof by the
+// names of their functions.
+func (p *program) objects(dgprof string) map[string]dgtypes.FuncProfile {
+	f, err := os.Open(filepath.Join(dgprof, "object-profiles.bin"))
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer f.Close()
+	objects := make(map[string]dgtypes.FuncProfile)
+	r := dgtypes.NewObjectProfileReader(f)
+	for {
+		if _, err := r.Next(); err == io.EOF {
+			return objects
+		} else if err != nil {
+			p.t.Fatal(err)
+		}
+		fn, err := r.Func()
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		objects[fn.FuncName] = fn
+	}
+}
@@ -0,0 +1,275 @@
+package profile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+import (
+	"github.com/timtadh/getopt"
+)
+
+import (
+	"github.com/timtadh/dynagrok/cmd"
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+func NewCommand(c *cmd.Config) cmd.Runnable {
+	main := NewProfileMain(c)
+	merge := NewMergeCommand(c)
+	diff := NewDiffCommand(c)
+	stats := NewStatsCommand(c)
+	return cmd.Concat(
+		main,
+		cmd.Commands(map[string]cmd.Runnable{
+			merge.Name(): merge,
+			diff.Name():  diff,
+			stats.Name(): stats,
+		}),
+	)
+}
+
+func NewProfileMain(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("profile",
+		`[options]`,
+		`
+Combine, compare and summarize the profiles (flow-graph.txt files) written by
+instrumented programs.
+
+A <profiles> argument is a flow-graph.txt file (which may be gzipped) or a
+directory of them. Each may hold the profiles of several runs.
+
+Option Flags
+    -h,--help                         Show this message
+`,
+		"",
+		[]string{},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			return args, nil
+		})
+}
+
+func NewMergeCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("merge",
+		`[options] <profiles>+`,
+		`
+Merge the profiles into one profile by summing their flows, calls and
+durations. The merged profile is written in the flow-graph.txt format.
+
+Option Flags
+    -h,--help                         Show this message
+    -o,--output=<path>                Output file to create
+                                      (defaults to standard output)
+    --dot=<path>                      Also write the merged profile as DOT
+`,
+		"o:",
+		[]string{
+			"output=",
+			"dot=",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			dot := ""
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "--dot":
+					dot = oa.Arg()
+				}
+			}
+			if len(args) < 1 {
+				return nil, cmd.Usage(r, 2, "Expected one or more profiles got none")
+			}
+			merged, _, err := Load(args)
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			err = write(output, merged.WriteSimple)
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			if dot != "" {
+				err = write(dot, merged.WriteDotty)
+				if err != nil {
+					return nil, cmd.Err(1, err)
+				}
+			}
+			return nil, nil
+		})
+}
+
+func NewDiffCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("diff",
+		`[options] <a-profiles> <b-profiles>`,
+		`
+Compare two sets of profiles. Lists the blocks and edges which are only in
+the profiles of a (-), only in the profiles of b (+) and those which are in
+both but were entered or traversed more or less often per run (~).
+
+Option Flags
+    -h,--help                         Show this message
+    -o,--output=<path>                Output file to create
+                                      (defaults to standard output)
+    -t,--threshold=<ratio>            Only list the changed frequencies which
+                                      changed by more than <ratio> of the larger
+                                      of the two (defaults to 0)
+`,
+		"o:t:",
+		[]string{
+			"output=",
+			"threshold=",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			threshold := 0.0
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-t", "--threshold":
+					t, err := strconv.ParseFloat(oa.Arg(), 64)
+					if err != nil {
+						return nil, cmd.Usage(r, 1, fmt.Sprintf(
+							"%v takes a float. %v", oa.Opt(), err.Error()))
+					}
+					if t < 0 || t > 1 {
+						return nil, cmd.Usage(r, 1, fmt.Sprintf(
+							"%v takes a float between 0 and 1, got: %v", oa.Opt(), t))
+					}
+					threshold = t
+				}
+			}
+			if len(args) != 2 {
+				return nil, cmd.Usage(r, 2, "Expected 2 arguments for the a and b profiles got %v", args)
+			}
+			a, aRuns, err := Load(args[:1])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			b, bRuns, err := Load(args[1:])
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			d := Diff(Summarize(a, aRuns), Summarize(b, bRuns), threshold)
+			err = write(output, d.Write)
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, nil
+		})
+}
+
+func NewStatsCommand(c *cmd.Config) cmd.Runnable {
+	return cmd.Cmd("stats",
+		`[options] <profiles>+`,
+		`
+Summarize the profiles: the number of runs, functions, blocks and edges and
+the hottest blocks.
+
+Option Flags
+    -h,--help                         Show this message
+    -o,--output=<path>                Output file to create
+                                      (defaults to standard output)
+    -n,--top=<n>                      Number of hottest blocks to list
+                                      (defaults to 10)
+`,
+		"o:n:",
+		[]string{
+			"output=",
+			"top=",
+		},
+		func(r cmd.Runnable, args []string, optargs []getopt.OptArg) ([]string, *cmd.Error) {
+			output := ""
+			top := 10
+			for _, oa := range optargs {
+				switch oa.Opt() {
+				case "-o", "--output":
+					output = oa.Arg()
+				case "-n", "--top":
+					n, err := strconv.Atoi(oa.Arg())
+					if err != nil {
+						return nil, cmd.Usage(r, 1, fmt.Sprintf(
+							"%v takes an int. %v", oa.Opt(), err.Error()))
+					}
+					top = n
+				}
+			}
+			if len(args) < 1 {
+				return nil, cmd.Usage(r, 2, "Expected one or more profiles got none")
+			}
+			merged, runs, err := Load(args)
+			if err != nil {
+				return nil, cmd.Err(2, err)
+			}
+			s := Summarize(merged, runs)
+			err = write(output, func(fout io.Writer) {
+				s.WriteStats(fout, top)
+			})
+			if err != nil {
+				return nil, cmd.Err(1, err)
+			}
+			return nil, nil
+		})
+}
+
+// Load reads the profiles in the paths (see cmd.Inputs) and merges them.
+// It returns the merged profile and the number of runs (profiles) read.
+func Load(paths []string) (*dgtypes.Profile, int, error) {
+	profiles, err := LoadAll(paths)
+	if err != nil {
+		return nil, 0, err
+	}
+	merged := dgtypes.NewProfile()
+	for i, p := range profiles {
+		if err := merged.Merge(p); err != nil {
+			return nil, 0, fmt.Errorf("Could not merge profile %d of %v\n%v", i+1, paths, err)
+		}
+	}
+	return merged, len(profiles), nil
+}
+
+// LoadAll reads the profile of each run in the paths (see cmd.Inputs).
+func LoadAll(paths []string) ([]*dgtypes.Profile, error) {
+	input, closeall, err := cmd.Inputs(paths)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read profiles from %v\n%v", paths, err)
+	}
+	defer closeall()
+	profiles, err := dgtypes.LoadSimpleAll(input)
+	if err != nil {
+		return nil, fmt.Errorf("Could not load profiles from %v\n%v", paths, err)
+	}
+	return profiles, nil
+}
+
+// write writes to the output path or to standard output if it is empty.
+// It returns the first error writing to (or closing) the output.
+func write(output string, writeTo func(io.Writer)) error {
+	fout := os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("Could not create output file: %v, error: %v", output, err)
+		}
+		fout = f
+	}
+	// the writers ignore the errors, the buffer keeps the first one
+	buf := bufio.NewWriter(fout)
+	writeTo(buf)
+	err := buf.Flush()
+	if output != "" {
+		if cerr := fout.Close(); err == nil {
+			err = cerr
+		}
+	} else {
+		output = "standard output"
+	}
+	if err != nil {
+		return fmt.Errorf("Could not write to %v, error: %v", output, err)
+	}
+	return nil
+}
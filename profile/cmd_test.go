@@ -0,0 +1,35 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The errors writing to (and creating) the output are returned.
+func TestWriteErrors(t *testing.T) {
+	writeTo := func(fout io.Writer) {
+		for i := 0; i < 10000; i++ {
+			fmt.Fprintln(fout, "line", i)
+		}
+	}
+	dir, err := ioutil.TempDir("", "profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := write(filepath.Join(dir, "out.txt"), writeTo); err != nil {
+		t.Error(err)
+	}
+	if err := write(filepath.Join(dir, "missing", "out.txt"), writeTo); err == nil {
+		t.Error("expected an error creating the output in a missing directory")
+	}
+	if _, err := os.Stat("/dev/full"); err == nil {
+		if err := write("/dev/full", writeTo); err == nil {
+			t.Error("expected an error writing to a full device")
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// A Difference of a block or an edge between the profiles of a and of b.
+// The frequencies are the entrances (or traversals) per run.
+type Difference struct {
+	Change string // "-" only in a, "+" only in b, "~" changed frequency
+	What   string // "block <name>" or the Edge
+	A, B   float64
+}
+
+func (d Difference) String() string {
+	return fmt.Sprintf("%v %v\t%.2f\t%.2f", d.Change, d.What, d.A, d.B)
+}
+
+// Differences lists the blocks and edges which differ.
+type Differences []Difference
+
+// Diff compares the summaries a and b. The blocks and edges in both with
+// frequencies which changed by no more than threshold times the larger of
+// the two are left out.
+func Diff(a, b *Summary, threshold float64) Differences {
+	var d Differences
+	add := func(what string, x, y float64, inA, inB bool) {
+		change := "~"
+		switch {
+		case !inB:
+			change = "-"
+		case !inA:
+			change = "+"
+		case x == y || math.Abs(x-y) <= threshold*math.Max(x, y):
+			return
+		}
+		d = append(d, Difference{Change: change, What: what, A: x, B: y})
+	}
+	for name, blk := range a.Blocks {
+		x := b.Blocks[name]
+		if x == nil {
+			add("block "+name, a.PerRun(blk.Entrances), 0, true, false)
+		} else {
+			add("block "+name, a.PerRun(blk.Entrances), b.PerRun(x.Entrances), true, true)
+		}
+	}
+	for name, blk := range b.Blocks {
+		if _, has := a.Blocks[name]; !has {
+			add("block "+name, 0, b.PerRun(blk.Entrances), false, true)
+		}
+	}
+	for e, count := range a.Edges {
+		y, has := b.Edges[e]
+		add(e.String(), a.PerRun(count), b.PerRun(y), true, has)
+	}
+	for e, count := range b.Edges {
+		if _, has := a.Edges[e]; !has {
+			add(e.String(), 0, b.PerRun(count), false, true)
+		}
+	}
+	order := map[string]int{"-": 0, "+": 1, "~": 2}
+	sort.Slice(d, func(i, j int) bool {
+		if d[i].Change != d[j].Change {
+			return order[d[i].Change] < order[d[j].Change]
+		}
+		return d[i].What < d[j].What
+	})
+	return d
+}
+
+// Write writes a difference per line, the removed (-) then the added (+)
+// then the changed (~) ones.
+func (d Differences) Write(fout io.Writer) {
+	for _, x := range d {
+		fmt.Fprintln(fout, x)
+	}
+}
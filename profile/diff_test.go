@@ -0,0 +1,71 @@
+package profile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func summary(runs int, blocks map[string]int, edges map[Edge]int) *Summary {
+	s := &Summary{Runs: runs, Functions: map[string]int{}, Blocks: map[string]*Block{}, Edges: edges}
+	for name, entrances := range blocks {
+		s.Blocks[name] = &Block{Name: name, Entrances: entrances}
+	}
+	return s
+}
+
+func TestDiff(t *testing.T) {
+	e := Edge{"flow", "a blk 0", "a blk 1"}
+	cases := []struct {
+		name      string
+		a, b      *Summary
+		threshold float64
+		expected  Differences
+	}{
+		{"same",
+			summary(1, map[string]int{"a blk 0": 2}, map[Edge]int{e: 2}),
+			summary(2, map[string]int{"a blk 0": 4}, map[Edge]int{e: 4}),
+			0, nil},
+		{"removed and added",
+			summary(1, map[string]int{"a blk 0": 2, "a blk 1": 1}, map[Edge]int{e: 1}),
+			summary(1, map[string]int{"a blk 0": 2, "b blk 0": 3}, map[Edge]int{}),
+			0, Differences{
+				{"-", "block a blk 1", 1, 0},
+				{"-", "flow a blk 0 -> a blk 1", 1, 0},
+				{"+", "block b blk 0", 0, 3},
+			}},
+		{"changed per run",
+			summary(2, map[string]int{"a blk 0": 2}, map[Edge]int{e: 8}),
+			summary(1, map[string]int{"a blk 0": 2}, map[Edge]int{e: 3}),
+			0, Differences{
+				{"~", "block a blk 0", 1, 2},
+				{"~", "flow a blk 0 -> a blk 1", 4, 3},
+			}},
+		// only the block changed by more than a third of the larger
+		{"threshold",
+			summary(2, map[string]int{"a blk 0": 2}, map[Edge]int{e: 8}),
+			summary(1, map[string]int{"a blk 0": 2}, map[Edge]int{e: 3}),
+			1.0 / 3, Differences{
+				{"~", "block a blk 0", 1, 2},
+			}},
+	}
+	for _, c := range cases {
+		d := Diff(c.a, c.b, c.threshold)
+		if !reflect.DeepEqual(d, c.expected) {
+			t.Errorf("%v expected %v got %v", c.name, c.expected, d)
+		}
+	}
+}
+
+func TestDiffWrite(t *testing.T) {
+	d := Differences{
+		{"-", "block a blk 1", 1, 0},
+		{"~", "flow a blk 0 -> a blk 1", 4, 2.5},
+	}
+	var buf bytes.Buffer
+	d.Write(&buf)
+	expected := "- block a blk 1\t1.00\t0.00\n~ flow a blk 0 -> a blk 1\t4.00\t2.50\n"
+	if buf.String() != expected {
+		t.Errorf("expected:\n%v\ngot:\n%v", expected, buf.String())
+	}
+}
@@ -0,0 +1,157 @@
+package profile
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+import (
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+// A Summary is a (merged) profile with its blocks and edges named so the
+// profiles of different runs, and so of different program counters, can
+// be compared.
+type Summary struct {
+	Runs      int
+	Functions map[string]int // function name -> calls
+	Blocks    map[string]*Block
+	Edges     map[Edge]int // edge -> times traversed
+}
+
+// A Block is named by its function and block id.
+type Block struct {
+	Name      string
+	Position  string
+	Entrances int
+	Duration  time.Duration
+}
+
+// An Edge is a control flow edge (Kind "flow") or one of the labeled
+// edges of the profile (eg. "spawn" or "panic").
+type Edge struct {
+	Kind string
+	Src  string
+	Targ string
+}
+
+func (e Edge) String() string {
+	return fmt.Sprintf("%v %v -> %v", e.Kind, e.Src, e.Targ)
+}
+
+// BlockName is the name of the block bbid of the function in a Summary.
+func BlockName(fn string, bbid int) string {
+	return fmt.Sprintf("%v blk %d", fn, bbid)
+}
+
+// Summarize names the blocks and edges of the profile merged from the
+// given number of runs.
+func Summarize(p *dgtypes.Profile, runs int) *Summary {
+	s := &Summary{
+		Runs:      runs,
+		Functions: make(map[string]int, len(p.Funcs)),
+		Blocks:    make(map[string]*Block),
+		Edges:     make(map[Edge]int),
+	}
+	for _, f := range p.Funcs {
+		s.Functions[f.Name] += f.Calls
+	}
+	name := func(b dgtypes.BlkEntrance) string {
+		if b.In == 0 && b.BasicBlockId == 0 {
+			return "entry"
+		}
+		fn := "unknown"
+		if f, has := p.Funcs[b.In]; has {
+			fn = f.Name
+		}
+		return BlockName(fn, b.BasicBlockId)
+	}
+	block := func(b dgtypes.BlkEntrance) *Block {
+		n := name(b)
+		if blk, has := s.Blocks[n]; has {
+			return blk
+		}
+		blk := &Block{Name: n, Position: p.Positions[b], Duration: p.Durations[b]}
+		s.Blocks[n] = blk
+		return blk
+	}
+	for _, k := range []struct {
+		kind  string
+		edges map[dgtypes.FlowEdge]int
+	}{
+		{"flow", p.Flows},
+		{dgtypes.SpawnLabel, p.Spawns},
+		{dgtypes.CommLabel, p.Comms},
+		{dgtypes.PanicLabel, p.Panics},
+		{dgtypes.RecoverLabel, p.Recovers},
+	} {
+		for e, count := range k.edges {
+			block(e.Src)
+			targ := block(e.Targ)
+			if k.kind == "flow" || k.kind == dgtypes.SpawnLabel {
+				targ.Entrances += count
+			}
+			s.Edges[Edge{Kind: k.kind, Src: name(e.Src), Targ: name(e.Targ)}] += count
+		}
+	}
+	delete(s.Blocks, "entry")
+	return s
+}
+
+// PerRun is the count averaged over the runs.
+func (s *Summary) PerRun(count int) float64 {
+	if s.Runs == 0 {
+		return 0
+	}
+	return float64(count) / float64(s.Runs)
+}
+
+// Hottest lists the n most entered blocks.
+func (s *Summary) Hottest(n int) []*Block {
+	blks := make([]*Block, 0, len(s.Blocks))
+	for _, b := range s.Blocks {
+		blks = append(blks, b)
+	}
+	sort.Slice(blks, func(i, j int) bool {
+		if blks[i].Entrances != blks[j].Entrances {
+			return blks[i].Entrances > blks[j].Entrances
+		}
+		return blks[i].Name < blks[j].Name
+	})
+	if n >= 0 && n < len(blks) {
+		blks = blks[:n]
+	}
+	return blks
+}
+
+// WriteStats writes the counts of the summary and its n hottest blocks.
+func (s *Summary) WriteStats(fout io.Writer, n int) {
+	calls := 0
+	for _, c := range s.Functions {
+		calls += c
+	}
+	kinds := make(map[string]int)
+	traversals := make(map[string]int)
+	for e, count := range s.Edges {
+		kinds[e.Kind]++
+		traversals[e.Kind] += count
+	}
+	fmt.Fprintf(fout, "runs\t%d\n", s.Runs)
+	fmt.Fprintf(fout, "functions\t%d\n", len(s.Functions))
+	fmt.Fprintf(fout, "calls\t%d\t(%.2f per run)\n", calls, s.PerRun(calls))
+	fmt.Fprintf(fout, "blocks\t%d\n", len(s.Blocks))
+	for _, kind := range []string{"flow", dgtypes.SpawnLabel, dgtypes.CommLabel, dgtypes.PanicLabel, dgtypes.RecoverLabel} {
+		if kinds[kind] == 0 {
+			continue
+		}
+		fmt.Fprintf(fout, "%v edges\t%d\ttraversed %d\t(%.2f per run)\n",
+			kind, kinds[kind], traversals[kind], s.PerRun(traversals[kind]))
+	}
+	fmt.Fprintf(fout, "\nhottest blocks\n")
+	for _, b := range s.Hottest(n) {
+		fmt.Fprintf(fout, "%d\t%.2f per run\t%v\t%v\t%v\n",
+			b.Entrances, s.PerRun(b.Entrances), b.Duration, b.Name, b.Position)
+	}
+}
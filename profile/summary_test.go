@@ -0,0 +1,153 @@
+package profile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timtadh/dynagrok/dgruntime/dgtypes"
+)
+
+func blk(pc uintptr, bbid int) dgtypes.BlkEntrance {
+	return dgtypes.BlkEntrance{In: pc, BasicBlockId: bbid}
+}
+
+func edge(src, targ dgtypes.BlkEntrance) dgtypes.FlowEdge {
+	return dgtypes.FlowEdge{Src: src, Targ: targ}
+}
+
+var entry = dgtypes.BlkEntrance{}
+
+// testProfile has main.main (pc 1) which calls main.work (pc 2) calls
+// times.
+func testProfile(calls int) *dgtypes.Profile {
+	p := dgtypes.NewProfile()
+	p.Funcs[1] = &dgtypes.Function{Name: "main.main", FuncPc: 1, Calls: 1}
+	p.Funcs[2] = &dgtypes.Function{Name: "main.work", FuncPc: 2, Calls: calls}
+	p.Flows[edge(entry, blk(1, 0))] = 1
+	p.Flows[edge(blk(1, 0), blk(2, 0))] = calls
+	p.Flows[edge(blk(2, 0), blk(1, 0))] = calls
+	p.Positions[blk(1, 0)] = "main.go:3:13"
+	p.Positions[blk(2, 0)] = "main.go:9:18"
+	p.Durations[blk(2, 0)] = time.Duration(calls) * time.Millisecond
+	return p
+}
+
+func TestSummarize(t *testing.T) {
+	spawned := testProfile(2)
+	spawned.Spawns[edge(blk(1, 0), blk(2, 1))] = 3
+	spawned.Comms[edge(blk(2, 1), blk(1, 1))] = 4
+	unknown := testProfile(1)
+	unknown.Flows[edge(blk(1, 0), blk(3, 0))] = 5
+	cases := []struct {
+		name   string
+		p      *dgtypes.Profile
+		runs   int
+		fns    map[string]int
+		blocks map[string]int // entrances
+		edges  map[Edge]int
+	}{
+		{"calls", testProfile(2), 1,
+			map[string]int{"main.main": 1, "main.work": 2},
+			map[string]int{"main.main blk 0": 3, "main.work blk 0": 2},
+			map[Edge]int{
+				{"flow", "entry", "main.main blk 0"}:           1,
+				{"flow", "main.main blk 0", "main.work blk 0"}: 2,
+				{"flow", "main.work blk 0", "main.main blk 0"}: 2,
+			}},
+		// the spawns enter their blocks, the comms do not
+		{"spawns and comms", spawned, 2,
+			map[string]int{"main.main": 1, "main.work": 2},
+			map[string]int{"main.main blk 0": 3, "main.main blk 1": 0, "main.work blk 0": 2, "main.work blk 1": 3},
+			map[Edge]int{
+				{"flow", "entry", "main.main blk 0"}:                       1,
+				{"flow", "main.main blk 0", "main.work blk 0"}:             2,
+				{"flow", "main.work blk 0", "main.main blk 0"}:             2,
+				{dgtypes.SpawnLabel, "main.main blk 0", "main.work blk 1"}: 3,
+				{dgtypes.CommLabel, "main.work blk 1", "main.main blk 1"}:  4,
+			}},
+		{"unknown function", unknown, 1,
+			map[string]int{"main.main": 1, "main.work": 1},
+			map[string]int{"main.main blk 0": 2, "main.work blk 0": 1, "unknown blk 0": 5},
+			map[Edge]int{
+				{"flow", "entry", "main.main blk 0"}:           1,
+				{"flow", "main.main blk 0", "main.work blk 0"}: 1,
+				{"flow", "main.work blk 0", "main.main blk 0"}: 1,
+				{"flow", "main.main blk 0", "unknown blk 0"}:   5,
+			}},
+	}
+	for _, c := range cases {
+		s := Summarize(c.p, c.runs)
+		if s.Runs != c.runs {
+			t.Errorf("%v expected %d runs got %d", c.name, c.runs, s.Runs)
+		}
+		if !reflect.DeepEqual(s.Functions, c.fns) {
+			t.Errorf("%v expected the functions %v got %v", c.name, c.fns, s.Functions)
+		}
+		blocks := make(map[string]int, len(s.Blocks))
+		for name, b := range s.Blocks {
+			if b.Name != name {
+				t.Errorf("%v expected the block %v to be named %v", c.name, b.Name, name)
+			}
+			blocks[name] = b.Entrances
+		}
+		if !reflect.DeepEqual(blocks, c.blocks) {
+			t.Errorf("%v expected the blocks %v got %v", c.name, c.blocks, blocks)
+		}
+		if !reflect.DeepEqual(s.Edges, c.edges) {
+			t.Errorf("%v expected the edges %v got %v", c.name, c.edges, s.Edges)
+		}
+	}
+	s := Summarize(testProfile(2), 1)
+	if b := s.Blocks["main.work blk 0"]; b.Position != "main.go:9:18" || b.Duration != 2*time.Millisecond {
+		t.Errorf("expected the position and duration of main.work blk 0 got %v", b)
+	}
+}
+
+func TestWriteStats(t *testing.T) {
+	spawned := testProfile(2)
+	spawned.Spawns[edge(blk(1, 0), blk(2, 1))] = 3
+	cases := []struct {
+		name     string
+		s        *Summary
+		top      int
+		expected string
+	}{
+		{"top 1", Summarize(testProfile(2), 1), 1, `runs	1
+functions	2
+calls	3	(3.00 per run)
+blocks	2
+flow edges	3	traversed 5	(5.00 per run)
+
+hottest blocks
+3	3.00 per run	0s	main.main blk 0	main.go:3:13
+`},
+		{"all per run", Summarize(spawned, 2), -1, `runs	2
+functions	2
+calls	3	(1.50 per run)
+blocks	3
+flow edges	3	traversed 5	(2.50 per run)
+spawn edges	1	traversed 3	(1.50 per run)
+
+hottest blocks
+3	1.50 per run	0s	main.main blk 0	main.go:3:13
+3	1.50 per run	0s	main.work blk 1	
+2	1.00 per run	2ms	main.work blk 0	main.go:9:18
+`},
+		{"no runs", &Summary{Functions: map[string]int{}, Blocks: map[string]*Block{}, Edges: map[Edge]int{}}, 10, `runs	0
+functions	0
+calls	0	(0.00 per run)
+blocks	0
+
+hottest blocks
+`},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		c.s.WriteStats(&buf, c.top)
+		if buf.String() != c.expected {
+			t.Errorf("%v expected:\n%v\ngot:\n%v", c.name, c.expected, buf.String())
+		}
+	}
+}